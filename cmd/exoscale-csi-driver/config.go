@@ -0,0 +1,93 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// loadConfigFile sets the flags of fs from the YAML config file at path, keyed by flag name, e.g.
+//
+//	mode: controller
+//	max-volume-size-gib: 1024
+//	default-mount-options: [noatime]
+//	feature-gates:
+//	  OnlineExpansion: true
+//
+// Lists are joined with commas and mappings are joined as comma separated key=value pairs.
+// The flags set on the command line override the config file.
+func loadConfigFile(fs *flag.FlagSet, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var config map[string]any
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	for name, value := range config {
+		if fs.Lookup(name) == nil || name == configFlagName {
+			return fmt.Errorf("%s: unknown option %q", path, name)
+		}
+		if set[name] {
+			continue
+		}
+
+		v, err := configValue(value)
+		if err != nil {
+			return fmt.Errorf("%s: option %s: %w", path, name, err)
+		}
+		if err := fs.Set(name, v); err != nil {
+			return fmt.Errorf("%s: option %s: %w", path, name, err)
+		}
+	}
+
+	return nil
+}
+
+// configValue returns the flag value of a config file value.
+func configValue(value any) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case []any:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			s, err := configValue(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, s)
+		}
+		return strings.Join(items, ","), nil
+	case map[string]any:
+		pairs := make([]string, 0, len(v))
+		for key, item := range v {
+			s, err := configValue(item)
+			if err != nil {
+				return "", err
+			}
+			pairs = append(pairs, key+"="+s)
+		}
+		slices.Sort(pairs)
+		return strings.Join(pairs, ","), nil
+	default:
+		return "", fmt.Errorf("unsupported value %v", value)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadConfigFile(t *testing.T) {
+	newFlagSet := func() *flag.FlagSet {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.String(configFlagName, "", "")
+		fs.String("mode", "all", "")
+		fs.Int64("max-volume-size-gib", 1024, "")
+		fs.Bool("xfs-repair", false, "")
+		fs.Duration("device-wait-timeout", 30*time.Second, "")
+		fs.String("default-mount-options", "", "")
+		fs.String("feature-gates", "", "")
+		return fs
+	}
+
+	testsBench := []struct {
+		name   string
+		config string
+		args   []string
+		res    map[string]string
+		err    bool
+	}{
+		{
+			name: "all types",
+			config: `
+mode: node
+max-volume-size-gib: 2048
+xfs-repair: true
+device-wait-timeout: 1m
+default-mount-options: [noatime, discard]
+feature-gates:
+  OnlineExpansion: true
+`,
+			res: map[string]string{
+				"mode":                  "node",
+				"max-volume-size-gib":   "2048",
+				"xfs-repair":            "true",
+				"device-wait-timeout":   "1m0s",
+				"default-mount-options": "noatime,discard",
+				"feature-gates":         "OnlineExpansion=true",
+			},
+		},
+		{
+			name:   "command line override",
+			config: "mode: node\nmax-volume-size-gib: 2048\n",
+			args:   []string{"--mode=controller"},
+			res:    map[string]string{"mode": "controller", "max-volume-size-gib": "2048"},
+		},
+		{
+			name:   "unknown option",
+			config: "modes: node\n",
+			err:    true,
+		},
+		{
+			name:   "config option",
+			config: "config: other.yaml\n",
+			err:    true,
+		},
+		{
+			name:   "invalid value",
+			config: "max-volume-size-gib: large\n",
+			err:    true,
+		},
+		{
+			name:   "invalid YAML",
+			config: "mode: [node\n",
+			err:    true,
+		},
+	}
+
+	for _, tt := range testsBench {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			require.NoError(t, os.WriteFile(path, []byte(tt.config), 0o600))
+
+			fs := newFlagSet()
+			require.NoError(t, fs.Parse(tt.args))
+
+			err := loadConfigFile(fs, path)
+			if tt.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			for name, value := range tt.res {
+				require.Equal(t, value, fs.Lookup(name).Value.String(), name)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFileMissing(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	require.Error(t, loadConfigFile(fs, filepath.Join(t.TempDir(), "config.yaml")))
+}
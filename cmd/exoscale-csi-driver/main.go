@@ -4,21 +4,105 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"strings"
 
 	v3 "github.com/exoscale/egoscale/v3"
 	"github.com/exoscale/egoscale/v3/credentials"
 	"github.com/exoscale/exoscale-csi-driver/cmd/exoscale-csi-driver/buildinfo"
 	"github.com/exoscale/exoscale-csi-driver/driver"
 
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/klog/v2"
 )
 
+// configFlagName is the flag of the config file, which can't be set in the config file itself.
+const configFlagName = "config"
+
 var (
-	endpoint    = flag.String("endpoint", "unix:/tmp/csi.sock", "CSI endpoint")
+	configFile = flag.String(configFlagName, "", "YAML file of the options keyed by flag name, e.g. \"mode: node\", overridden by the flags set on the command line")
+
+	endpoint    = flag.String("endpoint", "unix:/tmp/csi.sock", "CSI endpoint, either a unix socket (unix:///csi/csi.sock) or a TCP address (tcp://0.0.0.0:10000)")
 	prefix      = flag.String("prefix", "", "Prefix to add in block volume name")
 	versionFlag = flag.Bool("version", false, "Print the version and exit")
 	mode        = flag.String("mode", string(driver.AllMode), "The mode in which the CSI driver will be run (all, node, controller)")
 
+	driverName = flag.String("driver-name", driver.DefaultDriverName, "Name of the CSI driver, also prefixing its topology keys and volume and publish context keys, to install several versions side by side")
+
+	apiEndpoint      = flag.String("api-endpoint", os.Getenv("EXOSCALE_API_ENDPOINT"), "Exoscale API endpoint to discover the zones from, e.g. https://api-ch-gva-2.exoscale.com/v2 (env EXOSCALE_API_ENDPOINT)")
+	apiCAFile        = flag.String("api-ca-file", "", "PEM bundle of CA certificates to trust for the Exoscale API besides the system ones, e.g. the CA of a TLS intercepting proxy set with HTTPS_PROXY")
+	zoneAPIEndpoints = flag.String("zone-api-endpoints", "", "Comma separated list of zone=endpoint pairs overriding the API endpoints of the zones, e.g. ch-gva-2=https://api.example.net/v2")
+
+	nodeID = flag.String("node-id", os.Getenv("EXOSCALE_NODE_ID"), "Instance ID of the node, discovered from the metadata if empty (env EXOSCALE_NODE_ID)")
+	zone   = flag.String("zone", os.Getenv("EXOSCALE_ZONE"), "Zone of the node, discovered from the metadata if empty (env EXOSCALE_ZONE)")
+
+	nodeName = flag.String("node-name", "", "Name of the Kubernetes Node of the driver, e.g. from spec.nodeName with the downward API, to resolve the node ID and zone from its providerID and labels when the metadata can't be discovered")
+
+	kubeconfig = flag.String("kubeconfig", "", "Kubeconfig file of the cluster to run the controller outside of it, e.g. from a management cluster, the in-cluster config is used if empty")
+
+	controllerZone   = flag.String("controller-zone", "", "Default zone of the controller, the zone of the node if empty, skipping the metadata discovery in controller mode")
+	skipNodeMetadata = flag.Bool("skip-node-metadata", false, "Skip the metadata discovery in controller mode, e.g. outside of Exoscale instances, the zone is then taken from --controller-zone or --zone")
+
+	minVolumeSize     = flag.Int64("min-volume-size-gib", driver.MinimalVolumeSizeGiB, "Minimum size of a volume in GiB")
+	maxVolumeSize     = flag.Int64("max-volume-size-gib", driver.MaximumVolumeSizeGiB, "Maximum size of a volume in GiB")
+	defaultVolumeSize = flag.Int64("default-volume-size-gib", driver.DefaultVolumeSizeGiB, "Size in GiB of a volume provisioned without requested capacity")
+
+	maxVolumesPerNode = flag.Int64("max-volumes-per-node", driver.DefaultMaxVolumesPerNode, "Maximum number of block storage volumes attached to an instance, reported by the node to the scheduler and enforced by the controller")
+
+	volumeNameTemplate   = flag.String("volume-name-template", driver.DefaultVolumeNameTemplate, "Template of the block volume names, supports {prefix}, {name}, {namespace}, {pvc} and {pv}")
+	snapshotNameTemplate = flag.String("snapshot-name-template", driver.DefaultSnapshotNameTemplate, "Template of the block volume snapshot names, supports {prefix}, {name}, {namespace}, {snapshot} and {snapshotcontent}")
+
+	operationTimeout      = flag.Duration("operation-timeout", driver.DefaultOperationTimeout, "Maximum duration to wait for an Exoscale operation to complete")
+	operationPollInterval = flag.Duration("operation-poll-interval", driver.DefaultOperationPollInterval, "Interval between two polls of a pending Exoscale operation")
+
+	defaultRPCTimeout = flag.Duration("default-rpc-timeout", 0, "Maximum duration of an RPC unless the caller set an earlier deadline, the RPCs running longer are canceled with DEADLINE_EXCEEDED, 0 disables the timeout")
+
+	shutdownTimeout = flag.Duration("shutdown-timeout", driver.DefaultShutdownTimeout, "Maximum duration to wait for the in-flight RPCs on SIGTERM, they are then canceled and the server is stopped 5s later, 0 waits forever")
+
+	credentialsSecret = flag.String("credentials-secret", "", "<namespace>/<name> of the Secret of the EXOSCALE_API_KEY and EXOSCALE_API_SECRET credentials, e.g. kube-system/exoscale-credentials, read through the Kubernetes API replacing the environment credentials and reloaded when it changes")
+	credentialsFile   = flag.String("credentials-file", "", "File of EXOSCALE_API_KEY=<key> and EXOSCALE_API_SECRET=<secret> lines, or directory of the mounted exoscale-credentials Secret, replacing the environment credentials and reloaded when it changes")
+
+	apiQPS   = flag.Float64("api-qps", 0, "Maximum average number of Exoscale API requests per second, 0 disables the rate limiting")
+	apiBurst = flag.Int("api-burst", 10, "Maximum burst of Exoscale API requests when rate limiting is enabled")
+
+	listCacheTTL = flag.Duration("list-cache-ttl", driver.DefaultListCacheTTL, "Duration during which the ListVolumes and ListSnapshots results are reused, 0 disables the cache")
+
+	attachmentReconcileInterval = flag.Duration("attachment-reconcile-interval", 0, "Interval at which the volumes of the VolumeAttachments attached to deleted instances are detached, 0 disables the reconciliation")
+
+	pvcLabelSyncInterval = flag.Duration("pvc-label-sync-interval", 0, "Interval at which the --pvc-label-sync-keys labels of the PVCs are copied onto their volume, 0 disables the sync")
+	pvcLabelSyncKeys     = flag.String("pvc-label-sync-keys", "", "Comma separated list of PVC label keys to copy onto the volume labels")
+
+	defaultFSType       = flag.String("default-fstype", driver.DefaultFSType, "Filesystem type of the volumes provisioned without fsType in their StorageClass or volume capability")
+	defaultMountOptions = flag.String("default-mount-options", "", "Comma separated list of mount options added to the filesystem mounts unless the StorageClass overrides them, e.g. noatime")
+	deviceWaitTimeout   = flag.Duration("device-wait-timeout", driver.DefaultDeviceWaitTimeout, "Maximum duration to wait for the device of an attached volume to appear on the node")
+	mountPropagation    = flag.String("mount-propagation", string(driver.SharedMountPropagation), "Propagation required for the staging and publishing mounts (shared, none), none skips the check")
+	allowLazyUnmount    = flag.Bool("allow-lazy-unmount", false, "Lazily unmount the targets still busy after the unmount retries, the filesystem stays alive until the processes using it exit")
+	xfsRepair           = flag.Bool("xfs-repair", false, "Run xfs_repair -L on the xfs filesystems failing to mount because of their dirty log, the latest changes may be lost")
+	fstrimInterval      = flag.Duration("fstrim-interval", 0, "Interval at which the node trims the filesystems of the volumes to release the space of deleted data, 0 disables the trimming")
+	kubeletDir          = flag.String("kubelet-dir", driver.DefaultKubeletDir, "Root directory of the kubelet, in which the node cleans up the orphaned staging paths at startup, disabled if empty")
+
+	usageCheckInterval   = flag.Duration("usage-check-interval", 0, "Interval at which the node checks the usage of the filesystems of the volumes and emits an event on their PVC above the thresholds, 0 disables the checks")
+	usageThreshold       = flag.Float64("usage-threshold", driver.DefaultUsageThreshold, "Percentage of the space of a filesystem above which its usage is high, 0 disables the check")
+	inodesUsageThreshold = flag.Float64("inodes-usage-threshold", driver.DefaultUsageThreshold, "Percentage of the inodes of a filesystem above which its usage is high, 0 disables the check")
+
+	watchDeviceRemoval   = flag.Bool("watch-device-removal", false, "Watch the devices removed while their volume is staged, e.g. by a forced detach, to report the volume abnormal with an event on its PVC")
+	deviceRemovalCleanup = flag.Bool("device-removal-cleanup", false, "Forcibly unmount the staging path of the volumes whose device was removed, with --watch-device-removal")
+
+	fsFreeze = flag.Bool("fsfreeze", false, "Freeze the filesystems of the volumes while snapshotting them when requested by the fsFreeze VolumeSnapshotClass parameter, enable on both the controller and the nodes")
+
+	tlsCertFile     = flag.String("tls-cert-file", "", "Certificate file to serve the CSI endpoint over TLS, with --tls-key-file")
+	tlsKeyFile      = flag.String("tls-key-file", "", "Private key file of the --tls-cert-file certificate")
+	tlsClientCAFile = flag.String("tls-client-ca-file", "", "CA file to require and verify the client certificates against (mTLS), with --tls-cert-file")
+
+	metricsAddress = flag.String("metrics-address", "", "Address to serve the Prometheus metrics on, e.g. :9809, disabled if empty")
+	httpEndpoint   = flag.String("http-endpoint", "", "Address to serve the /healthz liveness and /readyz readiness endpoints on, e.g. :9808, disabled if empty")
+
+	mockDiskUtils = flag.Bool("mock-diskutils", false, "Simulate the devices and mounts of the node in memory to run the node RPCs without devices nor root privileges, for local development only, requires the mockdiskutils build tag")
+
+	logVerbosity = flag.String("log-verbosity", "", "Comma separated list of subsystem=level pairs raising the log verbosity of subsystems (controller, node, diskutils), e.g. diskutils=5, updated at runtime with a PUT on /verbosity of --http-endpoint")
+
+	featureGates = flag.String("feature-gates", "", "Comma separated list of Feature=bool pairs to toggle optional features (OnlineExpansion)")
+
 	// These are set during build time via -ldflags
 	version   string = "dirty"
 	commit    string
@@ -42,15 +126,123 @@ func main() {
 		os.Exit(0)
 	}
 
-	// Mostly for internal use.
-	apiEndpoint := os.Getenv("EXOSCALE_API_ENDPOINT")
+	if *configFile != "" {
+		if err := loadConfigFile(flag.CommandLine, *configFile); err != nil {
+			klog.Fatalf("config file: %v", err)
+		}
+	}
+
+	gates, err := driver.ParseFeatureGates(*featureGates)
+	if err != nil {
+		klog.Fatalln(err)
+	}
+
+	verbosity, err := driver.ParseLogVerbosity(*logVerbosity)
+	if err != nil {
+		klog.Fatalln(err)
+	}
+
+	propagation, err := driver.ParseMountPropagation(*mountPropagation)
+	if err != nil {
+		klog.Fatalln(err)
+	}
+
+	zoneEndpoints, err := driver.ParseZoneEndpoints(*zoneAPIEndpoints)
+	if err != nil {
+		klog.Fatalln(err)
+	}
+
+	labelSyncKeys := splitList(*pvcLabelSyncKeys)
+
+	// The Kubernetes API is only used by the optional controller loops, the filesystem freeze coordination,
+	// the credentials Secret, the PVC events of the node watchers and the Node fallback of the metadata.
+	// The controller may run outside of the cluster, reaching its API with a kubeconfig.
+	var restConfig *rest.Config
+	if *attachmentReconcileInterval > 0 || *pvcLabelSyncInterval > 0 && len(labelSyncKeys) > 0 || *fsFreeze || *credentialsSecret != "" ||
+		*usageCheckInterval > 0 || *watchDeviceRemoval || *nodeName != "" {
+		restConfig, err = kubeRestConfig(*kubeconfig)
+		if err != nil {
+			klog.Fatalf("kubernetes config: %v", err)
+		}
+	}
 
 	exoDriver, err := driver.NewDriver(&driver.DriverConfig{
+		DriverName:   *driverName,
 		Endpoint:     *endpoint,
 		Mode:         driver.Mode(*mode),
 		Prefix:       *prefix,
 		Credentials:  credentials.NewEnvCredentials(),
-		ZoneEndpoint: v3.Endpoint(apiEndpoint),
+		RestConfig:   restConfig,
+		ZoneEndpoint: v3.Endpoint(*apiEndpoint),
+		NodeID:       *nodeID,
+		Zone:         *zone,
+		NodeName:     *nodeName,
+
+		ControllerZone:   *controllerZone,
+		SkipNodeMetadata: *skipNodeMetadata,
+
+		ZoneEndpoints: zoneEndpoints,
+		APICAFile:     *apiCAFile,
+
+		MinVolumeSizeGiB:     *minVolumeSize,
+		MaxVolumeSizeGiB:     *maxVolumeSize,
+		DefaultVolumeSizeGiB: *defaultVolumeSize,
+
+		MaxVolumesPerNode: *maxVolumesPerNode,
+
+		VolumeNameTemplate:   *volumeNameTemplate,
+		SnapshotNameTemplate: *snapshotNameTemplate,
+
+		FeatureGates: gates,
+
+		OperationTimeout:      *operationTimeout,
+		OperationPollInterval: *operationPollInterval,
+
+		DefaultRPCTimeout: *defaultRPCTimeout,
+
+		ShutdownTimeout: *shutdownTimeout,
+
+		LogVerbosity: verbosity,
+
+		CredentialsFile:   *credentialsFile,
+		CredentialsSecret: *credentialsSecret,
+
+		APIQPS:   *apiQPS,
+		APIBurst: *apiBurst,
+
+		ListCacheTTL: *listCacheTTL,
+
+		AttachmentReconcileInterval: *attachmentReconcileInterval,
+
+		PVCLabelSyncInterval: *pvcLabelSyncInterval,
+		PVCLabelSyncKeys:     labelSyncKeys,
+
+		FSFreeze: *fsFreeze,
+
+		DefaultFSType:       *defaultFSType,
+		DefaultMountOptions: splitList(*defaultMountOptions),
+		MountPropagation:    propagation,
+		AllowLazyUnmount:    *allowLazyUnmount,
+		XFSRepair:           *xfsRepair,
+		FstrimInterval:      *fstrimInterval,
+		KubeletDir:          *kubeletDir,
+		DeviceWaitTimeout:   *deviceWaitTimeout,
+
+		UsageCheckInterval:   *usageCheckInterval,
+		UsageThreshold:       *usageThreshold,
+		InodesUsageThreshold: *inodesUsageThreshold,
+
+		DeviceRemovalWatch:   *watchDeviceRemoval,
+		DeviceRemovalCleanup: *deviceRemovalCleanup,
+
+		MetricsAddress: *metricsAddress,
+		HTTPEndpoint:   *httpEndpoint,
+
+		TLSCertFile:     *tlsCertFile,
+		TLSKeyFile:      *tlsKeyFile,
+		TLSClientCAFile: *tlsClientCAFile,
+
+		MockDiskUtils: *mockDiskUtils,
 	})
 	if err != nil {
 		klog.Error(err)
@@ -66,3 +258,24 @@ func main() {
 
 	klog.Info("Run OK")
 }
+
+// kubeRestConfig returns the Kubernetes client config of the kubeconfig file, or else the in-cluster config.
+func kubeRestConfig(kubeconfig string) (*rest.Config, error) {
+	if kubeconfig != "" {
+		return clientcmd.BuildConfigFromFlags("", kubeconfig)
+	}
+
+	return rest.InClusterConfig()
+}
+
+// splitList returns the non-empty items of a comma separated list.
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
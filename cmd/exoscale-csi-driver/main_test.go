@@ -0,0 +1,39 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestKubeRestConfig(t *testing.T) {
+	kubeconfig := filepath.Join(t.TempDir(), "kubeconfig")
+	require.NoError(t, os.WriteFile(kubeconfig, []byte(`
+apiVersion: v1
+kind: Config
+clusters:
+- name: sks
+  cluster:
+    server: https://sks.example.net:443
+contexts:
+- name: sks
+  context:
+    cluster: sks
+    user: csi
+current-context: sks
+users:
+- name: csi
+  user:
+    token: s3cr3t
+`), 0o600))
+
+	config, err := kubeRestConfig(kubeconfig)
+	require.NoError(t, err)
+	require.Equal(t, "https://sks.example.net:443", config.Host)
+	require.Equal(t, "s3cr3t", config.BearerToken)
+
+	_, err = kubeRestConfig(filepath.Join(t.TempDir(), "missing"))
+	require.Error(t, err)
+}
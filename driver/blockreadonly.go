@@ -0,0 +1,153 @@
+package driver
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// blockReadonlySetter gets and sets the read-only state of block devices.
+type blockReadonlySetter interface {
+	GetBlockReadonly(devicePath string) (bool, error)
+	SetBlockReadonly(devicePath string, readonly bool) error
+}
+
+// readonlyBlockDevices keeps track of the raw block devices set read-only to publish them read-only,
+// to restore their previous state once they are no longer published read-only.
+type readonlyBlockDevices struct {
+	mu      sync.Mutex
+	devices map[string]*readonlyBlockDevice
+}
+
+type readonlyBlockDevice struct {
+	// wasReadonly is the read-only state of the device before it was first published read-only.
+	wasReadonly bool
+	targets     map[string]struct{}
+}
+
+func newReadonlyBlockDevices() *readonlyBlockDevices {
+	return &readonlyBlockDevices{
+		devices: make(map[string]*readonlyBlockDevice),
+	}
+}
+
+// canonicalDevicePath returns the path of the device the links of devicePath resolve to,
+// so that a device is tracked once whatever the path it is published from.
+func canonicalDevicePath(devicePath string) string {
+	if resolved, err := filepath.EvalSymlinks(devicePath); err == nil {
+		return resolved
+	}
+
+	return devicePath
+}
+
+// publish sets the device read-only for it to be published read-only on targetPath.
+func (r *readonlyBlockDevices) publish(setter blockReadonlySetter, devicePath, targetPath string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	devicePath = canonicalDevicePath(devicePath)
+
+	device, ok := r.devices[devicePath]
+	if !ok {
+		readonly, err := setter.GetBlockReadonly(devicePath)
+		if err != nil {
+			return err
+		}
+		if !readonly {
+			if err := setter.SetBlockReadonly(devicePath, true); err != nil {
+				return err
+			}
+		}
+
+		device = &readonlyBlockDevice{
+			wasReadonly: readonly,
+			targets:     make(map[string]struct{}),
+		}
+		r.devices[devicePath] = device
+	}
+	device.targets[targetPath] = struct{}{}
+
+	return nil
+}
+
+// restore tracks the device published read-only on targetPath before the driver restarted,
+// it is assumed to have been set read-only by the driver.
+func (r *readonlyBlockDevices) restore(devicePath, targetPath string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	devicePath = canonicalDevicePath(devicePath)
+	device, ok := r.devices[devicePath]
+	if !ok {
+		device = &readonlyBlockDevice{targets: make(map[string]struct{})}
+		r.devices[devicePath] = device
+	}
+	device.targets[targetPath] = struct{}{}
+}
+
+// unpublish restores the read-only state of the device published read-only on targetPath,
+// once it isn't published read-only on any other target.
+func (r *readonlyBlockDevices) unpublish(setter blockReadonlySetter, targetPath string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for devicePath, device := range r.devices {
+		if _, ok := device.targets[targetPath]; !ok {
+			continue
+		}
+
+		delete(device.targets, targetPath)
+		if len(device.targets) > 0 {
+			return nil
+		}
+
+		if !device.wasReadonly {
+			if err := setter.SetBlockReadonly(devicePath, false); err != nil {
+				device.targets[targetPath] = struct{}{}
+				return err
+			}
+		}
+		delete(r.devices, devicePath)
+
+		return nil
+	}
+
+	return nil
+}
+
+func (d *diskUtils) GetBlockReadonly(devicePath string) (bool, error) {
+	// unix specific, will error if not unix
+	fd, err := unix.Openat(unix.AT_FDCWD, devicePath, unix.O_RDONLY, uint32(0))
+	if err != nil {
+		return false, fmt.Errorf("error opening block device %s: %w", devicePath, err)
+	}
+	defer unix.Close(fd)
+
+	ro, err := unix.IoctlGetInt(fd, unix.BLKROGET)
+	if err != nil {
+		return false, fmt.Errorf("error getting BLKROGET for block device %s: %w", devicePath, err)
+	}
+
+	return ro == 1, nil
+}
+
+func (d *diskUtils) SetBlockReadonly(devicePath string, readonly bool) error {
+	fd, err := unix.Openat(unix.AT_FDCWD, devicePath, unix.O_RDONLY, uint32(0))
+	if err != nil {
+		return fmt.Errorf("error opening block device %s: %w", devicePath, err)
+	}
+	defer unix.Close(fd)
+
+	ro := 0
+	if readonly {
+		ro = 1
+	}
+	if err := unix.IoctlSetPointerInt(fd, unix.BLKROSET, ro); err != nil {
+		return fmt.Errorf("error setting BLKROSET for block device %s: %w", devicePath, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,66 @@
+package driver
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type fakeBlockReadonly struct {
+	readonly map[string]bool
+	err      error
+}
+
+func (f *fakeBlockReadonly) GetBlockReadonly(devicePath string) (bool, error) {
+	return f.readonly[devicePath], f.err
+}
+
+func (f *fakeBlockReadonly) SetBlockReadonly(devicePath string, readonly bool) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.readonly[devicePath] = readonly
+	return nil
+}
+
+func TestReadonlyBlockDevices(t *testing.T) {
+	setter := &fakeBlockReadonly{readonly: map[string]bool{"/dev/vdb": false, "/dev/vdc": true}}
+	devices := newReadonlyBlockDevices()
+
+	// The device is restored once unpublished from all its read-only targets.
+	require.NoError(t, devices.publish(setter, "/dev/vdb", "/target/a"))
+	require.NoError(t, devices.publish(setter, "/dev/vdb", "/target/b"))
+	require.True(t, setter.readonly["/dev/vdb"])
+
+	require.NoError(t, devices.unpublish(setter, "/target/a"))
+	require.True(t, setter.readonly["/dev/vdb"])
+	require.NoError(t, devices.unpublish(setter, "/target/b"))
+	require.False(t, setter.readonly["/dev/vdb"])
+	require.Empty(t, devices.devices)
+
+	// A device which was read-only before stays read-only.
+	require.NoError(t, devices.publish(setter, "/dev/vdc", "/target/c"))
+	require.NoError(t, devices.unpublish(setter, "/target/c"))
+	require.True(t, setter.readonly["/dev/vdc"])
+
+	// Targets which weren't published read-only are ignored.
+	require.NoError(t, devices.unpublish(setter, "/target/d"))
+
+	// The device is still tracked when its state can't be restored.
+	require.NoError(t, devices.publish(setter, "/dev/vdb", "/target/a"))
+	setter.err = errors.New("ioctl failed")
+	require.Error(t, devices.unpublish(setter, "/target/a"))
+	setter.err = nil
+	require.NoError(t, devices.unpublish(setter, "/target/a"))
+	require.False(t, setter.readonly["/dev/vdb"])
+
+	// The devices published read-only before a restart are restored once unpublished.
+	setter.readonly["/dev/vdb"] = true
+	devices.restore("/dev/vdb", "/target/a")
+	require.NoError(t, devices.publish(setter, "/dev/vdb", "/target/b"))
+	require.NoError(t, devices.unpublish(setter, "/target/a"))
+	require.True(t, setter.readonly["/dev/vdb"])
+	require.NoError(t, devices.unpublish(setter, "/target/b"))
+	require.False(t, setter.readonly["/dev/vdb"])
+}
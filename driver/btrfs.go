@@ -0,0 +1,78 @@
+package driver
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	btrfsCompressionParameter = "btrfsCompression"
+	btrfsSubvolumeParameter   = "btrfsSubvolume"
+)
+
+var (
+	exoscaleBtrfsCompression = DriverName + "/btrfs-compression"
+	exoscaleBtrfsSubvolume   = DriverName + "/btrfs-subvolume"
+
+	// btrfsCompressionPattern matches the btrfs compression algorithms with their optional level, e.g. zstd:3.
+	btrfsCompressionPattern = regexp.MustCompile(`^(zlib|lzo|zstd)(:[0-9]+)?$`)
+)
+
+// getBtrfsOptions returns the volume context entries of the btrfs StorageClass parameters,
+// an error is returned if a value is invalid or if the volume filesystem isn't btrfs.
+func getBtrfsOptions(parameters map[string]string, fsType string) (map[string]string, error) {
+	compression, hasCompression := parameters[btrfsCompressionParameter]
+	subvolume, hasSubvolume := parameters[btrfsSubvolumeParameter]
+	if !hasCompression && !hasSubvolume {
+		return nil, nil
+	}
+
+	if fsType != "" && fsType != "btrfs" {
+		return nil, fmt.Errorf("btrfs options with filesystem type %s", fsType)
+	}
+
+	btrfsOptions := make(map[string]string)
+	if hasCompression {
+		if !btrfsCompressionPattern.MatchString(compression) {
+			return nil, fmt.Errorf("%s: unknown compression %q, expected zlib, lzo or zstd with an optional level, e.g. zstd:3", btrfsCompressionParameter, compression)
+		}
+		btrfsOptions[exoscaleBtrfsCompression] = compression
+	}
+	if hasSubvolume {
+		if err := validateBtrfsSubvolume(subvolume); err != nil {
+			return nil, fmt.Errorf("%s: %w", btrfsSubvolumeParameter, err)
+		}
+		btrfsOptions[exoscaleBtrfsSubvolume] = subvolume
+	}
+
+	return btrfsOptions, nil
+}
+
+func validateBtrfsSubvolume(name string) error {
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return fmt.Errorf("invalid subvolume name %q", name)
+	}
+
+	return nil
+}
+
+// withBtrfsCompression returns the mount options of a btrfs filesystem with the compression of the volume context,
+// unless the mount options already set one.
+func withBtrfsCompression(mountOptions []string, volumeContext map[string]string) []string {
+	compression, ok := volumeContext[exoscaleBtrfsCompression]
+	if !ok {
+		return mountOptions
+	}
+	for _, option := range mountOptions {
+		if key := optionKey(option); key == "compress" || key == "compress-force" {
+			return mountOptions
+		}
+	}
+
+	return append(mountOptions, "compress="+compression)
+}
+
+func (d *diskUtils) CreateBtrfsSubvolume(path string) error {
+	return runCommand(nil, "btrfs", "subvolume", "create", path)
+}
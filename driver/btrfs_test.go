@@ -0,0 +1,44 @@
+package driver
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetBtrfsOptions(t *testing.T) {
+	testsBench := []struct {
+		parameters map[string]string
+		fsType     string
+		res        map[string]string
+		valid      bool
+	}{
+		{parameters: nil, fsType: "ext4", res: nil, valid: true},
+		{
+			parameters: map[string]string{"btrfsCompression": "zstd:3", "btrfsSubvolume": "data"},
+			fsType:     "btrfs",
+			res:        map[string]string{exoscaleBtrfsCompression: "zstd:3", exoscaleBtrfsSubvolume: "data"},
+			valid:      true,
+		},
+		{parameters: map[string]string{"btrfsCompression": "lzo"}, fsType: "", res: map[string]string{exoscaleBtrfsCompression: "lzo"}, valid: true},
+		{parameters: map[string]string{"btrfsCompression": "zstd"}, fsType: "xfs", valid: false},
+		{parameters: map[string]string{"btrfsCompression": "lz4"}, fsType: "btrfs", valid: false},
+		{parameters: map[string]string{"btrfsCompression": "zstd:"}, fsType: "btrfs", valid: false},
+		{parameters: map[string]string{"btrfsSubvolume": "../data"}, fsType: "btrfs", valid: false},
+		{parameters: map[string]string{"btrfsSubvolume": ""}, fsType: "btrfs", valid: false},
+	}
+
+	for _, test := range testsBench {
+		res, err := getBtrfsOptions(test.parameters, test.fsType)
+		require.Equal(t, test.valid, err == nil, err)
+		require.Equal(t, test.res, res)
+	}
+}
+
+func TestWithBtrfsCompression(t *testing.T) {
+	volumeContext := map[string]string{exoscaleBtrfsCompression: "zstd"}
+
+	require.Equal(t, []string{"noatime"}, withBtrfsCompression([]string{"noatime"}, nil))
+	require.Equal(t, []string{"noatime", "compress=zstd"}, withBtrfsCompression([]string{"noatime"}, volumeContext))
+	require.Equal(t, []string{"compress-force=lzo"}, withBtrfsCompression([]string{"compress-force=lzo"}, volumeContext))
+}
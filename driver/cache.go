@@ -0,0 +1,222 @@
+package driver
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+
+	v3 "github.com/exoscale/egoscale/v3"
+)
+
+const (
+	// volumeNameCacheSize is the maximum number of volume names cached, the least recently used are evicted first.
+	volumeNameCacheSize = 10000
+	// volumeNameIndexTTL is the duration during which the names of a listed zone are trusted to be all its volumes,
+	// after which the zone is listed again on the next cache miss.
+	volumeNameIndexTTL = 10 * time.Minute
+)
+
+// volumeNameCache maps the names of the Exoscale volumes to their ID, so CreateVolume doesn't have to list
+// all the volumes of a zone: the Exoscale API can't filter the volumes by name or label.
+// A listing of a zone indexes all its volumes, until volumeNameIndexTTL a name missing from the index of the zone
+// is a volume which doesn't exist unless it is uncertain, e.g. its creation timed out.
+type volumeNameCache struct {
+	mu      sync.Mutex
+	size    int
+	lru     *list.List
+	entries map[string]*list.Element
+	ids     map[v3.UUID]*list.Element
+	// indexed are the zones whose volumes are all cached, until the time their index expires.
+	indexed map[v3.ZoneName]time.Time
+	// uncertain are the names of the volumes which may exist without being cached.
+	uncertain map[string]struct{}
+}
+
+type volumeNameEntry struct {
+	zoneName v3.ZoneName
+	name     string
+	id       v3.UUID
+}
+
+func newVolumeNameCache(size int) *volumeNameCache {
+	return &volumeNameCache{
+		size:      size,
+		lru:       list.New(),
+		entries:   make(map[string]*list.Element),
+		ids:       make(map[v3.UUID]*list.Element),
+		indexed:   make(map[v3.ZoneName]time.Time),
+		uncertain: make(map[string]struct{}),
+	}
+}
+
+func (c *volumeNameCache) get(zoneName v3.ZoneName, name string) (v3.UUID, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[volumeNameCacheKey(zoneName, name)]
+	if !ok {
+		return "", false
+	}
+	c.lru.MoveToFront(e)
+
+	return e.Value.(*volumeNameEntry).id, true
+}
+
+func (c *volumeNameCache) set(zoneName v3.ZoneName, name string, id v3.UUID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.setLocked(zoneName, name, id)
+}
+
+func (c *volumeNameCache) setLocked(zoneName v3.ZoneName, name string, id v3.UUID) {
+	key := volumeNameCacheKey(zoneName, name)
+	delete(c.uncertain, key)
+
+	if e, ok := c.entries[key]; ok {
+		c.removeLocked(e)
+	}
+	e := c.lru.PushFront(&volumeNameEntry{zoneName: zoneName, name: name, id: id})
+	c.entries[key] = e
+	c.ids[id] = e
+
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		// The index of the zone of the evicted name is no longer complete.
+		delete(c.indexed, oldest.Value.(*volumeNameEntry).zoneName)
+		c.removeLocked(oldest)
+	}
+}
+
+func (c *volumeNameCache) delete(zoneName v3.ZoneName, name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[volumeNameCacheKey(zoneName, name)]; ok {
+		c.removeLocked(e)
+	}
+}
+
+// deleteID evicts the volume id, once deleted.
+func (c *volumeNameCache) deleteID(id v3.UUID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.ids[id]; ok {
+		c.removeLocked(e)
+	}
+}
+
+func (c *volumeNameCache) removeLocked(e *list.Element) {
+	entry := e.Value.(*volumeNameEntry)
+	delete(c.entries, volumeNameCacheKey(entry.zoneName, entry.name))
+	if c.ids[entry.id] == e {
+		delete(c.ids, entry.id)
+	}
+	c.lru.Remove(e)
+}
+
+// index caches the names of all the volumes of the zone, listed at now.
+// The zone isn't indexed if its volumes don't fit in the cache.
+func (c *volumeNameCache) index(zoneName v3.ZoneName, volumes []v3.BlockStorageVolume, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, volume := range volumes {
+		c.setLocked(zoneName, volume.Name, volume.ID)
+	}
+	for key := range c.uncertain {
+		if volumeNameCacheKeyZone(key) == zoneName {
+			delete(c.uncertain, key)
+		}
+	}
+
+	if len(volumes) <= c.size {
+		c.indexed[zoneName] = now.Add(volumeNameIndexTTL)
+	}
+}
+
+// missing returns true if the volume name is known not to exist in the zone at now, without listing the zone.
+func (c *volumeNameCache) missing(zoneName v3.ZoneName, name string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := volumeNameCacheKey(zoneName, name)
+	if _, ok := c.entries[key]; ok {
+		return false
+	}
+	if _, ok := c.uncertain[key]; ok {
+		return false
+	}
+	expires, ok := c.indexed[zoneName]
+
+	return ok && now.Before(expires)
+}
+
+// setUncertain records that the volume name may exist without being cached,
+// e.g. when its creation failed or timed out, so that the next lookup lists the zone.
+func (c *volumeNameCache) setUncertain(zoneName v3.ZoneName, name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.uncertain[volumeNameCacheKey(zoneName, name)] = struct{}{}
+}
+
+func volumeNameCacheKey(zoneName v3.ZoneName, name string) string {
+	return string(zoneName) + "/" + name
+}
+
+func volumeNameCacheKeyZone(key string) v3.ZoneName {
+	zoneName, _, _ := strings.Cut(key, "/")
+	return v3.ZoneName(zoneName)
+}
+
+// DefaultListCacheTTL is the duration during which the ListVolumes and ListSnapshots results are reused.
+const DefaultListCacheTTL = 5 * time.Second
+
+// listCache holds the result of listing all the zones for ttl, so that frequent polling
+// of ListVolumes and ListSnapshots doesn't multiply the API requests. A zero ttl disables it.
+type listCache[T any] struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries []T
+	expires time.Time
+}
+
+func newListCache[T any](ttl time.Duration) *listCache[T] {
+	return &listCache[T]{ttl: ttl}
+}
+
+// get returns the cached entries if they have not expired.
+// The entries are shared between the callers and must not be modified.
+func (c *listCache[T]) get() ([]T, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.entries == nil || time.Now().After(c.expires) {
+		return nil, false
+	}
+
+	return c.entries, true
+}
+
+func (c *listCache[T]) set(entries []T) {
+	if c.ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = entries
+	c.expires = time.Now().Add(c.ttl)
+}
+
+// invalidate drops the cached entries, it is called after the listed resources change.
+func (c *listCache[T]) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = nil
+}
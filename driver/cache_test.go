@@ -0,0 +1,101 @@
+package driver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	v3 "github.com/exoscale/egoscale/v3"
+)
+
+func TestVolumeNameCache(t *testing.T) {
+	cache := newVolumeNameCache(volumeNameCacheSize)
+	id := v3.UUID("8a6ad5e0-5de1-4ecb-b9d6-e2d4c2a3c0e4")
+
+	_, ok := cache.get("ch-gva-2", "pvc-1")
+	require.False(t, ok)
+
+	cache.set("ch-gva-2", "pvc-1", id)
+
+	res, ok := cache.get("ch-gva-2", "pvc-1")
+	require.True(t, ok)
+	require.Equal(t, id, res)
+
+	_, ok = cache.get("de-fra-1", "pvc-1")
+	require.False(t, ok)
+
+	cache.delete("ch-gva-2", "pvc-1")
+	_, ok = cache.get("ch-gva-2", "pvc-1")
+	require.False(t, ok)
+
+	cache.set("ch-gva-2", "pvc-1", id)
+	cache.deleteID(id)
+	_, ok = cache.get("ch-gva-2", "pvc-1")
+	require.False(t, ok)
+}
+
+func TestVolumeNameCacheIndex(t *testing.T) {
+	now := time.Now()
+	cache := newVolumeNameCache(2)
+
+	require.False(t, cache.missing("ch-gva-2", "pvc-3", now), "unlisted zone")
+
+	cache.index("ch-gva-2", []v3.BlockStorageVolume{
+		{ID: "8a6ad5e0-5de1-4ecb-b9d6-e2d4c2a3c0e1", Name: "pvc-1"},
+		{ID: "8a6ad5e0-5de1-4ecb-b9d6-e2d4c2a3c0e2", Name: "pvc-2"},
+	}, now)
+	require.False(t, cache.missing("ch-gva-2", "pvc-1", now), "cached name")
+	require.True(t, cache.missing("ch-gva-2", "pvc-3", now))
+	require.False(t, cache.missing("ch-gva-2", "pvc-3", now.Add(volumeNameIndexTTL)), "expired index")
+	require.False(t, cache.missing("de-fra-1", "pvc-3", now), "other zone")
+
+	cache.setUncertain("ch-gva-2", "pvc-3")
+	require.False(t, cache.missing("ch-gva-2", "pvc-3", now), "uncertain name")
+	cache.index("ch-gva-2", nil, now)
+	require.True(t, cache.missing("ch-gva-2", "pvc-3", now), "listed again")
+
+	// Evicting a name of the zone makes its index incomplete.
+	cache.index("ch-gva-2", []v3.BlockStorageVolume{
+		{ID: "8a6ad5e0-5de1-4ecb-b9d6-e2d4c2a3c0e1", Name: "pvc-1"},
+		{ID: "8a6ad5e0-5de1-4ecb-b9d6-e2d4c2a3c0e2", Name: "pvc-2"},
+	}, now)
+	cache.set("de-fra-1", "pvc-4", "8a6ad5e0-5de1-4ecb-b9d6-e2d4c2a3c0e4")
+	_, ok := cache.get("ch-gva-2", "pvc-1")
+	require.False(t, ok, "least recently used name evicted")
+	require.False(t, cache.missing("ch-gva-2", "pvc-3", now))
+
+	// The zones with more volumes than the cache size are not indexed.
+	cache.index("at-vie-1", []v3.BlockStorageVolume{
+		{ID: "8a6ad5e0-5de1-4ecb-b9d6-e2d4c2a3c0e5", Name: "pvc-5"},
+		{ID: "8a6ad5e0-5de1-4ecb-b9d6-e2d4c2a3c0e6", Name: "pvc-6"},
+		{ID: "8a6ad5e0-5de1-4ecb-b9d6-e2d4c2a3c0e7", Name: "pvc-7"},
+	}, now)
+	require.False(t, cache.missing("at-vie-1", "pvc-8", now))
+}
+
+func TestListCache(t *testing.T) {
+	cache := newListCache[string](time.Minute)
+
+	_, ok := cache.get()
+	require.False(t, ok)
+
+	cache.set([]string{"vol-1", "vol-2"})
+	res, ok := cache.get()
+	require.True(t, ok)
+	require.Equal(t, []string{"vol-1", "vol-2"}, res)
+
+	cache.invalidate()
+	_, ok = cache.get()
+	require.False(t, ok)
+
+	cache.set([]string{})
+	cache.expires = time.Now().Add(-time.Second)
+	_, ok = cache.get()
+	require.False(t, ok)
+
+	disabled := newListCache[string](0)
+	disabled.set([]string{"vol-1"})
+	_, ok = disabled.get()
+	require.False(t, ok)
+}
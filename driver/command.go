@@ -0,0 +1,76 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+
+	"k8s.io/klog/v2"
+	kexec "k8s.io/utils/exec"
+)
+
+// runCommand runs the command with args, feeding it stdin if not nil.
+// Its combined output is logged at debug level and returned in the error if it fails,
+// so that the failure is actionable rather than a bare exit status.
+func runCommand(stdin io.Reader, name string, args ...string) error {
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(path, args...)
+	if stdin != nil {
+		cmd.Stdin = stdin
+	}
+
+	argv := append([]string{name}, args...)
+	out, err := cmd.CombinedOutput()
+	logCommandOutput(argv, out, err)
+	if err == nil {
+		return nil
+	}
+
+	if output := strings.TrimSpace(string(out)); output != "" {
+		return fmt.Errorf("%s: %w: %s", strings.Join(argv, " "), err, output)
+	}
+
+	return fmt.Errorf("%s: %w", strings.Join(argv, " "), err)
+}
+
+// logCommandOutput logs the result and the output of the command argv at debug level.
+func logCommandOutput(argv []string, out []byte, err error) {
+	klog.V(5).Infof("%s: %v, output: %s", strings.Join(argv, " "), err, strings.TrimSpace(string(out)))
+}
+
+// loggingExec logs the output of the commands run by the mount-utils formatter and resizer,
+// which only report it when they fail.
+type loggingExec struct {
+	kexec.Interface
+}
+
+func (e loggingExec) Command(cmd string, args ...string) kexec.Cmd {
+	return &loggingCmd{Cmd: e.Interface.Command(cmd, args...), argv: append([]string{cmd}, args...)}
+}
+
+func (e loggingExec) CommandContext(ctx context.Context, cmd string, args ...string) kexec.Cmd {
+	return &loggingCmd{Cmd: e.Interface.CommandContext(ctx, cmd, args...), argv: append([]string{cmd}, args...)}
+}
+
+type loggingCmd struct {
+	kexec.Cmd
+	argv []string
+}
+
+func (c *loggingCmd) CombinedOutput() ([]byte, error) {
+	out, err := c.Cmd.CombinedOutput()
+	logCommandOutput(c.argv, out, err)
+	return out, err
+}
+
+func (c *loggingCmd) Output() ([]byte, error) {
+	out, err := c.Cmd.Output()
+	logCommandOutput(c.argv, out, err)
+	return out, err
+}
@@ -0,0 +1,33 @@
+package driver
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	kexec "k8s.io/utils/exec"
+)
+
+func TestRunCommand(t *testing.T) {
+	require.NoError(t, runCommand(nil, "true"))
+
+	err := runCommand(nil, "sh", "-c", "echo resize2fs: Bad magic number in super-block >&2; exit 1")
+	require.ErrorContains(t, err, "exit status 1: resize2fs: Bad magic number in super-block")
+
+	err = runCommand(strings.NewReader("passphrase"), "sh", "-c", "read p; test $p = other")
+	require.EqualError(t, err, "sh -c read p; test $p = other: exit status 1")
+}
+
+func TestLoggingExec(t *testing.T) {
+	e := loggingExec{kexec.New()}
+
+	out, err := e.Command("sh", "-c", "echo formatted").CombinedOutput()
+	require.NoError(t, err)
+	require.Equal(t, "formatted\n", string(out))
+
+	// The mount-utils formatter checks the exit status of the commands.
+	_, err = e.Command("sh", "-c", "exit 2").CombinedOutput()
+	exitErr, ok := err.(kexec.ExitError)
+	require.True(t, ok)
+	require.Equal(t, 2, exitErr.ExitStatus())
+}
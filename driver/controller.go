@@ -4,13 +4,15 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"maps"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
-	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
 	"k8s.io/klog/v2"
 
 	v3 "github.com/exoscale/egoscale/v3"
@@ -55,6 +57,11 @@ var (
 		// SINGLE_NODE_SINGLE_WRITER and/or SINGLE_NODE_MULTI_WRITER are
 		// supported, in order to permit older COs to continue working.
 		csi.ControllerServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
+		// Indicates the SP supports ControllerPublishVolume.readonly field.
+		// The read-only intent is forwarded to the node through the publish context.
+		csi.ControllerServiceCapability_RPC_PUBLISH_READONLY,
+		// Indicates the SP supports the ControllerModifyVolume RPC.
+		csi.ControllerServiceCapability_RPC_MODIFY_VOLUME,
 	}
 
 	// supportedAccessModes represents the supported access modes for the Exoscale Block Volumes
@@ -65,11 +72,47 @@ var (
 		{
 			Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER,
 		},
+		{
+			Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER,
+		},
 	}
 
 	exoscaleVolumeID   = DriverName + "/volume-id"
 	exoscaleVolumeName = DriverName + "/volume-name"
 	exoscaleVolumeZone = DriverName + "/volume-zone"
+	// exoscaleDeviceSerial is the serial of the virtio-blk device backing the volume on the instance.
+	exoscaleDeviceSerial = DriverName + "/device-serial"
+	// exoscaleVolumeReadonly is set in the publish context when the volume is published read-only.
+	exoscaleVolumeReadonly = DriverName + "/readonly"
+	// exoscaleDeletionProtection is the volume label preventing DeleteVolume from deleting it.
+	// Like the other volume labels, it keeps the default driver name whatever the name of the driver.
+	exoscaleDeletionProtection = DefaultDriverName + "/deletion-protection"
+	// exoscaleVolumeFSType is set in the volume context to the filesystem type resolved at provisioning.
+	exoscaleVolumeFSType = DriverName + "/fstype"
+	// exoscaleVolumeEncrypted is set in the volume context of the volumes to encrypt with LUKS on the node.
+	exoscaleVolumeEncrypted = DriverName + "/encrypted"
+	// exoscaleMkfsOptionsPrefix prefixes the filesystem type of the mkfs options set in the volume context.
+	exoscaleMkfsOptionsPrefix = DriverName + "/mkfs-options-"
+)
+
+const (
+	// defaultSizeParameter is the StorageClass parameter overriding the size
+	// of volumes provisioned without requested capacity, e.g. "50Gi".
+	defaultSizeParameter = "defaultSize"
+	// fsTypeParameter is the StorageClass parameter of the filesystem type, usually passed
+	// by the external-provisioner in the mount capability instead.
+	fsTypeParameter = "csi.storage.k8s.io/fstype"
+	// deletionProtectionParameter is the StorageClass and VolumeAttributesClass parameter
+	// enabling the deletion protection of volumes, e.g. "true".
+	deletionProtectionParameter = "deletionProtection"
+	// performanceTierParameter is reserved for the block storage performance classes,
+	// which Exoscale block storage doesn't offer yet.
+	performanceTierParameter = "performanceTier"
+	// encryptedParameter is the StorageClass parameter enabling the LUKS encryption of volumes, e.g. "true".
+	encryptedParameter = "encrypted"
+	// mkfsOptionsParameterPrefix prefixes the filesystem type of the StorageClass parameters
+	// of the options to format volumes with, e.g. "mkfsOptions-ext4": "-b 4096 -I 256".
+	mkfsOptionsParameterPrefix = "mkfsOptions-"
 )
 
 const (
@@ -78,61 +121,271 @@ const (
 	MaximumVolumeSizeGiB = 10000
 )
 
+// volumeSizeLimits represents the sizing policy applied to the provisioned volumes.
+type volumeSizeLimits struct {
+	minGiB     int64
+	maxGiB     int64
+	defaultGiB int64
+}
+
+// newVolumeSizeLimits returns the sizing policy for the given limits,
+// zero values fall back to the driver defaults.
+func newVolumeSizeLimits(minGiB, maxGiB, defaultGiB int64) (volumeSizeLimits, error) {
+	limits := volumeSizeLimits{
+		minGiB:     MinimalVolumeSizeGiB,
+		maxGiB:     MaximumVolumeSizeGiB,
+		defaultGiB: DefaultVolumeSizeGiB,
+	}
+	if minGiB != 0 {
+		limits.minGiB = minGiB
+	}
+	if maxGiB != 0 {
+		limits.maxGiB = maxGiB
+	}
+	if defaultGiB != 0 {
+		limits.defaultGiB = defaultGiB
+	}
+
+	if limits.minGiB < MinimalVolumeSizeGiB {
+		return volumeSizeLimits{}, fmt.Errorf("minimum volume size %d GiB is less than %d GiB", limits.minGiB, MinimalVolumeSizeGiB)
+	}
+	if limits.maxGiB < limits.minGiB {
+		return volumeSizeLimits{}, fmt.Errorf("maximum volume size %d GiB is less than the minimum volume size %d GiB", limits.maxGiB, limits.minGiB)
+	}
+	if limits.defaultGiB < limits.minGiB || limits.defaultGiB > limits.maxGiB {
+		return volumeSizeLimits{}, fmt.Errorf("default volume size %d GiB is not between %d GiB and %d GiB", limits.defaultGiB, limits.minGiB, limits.maxGiB)
+	}
+
+	return limits, nil
+}
+
 type controllerService struct {
-	client   *v3.Client
-	zoneName v3.ZoneName
+	client      *v3.Client
+	zoneName    v3.ZoneName
+	volumeNames *volumeNameCache
+	volumeSizes volumeSizeLimits
+	// maxVolumesPerNode is the maximum number of block storage volumes attached to an instance.
+	maxVolumesPerNode int64
+
+	// clientOpts are used to create the clients from the credentials of CSI secrets.
+	clientOpts []v3.ClientOpt
+	// zoneEndpoints overrides the API endpoints of the zones.
+	zoneEndpoints ZoneEndpoints
+	// apiCheck remembers the last successful check of the API key by Probe.
+	apiCheck *apiCheck
+	// reloadedClient holds the client using the latest reloaded credentials, nil unless they are reloaded.
+	reloadedClient *atomic.Pointer[v3.Client]
+
+	volumeNameTemplate   *nameTemplate
+	snapshotNameTemplate *nameTemplate
+
+	// onlineExpansion allows to resize volumes attached to an instance.
+	onlineExpansion bool
+	// defaultFSType is recorded in the volume context of the volumes provisioned without filesystem type.
+	defaultFSType string
+
+	operationTimeout      time.Duration
+	operationPollInterval time.Duration
+	pendingOperations     *pendingOperations
+
+	// blockStorageZones remembers the zones without block storage skipped when listing.
+	blockStorageZones *blockStorageZones
+
+	volumesList   *listCache[*csi.ListVolumesResponse_Entry]
+	snapshotsList *listCache[*csi.ListSnapshotsResponse_Entry]
+
+	// kube coordinates the filesystem freezes with the nodes, nil if disabled.
+	kube *kubeClient
 
 	csi.UnimplementedControllerServer
 }
 
-func newControllerService(client *v3.Client, nodeMeta *nodeMetadata) controllerService {
-	return controllerService{
-		client:   client,
-		zoneName: nodeMeta.zoneName,
+func newControllerService(client *v3.Client, clientOpts []v3.ClientOpt, nodeMeta *nodeMetadata, config *DriverConfig) (controllerService, error) {
+	volumeSizes, err := newVolumeSizeLimits(config.MinVolumeSizeGiB, config.MaxVolumeSizeGiB, config.DefaultVolumeSizeGiB)
+	if err != nil {
+		return controllerService{}, err
+	}
+
+	volumeNameTemplate := config.VolumeNameTemplate
+	if volumeNameTemplate == "" {
+		volumeNameTemplate = DefaultVolumeNameTemplate
+	}
+	volumeNames, err := newNameTemplate(volumeNameTemplate, config.Prefix, volumeNamePlaceholders)
+	if err != nil {
+		return controllerService{}, err
+	}
+
+	snapshotNameTemplate := config.SnapshotNameTemplate
+	if snapshotNameTemplate == "" {
+		snapshotNameTemplate = DefaultSnapshotNameTemplate
 	}
+	snapshotNames, err := newNameTemplate(snapshotNameTemplate, config.Prefix, snapshotNamePlaceholders)
+	if err != nil {
+		return controllerService{}, err
+	}
+
+	operationTimeout, operationPollInterval := newOperationSettings(config.OperationTimeout, config.OperationPollInterval)
+
+	maxVolumesPerNode := config.MaxVolumesPerNode
+	if maxVolumesPerNode <= 0 {
+		maxVolumesPerNode = DefaultMaxVolumesPerNode
+	}
+	defaultFSType := config.DefaultFSType
+	if defaultFSType == "" {
+		defaultFSType = DefaultFSType
+	}
+
+	var kube *kubeClient
+	if config.FSFreeze {
+		kube, err = newKubeClient(config.RestConfig)
+		if err != nil {
+			return controllerService{}, fmt.Errorf("filesystem freeze: %w", err)
+		}
+	}
+
+	var reloadedClient *atomic.Pointer[v3.Client]
+	if config.CredentialsFile != "" || config.CredentialsSecret != "" {
+		reloadedClient = new(atomic.Pointer[v3.Client])
+	}
+
+	return controllerService{
+		client:                client,
+		clientOpts:            clientOpts,
+		reloadedClient:        reloadedClient,
+		zoneEndpoints:         config.ZoneEndpoints,
+		apiCheck:              &apiCheck{},
+		zoneName:              nodeMeta.zoneName,
+		volumeNames:           newVolumeNameCache(volumeNameCacheSize),
+		volumeSizes:           volumeSizes,
+		maxVolumesPerNode:     maxVolumesPerNode,
+		defaultFSType:         defaultFSType,
+		volumeNameTemplate:    volumeNames,
+		snapshotNameTemplate:  snapshotNames,
+		onlineExpansion:       config.FeatureGates.Enabled(OnlineExpansion),
+		operationTimeout:      operationTimeout,
+		operationPollInterval: operationPollInterval,
+		pendingOperations:     newPendingOperations(),
+		blockStorageZones:     newBlockStorageZones(),
+		volumesList:           newListCache[*csi.ListVolumesResponse_Entry](config.ListCacheTTL),
+		snapshotsList:         newListCache[*csi.ListSnapshotsResponse_Entry](config.ListCacheTTL),
+		kube:                  kube,
+	}, nil
 }
 
 // CreateVolume creates a new volume from CreateVolumeRequest with blockstorage ProvisionVolume.
 // This function is idempotent.
 func (d *controllerService) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
-	klog.V(4).Infof("CreateVolume")
+	logger := klog.FromContext(ctx)
+	logger.V(4).Info("CreateVolume")
+
+	if len(req.GetVolumeCapabilities()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "volume capabilities not provided")
+	}
+	if err := validateVolumeCapabilities(req.GetVolumeCapabilities()); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "volume capabilities not supported: %v", err)
+	}
+
+	// Reject unsupported filesystems at provisioning rather than when staging the volume.
+	fsType, err := getVolumeFSType(req.GetParameters(), req.GetVolumeCapabilities())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid filesystem type: %v", err)
+	}
+	// The filesystem type is resolved at provisioning so that the volume keeps it if the default changes.
+	if fsType == "" && hasMountCapability(req.GetVolumeCapabilities()) {
+		fsType = d.defaultFSType
+	}
+	encrypted, err := getVolumeEncrypted(req.GetParameters(), req.GetVolumeCapabilities())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid %s parameter: %v", encryptedParameter, err)
+	}
+	mkfsOptions, err := getMkfsOptions(req.GetParameters())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid mkfs options: %v", err)
+	}
+	ioTuning, err := getIOTuning(req.GetParameters())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid I/O tuning: %v", err)
+	}
+	btrfsOptions, err := getBtrfsOptions(req.GetParameters(), fsType)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid btrfs options: %v", err)
+	}
+	extTuning, err := getExtTuning(req.GetParameters(), fsType)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid ext tuning: %v", err)
+	}
+	stripes, err := getVolumeStripes(req.GetParameters())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid %s parameter: %v", stripesParameter, err)
+	}
+	// The volumes of a striped volume are all attached to the node, each of them taking an attachment slot.
+	if stripes > 1 && int64(stripes) > d.maxVolumesPerNode {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid %s parameter: %d volumes can't be attached to a node, the limit is %d",
+			stripesParameter, stripes, d.maxVolumesPerNode)
+	}
+	volumeContext := newVolumeContext(fsType, encrypted, mkfsOptions, ioTuning, btrfsOptions, extTuning)
+	if stripes > 1 {
+		volumeContext[exoscaleVolumeStripes] = strconv.Itoa(stripes)
+	}
+
+	// Fail rather than silently provisioning a volume with the default performance.
+	if tier, ok := req.GetParameters()[performanceTierParameter]; ok {
+		return nil, status.Errorf(codes.InvalidArgument, "%s %s: performance tiers are not supported by Exoscale block storage", performanceTierParameter, tier)
+	}
 
 	zoneName, err := getRequiredZone(req.GetAccessibilityRequirements(), d.zoneName)
 	if err != nil {
-		klog.Errorf("create block storage volume get required zone: %v", err)
+		logger.Error(err, "create block storage volume get required zone")
 		return nil, err
 	}
 
-	client, err := newClientZone(ctx, d.client, zoneName)
+	client, err := d.clientZone(ctx, req.GetSecrets(), zoneName)
 	if err != nil {
-		klog.Errorf("create volume: new client zone: %v", err)
+		logger.Error(err, "create volume: new client zone")
 		return nil, err
 	}
 
-	resp, err := client.ListBlockStorageVolumes(ctx)
-	if err != nil {
-		klog.Errorf("create block storage volume list: %v", err)
+	volumeName := d.volumeNameTemplate.render(req.Name, req.GetParameters())
+	operationKey := "create-volume/" + volumeNameCacheKey(zoneName, volumeName)
+
+	if err := d.checkPendingOperation(ctx, client, operationKey); err != nil {
 		return nil, err
 	}
 
 	// Make the call idempotent since CreateBlockStorageVolume is not.
-	for _, v := range resp.BlockStorageVolumes {
-		if v.Name == req.Name {
-			return &csi.CreateVolumeResponse{
-				Volume: &csi.Volume{
-					VolumeId:           exoscaleID(zoneName, v.ID),
-					CapacityBytes:      convertGiBToBytes(v.Size),
-					AccessibleTopology: newZoneTopology(zoneName),
-				},
-			}, nil
+	volume, err := d.findVolumeByName(ctx, client, zoneName, volumeName)
+	if err != nil {
+		logger.Error(err, "create block storage volume find by name", "volumeName", volumeName)
+		return nil, err
+	}
+	if volume != nil {
+		// A previous call may have failed before creating all the volumes of a striped volume.
+		if volumeStripes(volume.Labels) > 1 {
+			if err := d.createStripes(ctx, client, zoneName, volume); err != nil {
+				logger.Error(err, "create volumes of striped volume", "volumeID", volume.ID)
+				return nil, err
+			}
 		}
+
+		return &csi.CreateVolumeResponse{
+			Volume: &csi.Volume{
+				VolumeId:           exoscaleID(zoneName, volume.ID),
+				CapacityBytes:      convertGiBToBytes(volume.Size * int64(volumeStripes(volume.Labels))),
+				AccessibleTopology: newZoneTopology(zoneName),
+				VolumeContext:      volumeContext,
+			},
+		}, nil
 	}
 
 	// create the volume from a snapshot if a snapshot ID was provided.
 	var snapshotTarget *v3.BlockStorageSnapshotTarget
 	if req.GetVolumeContentSource() != nil {
+		if stripes > 1 {
+			return nil, status.Error(codes.InvalidArgument, "striped volumes can't be created from a snapshot")
+		}
 		if _, ok := req.GetVolumeContentSource().GetType().(*csi.VolumeContentSource_Snapshot); !ok {
-			return nil, status.Error(codes.InvalidArgument, "unsupported volumeContentSource type")
+			// Exoscale block storage volumes can only be created empty or from a snapshot.
+			return nil, status.Error(codes.InvalidArgument, "unsupported volumeContentSource type, only snapshots are supported")
 		}
 
 		srcSnapshot := req.GetVolumeContentSource().GetSnapshot()
@@ -141,70 +394,117 @@ func (d *controllerService) CreateVolume(ctx context.Context, req *csi.CreateVol
 		}
 		_, snapshotID, err := getExoscaleID(srcSnapshot.SnapshotId)
 		if err != nil {
-			klog.Errorf("create volume from snapshot: %v", err)
+			logger.Error(err, "create volume from snapshot")
 			return nil, err
 		}
 
 		snapshot, err := client.GetBlockStorageSnapshot(ctx, snapshotID)
 		if err != nil {
 			if errors.Is(err, v3.ErrNotFound) {
-				klog.Errorf("create volume get snapshot not found: %v", err)
+				logger.Error(err, "create volume get snapshot not found")
 				return nil, status.Errorf(codes.NotFound, "snapshot %s not found", snapshotID)
 			}
-			klog.Errorf("create volume get snapshot: %v", err)
+			logger.Error(err, "create volume get snapshot")
 
 			return nil, err
 		}
 
+		if !isSnapshotReady(snapshot) {
+			return nil, status.Errorf(codes.Unavailable, "snapshot %s is not ready, state %s", snapshotID, snapshot.State)
+		}
+
 		snapshotTarget = &v3.BlockStorageSnapshotTarget{
 			ID: snapshot.ID,
 		}
 
-		klog.Infof("creating volume from snapshot %q", snapshotTarget.ID.String())
+		logger.Info("creating volume from snapshot", "snapshotID", snapshotTarget.ID)
 	}
 
-	var sizeInGiB int64 = DefaultVolumeSizeGiB
-	if req.GetCapacityRange() != nil {
-		requiredBytes := req.GetCapacityRange().RequiredBytes
-		if requiredBytes%GiB != 0 {
+	sizeInGiB, err := getDefaultVolumeSizeGiB(req.GetParameters(), d.volumeSizes)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid parameter %s: %v", defaultSizeParameter, err)
+	}
+	if capRange := req.GetCapacityRange(); capRange.GetRequiredBytes() > 0 || capRange.GetLimitBytes() > 0 {
+		sizeInBytes, err := getNewVolumeSize(capRange, d.volumeSizes)
+		if err != nil {
+			return nil, status.Errorf(codes.OutOfRange, "invalid capacity range: %v", err)
+		}
+
+		if sizeInBytes%GiB != 0 {
 			msg := "requested size in bytes cannot be exactly converted to GiB: %d"
 
-			klog.Errorf(msg, requiredBytes)
+			logger.Error(nil, "requested size in bytes cannot be exactly converted to GiB", "size", sizeInBytes)
 
-			return nil, fmt.Errorf(msg, requiredBytes)
+			return nil, fmt.Errorf(msg, sizeInBytes)
 		}
 
-		sizeInGiB = convertBytesToGiB(requiredBytes)
+		sizeInGiB = convertBytesToGiB(sizeInBytes)
+	}
+	// The size of a striped volume is split between its volumes.
+	sizeInGiB, err = stripedVolumeSizeGiB(sizeInGiB, stripes, req.GetCapacityRange(), d.volumeSizes)
+	if err != nil {
+		return nil, status.Errorf(codes.OutOfRange, "invalid capacity range: %v", err)
+	}
+
+	if err := checkVolumeQuota(ctx, client, sizeInGiB*int64(stripes)); err != nil {
+		return nil, err
+	}
+
+	labels, err := getVolumeLabels(req.GetParameters(), nil)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid parameters: %v", err)
+	}
+	if stripes > 1 {
+		if labels == nil {
+			labels = v3.Labels{}
+		}
+		labels[exoscaleVolumeStripes] = strconv.Itoa(stripes)
 	}
 
 	request := v3.CreateBlockStorageVolumeRequest{
-		Name:                 req.Name,
+		Name:                 volumeName,
 		Size:                 sizeInGiB,
 		BlockStorageSnapshot: snapshotTarget,
+		Labels:               labels,
 	}
 
 	if err := client.Validate(request); err != nil {
-		klog.Errorf("create block storage volume validation: %v", err)
+		logger.Error(err, "create block storage volume validation")
 		return nil, err
 	}
 
 	op, err := client.CreateBlockStorageVolume(ctx, request)
 	if err != nil {
-		klog.Errorf("create block storage volume: %v", err)
+		// The volume may have been created nevertheless, e.g. if the response was lost.
+		d.volumeNames.setUncertain(zoneName, volumeName)
+		logger.Error(err, "create block storage volume")
 		return nil, err
 	}
 
-	opDone, err := client.Wait(ctx, op, v3.OperationStateSuccess)
+	opDone, err := d.waitTrackedOperation(ctx, client, operationKey, op)
 	if err != nil {
+		d.volumeNames.setUncertain(zoneName, volumeName)
 		return nil, err
 	}
 
+	d.volumeNames.set(zoneName, volumeName, opDone.Reference.ID)
+	d.volumesList.invalidate()
+
+	if stripes > 1 {
+		volume := &v3.BlockStorageVolume{ID: opDone.Reference.ID, Name: volumeName, Size: sizeInGiB, Labels: labels}
+		if err := d.createStripes(ctx, client, zoneName, volume); err != nil {
+			logger.Error(err, "create volumes of striped volume", "volumeID", volume.ID)
+			return nil, err
+		}
+	}
+
 	return &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
 			VolumeId:           exoscaleID(zoneName, opDone.Reference.ID),
-			CapacityBytes:      convertGiBToBytes(sizeInGiB),
+			CapacityBytes:      convertGiBToBytes(sizeInGiB * int64(stripes)),
 			AccessibleTopology: newZoneTopology(zoneName),
 			ContentSource:      req.GetVolumeContentSource(),
+			VolumeContext:      volumeContext,
 		},
 	}, nil
 }
@@ -212,34 +512,65 @@ func (d *controllerService) CreateVolume(ctx context.Context, req *csi.CreateVol
 // DeleteVolume detach and deprovision a volume.
 // This operation MUST be idempotent.
 func (d *controllerService) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
-	klog.V(4).Infof("DeleteVolume")
+	logger := klog.FromContext(ctx)
+	logger.V(4).Info("DeleteVolume")
 
 	zoneName, volumeID, err := getExoscaleID(req.VolumeId)
 	if err != nil {
-		klog.Errorf("parse exoscale volume ID %s: %v", req.VolumeId, err)
+		logger.Error(err, "parse exoscale volume ID")
 		return nil, err
 	}
 
-	client, err := newClientZone(ctx, d.client, zoneName)
+	client, err := d.clientZone(ctx, req.GetSecrets(), zoneName)
 	if err != nil {
-		klog.Errorf("delete volume: new client zone: %v", err)
+		logger.Error(err, "delete volume: new client zone")
 		return nil, err
 	}
 
+	if err := d.checkPendingOperation(ctx, client, req.VolumeId); err != nil {
+		return nil, err
+	}
+
+	volume, err := client.GetBlockStorageVolume(ctx, volumeID)
+	if err != nil {
+		if errors.Is(err, v3.ErrNotFound) {
+			d.volumeNames.deleteID(volumeID)
+			return &csi.DeleteVolumeResponse{}, nil
+		}
+		logger.Error(err, "get block storage volume")
+		return nil, err
+	}
+
+	if isDeletionProtected(volume.Labels) {
+		return nil, status.Errorf(codes.FailedPrecondition,
+			"volume %s is protected against deletion, remove its %s label to delete it", volumeID, exoscaleDeletionProtection)
+	}
+
+	// The first volume of a striped volume is deleted last, so that retries find the others.
+	if volumeStripes(volume.Labels) > 1 {
+		if err := d.deleteStripes(ctx, client, zoneName, volume); err != nil {
+			logger.Error(err, "delete volumes of striped volume")
+			return nil, err
+		}
+	}
+
 	op, err := client.DeleteBlockStorageVolume(ctx, volumeID)
 	if err != nil {
 		if errors.Is(err, v3.ErrNotFound) {
+			d.volumeNames.deleteID(volumeID)
 			return &csi.DeleteVolumeResponse{}, nil
 		}
-		klog.Errorf("destroy block storage volume %s: %v", volumeID, err)
+		logger.Error(err, "destroy block storage volume")
 		return nil, err
 	}
 
-	_, err = client.Wait(ctx, op, v3.OperationStateSuccess)
+	_, err = d.waitTrackedOperation(ctx, client, req.VolumeId, op)
 	if err != nil {
-		klog.Errorf("wait destroy block storage volume %s: %v", volumeID, err)
+		logger.Error(err, "wait destroy block storage volume")
 		return nil, err
 	}
+	d.volumeNames.deleteID(volumeID)
+	d.volumesList.invalidate()
 
 	return &csi.DeleteVolumeResponse{}, nil
 }
@@ -248,23 +579,28 @@ func (d *controllerService) DeleteVolume(ctx context.Context, req *csi.DeleteVol
 // This operation MUST be idempotent.
 // Exoscale Attach
 func (d *controllerService) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
-	klog.V(4).Infof("ControllerPublishVolume")
+	logger := klog.FromContext(ctx)
+	logger.V(4).Info("ControllerPublishVolume")
 
 	zoneName, instanceID, err := getExoscaleID(req.NodeId)
 	if err != nil {
-		klog.Errorf("parse node ID %s: %v", req.NodeId, err)
+		logger.Error(err, "parse node ID", "nodeID", req.NodeId)
 		return nil, err
 	}
 
-	client, err := newClientZone(ctx, d.client, zoneName)
+	client, err := d.clientZone(ctx, req.GetSecrets(), zoneName)
 	if err != nil {
-		klog.Errorf("publish volume: new client zone: %v", err)
+		logger.Error(err, "publish volume: new client zone")
 		return nil, err
 	}
 
 	_, volumeID, err := getExoscaleID(req.VolumeId)
 	if err != nil {
-		klog.Errorf("parse exoscale volume ID %s: %v", req.VolumeId, err)
+		logger.Error(err, "parse exoscale volume ID")
+		return nil, err
+	}
+
+	if err := d.checkPendingOperation(ctx, client, req.VolumeId); err != nil {
 		return nil, err
 	}
 
@@ -280,14 +616,26 @@ func (d *controllerService) ControllerPublishVolume(ctx context.Context, req *cs
 	// PublishVolume idempotent
 	if volume.Instance != nil {
 		if volume.Instance.ID == instanceID {
+			publishContext := newPublishContext(zoneName, volume, req.GetReadonly())
+			if volumeStripes(volume.Labels) > 1 {
+				if err := d.publishStripes(ctx, client, zoneName, volume, instanceID, publishContext); err != nil {
+					logger.Error(err, "attach volumes of striped volume", "instanceID", instanceID)
+					return nil, err
+				}
+			}
+
 			return &csi.ControllerPublishVolumeResponse{
-				PublishContext: map[string]string{
-					exoscaleVolumeName: volume.Name,
-					exoscaleVolumeID:   volume.ID.String(),
-					exoscaleVolumeZone: string(zoneName),
-				},
+				PublishContext: publishContext,
 			}, nil
 		}
+
+		return nil, status.Errorf(codes.FailedPrecondition, "volume %s is already attached to node %s",
+			volumeID, exoscaleID(zoneName, volume.Instance.ID))
+	}
+
+	// The block storage volumes of a striped volume are all attached to the instance.
+	if err := d.checkAttachLimit(ctx, client, instanceID, volumeStripes(volume.Labels)); err != nil {
+		return nil, err
 	}
 
 	op, err := client.AttachBlockStorageVolumeToInstance(ctx, volumeID, v3.AttachBlockStorageVolumeToInstanceRequest{
@@ -296,58 +644,137 @@ func (d *controllerService) ControllerPublishVolume(ctx context.Context, req *cs
 		},
 	})
 	if err != nil {
-		klog.Errorf("attach block storage volume %s to instance %s: %v", volumeID, instanceID, err)
+		logger.Error(err, "attach block storage volume", "instanceID", instanceID)
 		return nil, err
 	}
 
-	_, err = client.Wait(ctx, op, v3.OperationStateSuccess)
+	_, err = d.waitTrackedOperation(ctx, client, req.VolumeId, op)
 	if err != nil {
-		klog.Errorf("wait attach block storage volume %s to instance %s: %v", volumeID, instanceID, err)
+		logger.Error(err, "wait attach block storage volume", "instanceID", instanceID)
 		return nil, err
 	}
+	d.volumesList.invalidate()
+
+	publishContext := newPublishContext(zoneName, volume, req.GetReadonly())
+	if volumeStripes(volume.Labels) > 1 {
+		if err := d.publishStripes(ctx, client, zoneName, volume, instanceID, publishContext); err != nil {
+			logger.Error(err, "attach volumes of striped volume", "instanceID", instanceID)
+			return nil, err
+		}
+	}
 
 	return &csi.ControllerPublishVolumeResponse{
-		PublishContext: map[string]string{
-			exoscaleVolumeName: volume.Name,
-			exoscaleVolumeID:   volume.ID.String(),
-			exoscaleVolumeZone: string(zoneName),
-		},
+		PublishContext: publishContext,
 	}, nil
 }
 
+// checkAttachLimit returns a RESOURCE_EXHAUSTED error if attaching count more block storage volumes to the instance
+// would exceed its volume attachment limit, so the CO reschedules the workload instead of retrying the attach forever.
+func (d *controllerService) checkAttachLimit(ctx context.Context, client *v3.Client, instanceID v3.UUID, count int) error {
+	attached, err := client.ListBlockStorageVolumes(ctx, v3.ListBlockStorageVolumesWithInstanceID(instanceID))
+	if err != nil {
+		return fmt.Errorf("list block storage volumes attached to instance %s: %w", instanceID, err)
+	}
+	if int64(len(attached.BlockStorageVolumes)+count) > d.maxVolumesPerNode {
+		return status.Errorf(codes.ResourceExhausted, "instance %s already has %d block storage volumes attached, attaching %d more exceeds the limit of %d",
+			instanceID, len(attached.BlockStorageVolumes), count, d.maxVolumesPerNode)
+	}
+
+	return nil
+}
+
 // ControllerUnpublishVolume call blockstoraqge DetachAndDeprovisionVolume
 // This operation MUST be idempotent.
 // Exoscale Detach
 func (d *controllerService) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
-	klog.V(4).Infof("ControllerUnpublishVolume")
+	logger := klog.FromContext(ctx)
+	logger.V(4).Info("ControllerUnpublishVolume")
 
 	zoneName, volumeID, err := getExoscaleID(req.VolumeId)
 	if err != nil {
-		klog.Errorf("parse exoscale volume ID %s: %v", req.VolumeId, err)
+		logger.Error(err, "parse exoscale volume ID")
 		return nil, err
 	}
 
-	client, err := newClientZone(ctx, d.client, zoneName)
+	client, err := d.clientZone(ctx, req.GetSecrets(), zoneName)
 	if err != nil {
-		klog.Errorf("unpublish volume: new client zone: %v", err)
+		logger.Error(err, "unpublish volume: new client zone")
+		return nil, err
+	}
+
+	if err := d.checkPendingOperation(ctx, client, req.VolumeId); err != nil {
 		return nil, err
 	}
 
+	volume, err := client.GetBlockStorageVolume(ctx, volumeID)
+	if err != nil {
+		if errors.Is(err, v3.ErrNotFound) {
+			return &csi.ControllerUnpublishVolumeResponse{}, nil
+		}
+
+		logger.Error(err, "get block storage volume")
+		return nil, err
+	}
+
+	if volume.Instance == nil || volume.Instance.ID == "" {
+		return &csi.ControllerUnpublishVolumeResponse{}, nil
+	}
+
+	// The volume may have been legitimately re-attached to another node in the meantime,
+	// e.g. during a failover, only detach it from the requested node.
+	if req.NodeId != "" {
+		_, instanceID, err := getExoscaleID(req.NodeId)
+		if err != nil {
+			logger.Error(err, "parse node ID", "nodeID", req.NodeId)
+			return nil, status.Errorf(codes.InvalidArgument, "invalid node ID %s: %v", req.NodeId, err)
+		}
+
+		if volume.Instance.ID != instanceID {
+			logger.V(4).Info("volume is attached to another instance: nothing to detach", "attachedInstanceID", volume.Instance.ID, "instanceID", instanceID)
+			return &csi.ControllerUnpublishVolumeResponse{}, nil
+		}
+	}
+
+	// The first volume of a striped volume is detached last, so that retries find the others.
+	if volumeStripes(volume.Labels) > 1 {
+		if err := d.unpublishStripes(ctx, client, zoneName, volume, volume.Instance.ID); err != nil {
+			logger.Error(err, "detach volumes of striped volume")
+			return nil, err
+		}
+	}
+
 	op, err := client.DetachBlockStorageVolume(ctx, volumeID)
 	if err != nil {
-		if errors.Is(err, v3.ErrNotFound) || strings.Contains(err.Error(), "Volume not attached") {
+		if strings.Contains(err.Error(), "Volume not attached") {
 			return &csi.ControllerUnpublishVolumeResponse{}, nil
 		}
 
-		klog.Errorf("detach block storage volume %s: %v", volumeID, err)
+		// The instance was deleted outside of Kubernetes: detach all its volumes at once
+		// so that the other VolumeAttachments of the ghost node are released as well.
+		if isInstanceDeleted(ctx, client, volume.Instance.ID) {
+			logger.Info("instance of volume was deleted, detaching all its volumes", "instanceID", volume.Instance.ID)
+			if err := d.detachInstanceVolumes(ctx, client, zoneName, volume.Instance.ID); err != nil {
+				logger.Error(err, "detach volumes of deleted instance", "instanceID", volume.Instance.ID)
+				return nil, err
+			}
+
+			return &csi.ControllerUnpublishVolumeResponse{}, nil
+		}
+
+		if errors.Is(err, v3.ErrNotFound) {
+			return &csi.ControllerUnpublishVolumeResponse{}, nil
+		}
+
+		logger.Error(err, "detach block storage volume")
 		return nil, err
 	}
 
-	_, err = client.Wait(ctx, op, v3.OperationStateSuccess)
+	_, err = d.waitTrackedOperation(ctx, client, req.VolumeId, op)
 	if err != nil {
-		klog.Errorf("wait detach block storage volume %s: %v", volumeID, err)
+		logger.Error(err, "wait detach block storage volume")
 		return nil, err
 	}
+	d.volumesList.invalidate()
 
 	return &csi.ControllerUnpublishVolumeResponse{}, nil
 }
@@ -357,50 +784,56 @@ func (d *controllerService) ControllerUnpublishVolume(ctx context.Context, req *
 // Get the volume info and check if it's match the CO needs.
 // This operation MUST be idempotent.
 func (d *controllerService) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
-	klog.V(4).Infof("ValidateVolumeCapabilities")
+	logger := klog.FromContext(ctx)
+	logger.V(4).Info("ValidateVolumeCapabilities")
 
 	zoneName, volumeID, err := getExoscaleID(req.VolumeId)
 	if err != nil {
-		klog.Errorf("parse exoscale ID %s: %v", req.VolumeId, err)
+		logger.Error(err, "parse exoscale ID")
 		return nil, err
 	}
 
-	client, err := newClientZone(ctx, d.client, zoneName)
+	volumeCapabilities := req.GetVolumeCapabilities()
+	if len(volumeCapabilities) == 0 {
+		logger.Error(nil, "volume capabilities not provided")
+		return nil, status.Error(codes.InvalidArgument, "volumeCapabilities is not provided")
+	}
+
+	client, err := d.clientZone(ctx, req.GetSecrets(), zoneName)
 	if err != nil {
-		klog.Errorf("validate volume capabilities: new client zone: %v", err)
+		logger.Error(err, "validate volume capabilities: new client zone")
 		return nil, err
 	}
 
 	_, err = client.GetBlockStorageVolume(ctx, volumeID)
 	if err != nil {
-		klog.Errorf("get block storage volume %s: %v", volumeID, err)
+		if errors.Is(err, v3.ErrNotFound) {
+			return nil, status.Errorf(codes.NotFound, "volume %s not found", volumeID)
+		}
+
+		logger.Error(err, "get block storage volume")
 		return nil, err
 	}
 
-	volumeCapabilities := req.GetVolumeCapabilities()
-	if volumeCapabilities == nil {
-		klog.Errorf("volume capabilities %s not provided: %v", volumeID, err)
-		return nil, status.Error(codes.InvalidArgument, "volumeCapabilities is not provided")
+	if err := validateVolumeCapabilities(volumeCapabilities); err != nil {
+		logger.V(4).Info("volume capabilities not confirmed", "reason", err)
+		return &csi.ValidateVolumeCapabilitiesResponse{
+			Message: err.Error(),
+		}, nil
 	}
 
-	// TODO validate and return the right mode.
-	// Since the only supported mode is one volume per instance,
-	// let's use SINGLE_NODE_WRITER by default.
-
 	return &csi.ValidateVolumeCapabilitiesResponse{
 		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
-			VolumeCapabilities: []*csi.VolumeCapability{
-				{
-					AccessMode: &supportedAccessModes[0],
-				},
-			},
+			VolumeContext:      req.GetVolumeContext(),
+			VolumeCapabilities: volumeCapabilities,
+			Parameters:         req.GetParameters(),
 		},
 	}, nil
 }
 
 // ListVolumes returns the list of requested volumes.
 func (d *controllerService) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
-	klog.V(4).Infof("ListVolumes")
+	klog.FromContext(ctx).V(4).Info("ListVolumes")
 	var numberResults int
 	var err error
 
@@ -412,43 +845,13 @@ func (d *controllerService) ListVolumes(ctx context.Context, req *csi.ListVolume
 		}
 	}
 
-	zones, err := d.client.ListZones(ctx)
-	if err != nil {
-		klog.Errorf("create block storage volume list zones: %v", err)
-		return nil, err
-	}
-
-	volumesEntries := []*csi.ListVolumesResponse_Entry{}
-	for _, zone := range zones.Zones {
-		client := d.client.WithEndpoint(zone.APIEndpoint)
-
-		volumesResp, err := client.ListBlockStorageVolumes(ctx)
+	volumesEntries, ok := d.volumesList.get()
+	if !ok {
+		volumesEntries, err = d.listAllVolumes(ctx)
 		if err != nil {
-			// TODO: remove it when Block Storage is available in all zone.
-			if strings.Contains(err.Error(), "Availability of the block storage volumes") {
-				continue
-			}
-			klog.Errorf("list block storage volumes: %v", err)
 			return nil, err
 		}
-
-		for _, v := range volumesResp.BlockStorageVolumes {
-			var instancesID []string
-			if v.Instance != nil && v.Instance.ID != "" {
-				instancesID = append(instancesID, exoscaleID(zone.Name, v.Instance.ID))
-			}
-
-			volumesEntries = append(volumesEntries, &csi.ListVolumesResponse_Entry{
-				Volume: &csi.Volume{
-					VolumeId:           exoscaleID(zone.Name, v.ID),
-					CapacityBytes:      convertGiBToBytes(v.Size),
-					AccessibleTopology: newZoneTopology(zone.Name),
-				},
-				Status: &csi.ListVolumesResponse_VolumeStatus{
-					PublishedNodeIds: instancesID,
-				},
-			})
-		}
+		d.volumesList.set(volumesEntries)
 	}
 
 	// Since MaxEntries is not optional,
@@ -474,15 +877,72 @@ func (d *controllerService) ListVolumes(ctx context.Context, req *csi.ListVolume
 	}, nil
 }
 
+// listAllVolumes returns the volumes of all the zones where block storage is available.
+func (d *controllerService) listAllVolumes(ctx context.Context) ([]*csi.ListVolumesResponse_Entry, error) {
+	logger := klog.FromContext(ctx)
+
+	zones, err := d.apiClient().ListZones(ctx)
+	if err != nil {
+		logger.Error(err, "create block storage volume list zones")
+		return nil, err
+	}
+
+	blockStorageZones := d.blockStorageZones.filter(d.zoneEndpoints.apply(zones.Zones))
+	zonesEntries := make([][]*csi.ListVolumesResponse_Entry, len(blockStorageZones))
+	err = forEachZone(ctx, d.apiClient(), blockStorageZones, func(ctx context.Context, i int, client *v3.Client, zone v3.Zone) error {
+		volumesResp, err := client.ListBlockStorageVolumes(ctx)
+		if err != nil {
+			if isBlockStorageUnavailable(err) {
+				logger.V(4).Info("block storage unavailable in zone", "zone", zone.Name, "reason", err)
+				d.blockStorageZones.setUnavailable(zone.Name)
+				return nil
+			}
+			logger.Error(err, "list block storage volumes in zone", "zone", zone.Name)
+			return listZoneError(zone.Name, err)
+		}
+
+		for _, v := range volumesResp.BlockStorageVolumes {
+			// The other volumes of the striped volumes are part of their first volume.
+			if _, ok := v.Labels[exoscaleStripeOf]; ok {
+				continue
+			}
+
+			zonesEntries[i] = append(zonesEntries[i], &csi.ListVolumesResponse_Entry{
+				Volume: &csi.Volume{
+					VolumeId:           exoscaleID(zone.Name, v.ID),
+					CapacityBytes:      convertGiBToBytes(v.Size * int64(volumeStripes(v.Labels))),
+					AccessibleTopology: newZoneTopology(zone.Name),
+				},
+				Status: &csi.ListVolumesResponse_VolumeStatus{
+					PublishedNodeIds: publishedNodeIDs(zone.Name, &v),
+				},
+			})
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Aggregate in the order of the zones to keep the pagination stable.
+	volumesEntries := []*csi.ListVolumesResponse_Entry{}
+	for _, entries := range zonesEntries {
+		volumesEntries = append(volumesEntries, entries...)
+	}
+
+	return volumesEntries, nil
+}
+
 // GetCapacity returns the capacity of the "storage pool" from which the controller provisions volumes.
 func (d *controllerService) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
-	klog.V(4).Infof("GetCapacity is not yet implemented")
+	klog.FromContext(ctx).V(4).Info("GetCapacity is not yet implemented")
 	return nil, status.Error(codes.Unimplemented, "GetCapacity is not yet implemented")
 }
 
 // ControllerGetCapabilities returns  the supported capabilities of controller service provided by the Plugin.
 func (d *controllerService) ControllerGetCapabilities(ctx context.Context, req *csi.ControllerGetCapabilitiesRequest) (*csi.ControllerGetCapabilitiesResponse, error) {
-	klog.V(4).Infof("ControllerGetCapabilities")
+	klog.FromContext(ctx).V(4).Info("ControllerGetCapabilities")
 
 	var capabilities []*csi.ControllerServiceCapability // nolint:prealloc
 	for _, capability := range controllerCapabilities {
@@ -499,116 +959,169 @@ func (d *controllerService) ControllerGetCapabilities(ctx context.Context, req *
 
 // CreateSnapshot call blockstorage SnapshotVolume.
 func (d *controllerService) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
-	klog.V(4).Infof("CreateSnapshot")
+	logger := klog.FromContext(ctx)
+	logger.V(4).Info("CreateSnapshot")
 
 	zoneName, volumeID, err := getExoscaleID(req.SourceVolumeId)
 	if err != nil {
-		klog.Errorf("parse exoscale ID %s: %v", req.SourceVolumeId, err)
+		logger.Error(err, "parse exoscale ID")
 		return nil, err
 	}
 
-	client, err := newClientZone(ctx, d.client, zoneName)
+	freeze := false
+	if value, ok := req.GetParameters()[fsFreezeParameter]; ok {
+		freeze, err = strconv.ParseBool(value)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid %s parameter %q, expected a boolean", fsFreezeParameter, value)
+		}
+	}
+	if freeze && d.kube == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "%s parameter requires the driver to be started with --fsfreeze", fsFreezeParameter)
+	}
+
+	client, err := d.clientZone(ctx, req.GetSecrets(), zoneName)
 	if err != nil {
-		klog.Errorf("create snapshot: new client zone: %v", err)
+		logger.Error(err, "create snapshot: new client zone")
 		return nil, err
 	}
 
 	volume, err := client.GetBlockStorageVolume(ctx, volumeID)
 	if err != nil {
-		klog.Errorf("create snapshot get volume %s: %v", volumeID, err)
+		if errors.Is(err, v3.ErrNotFound) {
+			return nil, status.Errorf(codes.NotFound, "volume %s not found", volumeID)
+		}
+
+		logger.Error(err, "create snapshot get volume")
 		return nil, err
 	}
+	if volumeStripes(volume.Labels) > 1 {
+		return nil, status.Errorf(codes.InvalidArgument, "volume %s is striped, its volumes can't be snapshotted consistently", volumeID)
+	}
 
-	for _, s := range volume.BlockStorageSnapshots {
-		snapshot, err := client.GetBlockStorageSnapshot(ctx, s.ID)
-		if err != nil {
-			klog.Errorf("create snapshot get snapshot %s: %v", s.ID, err)
+	snapshotName := d.snapshotNameTemplate.render(req.Name, req.GetParameters())
+
+	// Make the call idempotent since CreateBlockStorageSnapshot is not.
+	snapshot, err := findSnapshotByName(ctx, client, snapshotName)
+	if err != nil {
+		logger.Error(err, "create snapshot find by name", "snapshotName", snapshotName)
+		return nil, err
+	}
+	if snapshot != nil {
+		if snapshot.BlockStorageVolume == nil || snapshot.BlockStorageVolume.ID != volume.ID {
+			return nil, status.Errorf(codes.AlreadyExists, "snapshot %s already exists for another volume", snapshotName)
 		}
 
-		if snapshot.Name == req.Name {
-			return &csi.CreateSnapshotResponse{
-				Snapshot: &csi.Snapshot{
-					SnapshotId:     exoscaleID(zoneName, snapshot.ID),
-					SourceVolumeId: exoscaleID(zoneName, volume.ID),
-					CreationTime:   timestamppb.New(snapshot.CreatedAT),
-					ReadyToUse:     true,
-					// We leave the optional SizeBytes field unset as the size of a block storage snapshot is the size of the difference to the volume or previous snapshots, k8s however expects the size to be the size of the restored volume.
-				},
-			}, nil
+		if snapshot.State == v3.BlockStorageSnapshotStateError {
+			return nil, status.Errorf(codes.Internal, "snapshot %s is in error state", snapshot.ID)
+		}
+
+		return &csi.CreateSnapshotResponse{
+			Snapshot: newCSISnapshot(zoneName, snapshot),
+		}, nil
+	}
+
+	// The filesystem of a detached volume is consistent already.
+	var frozen *volumeFreeze
+	if freeze && volume.Instance != nil {
+		frozen, err = d.freezeVolume(ctx, req.SourceVolumeId, req.GetParameters(), volume.Instance.ID, snapshotName)
+		if err != nil {
+			return nil, status.Errorf(codes.Unavailable, "freeze filesystem of volume %s: %v", volume.ID, err)
 		}
+		defer frozen.thaw()
 	}
 
 	op, err := client.CreateBlockStorageSnapshot(ctx, volume.ID, v3.CreateBlockStorageSnapshotRequest{
-		Name: req.Name,
+		Name: snapshotName,
 	})
 	if err != nil {
-		klog.Errorf("create block storage volume %s snapshot: %v", volume.ID, err)
+		logger.Error(err, "create block storage volume snapshot")
 		return nil, err
 	}
-	op, err = client.Wait(ctx, op, v3.OperationStateSuccess)
+	op, err = d.waitOperation(ctx, client, op)
 	if err != nil {
-		klog.Errorf("wait create block storage volume %s snapshot: %v", volume.ID, err)
+		logger.Error(err, "wait create block storage volume snapshot")
 		return nil, err
 	}
 
 	if op.Reference == nil {
-		klog.Errorf("operation reference is nil")
+		logger.Error(nil, "operation reference is nil", "operationID", op.ID)
 		return nil, fmt.Errorf("operation reference: %v not found", op.ID)
 	}
 
-	snapshot, err := client.GetBlockStorageSnapshot(ctx, op.Reference.ID)
+	// The snapshot of a filesystem thawed before it completed may be inconsistent, it is deleted
+	// for the next attempt to take it again rather than finding it by name.
+	if frozen != nil {
+		if err := frozen.check(ctx); err != nil {
+			if err := d.deleteSnapshot(ctx, client, op.Reference.ID); err != nil {
+				logger.Error(err, "delete snapshot of thawed filesystem", "snapshotID", op.Reference.ID)
+			}
+			return nil, status.Errorf(codes.Aborted, "snapshot of volume %s: %v", volume.ID, err)
+		}
+	}
+
+	snapshot, err = client.GetBlockStorageSnapshot(ctx, op.Reference.ID)
 	if err != nil {
-		klog.Errorf("get block storage volume snapshot %s: %v", op.Reference.ID, err)
+		logger.Error(err, "get block storage volume snapshot", "snapshotID", op.Reference.ID)
 		return nil, err
 	}
 
-	klog.Infof("successfully created snapshot %q of size %d GiB from volume %q", snapshot.ID, volume.Size, volume.ID)
+	d.snapshotsList.invalidate()
+
+	logger.Info("successfully created snapshot", "snapshotID", snapshot.ID, "sizeGiB", volume.Size)
+
+	csiSnapshot := newCSISnapshot(zoneName, snapshot)
+	csiSnapshot.SourceVolumeId = exoscaleID(zoneName, volume.ID)
 
 	return &csi.CreateSnapshotResponse{
-		Snapshot: &csi.Snapshot{
-			SnapshotId:     exoscaleID(zoneName, snapshot.ID),
-			SourceVolumeId: exoscaleID(zoneName, volume.ID),
-			CreationTime:   timestamppb.New(snapshot.CreatedAT),
-			ReadyToUse:     true,
-			// We leave the optional SizeBytes field unset as the size of a block storage snapshot is the size of the difference to the volume or previous snapshots, k8s however expects the size to be the size of the restored volume.
-		},
+		Snapshot: csiSnapshot,
 	}, nil
 }
 
 // DeleteSnapshot destroys a block storage volume snapshot.
 func (d *controllerService) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
-	klog.V(4).Infof("DeleteSnapshot")
+	logger := klog.FromContext(ctx)
+	logger.V(4).Info("DeleteSnapshot")
 
 	zoneName, snapshotID, err := getExoscaleID(req.SnapshotId)
 	if err != nil {
-		klog.Errorf("parse exoscale snapshot ID %s: %v", req.SnapshotId, err)
+		logger.Error(err, "parse exoscale snapshot ID")
 		return nil, err
 	}
 
-	client, err := newClientZone(ctx, d.client, zoneName)
+	client, err := d.clientZone(ctx, req.GetSecrets(), zoneName)
 	if err != nil {
-		klog.Errorf("delete snapshot: new client zone: %v", err)
+		logger.Error(err, "delete snapshot: new client zone")
+		return nil, err
+	}
+
+	if err := d.deleteSnapshot(ctx, client, snapshotID); err != nil {
 		return nil, err
 	}
 
+	return &csi.DeleteSnapshotResponse{}, nil
+}
+
+// deleteSnapshot deletes the snapshot if it still exists.
+func (d *controllerService) deleteSnapshot(ctx context.Context, client *v3.Client, snapshotID v3.UUID) error {
 	op, err := client.DeleteBlockStorageSnapshot(ctx, snapshotID)
 	if err != nil {
 		if errors.Is(err, v3.ErrNotFound) {
-			return &csi.DeleteSnapshotResponse{}, nil
+			return nil
 		}
-		return nil, err
+		return err
 	}
 
-	if _, err := client.Wait(ctx, op, v3.OperationStateSuccess); err != nil {
-		return nil, err
+	if _, err := d.waitOperation(ctx, client, op); err != nil {
+		return err
 	}
+	d.snapshotsList.invalidate()
 
-	return &csi.DeleteSnapshotResponse{}, nil
+	return nil
 }
 
 // ListSnapshots lists block storage volume snapshot.
 func (d *controllerService) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
-	klog.V(4).Infof("ListSnapshots")
+	klog.FromContext(ctx).V(4).Info("ListSnapshots")
 	var numberResults int
 	var err error
 
@@ -620,37 +1133,13 @@ func (d *controllerService) ListSnapshots(ctx context.Context, req *csi.ListSnap
 		}
 	}
 
-	zones, err := d.client.ListZones(ctx)
-	if err != nil {
-		klog.Errorf("create block storage volume list zones: %v", err)
-		return nil, err
-	}
-
-	snapshotsEntries := []*csi.ListSnapshotsResponse_Entry{}
-	for _, zone := range zones.Zones {
-		client := d.client.WithEndpoint(zone.APIEndpoint)
-
-		snapResp, err := client.ListBlockStorageSnapshots(ctx)
+	snapshotsEntries, ok := d.snapshotsList.get()
+	if !ok {
+		snapshotsEntries, err = d.listAllSnapshots(ctx)
 		if err != nil {
-			// TODO: remove it when Block Storage is available in all zone.
-			if strings.Contains(err.Error(), "Availability of the block storage volumes") {
-				continue
-			}
-			klog.Errorf("list block storage snapshot: %v", err)
 			return nil, err
 		}
-
-		for _, s := range snapResp.BlockStorageSnapshots {
-			snapshotsEntries = append(snapshotsEntries, &csi.ListSnapshotsResponse_Entry{
-				Snapshot: &csi.Snapshot{
-					SourceVolumeId: exoscaleID(zone.Name, s.BlockStorageVolume.ID),
-					SnapshotId:     exoscaleID(zone.Name, s.ID),
-					CreationTime:   timestamppb.New(s.CreatedAT),
-					ReadyToUse:     true,
-					// We leave the optional SizeBytes field unset as the size of a block storage snapshot is the size of the difference to the volume or previous snapshots, k8s however expects the size to be the size of the restored volume.
-				},
-			})
-		}
+		d.snapshotsList.set(snapshotsEntries)
 	}
 
 	// Since MaxEntries is not optional,
@@ -676,21 +1165,67 @@ func (d *controllerService) ListSnapshots(ctx context.Context, req *csi.ListSnap
 	}, nil
 }
 
+// listAllSnapshots returns the snapshots of all the zones where block storage is available.
+func (d *controllerService) listAllSnapshots(ctx context.Context) ([]*csi.ListSnapshotsResponse_Entry, error) {
+	logger := klog.FromContext(ctx)
+
+	zones, err := d.apiClient().ListZones(ctx)
+	if err != nil {
+		logger.Error(err, "create block storage volume list zones")
+		return nil, err
+	}
+
+	blockStorageZones := d.blockStorageZones.filter(d.zoneEndpoints.apply(zones.Zones))
+	zonesEntries := make([][]*csi.ListSnapshotsResponse_Entry, len(blockStorageZones))
+	err = forEachZone(ctx, d.apiClient(), blockStorageZones, func(ctx context.Context, i int, client *v3.Client, zone v3.Zone) error {
+		snapResp, err := client.ListBlockStorageSnapshots(ctx)
+		if err != nil {
+			if isBlockStorageUnavailable(err) {
+				logger.V(4).Info("block storage unavailable in zone", "zone", zone.Name, "reason", err)
+				d.blockStorageZones.setUnavailable(zone.Name)
+				return nil
+			}
+			logger.Error(err, "list block storage snapshots in zone", "zone", zone.Name)
+			return listZoneError(zone.Name, err)
+		}
+
+		for _, s := range snapResp.BlockStorageSnapshots {
+			zonesEntries[i] = append(zonesEntries[i], &csi.ListSnapshotsResponse_Entry{
+				Snapshot: newCSISnapshot(zone.Name, &s),
+			})
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Aggregate in the order of the zones to keep the pagination stable.
+	snapshotsEntries := []*csi.ListSnapshotsResponse_Entry{}
+	for _, entries := range zonesEntries {
+		snapshotsEntries = append(snapshotsEntries, entries...)
+	}
+
+	return snapshotsEntries, nil
+}
+
 // ControllerExpandVolume resizes Block Storage volume.
 func (d *controllerService) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
-	klog.V(4).Infof("ControllerExpandVolume")
+	logger := klog.FromContext(ctx)
+	logger.V(4).Info("ControllerExpandVolume")
 	zoneName, volumeID, err := getExoscaleID(req.GetVolumeId())
 	if err != nil {
 		return nil, err
 	}
 
-	client, err := newClientZone(ctx, d.client, zoneName)
+	client, err := d.clientZone(ctx, req.GetSecrets(), zoneName)
 	if err != nil {
-		klog.Errorf("expand volume: new client zone: %v", err)
+		logger.Error(err, "expand volume: new client zone")
 		return nil, err
 	}
 
-	_, err = client.GetBlockStorageVolume(ctx, volumeID)
+	volume, err := client.GetBlockStorageVolume(ctx, volumeID)
 	if err != nil {
 		if errors.Is(err, v3.ErrNotFound) {
 			return nil, status.Errorf(codes.NotFound, "volume %s not found", volumeID)
@@ -699,7 +1234,12 @@ func (d *controllerService) ControllerExpandVolume(ctx context.Context, req *csi
 		return nil, err
 	}
 
+	if volumeStripes(volume.Labels) > 1 {
+		return nil, status.Errorf(codes.InvalidArgument, "volume %s is striped, striped volumes can't be expanded", volumeID)
+	}
+
 	nodeExpansionRequired := true
+	fsType := ""
 	volumeCapability := req.GetVolumeCapability()
 	if volumeCapability != nil {
 		err := validateVolumeCapability(volumeCapability)
@@ -710,9 +1250,10 @@ func (d *controllerService) ControllerExpandVolume(ctx context.Context, req *csi
 		if _, ok := volumeCapability.GetAccessType().(*csi.VolumeCapability_Block); ok {
 			nodeExpansionRequired = false
 		}
+		fsType = volumeCapability.GetMount().GetFsType()
 	}
 
-	newSizeInBytes, err := getNewVolumeSize(req.GetCapacityRange())
+	newSizeInBytes, err := getNewVolumeSize(req.GetCapacityRange(), d.volumeSizes)
 	if err != nil {
 		return nil, status.Errorf(codes.OutOfRange, "invalid capacity range: %v", err)
 	}
@@ -720,19 +1261,44 @@ func (d *controllerService) ControllerExpandVolume(ctx context.Context, req *csi
 	if newSizeInBytes%GiB != 0 {
 		msg := "requested size in bytes cannot be exactly converted to GiB: %d"
 
-		klog.Errorf(msg, newSizeInBytes)
+		logger.Error(nil, "requested size in bytes cannot be exactly converted to GiB", "size", newSizeInBytes)
 
 		return nil, fmt.Errorf(msg, newSizeInBytes)
 	}
 
 	sizeInGiB := convertBytesToGiB(newSizeInBytes)
 
+	// Retried expansions find the volume already resized.
+	if volume.Size >= sizeInGiB {
+		logger.V(4).Info("volume is already large enough, no need to resize it", "sizeGiB", volume.Size, "requestedSizeGiB", sizeInGiB)
+		return &csi.ControllerExpandVolumeResponse{
+			CapacityBytes:         convertGiBToBytes(volume.Size),
+			NodeExpansionRequired: nodeExpansionRequired,
+		}, nil
+	}
+
+	if !d.onlineExpansion && volume.Instance != nil && volume.Instance.ID != "" {
+		return nil, status.Errorf(codes.FailedPrecondition, "volume %s must be detached from instance %s to be expanded", volumeID, volume.Instance.ID)
+	}
+
+	// resize.f2fs refuses mounted filesystems, the node grows them when staging the volumes.
+	if fsType == "f2fs" && volume.Instance != nil && volume.Instance.ID != "" {
+		return nil, status.Errorf(codes.FailedPrecondition, "volume %s has an f2fs filesystem, it must be detached from instance %s to be expanded", volumeID, volume.Instance.ID)
+	}
+
+	if err := d.checkPendingOperation(ctx, client, req.VolumeId); err != nil {
+		return nil, err
+	}
+
+	// The resize is synchronous: once it returns, the node sees the new device size
+	// when NodeExpandVolume grows the filesystem.
 	_, err = client.ResizeBlockStorageVolume(ctx, volumeID, v3.ResizeBlockStorageVolumeRequest{
 		Size: sizeInGiB,
 	})
 	if err != nil {
 		return nil, err
 	}
+	d.volumesList.invalidate()
 
 	return &csi.ControllerExpandVolumeResponse{
 		CapacityBytes:         newSizeInBytes,
@@ -740,17 +1306,80 @@ func (d *controllerService) ControllerExpandVolume(ctx context.Context, req *csi
 	}, nil
 }
 
+// ControllerModifyVolume updates the mutable parameters of a volume, i.e. its deletion protection.
+func (d *controllerService) ControllerModifyVolume(ctx context.Context, req *csi.ControllerModifyVolumeRequest) (*csi.ControllerModifyVolumeResponse, error) {
+	logger := klog.FromContext(ctx)
+	logger.V(4).Info("ControllerModifyVolume")
+
+	zoneName, volumeID, err := getExoscaleID(req.GetVolumeId())
+	if err != nil {
+		logger.Error(err, "parse exoscale volume ID")
+		return nil, err
+	}
+
+	client, err := d.clientZone(ctx, req.GetSecrets(), zoneName)
+	if err != nil {
+		logger.Error(err, "modify volume: new client zone")
+		return nil, err
+	}
+
+	volume, err := client.GetBlockStorageVolume(ctx, volumeID)
+	if err != nil {
+		if errors.Is(err, v3.ErrNotFound) {
+			return nil, status.Errorf(codes.NotFound, "volume %s not found", volumeID)
+		}
+
+		logger.Error(err, "get block storage volume")
+		return nil, err
+	}
+
+	for k := range req.GetMutableParameters() {
+		if k != deletionProtectionParameter {
+			return nil, status.Errorf(codes.InvalidArgument, "parameter %s cannot be modified", k)
+		}
+	}
+
+	labels, err := getVolumeLabels(req.GetMutableParameters(), volume.Labels)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid mutable parameters: %v", err)
+	}
+	if maps.Equal(labels, volume.Labels) {
+		return &csi.ControllerModifyVolumeResponse{}, nil
+	}
+
+	if err := d.checkPendingOperation(ctx, client, req.VolumeId); err != nil {
+		return nil, err
+	}
+
+	op, err := client.UpdateBlockStorageVolume(ctx, volumeID, v3.UpdateBlockStorageVolumeRequest{
+		Labels: labels,
+	})
+	if err != nil {
+		logger.Error(err, "update block storage volume")
+		return nil, err
+	}
+
+	if _, err := d.waitTrackedOperation(ctx, client, req.VolumeId, op); err != nil {
+		logger.Error(err, "wait update block storage volume")
+		return nil, err
+	}
+
+	return &csi.ControllerModifyVolumeResponse{}, nil
+}
+
 // ControllerGetVolume gets a volume and  return it.
 func (d *controllerService) ControllerGetVolume(ctx context.Context, req *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
+	logger := klog.FromContext(ctx)
+
 	zoneName, volumeID, err := getExoscaleID(req.VolumeId)
 	if err != nil {
-		klog.Errorf("parse exoscale ID %s: %v", req.VolumeId, err)
+		logger.Error(err, "parse exoscale ID")
 		return nil, err
 	}
 
-	client, err := newClientZone(ctx, d.client, zoneName)
+	client, err := newClientZone(ctx, d.apiClient(), zoneName, d.zoneEndpoints)
 	if err != nil {
-		klog.Errorf("expand volume: new client zone: %v", err)
+		logger.Error(err, "expand volume: new client zone")
 		return nil, err
 	}
 
@@ -760,27 +1389,84 @@ func (d *controllerService) ControllerGetVolume(ctx context.Context, req *csi.Co
 			return nil, status.Errorf(codes.NotFound, "volume %s not found", volumeID)
 		}
 
-		klog.Errorf("get block storage volume controller %s: %v", volumeID, err)
+		logger.Error(err, "get block storage volume controller")
 		return nil, err
 	}
 
-	var instancesID []string
-	if volume.Instance != nil && volume.Instance.ID != "" {
-		instancesID = append(instancesID, exoscaleID(zoneName, volume.Instance.ID))
-	}
-
 	return &csi.ControllerGetVolumeResponse{
 		Volume: &csi.Volume{
 			VolumeId:      exoscaleID(zoneName, volume.ID),
-			CapacityBytes: convertGiBToBytes(volume.Size),
+			CapacityBytes: convertGiBToBytes(volume.Size * int64(volumeStripes(volume.Labels))),
 		},
 		Status: &csi.ControllerGetVolumeResponse_VolumeStatus{
-			PublishedNodeIds: instancesID,
+			PublishedNodeIds: publishedNodeIDs(zoneName, volume),
 		},
 	}, nil
 }
 
-func newClientZone(ctx context.Context, c *v3.Client, z v3.ZoneName) (*v3.Client, error) {
+// findVolumeByName returns the volume named name in the zone or nil if it doesn't exist.
+// Known name to ID mappings are checked first with a single GET, the names missing from the index of the zone
+// don't exist, the volumes of the zone are only listed when its index expired or the name is uncertain.
+func (d *controllerService) findVolumeByName(ctx context.Context, client *v3.Client, zoneName v3.ZoneName, name string) (*v3.BlockStorageVolume, error) {
+	if id, ok := d.volumeNames.get(zoneName, name); ok {
+		volume, err := client.GetBlockStorageVolume(ctx, id)
+		if err != nil && !errors.Is(err, v3.ErrNotFound) {
+			return nil, err
+		}
+		if err == nil && volume.Name == name {
+			return volume, nil
+		}
+		d.volumeNames.delete(zoneName, name)
+	}
+
+	if d.volumeNames.missing(zoneName, name, time.Now()) {
+		return nil, nil
+	}
+
+	resp, err := client.ListBlockStorageVolumes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	d.volumeNames.index(zoneName, resp.BlockStorageVolumes, time.Now())
+
+	volume, err := resp.FindBlockStorageVolume(name)
+	if err != nil {
+		if errors.Is(err, v3.ErrNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return &volume, nil
+}
+
+// findSnapshotByName returns the snapshot named name in the zone of the client or nil if it doesn't exist.
+func findSnapshotByName(ctx context.Context, client *v3.Client, name string) (*v3.BlockStorageSnapshot, error) {
+	resp, err := client.ListBlockStorageSnapshots(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot, err := resp.FindBlockStorageSnapshot(name)
+	if err != nil {
+		if errors.Is(err, v3.ErrNotFound) {
+			return nil, nil
+		}
+		if errors.Is(err, v3.ErrConflict) {
+			return nil, status.Errorf(codes.AlreadyExists, "several snapshots named %s exist", name)
+		}
+		return nil, err
+	}
+
+	return &snapshot, nil
+}
+
+// newClientZone returns a copy of the client to the API endpoint of the zone, overridden by endpoints if set.
+func newClientZone(ctx context.Context, c *v3.Client, z v3.ZoneName, endpoints ZoneEndpoints) (*v3.Client, error) {
+	if endpoint, ok := endpoints[z]; ok {
+		return c.WithEndpoint(endpoint), nil
+	}
+
 	endpoint, err := c.GetZoneAPIEndpoint(ctx, z)
 	if err != nil {
 		return nil, fmt.Errorf("get zone api endpoint: %w", err)
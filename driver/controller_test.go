@@ -0,0 +1,153 @@
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	v3 "github.com/exoscale/egoscale/v3"
+	"github.com/exoscale/egoscale/v3/credentials"
+)
+
+// testAPIKey is the API key of the clients returned by newTestAPIClient.
+const testAPIKey = "EXOtest"
+
+// newTestAPIClient returns a client of a fake Exoscale API served by handler, and the server of the API.
+func newTestAPIClient(t *testing.T, handler http.HandlerFunc) (*v3.Client, *httptest.Server) {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	client, err := v3.NewClient(credentials.NewStaticCredentials(testAPIKey, "secret"),
+		v3.ClientOptWithEndpoint(v3.Endpoint(server.URL)),
+	)
+	require.NoError(t, err)
+
+	return client, server
+}
+
+func TestFindSnapshotByName(t *testing.T) {
+	client, _ := newTestAPIClient(t, func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/block-storage-snapshot", r.URL.Path)
+		require.NoError(t, json.NewEncoder(w).Encode(v3.ListBlockStorageSnapshotsResponse{
+			BlockStorageSnapshots: []v3.BlockStorageSnapshot{
+				{ID: "b0b1c2d3-0000-4000-8000-000000000001", Name: "snapshot-1"},
+				{ID: "b0b1c2d3-0000-4000-8000-000000000002", Name: "snapshot-2"},
+				{ID: "b0b1c2d3-0000-4000-8000-000000000003", Name: "snapshot-2"},
+			},
+		}))
+	})
+
+	snapshot, err := findSnapshotByName(context.Background(), client, "snapshot-1")
+	require.NoError(t, err)
+	require.Equal(t, v3.UUID("b0b1c2d3-0000-4000-8000-000000000001"), snapshot.ID)
+
+	snapshot, err = findSnapshotByName(context.Background(), client, "snapshot-3")
+	require.NoError(t, err)
+	require.Nil(t, snapshot)
+
+	_, err = findSnapshotByName(context.Background(), client, "snapshot-2")
+	require.Equal(t, codes.AlreadyExists, status.Code(err))
+}
+
+func TestControllerExpandVolumeAttached(t *testing.T) {
+	testsBench := []struct {
+		name            string
+		onlineExpansion bool
+		capability      *csi.VolumeCapability
+	}{
+		{name: "offline expansion"},
+		{name: "online expansion of f2fs", onlineExpansion: true, capability: mountCapability("f2fs")},
+	}
+
+	client, server := newTestAPIClient(t, func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, http.MethodGet, r.Method, "the attached volume must not be resized")
+		require.Equal(t, "/block-storage/b0b1c2d3-0000-4000-8000-000000000001", r.URL.Path)
+		require.NoError(t, json.NewEncoder(w).Encode(v3.BlockStorageVolume{
+			ID:       "b0b1c2d3-0000-4000-8000-000000000001",
+			Size:     10,
+			Instance: &v3.InstanceTarget{ID: "7c1fd0e4-a3b0-4c64-8f6c-9d0c0ff4f2b2"},
+		}))
+	})
+
+	volumeSizes, err := newVolumeSizeLimits(0, 0, 0)
+	require.NoError(t, err)
+
+	for _, test := range testsBench {
+		t.Run(test.name, func(t *testing.T) {
+			d := &controllerService{
+				client:          client,
+				volumeSizes:     volumeSizes,
+				zoneEndpoints:   ZoneEndpoints{"ch-gva-2": v3.Endpoint(server.URL)},
+				onlineExpansion: test.onlineExpansion,
+			}
+
+			_, err := d.ControllerExpandVolume(context.Background(), &csi.ControllerExpandVolumeRequest{
+				VolumeId:         "ch-gva-2/b0b1c2d3-0000-4000-8000-000000000001",
+				CapacityRange:    &csi.CapacityRange{RequiredBytes: 20 * GiB},
+				VolumeCapability: test.capability,
+			})
+			require.Equal(t, codes.FailedPrecondition, status.Code(err), "%v", err)
+		})
+	}
+}
+
+func TestCheckAttachLimit(t *testing.T) {
+	client, _ := newTestAPIClient(t, func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/block-storage", r.URL.Path)
+		require.Equal(t, "7c1fd0e4-a3b0-4c64-8f6c-9d0c0ff4f2b2", r.URL.Query().Get("instanceID"))
+		require.NoError(t, json.NewEncoder(w).Encode(v3.ListBlockStorageVolumesResponse{
+			BlockStorageVolumes: make([]v3.BlockStorageVolume, 3),
+		}))
+	})
+	d := &controllerService{maxVolumesPerNode: 5}
+	instanceID := v3.UUID("7c1fd0e4-a3b0-4c64-8f6c-9d0c0ff4f2b2")
+
+	testsBench := []struct {
+		count int
+		code  codes.Code
+	}{
+		{count: 1, code: codes.OK},
+		{count: 2, code: codes.OK},
+		{count: 3, code: codes.ResourceExhausted},
+	}
+
+	for _, test := range testsBench {
+		err := d.checkAttachLimit(context.Background(), client, instanceID, test.count)
+		require.Equal(t, test.code, status.Code(err), "count %d: %v", test.count, err)
+	}
+}
+
+func TestControllerPublishVolumeAttachLimit(t *testing.T) {
+	client, server := newTestAPIClient(t, func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, http.MethodGet, r.Method, "the volume must not be attached")
+		switch r.URL.Path {
+		case "/block-storage/b0b1c2d3-0000-4000-8000-000000000001":
+			require.NoError(t, json.NewEncoder(w).Encode(v3.BlockStorageVolume{ID: "b0b1c2d3-0000-4000-8000-000000000001", Size: 10}))
+		case "/block-storage":
+			require.NoError(t, json.NewEncoder(w).Encode(v3.ListBlockStorageVolumesResponse{
+				BlockStorageVolumes: make([]v3.BlockStorageVolume, 5),
+			}))
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+	})
+	d := &controllerService{
+		client:            client,
+		zoneEndpoints:     ZoneEndpoints{"ch-gva-2": v3.Endpoint(server.URL)},
+		pendingOperations: newPendingOperations(),
+		maxVolumesPerNode: 5,
+	}
+
+	_, err := d.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+		VolumeId: "ch-gva-2/b0b1c2d3-0000-4000-8000-000000000001",
+		NodeId:   "ch-gva-2/7c1fd0e4-a3b0-4c64-8f6c-9d0c0ff4f2b2",
+	})
+	require.Equal(t, codes.ResourceExhausted, status.Code(err), "%v", err)
+}
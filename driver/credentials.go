@@ -0,0 +1,252 @@
+package driver
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"k8s.io/klog/v2"
+
+	v3 "github.com/exoscale/egoscale/v3"
+	"github.com/exoscale/egoscale/v3/credentials"
+)
+
+// credentialsReloadDelay groups the file events of an update of the credentials file before reloading it,
+// e.g. the several renames of the kubelet updating a mounted Secret.
+const credentialsReloadDelay = time.Second
+
+// credentialsRetryInterval is the interval between the attempts to reload invalid or unusable credentials.
+const credentialsRetryInterval = 30 * time.Second
+
+// readCredentialsFile returns the Exoscale API credentials of path, either a file of EXOSCALE_API_KEY=<key>
+// and EXOSCALE_API_SECRET=<secret> lines or the directory of the mounted exoscale-credentials Secret
+// holding the EXOSCALE_API_KEY and EXOSCALE_API_SECRET files.
+func readCredentialsFile(path string) (credentials.Value, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return credentials.Value{}, err
+	}
+
+	values := make(map[string]string)
+	if info.IsDir() {
+		for _, key := range []string{secretAPIKey, secretAPISecret} {
+			value, err := os.ReadFile(filepath.Join(path, key))
+			if err != nil {
+				return credentials.Value{}, err
+			}
+			values[key] = strings.TrimSpace(string(value))
+		}
+	} else {
+		f, err := os.Open(path)
+		if err != nil {
+			return credentials.Value{}, err
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			key, value, ok := strings.Cut(line, "=")
+			if !ok {
+				return credentials.Value{}, fmt.Errorf("invalid line in %s, expected KEY=value", path)
+			}
+			values[strings.TrimSpace(key)] = strings.Trim(strings.TrimSpace(value), `"'`)
+		}
+		if err := scanner.Err(); err != nil {
+			return credentials.Value{}, err
+		}
+	}
+
+	creds := credentials.Value{APIKey: values[secretAPIKey], APISecret: values[secretAPISecret]}
+	if !creds.IsSet() {
+		return credentials.Value{}, fmt.Errorf("%s must contain %s and %s", path, secretAPIKey, secretAPISecret)
+	}
+
+	return creds, nil
+}
+
+// apiClient returns the client of the Exoscale API, the latest one created from reloaded credentials if any.
+func (d *controllerService) apiClient() *v3.Client {
+	if d.reloadedClient != nil {
+		if client := d.reloadedClient.Load(); client != nil {
+			return client
+		}
+	}
+
+	return d.client
+}
+
+// reloadClient replaces the client of the Exoscale API with one using the credentials, returning an error
+// and keeping the current client if the new one can't be created.
+func (d *controllerService) reloadClient(ctx context.Context, creds credentials.Value) error {
+	client, err := v3.NewClient(credentials.NewStaticCredentials(creds.APIKey, creds.APISecret), d.clientOpts...)
+	if err != nil {
+		return err
+	}
+
+	client, err = newClientZone(ctx, client, d.zoneName, d.zoneEndpoints)
+	if err != nil {
+		return err
+	}
+
+	d.reloadedClient.Store(client)
+	return nil
+}
+
+// runCredentialsWatcher reloads the Exoscale API credentials of the credentials file when it changes until ctx is done,
+// current are the credentials of the client. Failed reloads are retried after credentialsRetryInterval.
+func (d *controllerService) runCredentialsWatcher(ctx context.Context, path string, current credentials.Value) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		klog.Errorf("watch credentials file %s: %v", path, err)
+		return
+	}
+	defer watcher.Close()
+
+	// The directory is watched rather than the file, replaced on updates, e.g. through a symlink for the mounted Secrets.
+	dir := path
+	if info, err := os.Stat(path); err == nil && !info.IsDir() {
+		dir = filepath.Dir(path)
+	}
+	if err := watcher.Add(dir); err != nil {
+		klog.Errorf("watch credentials file %s: %v", path, err)
+		return
+	}
+
+	klog.Infof("credentials file %s watcher started", path)
+
+	reload := time.NewTimer(credentialsReloadDelay)
+	reload.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			reload.Stop()
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			klog.V(5).Infof("credentials file event %s", event)
+			reload.Reset(credentialsReloadDelay)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			klog.Errorf("watch credentials file %s: %v", path, err)
+		case <-reload.C:
+			creds, err := readCredentialsFile(path)
+			if err == nil && creds == current {
+				continue
+			}
+			if err == nil {
+				err = d.reloadClient(ctx, creds)
+			}
+			if err != nil {
+				klog.Errorf("reload credentials file %s, keeping the current credentials: %v", path, err)
+				reload.Reset(credentialsRetryInterval)
+				continue
+			}
+			current = creds
+			klog.Infof("Exoscale API credentials reloaded from %s", path)
+		}
+	}
+}
+
+// credentialsSecretPollInterval is the interval between two reads of the credentials Secret.
+const credentialsSecretPollInterval = 30 * time.Second
+
+// parseCredentialsSecret returns the Kubernetes API path of the credentials Secret <namespace>/<name>.
+func parseCredentialsSecret(secret string) (string, error) {
+	namespace, name, ok := strings.Cut(secret, "/")
+	if !ok || namespace == "" || name == "" || strings.Contains(name, "/") {
+		return "", fmt.Errorf("invalid credentials Secret %q, expected <namespace>/<name>", secret)
+	}
+
+	return "/api/v1/namespaces/" + namespace + "/secrets/" + name, nil
+}
+
+// readCredentialsSecret returns the Exoscale API credentials of the EXOSCALE_API_KEY and EXOSCALE_API_SECRET keys
+// of the Secret at the Kubernetes API path.
+func readCredentialsSecret(ctx context.Context, kube *kubeClient, secretPath string) (credentials.Value, error) {
+	var secret kubeSecret
+	if err := kube.get(ctx, secretPath, &secret); err != nil {
+		return credentials.Value{}, err
+	}
+
+	creds := credentials.Value{
+		APIKey:    strings.TrimSpace(string(secret.Data[secretAPIKey])),
+		APISecret: strings.TrimSpace(string(secret.Data[secretAPISecret])),
+	}
+	if !creds.IsSet() {
+		return credentials.Value{}, fmt.Errorf("secret %s must contain %s and %s", secret.Metadata.Name, secretAPIKey, secretAPISecret)
+	}
+
+	return creds, nil
+}
+
+// getCredentialsSecret returns the Exoscale API credentials of the credentials Secret of the config.
+func getCredentialsSecret(config *DriverConfig) (credentials.Value, error) {
+	secretPath, err := parseCredentialsSecret(config.CredentialsSecret)
+	if err != nil {
+		return credentials.Value{}, err
+	}
+	kube, err := newKubeClient(config.RestConfig)
+	if err != nil {
+		return credentials.Value{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), credentialsSecretPollInterval)
+	defer cancel()
+
+	return readCredentialsSecret(ctx, kube, secretPath)
+}
+
+// runCredentialsSecretSync reloads the Exoscale API credentials of the Secret at the Kubernetes API path
+// when they change until ctx is done, current are the credentials of the client.
+func (d *controllerService) runCredentialsSecretSync(ctx context.Context, kube *kubeClient, secretPath string, current credentials.Value) {
+	klog.Infof("credentials Secret %s sync started, interval %s", secretPath, credentialsSecretPollInterval)
+
+	ticker := time.NewTicker(credentialsSecretPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reloaded, err := d.syncCredentialsSecret(ctx, kube, secretPath, current)
+			if err != nil {
+				klog.Errorf("reload credentials Secret %s, keeping the current credentials: %v", secretPath, err)
+				continue
+			}
+			current = reloaded
+		}
+	}
+}
+
+// syncCredentialsSecret reloads the client if the credentials of the Secret differ from current,
+// returning the credentials of the client.
+func (d *controllerService) syncCredentialsSecret(ctx context.Context, kube *kubeClient, secretPath string, current credentials.Value) (credentials.Value, error) {
+	creds, err := readCredentialsSecret(ctx, kube, secretPath)
+	if err != nil {
+		return current, err
+	}
+	if creds == current {
+		return current, nil
+	}
+
+	if err := d.reloadClient(ctx, creds); err != nil {
+		return current, err
+	}
+	klog.Infof("Exoscale API credentials reloaded from Secret %s", secretPath)
+
+	return creds, nil
+}
@@ -0,0 +1,159 @@
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	v3 "github.com/exoscale/egoscale/v3"
+	"github.com/exoscale/egoscale/v3/credentials"
+)
+
+func TestReadCredentialsFile(t *testing.T) {
+	dir := t.TempDir()
+
+	file := filepath.Join(dir, "credentials")
+	require.NoError(t, os.WriteFile(file, []byte("# Exoscale API\nEXOSCALE_API_KEY=EXOtest\nEXOSCALE_API_SECRET=\"secret\"\n"), 0o600))
+	creds, err := readCredentialsFile(file)
+	require.NoError(t, err)
+	require.Equal(t, credentials.Value{APIKey: "EXOtest", APISecret: "secret"}, creds)
+
+	secretDir := filepath.Join(dir, "secret")
+	require.NoError(t, os.Mkdir(secretDir, 0o700))
+	require.NoError(t, os.WriteFile(filepath.Join(secretDir, secretAPIKey), []byte("EXOtest"), 0o600))
+	_, err = readCredentialsFile(secretDir)
+	require.Error(t, err, "the API secret is missing")
+	require.NoError(t, os.WriteFile(filepath.Join(secretDir, secretAPISecret), []byte("secret\n"), 0o600))
+	creds, err = readCredentialsFile(secretDir)
+	require.NoError(t, err)
+	require.Equal(t, credentials.Value{APIKey: "EXOtest", APISecret: "secret"}, creds)
+
+	invalid := filepath.Join(dir, "invalid")
+	require.NoError(t, os.WriteFile(invalid, []byte("EXOtest\n"), 0o600))
+	_, err = readCredentialsFile(invalid)
+	require.Error(t, err)
+
+	_, err = readCredentialsFile(filepath.Join(dir, "missing"))
+	require.Error(t, err)
+}
+
+func TestRunCredentialsWatcher(t *testing.T) {
+	var mu sync.Mutex
+	var lastAuthorization string
+	client, server := newTestAPIClient(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		lastAuthorization = r.Header.Get("Authorization")
+		mu.Unlock()
+		require.NoError(t, json.NewEncoder(w).Encode(v3.ListZonesResponse{
+			Zones: []v3.Zone{{Name: "ch-gva-2", APIEndpoint: v3.Endpoint("http://" + r.Host)}},
+		}))
+	})
+
+	d := &controllerService{
+		client:         client,
+		clientOpts:     []v3.ClientOpt{v3.ClientOptWithEndpoint(v3.Endpoint(server.URL))},
+		zoneName:       "ch-gva-2",
+		reloadedClient: new(atomic.Pointer[v3.Client]),
+	}
+
+	file := filepath.Join(t.TempDir(), "credentials")
+	require.NoError(t, os.WriteFile(file, []byte("EXOSCALE_API_KEY="+testAPIKey+"\nEXOSCALE_API_SECRET=secret\n"), 0o600))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.runCredentialsWatcher(ctx, file, credentials.Value{APIKey: testAPIKey, APISecret: "secret"})
+	// Let the watcher start before updating the file.
+	time.Sleep(100 * time.Millisecond)
+
+	// Replace the file like the kubelet updating a mounted Secret.
+	tmp := file + ".tmp"
+	require.NoError(t, os.WriteFile(tmp, []byte("EXOSCALE_API_KEY=EXOnew\nEXOSCALE_API_SECRET=secret\n"), 0o600))
+	require.NoError(t, os.Rename(tmp, file))
+
+	require.Eventually(t, func() bool { return d.reloadedClient.Load() != nil }, 5*time.Second, 50*time.Millisecond)
+
+	_, err := d.apiClient().ListZones(ctx)
+	require.NoError(t, err)
+	mu.Lock()
+	defer mu.Unlock()
+	require.True(t, strings.Contains(lastAuthorization, "credential=EXOnew"), lastAuthorization)
+}
+
+func TestParseCredentialsSecret(t *testing.T) {
+	secretPath, err := parseCredentialsSecret("kube-system/exoscale-credentials")
+	require.NoError(t, err)
+	require.Equal(t, "/api/v1/namespaces/kube-system/secrets/exoscale-credentials", secretPath)
+
+	for _, secret := range []string{"exoscale-credentials", "kube-system/", "/exoscale-credentials", "kube-system/exoscale/credentials"} {
+		_, err := parseCredentialsSecret(secret)
+		require.Error(t, err, secret)
+	}
+}
+
+func TestSyncCredentialsSecret(t *testing.T) {
+	var mu sync.Mutex
+	secret := kubeSecret{
+		Metadata: kubeObjectMeta{Name: "exoscale-credentials", Namespace: "kube-system"},
+		Data:     map[string][]byte{secretAPIKey: []byte(testAPIKey), secretAPISecret: []byte("secret")},
+	}
+	var lastAuthorization string
+	client, server := newTestAPIClient(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.URL.Path {
+		case "/api/v1/namespaces/kube-system/secrets/exoscale-credentials":
+			require.NoError(t, json.NewEncoder(w).Encode(secret))
+		case "/zone":
+			lastAuthorization = r.Header.Get("Authorization")
+			require.NoError(t, json.NewEncoder(w).Encode(v3.ListZonesResponse{
+				Zones: []v3.Zone{{Name: "ch-gva-2", APIEndpoint: v3.Endpoint("http://" + r.Host)}},
+			}))
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	kube := &kubeClient{httpClient: server.Client(), host: server.URL}
+	secretPath := "/api/v1/namespaces/kube-system/secrets/exoscale-credentials"
+
+	d := &controllerService{
+		client:         client,
+		clientOpts:     []v3.ClientOpt{v3.ClientOptWithEndpoint(v3.Endpoint(server.URL))},
+		zoneName:       "ch-gva-2",
+		reloadedClient: new(atomic.Pointer[v3.Client]),
+	}
+	ctx := context.Background()
+
+	// Unchanged credentials keep the client.
+	current, err := d.syncCredentialsSecret(ctx, kube, secretPath, credentials.Value{APIKey: testAPIKey, APISecret: "secret"})
+	require.NoError(t, err)
+	require.Equal(t, testAPIKey, current.APIKey)
+	require.Nil(t, d.reloadedClient.Load())
+
+	mu.Lock()
+	secret.Data[secretAPIKey] = []byte("EXOnew")
+	mu.Unlock()
+	current, err = d.syncCredentialsSecret(ctx, kube, secretPath, current)
+	require.NoError(t, err)
+	require.Equal(t, "EXOnew", current.APIKey)
+	require.NotNil(t, d.reloadedClient.Load())
+
+	_, err = d.apiClient().ListZones(ctx)
+	require.NoError(t, err)
+	mu.Lock()
+	require.Contains(t, lastAuthorization, "credential=EXOnew")
+	// Incomplete credentials keep the current ones.
+	delete(secret.Data, secretAPISecret)
+	mu.Unlock()
+	current, err = d.syncCredentialsSecret(ctx, kube, secretPath, current)
+	require.Error(t, err)
+	require.Equal(t, "EXOnew", current.APIKey)
+}
@@ -0,0 +1,122 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"k8s.io/klog/v2"
+)
+
+const (
+	sysBlock = "/sys/block"
+	sysRoot  = "/sys"
+
+	// DefaultDeviceWaitTimeout is the maximum duration to wait for the device of a volume to appear on the node.
+	DefaultDeviceWaitTimeout = 30 * time.Second
+	// devicePollInterval is the interval between two lookups of a device when no udev event is received.
+	devicePollInterval = time.Second
+	// deviceRescanDelay is the duration after which the buses are rescanned if the device still isn't found.
+	deviceRescanDelay = 5 * time.Second
+)
+
+// rescanBuses asks the kernel to rescan the PCI bus, on which the virtio block devices are hot-plugged,
+// and the SCSI hosts of the sysDir sysfs directory, for the devices whose hotplug event was missed to show up.
+// The rescan is best-effort, the errors are only logged.
+func rescanBuses(sysDir string) {
+	if err := os.WriteFile(filepath.Join(sysDir, "bus", "pci", "rescan"), []byte("1"), 0o200); err != nil {
+		klog.V(4).Infof("rescan PCI bus: %v", err)
+	}
+
+	scanFiles, err := filepath.Glob(filepath.Join(sysDir, "class", "scsi_host", "*", "scan"))
+	if err != nil {
+		return
+	}
+	for _, scanFile := range scanFiles {
+		if err := os.WriteFile(scanFile, []byte("- - -"), 0o200); err != nil {
+			klog.V(4).Infof("rescan SCSI host %s: %v", filepath.Base(filepath.Dir(scanFile)), err)
+		}
+	}
+}
+
+// findDeviceBySerial returns the path of the virtio block device with the serial, looked up in the sysBlockDir
+// sysfs directory so that the device is found even before udev created its /dev/disk/by-id link.
+// An error is returned if several devices have the serial.
+func findDeviceBySerial(sysBlockDir, serial string) (string, error) {
+	entries, err := os.ReadDir(sysBlockDir)
+	if err != nil {
+		return "", err
+	}
+
+	var devicePath string
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join(sysBlockDir, entry.Name(), "serial"))
+		if err != nil {
+			continue
+		}
+		if strings.TrimSpace(string(data)) != serial {
+			continue
+		}
+		if devicePath != "" {
+			return "", fmt.Errorf("devices %s and %s have the same serial %s", devicePath, filepath.Join("/dev", entry.Name()), serial)
+		}
+		devicePath = filepath.Join("/dev", entry.Name())
+	}
+
+	if devicePath == "" {
+		return "", &os.PathError{Op: "find device", Path: serial, Err: os.ErrNotExist}
+	}
+
+	return devicePath, nil
+}
+
+// WaitDevicePathBySerial returns the path of the virtio device with the serial, waiting for it to appear until ctx is done.
+// The creation of the /dev/disk/by-id links is watched with inotify so that the device is found as soon as udev
+// processed it, the device is also looked up every devicePollInterval in case no event is received.
+// If the device still isn't found after deviceRescanDelay, the buses are rescanned once.
+func (d *diskUtils) WaitDevicePathBySerial(ctx context.Context, serial string) (string, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return "", err
+	}
+	defer unix.Close(fd)
+
+	// Watch before looking the device up so that a link created in between isn't missed.
+	if _, err := unix.InotifyAddWatch(fd, devDiskByID, unix.IN_CREATE|unix.IN_MOVED_TO); err != nil {
+		klog.V(4).Infof("watch %s: %v", devDiskByID, err)
+	}
+
+	buf := make([]byte, unix.SizeofInotifyEvent*64+unix.NAME_MAX+1)
+	rescanAt := time.Now().Add(deviceRescanDelay)
+	rescanned := false
+	for {
+		devicePath, err := d.GetDevicePathBySerial(serial)
+		if !os.IsNotExist(err) {
+			return devicePath, err
+		}
+
+		if ctx.Err() != nil {
+			return "", err
+		}
+
+		if !rescanned && time.Now().After(rescanAt) {
+			klog.Infof("device with serial %s not found after %s, rescanning the buses", serial, deviceRescanDelay)
+			rescanBuses(sysRoot)
+			rescanned = true
+		}
+
+		pollFds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+		n, pollErr := unix.Poll(pollFds, int(devicePollInterval.Milliseconds()))
+		if pollErr != nil && pollErr != unix.EINTR {
+			return "", pollErr
+		}
+		if n > 0 {
+			// The events only wake the loop up, drain them.
+			_, _ = unix.Read(fd, buf)
+		}
+	}
+}
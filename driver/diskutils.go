@@ -1,17 +1,21 @@
 package driver
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os"
-	"os/exec"
 	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	v3 "github.com/exoscale/egoscale/v3"
 
 	"golang.org/x/sys/unix"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/klog/v2"
 	kmount "k8s.io/mount-utils"
 	kexec "k8s.io/utils/exec"
@@ -19,11 +23,12 @@ import (
 )
 
 const (
-	devDiskByID     = "/dev/disk/by-id"
-	devDiskPrefix   = "virtio-"
-	devDiskIDLength = 20
+	devDiskByID   = "/dev/disk/by-id"
+	devDiskPrefix = "virtio-"
+	sysFS         = "/sys/fs"
 
-	defaultFSType = "ext4"
+	// DefaultFSType is the filesystem type of the volumes staged without filesystem type.
+	DefaultFSType = "ext4"
 
 	procMountInfoMaxListTries             = 3
 	procMountsExpectedNumFieldsPerLine    = 6
@@ -35,27 +40,100 @@ const (
 
 type DiskUtils interface {
 	// GetDevicePath returns the path for the specified volumeID
-	GetDevicePath(volumeID string) (string, error)
-	FormatAndMount(targetPath string, devicePath string, fsType string, mountOptions []string) error
+	GetDevicePath(volumeID v3.UUID) (string, error)
+	// GetDevicePathBySerial returns the path of the virtio device with the specified serial
+	GetDevicePathBySerial(serial string) (string, error)
+	// WaitDevicePathBySerial returns the path of the virtio device with the specified serial, waiting for it to appear
+	WaitDevicePathBySerial(ctx context.Context, serial string) (string, error)
+	// WaitDeviceRemoval waits for the removal of a device until ctx is done
+	WaitDeviceRemoval(ctx context.Context) error
+	FormatAndMount(targetPath string, devicePath string, fsType string, mountOptions []string, formatOptions []string) error
+	// GetDiskFormat returns the filesystem type of the device, empty if it isn't formatted
+	GetDiskFormat(devicePath string) (string, error)
 	IsSharedMounted(targetPath string, devicePath string) (bool, error)
 	GetMountInfo(targetPath string) (*mountInfo, error)
 	IsBlockDevice(path string) (bool, error)
 	MountToTarget(sourcePath, targetPath, fsType string, mountOptions []string) error
+	// MountIdmapped bind mounts sourcePath on targetPath with the ID mapping of the idmap mount option
+	MountIdmapped(sourcePath, targetPath, idmap string, mountOptions []string) error
 	Unmount(target string) error
+	// ForceUnmount lazily unmounts the target, which may be stale, and removes it
+	ForceUnmount(target string) error
 	GetStatfs(path string) (*unix.Statfs_t, error)
+	GetBlockReadonly(devicePath string) (bool, error)
+	// GetBlockSize returns the size in bytes of the block device
+	GetBlockSize(devicePath string) (int64, error)
+	SetBlockReadonly(devicePath string, readonly bool) error
+	// GetFilesystemErrors returns the number of errors recorded by the mounted filesystem, when it keeps count
+	GetFilesystemErrors(info *mountInfo) uint64
 	Resize(targetPath string, devicePath string) error
+	// ResizeF2FS grows the unmounted f2fs filesystem of the device
+	ResizeF2FS(devicePath string) error
+	// RepairXFS repairs the xfs filesystem of the device, zeroing its log
+	RepairXFS(devicePath string) error
+	// Tune2fs applies the tune2fs options to the ext filesystem of the device
+	Tune2fs(devicePath string, options []string) error
+	// CreateBtrfsSubvolume creates a btrfs subvolume on path
+	CreateBtrfsSubvolume(path string) error
+	// NeedResize returns whether the filesystem mounted on targetPath is smaller than its device
+	NeedResize(targetPath string, devicePath string) (bool, error)
+	// LuksOpen opens the encrypted device, formatting it with LUKS if blank, and returns the path of the mapping
+	LuksOpen(devicePath, name, passphrase string) (string, error)
+	LuksClose(name string) error
+	LuksResize(name, passphrase string) error
+	LuksMapping(name string) (string, bool)
+	ListMountInfo() ([]*mountInfo, error)
+	// ListVolumeDevices returns the paths of the block storage devices and encrypted mappings on the node
+	ListVolumeDevices() (map[string]bool, error)
+	Fstrim(mountPoint string) error
+	// Freeze suspends the writes to the filesystem mounted on mountPoint until it is thawed
+	Freeze(mountPoint string) error
+	Thaw(mountPoint string) error
+	// AssembleStripedVolume activates the LVM volume group of a striped volume, creating it on the devices if needed,
+	// and returns the path of its logical volume
+	AssembleStripedVolume(volumeGroup string, devicePaths []string) (string, error)
+	DisassembleStripedVolume(volumeGroup string) error
+}
+
+// MountPropagation is the propagation required for the staging and publishing mounts.
+type MountPropagation string
+
+const (
+	// SharedMountPropagation requires the mounts to be shared, so that they propagate
+	// from the node plugin container to the host and the pods.
+	SharedMountPropagation MountPropagation = "shared"
+	// NoMountPropagation doesn't check the propagation, e.g. when the node plugin runs in the host mount namespace.
+	NoMountPropagation MountPropagation = "none"
+)
+
+// ParseMountPropagation returns the mount propagation, shared if empty.
+func ParseMountPropagation(propagation string) (MountPropagation, error) {
+	switch p := MountPropagation(propagation); p {
+	case "":
+		return SharedMountPropagation, nil
+	case SharedMountPropagation, NoMountPropagation:
+		return p, nil
+	}
+
+	return "", fmt.Errorf("unknown mount propagation %q, expected %s or %s", propagation, SharedMountPropagation, NoMountPropagation)
 }
 
 type diskUtils struct {
 	kMounter *kmount.SafeFormatAndMount
+	// requireSharedMount makes IsSharedMounted fail on mounts which aren't shared.
+	requireSharedMount bool
+	// allowLazyUnmount makes Unmount detach the targets still busy after the unmount retries.
+	allowLazyUnmount bool
 }
 
-func newDiskUtils() *diskUtils {
+func newDiskUtils(config *DriverConfig) *diskUtils {
 	return &diskUtils{
 		kMounter: &kmount.SafeFormatAndMount{
 			Interface: kmount.New(""),
-			Exec:      kexec.New(),
+			Exec:      loggingExec{kexec.New()},
 		},
+		requireSharedMount: config.MountPropagation != NoMountPropagation,
+		allowLazyUnmount:   config.AllowLazyUnmount,
 	}
 }
 
@@ -105,44 +183,90 @@ func (d *diskUtils) GetMountInfo(targetPath string) (*mountInfo, error) {
 		if fields[4] != targetPath {
 			continue
 		}
-		id, err := strconv.Atoi(fields[0])
-		if err != nil {
-			return nil, err
+		return parseMountInfoFields(line, fields)
+	}
+	return nil, nil
+}
+
+// ListMountInfo returns all the mounts of /proc/self/mountinfo.
+func (d *diskUtils) ListMountInfo() ([]*mountInfo, error) {
+	content, err := kio.ConsistentRead(procMountInfoPath, procMountInfoMaxListTries)
+	if err != nil {
+		return nil, err
+	}
+
+	var mounts []*mountInfo
+	for _, line := range strings.Split(string(content), "\n") {
+		if line == "" {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < expectedAtLeastNumFieldsPerMountInfo {
+			return nil, fmt.Errorf("wrong number of fields in (expected at least %d, got %d): %s", expectedAtLeastNumFieldsPerMountInfo, len(fields), line)
 		}
-		parentID, err := strconv.Atoi(fields[1])
+		info, err := parseMountInfoFields(line, fields)
 		if err != nil {
 			return nil, err
 		}
-		info := &mountInfo{
-			id:           id,
-			parentID:     parentID,
-			majorMinor:   fields[2],
-			root:         fields[3],
-			mountPoint:   fields[4],
-			mountOptions: strings.Split(fields[5], ","),
-		}
-		// All fields until "-" are "optional fields".
-		i := 6
-		for ; i < len(fields) && fields[i] != "-"; i++ {
-			info.optionalFields = append(info.optionalFields, fields[i])
-		}
-		// Parse the rest 3 fields.
-		i++
-		if len(fields)-i < 3 {
-			return nil, fmt.Errorf("expect 3 fields in %s, got %d", line, len(fields)-i)
-		}
-		info.fsType = fields[i]
-		info.source = fields[i+1]
-		info.superOptions = strings.Split(fields[i+2], ",")
-		return info, nil
+		mounts = append(mounts, info)
 	}
-	return nil, nil
+
+	return mounts, nil
+}
+
+// taken from https://github.com/kubernetes/kubernetes/blob/master/pkg/util/mount/mount_linux.go
+func parseMountInfoFields(line string, fields []string) (*mountInfo, error) {
+	id, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return nil, err
+	}
+	parentID, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return nil, err
+	}
+	info := &mountInfo{
+		id:           id,
+		parentID:     parentID,
+		majorMinor:   fields[2],
+		root:         fields[3],
+		mountPoint:   fields[4],
+		mountOptions: strings.Split(fields[5], ","),
+	}
+	// All fields until "-" are "optional fields".
+	i := 6
+	for ; i < len(fields) && fields[i] != "-"; i++ {
+		info.optionalFields = append(info.optionalFields, fields[i])
+	}
+	// Parse the rest 3 fields.
+	i++
+	if len(fields)-i < 3 {
+		return nil, fmt.Errorf("expect 3 fields in %s, got %d", line, len(fields)-i)
+	}
+	info.fsType = fields[i]
+	info.source = fields[i+1]
+	info.superOptions = strings.Split(fields[i+2], ",")
+	return info, nil
 }
 
 func (d *diskUtils) GetDevicePath(volumeID v3.UUID) (string, error) {
-	devDiskID := volumeID.String()[:devDiskIDLength]
-	devicePath := path.Join(devDiskByID, devDiskPrefix+devDiskID)
-	realDevicePath, err := filepath.EvalSymlinks(devicePath)
+	// The device of an assembled striped volume is its logical volume.
+	lvPath := stripedVolumePath(stripedVolumeGroup(volumeID))
+	if _, err := os.Stat(lvPath); err == nil {
+		return lvPath, nil
+	}
+
+	return d.GetDevicePathBySerial(deviceSerial(volumeID))
+}
+
+func (d *diskUtils) GetDevicePathBySerial(serial string) (string, error) {
+	// The serial is looked up in sysfs first so that the devices sharing the truncated serial
+	// are reported rather than picking the one udev linked.
+	devicePath, err := findDeviceBySerial(sysBlock, serial)
+	realDevicePath := devicePath
+	if os.IsNotExist(err) {
+		devicePath = path.Join(devDiskByID, devDiskPrefix+serial)
+		realDevicePath, err = filepath.EvalSymlinks(devicePath)
+	}
 	if err != nil {
 		return "", err
 	}
@@ -160,20 +284,34 @@ func (d *diskUtils) GetDevicePath(volumeID v3.UUID) (string, error) {
 	return devicePath, nil
 }
 
-func (d *diskUtils) FormatAndMount(targetPath string, devicePath string, fsType string, mountOptions []string) error {
+func (d *diskUtils) FormatAndMount(targetPath string, devicePath string, fsType string, mountOptions []string, formatOptions []string) error {
 	if fsType == "" {
-		fsType = defaultFSType
+		fsType = DefaultFSType
 	}
 
-	klog.V(4).Infof("Attempting to mount %s on %s with type %s", devicePath, targetPath, fsType)
+	klog.V(4).Infof("Attempting to mount %s on %s with type %s and format options %v", devicePath, targetPath, fsType, formatOptions)
 
-	if err := d.kMounter.FormatAndMount(devicePath, targetPath, fsType, mountOptions); err != nil {
+	if err := d.kMounter.FormatAndMountSensitiveWithFormatOptions(devicePath, targetPath, fsType, mountOptions, nil, formatOptions); err != nil {
 		return fmt.Errorf("failed to optionnaly format and mount: %w", err)
 	}
 
 	return nil
 }
 
+func (d *diskUtils) GetDiskFormat(devicePath string) (string, error) {
+	return d.kMounter.GetDiskFormat(devicePath)
+}
+
+// isFSTypeMismatch returns whether the existing filesystem of a device can't be mounted with the requested fsType,
+// ext4 mounts the ext3 filesystems.
+func isFSTypeMismatch(existingFSType, fsType string) bool {
+	if existingFSType == "" || existingFSType == fsType {
+		return false
+	}
+
+	return !(existingFSType == "ext3" && fsType == "ext4")
+}
+
 func (d *diskUtils) IsSharedMounted(targetPath string, devicePath string) (bool, error) {
 	if targetPath == "" {
 		return false, fmt.Errorf("target path empty")
@@ -195,8 +333,8 @@ func (d *diskUtils) IsSharedMounted(targetPath string, devicePath string) (bool,
 			sharedMounted = true
 		}
 	}
-	if !sharedMounted {
-		return false, fmt.Errorf("target not shared mounter")
+	if d.requireSharedMount && !sharedMounted {
+		return false, fmt.Errorf("target %s is not a shared mount: mount the kubelet directory with mountPropagation Bidirectional in the node plugin and make sure the host mounts are shared (mount --make-rshared /), or set --mount-propagation=none", targetPath)
 	}
 
 	if devicePath != "" && mountInfo.source != devicePath {
@@ -226,9 +364,20 @@ func (d *diskUtils) IsBlockDevice(path string) (bool, error) {
 
 }
 
+func (d *diskUtils) GetBlockSize(devicePath string) (int64, error) {
+	device, err := os.Open(devicePath)
+	if err != nil {
+		return 0, err
+	}
+	defer device.Close()
+
+	// The end of a block device is its size.
+	return device.Seek(0, io.SeekEnd)
+}
+
 func (d *diskUtils) MountToTarget(sourcePath, targetPath, fsType string, mountOptions []string) error {
 	if fsType == "" {
-		fsType = defaultFSType
+		fsType = DefaultFSType
 	}
 
 	if err := d.kMounter.Mount(sourcePath, targetPath, fsType, mountOptions); err != nil {
@@ -238,8 +387,116 @@ func (d *diskUtils) MountToTarget(sourcePath, targetPath, fsType string, mountOp
 	return nil
 }
 
+// unmountBackoff is the backoff between the unmount attempts of a busy target,
+// which is usually held by short-lived processes such as log shippers or scanners.
+var unmountBackoff = wait.Backoff{
+	Duration: 200 * time.Millisecond,
+	Factor:   2,
+	Jitter:   0.1,
+	Steps:    5,
+}
+
 func (d *diskUtils) Unmount(target string) error {
-	return kmount.CleanupMountPoint(target, d.kMounter, true)
+	err := unmountWithRetry(target, unmountBackoff, func() error {
+		return kmount.CleanupMountPoint(target, d.kMounter, true)
+	})
+	if err != nil && d.allowLazyUnmount && isBusyError(err) {
+		klog.Warningf("target %s is still busy, lazily unmounting it: the filesystem stays mounted in the background until the processes using it exit: %v", target, err)
+		return lazyUnmount(target)
+	}
+
+	return err
+}
+
+// lazyUnmount detaches the target from the mount tree, the filesystem is unmounted once it is no longer in use, and removes it.
+func lazyUnmount(target string) error {
+	if err := unix.Unmount(target, unix.MNT_DETACH); err != nil && err != unix.EINVAL && err != unix.ENOENT {
+		return fmt.Errorf("lazy unmount %s: %w", target, err)
+	}
+
+	if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// unmountWithRetry unmounts the target with unmount, retrying with backoff while the target is busy.
+// A target which is no longer mounted, e.g. because it was unmounted concurrently, is not an error.
+func unmountWithRetry(target string, backoff wait.Backoff, unmount func() error) error {
+	var lastErr error
+	err := wait.ExponentialBackoff(backoff, func() (bool, error) {
+		lastErr = unmount()
+		switch {
+		case lastErr == nil:
+			return true, nil
+		case isNotMountedError(lastErr):
+			klog.V(4).Infof("target %s is not mounted: %v", target, lastErr)
+			lastErr = nil
+			return true, nil
+		case isBusyError(lastErr):
+			klog.Warningf("target %s is busy, retrying to unmount it: %v", target, lastErr)
+			return false, nil
+		}
+		return false, lastErr
+	})
+	if wait.Interrupted(err) {
+		return fmt.Errorf("target %s is still busy after %d attempts: %w", target, backoff.Steps, lastErr)
+	}
+
+	return err
+}
+
+// isBusyError returns whether the unmount error reports a target still in use.
+func isBusyError(err error) bool {
+	return errors.Is(err, unix.EBUSY) || strings.Contains(err.Error(), "target is busy") || strings.Contains(err.Error(), "device is busy")
+}
+
+// isNotMountedError returns whether the unmount error reports a target which isn't mounted.
+func isNotMountedError(err error) bool {
+	return strings.Contains(err.Error(), "not mounted")
+}
+
+func (d *diskUtils) ForceUnmount(target string) error {
+	// The target may be stale, detach it rather than waiting for the disappeared device.
+	if err := unix.Unmount(target, unix.MNT_FORCE|unix.MNT_DETACH); err != nil && err != unix.EINVAL && err != unix.ENOENT {
+		return fmt.Errorf("unmount %s: %w", target, err)
+	}
+
+	if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+func (d *diskUtils) GetFilesystemErrors(info *mountInfo) uint64 {
+	return filesystemErrors(sysFS, info)
+}
+
+// filesystemErrors returns the number of errors of the ext4 filesystem of the mount as recorded in the sysFSDir sysfs directory.
+// Other filesystems don't keep count, an xfs filesystem shuts down on corruption, failing statfs instead.
+func filesystemErrors(sysFSDir string, info *mountInfo) uint64 {
+	if info.fsType != "ext4" {
+		return 0
+	}
+
+	devicePath, err := filepath.EvalSymlinks(info.source)
+	if err != nil {
+		return 0
+	}
+
+	data, err := os.ReadFile(filepath.Join(sysFSDir, "ext4", filepath.Base(devicePath), "errors_count"))
+	if err != nil {
+		return 0
+	}
+
+	count, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0
+	}
+
+	return count
 }
 
 func (d *diskUtils) GetStatfs(path string) (*unix.Statfs_t, error) {
@@ -248,37 +505,25 @@ func (d *diskUtils) GetStatfs(path string) (*unix.Statfs_t, error) {
 	return fs, err
 }
 
+// Resize grows the filesystem of the device mounted on targetPath with the mount-utils resizer,
+// which detects the filesystem of the device and returns the output of the failed resize commands.
 func (d *diskUtils) Resize(targetPath string, devicePath string) error {
-	mountInfo, err := d.GetMountInfo(targetPath)
-	if err != nil {
-		return err
-	}
+	klog.V(4).Infof("resizing filesystem of %s mounted on %s", devicePath, targetPath)
 
-	klog.V(4).Infof("resizing filesystem %s on %s", mountInfo.fsType, devicePath)
+	_, err := kmount.NewResizeFs(d.kMounter.Exec).Resize(devicePath, targetPath)
+	return err
+}
 
-	switch mountInfo.fsType {
-	case "ext3", "ext4":
-		resize2fsPath, err := exec.LookPath("resize2fs")
-		if err != nil {
-			return err
-		}
-		resize2fsArgs := []string{devicePath}
-		return exec.Command(resize2fsPath, resize2fsArgs...).Run()
-	case "xfs":
-		xfsGrowfsPath, err := exec.LookPath("xfs_growfs")
-		if err != nil {
-			return err
-		}
-		xfsGrowfsArgs := []string{"-d", targetPath}
-		return exec.Command(xfsGrowfsPath, xfsGrowfsArgs...).Run()
-	case "btrfs":
-		btrfsPath, err := exec.LookPath("btrfs")
-		if err != nil {
-			return err
-		}
-		btrfsArgs := []string{"filesystem", "resize", "-max", targetPath}
-		return exec.Command(btrfsPath, btrfsArgs...).Run()
-	}
+func (d *diskUtils) NeedResize(targetPath string, devicePath string) (bool, error) {
+	return kmount.NewResizeFs(d.kMounter.Exec).NeedResize(devicePath, targetPath)
+}
+
+// isXFSCorrupted returns whether the mount error reports an xfs filesystem needing a repair,
+// e.g. because its log can't be replayed after an unclean shutdown.
+func isXFSCorrupted(err error) bool {
+	return strings.Contains(err.Error(), "Structure needs cleaning")
+}
 
-	return fmt.Errorf("filesystem %s does not support resizing", mountInfo.fsType)
+func (d *diskUtils) RepairXFS(devicePath string) error {
+	return runCommand(nil, "xfs_repair", "-L", devicePath)
 }
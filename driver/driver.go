@@ -3,12 +3,9 @@ package driver
 import (
 	"context"
 	"fmt"
-	"net"
-	"net/url"
 	"os"
 	"os/signal"
-	"path"
-	"path/filepath"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -19,6 +16,10 @@ import (
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"google.golang.org/grpc"
+	grpccredentials "google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/rest"
 	"k8s.io/klog/v2"
 )
@@ -35,20 +36,158 @@ const (
 	AllMode Mode = "all"
 )
 
-const (
-	// DriverName is the official name for the Exoscale CSI plugin
-	DriverName      = "csi.exoscale.com"
+// DefaultDriverName is the official name for the Exoscale CSI plugin
+const DefaultDriverName = "csi.exoscale.com"
+
+var (
+	// DriverName is the name of the plugin, DefaultDriverName unless overridden with DriverConfig.DriverName.
+	DriverName      = DefaultDriverName
 	ZoneTopologyKey = "topology." + DriverName + "/zone"
+	// RegionTopologyKey is a coarser topology segment grouping the zones of a same location, e.g. at-vie.
+	RegionTopologyKey = "topology." + DriverName + "/region"
 )
 
 // DriverConfig is used to configure a new Driver
 type DriverConfig struct {
+	// DriverName overrides DefaultDriverName, e.g. to install two versions of the driver side by side.
+	DriverName string
+
 	Endpoint     string
 	Prefix       string
 	Mode         Mode
 	Credentials  *credentials.Credentials
 	RestConfig   *rest.Config
 	ZoneEndpoint v3.Endpoint
+
+	// ZoneEndpoints overrides the API endpoints of the zones returned by the API.
+	ZoneEndpoints ZoneEndpoints
+
+	// APICAFile is a PEM bundle of CA certificates trusted by the API clients besides the system ones.
+	APICAFile string
+
+	// NodeID and Zone are the instance ID and zone of the node, discovered from the metadata if empty.
+	NodeID string
+	Zone   string
+	// NodeName is the name of the Kubernetes Node of the driver, resolving the node metadata when it can't be discovered.
+	NodeName string
+
+	// ControllerZone is the default zone of the controller, the zone of the node if empty.
+	// In controller mode, it skips the metadata discovery like SkipNodeMetadata.
+	ControllerZone string
+	// SkipNodeMetadata skips the metadata discovery in controller mode, the controller zone or the zone must be set.
+	SkipNodeMetadata bool
+
+	// Volume sizing policy, zero values fall back to the driver defaults.
+	MinVolumeSizeGiB     int64
+	MaxVolumeSizeGiB     int64
+	DefaultVolumeSizeGiB int64
+
+	// MaxVolumesPerNode is the maximum number of block storage volumes attached to an instance,
+	// zero falls back to the driver default.
+	MaxVolumesPerNode int64
+
+	// Templates used to name the volumes and snapshots, empty values fall back to the defaults.
+	VolumeNameTemplate   string
+	SnapshotNameTemplate string
+
+	FeatureGates FeatureGates
+
+	// Exoscale operations settings, zero values fall back to the driver defaults.
+	OperationTimeout      time.Duration
+	OperationPollInterval time.Duration
+
+	// Client-side rate limiting of the Exoscale API requests, disabled if APIQPS is zero.
+	APIQPS   float64
+	APIBurst int
+
+	// ListCacheTTL is the duration during which the ListVolumes and ListSnapshots results are reused, disabled if zero.
+	ListCacheTTL time.Duration
+
+	// AttachmentReconcileInterval is the interval at which the volumes of the VolumeAttachments attached
+	// to deleted instances are detached, disabled if zero. It requires RestConfig.
+	AttachmentReconcileInterval time.Duration
+
+	// PVCLabelSyncInterval is the interval at which the PVCLabelSyncKeys labels of the PVCs
+	// are copied onto their volume, disabled if zero. It requires RestConfig.
+	PVCLabelSyncInterval time.Duration
+	PVCLabelSyncKeys     []string
+
+	// FSFreeze enables the coordination of the filesystem freezes between the controller and the nodes
+	// for the snapshots with the fsFreeze parameter. It requires RestConfig.
+	FSFreeze bool
+
+	// DefaultFSType is the filesystem type of the volumes provisioned without filesystem type, ext4 if empty.
+	// It is recorded in the volume context, the volumes staged without it keep the filesystem on their device.
+	DefaultFSType string
+
+	// DefaultMountOptions are added to the mount options of the filesystems unless they override them.
+	DefaultMountOptions []string
+
+	// MountPropagation is the propagation required for the staging and publishing mounts, shared if empty.
+	MountPropagation MountPropagation
+
+	// AllowLazyUnmount enables detaching the targets still busy after the unmount retries,
+	// so that a stuck process doesn't block the node drains.
+	AllowLazyUnmount bool
+
+	// XFSRepair enables running xfs_repair -L on the xfs filesystems which fail to mount because of their dirty log.
+	XFSRepair bool
+
+	// FstrimInterval is the interval at which the node trims the filesystems of the volumes, disabled if zero.
+	FstrimInterval time.Duration
+
+	// UsageCheckInterval is the interval at which the node checks the usage of the filesystems of the volumes,
+	// disabled if zero. It requires KubeletDir and RestConfig.
+	UsageCheckInterval time.Duration
+	// UsageThreshold and InodesUsageThreshold are the percentages of the space and inodes of a filesystem
+	// above which the node emits an event on the PVC of the volume, zero disables the check of the resource.
+	UsageThreshold       float64
+	InodesUsageThreshold float64
+
+	// DeviceRemovalWatch enables the watch of the devices removed while their volume is staged,
+	// reported abnormal and with an event on their PVC, and their staging path unmounted with DeviceRemovalCleanup.
+	// It requires KubeletDir, the events require RestConfig.
+	DeviceRemovalWatch   bool
+	DeviceRemovalCleanup bool
+
+	// KubeletDir is the root directory of the kubelet, in which the node looks for the orphaned staging paths at startup,
+	// disabled if empty.
+	KubeletDir string
+
+	// DeviceWaitTimeout is the maximum duration to wait for the device of a volume to appear on the node,
+	// zero falls back to the driver default.
+	DeviceWaitTimeout time.Duration
+
+	// MetricsAddress is the address to serve the Prometheus metrics on, disabled if empty.
+	MetricsAddress string
+	// HTTPEndpoint is the address to serve the /healthz and /readyz endpoints on, disabled if empty.
+	HTTPEndpoint string
+
+	// TLSCertFile and TLSKeyFile serve the CSI endpoint over TLS, the client certificates are verified
+	// against TLSClientCAFile if set (mTLS). Meant for the tcp endpoints.
+	TLSCertFile     string
+	TLSKeyFile      string
+	TLSClientCAFile string
+
+	// DefaultRPCTimeout cancels the RPCs running for longer, unless the caller set an earlier deadline, disabled if 0.
+	DefaultRPCTimeout time.Duration
+
+	// LogVerbosity raises the verbosity of the logs of subsystems, it can be updated at runtime on the HTTP endpoint.
+	LogVerbosity LogVerbosity
+
+	// ShutdownTimeout bounds the wait for the in-flight RPCs on shutdown, they are canceled after it, 0 waits forever.
+	ShutdownTimeout time.Duration
+
+	// CredentialsFile is the file, or directory of the mounted Secret, of the Exoscale API credentials
+	// replacing Credentials, reloaded by the controller when it changes.
+	CredentialsFile string
+	// CredentialsSecret is the <namespace>/<name> Secret of the Exoscale API credentials replacing Credentials,
+	// read through the Kubernetes API and reloaded by the controller when it changes.
+	CredentialsSecret string
+
+	// MockDiskUtils replaces the devices and mounts of the node with in-memory ones, for local development.
+	// It requires the driver to be built with the mockdiskutils build tag.
+	MockDiskUtils bool
 }
 
 // Driver implements the interfaces csi.IdentityServer, csi.ControllerServer and csi.NodeServer
@@ -58,110 +197,200 @@ type Driver struct {
 	config *DriverConfig
 
 	srv *grpc.Server
+	// serving is set while srv is serving the CSI RPCs, reported by the health endpoints and service.
+	serving atomic.Bool
+	health  *health.Server
+	// rpcs is canceled by cancelRPCs to cancel the in-flight RPCs at the shutdown timeout.
+	rpcs       context.Context
+	cancelRPCs context.CancelCauseFunc
 	csi.UnimplementedIdentityServer
 }
 
 // NewDriver returns a CSI plugin
 func NewDriver(config *DriverConfig) (*Driver, error) {
+	if config.DriverName != "" {
+		if err := validateDriverName(config.DriverName); err != nil {
+			return nil, fmt.Errorf("new driver name: %w", err)
+		}
+		setDriverName(config.DriverName)
+	}
+
 	klog.Infof("driver: %s version: %s", DriverName, buildinfo.Version)
-	nodeMeta, err := getExoscaleNodeMetadataFromCdRom()
+	if len(config.LogVerbosity) > 0 {
+		if _, err := updateLogVerbosity(config.LogVerbosity); err != nil {
+			return nil, fmt.Errorf("new driver log verbosity: %w", err)
+		}
+	}
+
+	nodeMeta, err := getNodeMetadata(config)
 	if err != nil {
-		klog.Warningf("error to get exoscale node metadata from CD-ROM: %v", err)
-		klog.Info("fallback on server metadata")
-		nodeMeta, err = getExoscaleNodeMetadataFromServer()
+		return nil, fmt.Errorf("new driver get metadata: %w", err)
+	}
+
+	if err := validateFSType(config.DefaultFSType); err != nil {
+		return nil, fmt.Errorf("new driver default filesystem type: %w", err)
+	}
+	if _, err := validateMountOptions(config.DefaultMountOptions); err != nil {
+		return nil, fmt.Errorf("new driver default mount options: %w", err)
+	}
+
+	if config.CredentialsFile != "" && config.CredentialsSecret != "" {
+		return nil, fmt.Errorf("new driver: credentials file and Secret are mutually exclusive")
+	}
+	if config.CredentialsFile != "" && config.Mode != NodeMode {
+		creds, err := readCredentialsFile(config.CredentialsFile)
 		if err != nil {
-			klog.Errorf("error to get exoscale node metadata from server: %v", err)
-			return nil, fmt.Errorf("new driver get metadata: %w", err)
+			return nil, fmt.Errorf("new driver credentials file: %w", err)
 		}
+		config.Credentials = credentials.NewStaticCredentials(creds.APIKey, creds.APISecret)
+	}
+	if config.CredentialsSecret != "" && config.Mode != NodeMode {
+		creds, err := getCredentialsSecret(config)
+		if err != nil {
+			return nil, fmt.Errorf("new driver credentials Secret: %w", err)
+		}
+		config.Credentials = credentials.NewStaticCredentials(creds.APIKey, creds.APISecret)
 	}
 
 	driver := &Driver{
 		config: config,
 	}
+	driver.rpcs, driver.cancelRPCs = context.WithCancelCause(context.Background())
 
 	// Node Mode is not using client API.
 	// Config API credentials are not provided.
 	if config.Mode == NodeMode {
-		driver.nodeService = newNodeService(nodeMeta)
+		diskUtils, err := newNodeDiskUtils(config)
+		if err != nil {
+			return nil, fmt.Errorf("new driver: %w", err)
+		}
+		driver.nodeService = newNodeService(nodeMeta, config, diskUtils)
 		return driver, nil
 	}
 
-	var client *v3.Client
-	if config.ZoneEndpoint != "" {
-		client, err = v3.NewClient(config.Credentials,
-			v3.ClientOptWithEndpoint(config.ZoneEndpoint),
-		)
-	} else {
-		client, err = v3.NewClient(config.Credentials)
+	clientOpts, err := newAPIClientOpts(config)
+	if err != nil {
+		return nil, fmt.Errorf("new driver: %w", err)
 	}
+
+	client, err := v3.NewClient(config.Credentials, clientOpts...)
 	if err != nil {
 		return nil, fmt.Errorf("new driver: %w", err)
 	}
 
-	// Setup the client with the same zone endpoint as the node zone.
-	endpoint, err := client.GetZoneAPIEndpoint(context.Background(), nodeMeta.zoneName)
+	// The controller zone overrides the node zone as default zone of the controller in all mode.
+	controllerMeta := nodeMeta
+	if config.ControllerZone != "" {
+		controllerMeta = &nodeMetadata{zoneName: v3.ZoneName(config.ControllerZone), InstanceID: nodeMeta.InstanceID}
+	}
+
+	// Setup the client with the same zone endpoint as the controller zone.
+	client, err = newClientZone(context.Background(), client, controllerMeta.zoneName, config.ZoneEndpoints)
 	if err != nil {
 		return nil, fmt.Errorf("new driver: %w", err)
 	}
-	client = client.WithEndpoint(endpoint)
 
 	switch config.Mode {
 	case ControllerMode:
-		driver.controllerService = newControllerService(client, nodeMeta)
+		driver.controllerService, err = newControllerService(client, clientOpts, controllerMeta, config)
 	case AllMode:
-		driver.controllerService = newControllerService(client, nodeMeta)
-		driver.nodeService = newNodeService(nodeMeta)
+		driver.controllerService, err = newControllerService(client, clientOpts, controllerMeta, config)
+		if err != nil {
+			break
+		}
+		var diskUtils DiskUtils
+		diskUtils, err = newNodeDiskUtils(config)
+		driver.nodeService = newNodeService(nodeMeta, config, diskUtils)
 	default:
 		return nil, fmt.Errorf("unknown mode for driver: %s", config.Mode)
 	}
+	if err != nil {
+		return nil, fmt.Errorf("new driver: %w", err)
+	}
 
 	return driver, nil
 }
 
-// Run starts the CSI plugin on the given endpoint
-func (d *Driver) Run() error {
-	endpointURL, err := url.Parse(d.config.Endpoint)
+// newAPIClientOpts returns the options of the Exoscale API clients of the config.
+func newAPIClientOpts(config *DriverConfig) ([]v3.ClientOpt, error) {
+	transport, err := newAPITransport(config.APICAFile)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("API transport: %w", err)
 	}
 
-	if endpointURL.Scheme != "unix" {
-		klog.Errorf("only unix domain sockets are supported, not %s", endpointURL.Scheme)
-		return fmt.Errorf("errSchemeNotSupported")
+	clientOpts := []v3.ClientOpt{v3.ClientOptWithHTTPClient(newAPIMetricsHTTPClient(transport))}
+	if config.ZoneEndpoint != "" {
+		if err := validateAPIEndpoint(string(config.ZoneEndpoint)); err != nil {
+			return nil, err
+		}
+		clientOpts = append(clientOpts, v3.ClientOptWithEndpoint(config.ZoneEndpoint))
+	}
+	if config.APIQPS > 0 {
+		clientOpts = append(clientOpts, v3.ClientOptWithRequestInterceptors(
+			newRateLimitInterceptor(config.APIQPS, config.APIBurst),
+		))
 	}
 
-	addr := path.Join(endpointURL.Host, filepath.FromSlash(endpointURL.Path))
+	return clientOpts, nil
+}
 
-	klog.Infof("Removing existing socket if existing")
-	if err := os.Remove(addr); err != nil && !os.IsNotExist(err) {
-		klog.Errorf("error removing existing socket")
-		return fmt.Errorf("errRemovingSocket")
+// newNodeDiskUtils returns the DiskUtils of the node, the in-memory one if config.MockDiskUtils is set.
+func newNodeDiskUtils(config *DriverConfig) (DiskUtils, error) {
+	if config.MockDiskUtils {
+		klog.Warning("mock DiskUtils enabled, the volumes are neither attached, formatted nor mounted on the node")
+		return newMockDiskUtils()
 	}
 
-	dir := filepath.Dir(addr)
-	if _, err := os.Stat(dir); os.IsNotExist(err) {
-		err = os.MkdirAll(dir, os.ModePerm)
-		if err != nil {
-			return err
-		}
-	}
+	return newDiskUtils(config), nil
+}
 
-	listener, err := net.Listen(endpointURL.Scheme, addr)
+// Run starts the CSI plugin on the given endpoint
+func (d *Driver) Run() error {
+	listener, err := listen(d.config.Endpoint)
 	if err != nil {
 		return err
 	}
 
-	// log error through a grpc unary interceptor
+	// log error through a grpc unary interceptor,
+	// converting them to gRPC status errors for all the RPCs.
+	// The handlers log through the logger of the context, carrying the RPC name and its volume.
+	// The requests and responses are logged at high verbosity, with their secrets redacted.
 	logErrorHandler := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		start := time.Now()
+		logger := rpcLogger(ctx, info.FullMethod, req)
+		ctx = klog.NewContext(ctx, logger)
+		if v := logger.V(rpcLogVerbosity); v.Enabled() {
+			v.Info("request", "request", sanitizeMessage(req))
+		}
 		resp, err := handler(ctx, req)
 		if err != nil {
-			klog.Errorf("error for %s: %v", info.FullMethod, err)
+			logger.Error(err, "RPC failed")
+		} else if v := logger.V(rpcLogVerbosity); v.Enabled() {
+			v.Info("response", "response", sanitizeMessage(resp))
 		}
+		err = errToStatus(err)
+		observeRPC(info.FullMethod, status.Code(err), start)
 		return resp, err
 	}
 
+	interceptors := []grpc.UnaryServerInterceptor{logErrorHandler, newShutdownInterceptor(d.rpcs)}
+	if d.config.DefaultRPCTimeout > 0 {
+		interceptors = append(interceptors, newTimeoutInterceptor(d.config.DefaultRPCTimeout))
+	}
+
 	opts := []grpc.ServerOption{
-		grpc.UnaryInterceptor(logErrorHandler),
+		grpc.ChainUnaryInterceptor(interceptors...),
+	}
+
+	if d.config.TLSCertFile != "" || d.config.TLSKeyFile != "" || d.config.TLSClientCAFile != "" {
+		tlsConfig, err := serverTLSConfig(d.config.TLSCertFile, d.config.TLSKeyFile, d.config.TLSClientCAFile)
+		if err != nil {
+			listener.Close()
+			return err
+		}
+		opts = append(opts, grpc.Creds(grpccredentials.NewTLS(tlsConfig)))
+	} else if listener.Addr().Network() == "tcp" {
+		klog.Warningf("CSI endpoint %s served over plain TCP, set --tls-cert-file and --tls-key-file to encrypt it", listener.Addr())
 	}
 
 	d.srv = grpc.NewServer(opts...)
@@ -181,15 +410,107 @@ func (d *Driver) Run() error {
 
 	}
 
+	d.registerHealthServer()
+
 	// graceful shutdown
 	gracefulStop := make(chan os.Signal, 1)
 	signal.Notify(gracefulStop, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
 		<-gracefulStop
-		d.srv.GracefulStop()
+		d.shutdown(d.config.ShutdownTimeout)
 	}()
 
+	if d.config.MetricsAddress != "" {
+		go serveMetrics(d.config.MetricsAddress)
+	}
+
+	if d.config.HTTPEndpoint != "" {
+		go d.serveHealth(d.config.HTTPEndpoint)
+	}
+
+	if d.config.Mode != NodeMode && d.config.CredentialsFile != "" {
+		creds, err := d.config.Credentials.Get()
+		if err != nil {
+			return fmt.Errorf("credentials watcher: %w", err)
+		}
+		go d.controllerService.runCredentialsWatcher(context.Background(), d.config.CredentialsFile, creds)
+	}
+
+	if d.config.Mode != NodeMode && d.config.CredentialsSecret != "" {
+		creds, err := d.config.Credentials.Get()
+		if err != nil {
+			return fmt.Errorf("credentials Secret sync: %w", err)
+		}
+		secretPath, err := parseCredentialsSecret(d.config.CredentialsSecret)
+		if err != nil {
+			return fmt.Errorf("credentials Secret sync: %w", err)
+		}
+		kube, err := newKubeClient(d.config.RestConfig)
+		if err != nil {
+			return fmt.Errorf("credentials Secret sync: %w", err)
+		}
+		go d.controllerService.runCredentialsSecretSync(context.Background(), kube, secretPath, creds)
+	}
+
+	if d.config.Mode != NodeMode && d.config.AttachmentReconcileInterval > 0 {
+		kube, err := newKubeClient(d.config.RestConfig)
+		if err != nil {
+			return fmt.Errorf("attachment reconciler: %w", err)
+		}
+		go d.controllerService.runAttachmentReconciler(context.Background(), kube, d.config.AttachmentReconcileInterval)
+	}
+
+	if d.config.Mode != NodeMode && d.config.PVCLabelSyncInterval > 0 && len(d.config.PVCLabelSyncKeys) > 0 {
+		kube, err := newKubeClient(d.config.RestConfig)
+		if err != nil {
+			return fmt.Errorf("PVC label sync: %w", err)
+		}
+		go d.controllerService.runPVCLabelSync(context.Background(), kube, d.config.PVCLabelSyncKeys, d.config.PVCLabelSyncInterval)
+	}
+
+	if d.config.Mode != ControllerMode && d.config.KubeletDir != "" {
+		if err := d.nodeService.cleanupOrphanedStagingPaths(d.config.KubeletDir); err != nil {
+			klog.Errorf("clean up orphaned staging paths: %v", err)
+		}
+		if err := d.nodeService.restorePublications(d.config.KubeletDir); err != nil {
+			klog.Errorf("restore volume publications: %v", err)
+		}
+	}
+
+	if d.config.Mode != ControllerMode && d.config.FstrimInterval > 0 {
+		go d.nodeService.runFstrim(context.Background(), d.config.FstrimInterval)
+	}
+
+	if d.config.Mode != ControllerMode && d.config.FSFreeze {
+		kube, err := newKubeClient(d.config.RestConfig)
+		if err != nil {
+			return fmt.Errorf("filesystem freeze: %w", err)
+		}
+		go d.nodeService.runFreezeAgent(context.Background(), kube)
+	}
+
+	if d.config.Mode != ControllerMode && d.config.UsageCheckInterval > 0 && d.config.KubeletDir != "" {
+		kube, err := newKubeClient(d.config.RestConfig)
+		if err != nil {
+			return fmt.Errorf("volume usage watcher: %w", err)
+		}
+		thresholds := usageThresholds{bytes: d.config.UsageThreshold, inodes: d.config.InodesUsageThreshold}
+		go d.nodeService.runUsageWatcher(context.Background(), kube, d.config.KubeletDir, thresholds, d.config.UsageCheckInterval)
+	}
+
+	if d.config.Mode != ControllerMode && d.config.DeviceRemovalWatch && d.config.KubeletDir != "" {
+		var kube *kubeClient
+		if d.config.RestConfig != nil {
+			if kube, err = newKubeClient(d.config.RestConfig); err != nil {
+				return fmt.Errorf("device removal watcher: %w", err)
+			}
+		}
+		go d.nodeService.runDeviceRemovalWatcher(context.Background(), kube, d.config.KubeletDir, d.config.DeviceRemovalCleanup)
+	}
+
 	klog.Infof("CSI server started on %s", d.config.Endpoint)
+	d.setServing(true)
+	defer d.setServing(false)
 	return d.srv.Serve(listener)
 }
 
@@ -198,9 +519,116 @@ type nodeMetadata struct {
 	InstanceID v3.UUID
 }
 
-func getExoscaleNodeMetadataFromServer() (*nodeMetadata, error) {
-	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(time.Minute))
-	defer cancel()
+// getNodeMetadata returns the node metadata set in the config,
+// or else discovered from the CD-ROM, falling back on the metadata server and then on the Kubernetes Node.
+// The controller only needs a default zone and skips the discovery when its zone is set.
+func getNodeMetadata(config *DriverConfig) (*nodeMetadata, error) {
+	if config.SkipNodeMetadata && config.Mode != ControllerMode {
+		return nil, fmt.Errorf("the metadata discovery can only be skipped in %s mode", ControllerMode)
+	}
+	if config.Mode == ControllerMode && (config.SkipNodeMetadata || config.ControllerZone != "") {
+		return newControllerMetadata(config.ControllerZone, config.Zone)
+	}
+
+	if config.NodeID != "" || config.Zone != "" {
+		return newNodeMetadata(config.NodeID, config.Zone)
+	}
+
+	nodeMeta, err := getExoscaleNodeMetadataFromCdRom()
+	if err != nil {
+		klog.Warningf("error to get exoscale node metadata from CD-ROM: %v", err)
+		klog.Info("fallback on server metadata")
+		nodeMeta, err = getExoscaleNodeMetadataFromServerWithRetry(getExoscaleNodeMetadataFromServer)
+		if err != nil {
+			klog.Errorf("error to get exoscale node metadata from server: %v", err)
+			if config.NodeName == "" {
+				return nil, err
+			}
+
+			klog.Infof("fallback on the Kubernetes Node %s", config.NodeName)
+			nodeMeta, err = getNodeMetadataFromKube(config)
+			if err != nil {
+				klog.Errorf("error to get exoscale node metadata from the Kubernetes Node: %v", err)
+				return nil, err
+			}
+		}
+	}
+
+	return nodeMeta, nil
+}
+
+// newControllerMetadata returns the metadata of a controller running without Exoscale metadata,
+// e.g. on a managed control plane, its default zone is the controller zone, or else the zone.
+func newControllerMetadata(controllerZone, zone string) (*nodeMetadata, error) {
+	if controllerZone == "" {
+		controllerZone = zone
+	}
+	if controllerZone == "" {
+		return nil, fmt.Errorf("the controller zone must be set to skip the metadata discovery")
+	}
+
+	klog.Infof("using zone %s as the default zone of the controller instead of the metadata", controllerZone)
+
+	return &nodeMetadata{zoneName: v3.ZoneName(controllerZone)}, nil
+}
+
+// newNodeMetadata returns the node metadata of the instance ID and zone set by the user,
+// both are required to skip the metadata discovery.
+func newNodeMetadata(instanceID, zone string) (*nodeMetadata, error) {
+	if instanceID == "" || zone == "" {
+		return nil, fmt.Errorf("both the node ID and the zone must be set to skip the metadata discovery")
+	}
+
+	id, err := v3.ParseUUID(instanceID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid node ID %q: %w", instanceID, err)
+	}
+
+	klog.Infof("using node ID %s and zone %s instead of the metadata", id, zone)
+
+	return &nodeMetadata{
+		zoneName:   v3.ZoneName(zone),
+		InstanceID: id,
+	}, nil
+}
+
+// metadataServerBackoff is the backoff between the metadata server lookups,
+// which may fail transiently on a freshly booted instance.
+var metadataServerBackoff = wait.Backoff{
+	Duration: time.Second,
+	Factor:   2,
+	Jitter:   0.1,
+	Steps:    5,
+}
+
+// metadataServerTimeout is the timeout of each metadata server lookup, so that an unreachable
+// server doesn't delay the fallback on the Kubernetes Node by more than a few seconds per lookup.
+const metadataServerTimeout = 5 * time.Second
+
+// getExoscaleNodeMetadataFromServerWithRetry gets the node metadata with lookup,
+// retrying with metadataServerBackoff. The error of the last lookup is returned if they all failed.
+func getExoscaleNodeMetadataFromServerWithRetry(lookup func(ctx context.Context) (*nodeMetadata, error)) (*nodeMetadata, error) {
+	var nodeMeta *nodeMetadata
+	var lastErr error
+	err := wait.ExponentialBackoff(metadataServerBackoff, func() (bool, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), metadataServerTimeout)
+		defer cancel()
+
+		nodeMeta, lastErr = lookup(ctx)
+		if lastErr != nil {
+			klog.Warningf("error to get exoscale node metadata from server, retrying: %v", lastErr)
+			return false, nil
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, lastErr
+	}
+
+	return nodeMeta, nil
+}
+
+func getExoscaleNodeMetadataFromServer(ctx context.Context) (*nodeMetadata, error) {
 	zone, err := metadata.Get(ctx, metadata.AvailabilityZone)
 	if err != nil {
 		return nil, err
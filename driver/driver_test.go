@@ -0,0 +1,54 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+func TestGetExoscaleNodeMetadataFromServerWithRetry(t *testing.T) {
+	backoff := metadataServerBackoff
+	metadataServerBackoff = wait.Backoff{Duration: time.Millisecond, Steps: 3}
+	t.Cleanup(func() { metadataServerBackoff = backoff })
+
+	errUnreachable := errors.New("metadata server unreachable")
+	nodeMeta := &nodeMetadata{zoneName: "ch-gva-2", InstanceID: "3b8f4e0c-4c1a-4f6b-9d4e-2f1c5b6a7d8e"}
+
+	testsBench := []struct {
+		name     string
+		failures int
+		attempts int
+		res      *nodeMetadata
+		err      error
+	}{
+		{name: "first lookup", failures: 0, attempts: 1, res: nodeMeta},
+		{name: "transient failures", failures: 2, attempts: 3, res: nodeMeta},
+		{name: "unreachable", failures: 3, attempts: 3, err: errUnreachable},
+	}
+
+	for _, test := range testsBench {
+		t.Run(test.name, func(t *testing.T) {
+			attempts := 0
+			res, err := getExoscaleNodeMetadataFromServerWithRetry(func(ctx context.Context) (*nodeMetadata, error) {
+				attempts++
+
+				// Every lookup has its own short deadline rather than sharing a long one.
+				deadline, ok := ctx.Deadline()
+				require.True(t, ok)
+				require.LessOrEqual(t, time.Until(deadline), metadataServerTimeout)
+
+				if attempts <= test.failures {
+					return nil, errUnreachable
+				}
+				return nodeMeta, nil
+			})
+			require.Equal(t, test.attempts, attempts)
+			require.Equal(t, test.res, res)
+			require.ErrorIs(t, err, test.err)
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package driver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+
+	"k8s.io/klog/v2"
+)
+
+// listen returns the listener of the CSI endpoint, either a unix socket, replacing an existing one,
+// or a TCP address, e.g. unix:///csi/csi.sock or tcp://0.0.0.0:10000.
+func listen(endpoint string) (net.Listener, error) {
+	endpointURL, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	switch endpointURL.Scheme {
+	case "unix":
+		addr := path.Join(endpointURL.Host, filepath.FromSlash(endpointURL.Path))
+
+		klog.Infof("Removing existing socket if existing")
+		if err := os.Remove(addr); err != nil && !os.IsNotExist(err) {
+			klog.Errorf("error removing existing socket")
+			return nil, fmt.Errorf("errRemovingSocket")
+		}
+
+		dir := filepath.Dir(addr)
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			err = os.MkdirAll(dir, os.ModePerm)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return net.Listen("unix", addr)
+	case "tcp":
+		if endpointURL.Host == "" {
+			return nil, fmt.Errorf("tcp endpoint %s without address", endpoint)
+		}
+		return net.Listen("tcp", endpointURL.Host)
+	default:
+		klog.Errorf("only unix domain sockets and tcp are supported, not %s", endpointURL.Scheme)
+		return nil, fmt.Errorf("errSchemeNotSupported")
+	}
+}
+
+// serverTLSConfig returns the TLS configuration of the CSI server with the certificate and key files,
+// requiring and verifying the client certificates against the CA file if set (mTLS).
+func serverTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load TLS certificate: %w", err)
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if clientCAFile != "" {
+		pem, err := os.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read client CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in client CA %s", clientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return config, nil
+}
@@ -0,0 +1,167 @@
+package driver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestListen(t *testing.T) {
+	dir := t.TempDir()
+
+	testsBench := []struct {
+		name     string
+		endpoint string
+		network  string
+		wantErr  bool
+	}{
+		{
+			name:     "unix socket",
+			endpoint: "unix://" + filepath.Join(dir, "csi", "csi.sock"),
+			network:  "unix",
+		},
+		{
+			name:     "unix socket replacing an existing one",
+			endpoint: "unix://" + filepath.Join(dir, "csi", "csi.sock"),
+			network:  "unix",
+		},
+		{
+			name:     "tcp address",
+			endpoint: "tcp://127.0.0.1:0",
+			network:  "tcp",
+		},
+		{
+			name:     "tcp without address",
+			endpoint: "tcp://",
+			wantErr:  true,
+		},
+		{
+			name:     "unsupported scheme",
+			endpoint: "http://127.0.0.1:0",
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range testsBench {
+		t.Run(tt.name, func(t *testing.T) {
+			listener, err := listen(tt.endpoint)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.network, listener.Addr().Network())
+			// Keep the unix socket file to check it is replaced.
+			if l, ok := listener.(*net.UnixListener); ok {
+				l.SetUnlinkOnClose(false)
+			}
+			require.NoError(t, listener.Close())
+		})
+	}
+}
+
+// writeTestCertificate writes a self-signed certificate valid for 127.0.0.1 and its key in dir.
+func writeTestCertificate(t *testing.T, dir, name string) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+
+	return certFile, keyFile
+}
+
+func TestServerTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	serverCert, serverKey := writeTestCertificate(t, dir, "server")
+	clientCert, clientKey := writeTestCertificate(t, dir, "client")
+
+	config, err := serverTLSConfig(serverCert, serverKey, "")
+	require.NoError(t, err)
+	require.Equal(t, tls.NoClientCert, config.ClientAuth)
+
+	_, err = serverTLSConfig(serverCert, "", "")
+	require.Error(t, err)
+
+	_, err = serverTLSConfig(serverCert, serverKey, filepath.Join(dir, "missing.crt"))
+	require.Error(t, err)
+
+	_, err = serverTLSConfig(serverCert, serverKey, serverKey)
+	require.Error(t, err, "a client CA file without certificate must be rejected")
+
+	config, err = serverTLSConfig(serverCert, serverKey, clientCert)
+	require.NoError(t, err)
+	require.Equal(t, tls.RequireAndVerifyClientCert, config.ClientAuth)
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	serverPEM, err := os.ReadFile(serverCert)
+	require.NoError(t, err)
+	roots := x509.NewCertPool()
+	require.True(t, roots.AppendCertsFromPEM(serverPEM))
+
+	dial := func(certificates []tls.Certificate) error {
+		conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{RootCAs: roots, Certificates: certificates})
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		// The server verifies the client certificate after the client handshake returned, read its answer.
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		return err
+	}
+
+	err = dial(nil)
+	require.Error(t, err)
+	require.ErrorContains(t, err, "certificate required")
+
+	cert, err := tls.LoadX509KeyPair(clientCert, clientKey)
+	require.NoError(t, err)
+	err = dial([]tls.Certificate{cert})
+	require.ErrorContains(t, err, "EOF", "the handshake must succeed and the server close the connection")
+}
@@ -1,6 +1,17 @@
 package driver
 
-import "errors"
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	kmount "k8s.io/mount-utils"
+
+	v3 "github.com/exoscale/egoscale/v3"
+)
 
 var (
 	errLimitLessThanRequiredBytes      = errors.New("limit size is less than required size")
@@ -9,3 +20,137 @@ var (
 	errRequiredBytesGreaterThanMaximun = errors.New("required size is greater than the maximum size")
 	errLimitGreaterThanMaximum         = errors.New("limit size is greater than the maximum size")
 )
+
+// operationErrorDomain is the domain of the error details attached to the failed operations statuses.
+const operationErrorDomain = "exoscale.com"
+
+// apiErrorCodes maps the Exoscale API errors to the gRPC codes returned to the CO.
+var apiErrorCodes = []struct {
+	err  error
+	code codes.Code
+}{
+	{v3.ErrNotFound, codes.NotFound},
+	{v3.ErrBadRequest, codes.InvalidArgument},
+	{v3.ErrUnprocessableEntity, codes.InvalidArgument},
+	{v3.ErrConflict, codes.Aborted},
+	{v3.ErrLocked, codes.Aborted},
+	{v3.ErrPreconditionFailed, codes.FailedPrecondition},
+	{v3.ErrUnauthorized, codes.Unauthenticated},
+	{v3.ErrForbidden, codes.PermissionDenied},
+	{v3.ErrTooManyRequests, codes.Unavailable},
+	{v3.ErrServiceUnavailable, codes.Unavailable},
+	{v3.ErrBadGateway, codes.Unavailable},
+	{v3.ErrGatewayTimeout, codes.Unavailable},
+	{context.DeadlineExceeded, codes.DeadlineExceeded},
+	{context.Canceled, codes.Canceled},
+}
+
+// mountErrorCauses classifies the errors of formatting and mounting a device by the mount-utils error type
+// or the messages of mkfs, mount and the kernel, with the gRPC code and the cause reported to the users.
+// The first matching cause wins.
+var mountErrorCauses = []struct {
+	errorType kmount.MountErrorType
+	messages  []string
+	code      codes.Code
+	cause     string
+}{
+	{
+		errorType: kmount.FilesystemMismatch,
+		code:      codes.FailedPrecondition,
+		cause:     "the device is already formatted with another filesystem, fix the fsType of the StorageClass or the volume",
+	},
+	{
+		errorType: kmount.UnformattedReadOnly,
+		messages:  []string{"Read-only file system", "write-protected"},
+		code:      codes.FailedPrecondition,
+		cause:     "the device is read-only, detach the volume and check it isn't attached read-only",
+	},
+	{
+		messages: []string{"Device or resource busy", "already mounted or mount point busy", "apparently in use by the system"},
+		code:     codes.Unavailable,
+		cause:    "the device is busy, it may still be mounted or opened by another process on the node",
+	},
+	{
+		messages: []string{"unknown filesystem type"},
+		code:     codes.FailedPrecondition,
+		cause:    "the kernel of the node doesn't support the filesystem, load its module or change the fsType",
+	},
+	{
+		errorType: kmount.HasFilesystemErrors,
+		messages:  []string{"can't read superblock", "Structure needs cleaning"},
+		code:      codes.FailedPrecondition,
+		cause:     "the filesystem is corrupted, repair it with fsck or restore the volume from a snapshot",
+	},
+	{
+		messages: []string{"wrong fs type, bad option, bad superblock"},
+		code:     codes.Internal,
+		cause:    "the filesystem failed to mount, check the mount options of the StorageClass and the kernel log of the node",
+	},
+}
+
+// mountErrorStatus returns the status error of the failure to format and mount a device, msg describing the operation,
+// with the cause of the common failures for the users to tell from the events of the PVC what to do next.
+// Unclassified errors are Internal errors.
+func mountErrorStatus(err error, msg string) error {
+	var mountErr kmount.MountError
+	hasType := errors.As(err, &mountErr)
+
+	for _, c := range mountErrorCauses {
+		matches := hasType && c.errorType != "" && mountErr.Type == c.errorType
+		for _, message := range c.messages {
+			matches = matches || strings.Contains(err.Error(), message)
+		}
+		if matches {
+			return status.Errorf(c.code, "%s: %s: %v", msg, c.cause, err)
+		}
+	}
+
+	return status.Errorf(codes.Internal, "%s: %v", msg, err)
+}
+
+// errToStatus converts an error returned by an RPC to a gRPC status error,
+// errors which already are gRPC status errors are returned unchanged.
+// Exoscale API errors are mapped to their gRPC equivalent and other errors to Internal.
+// Failed Exoscale operations are Internal errors detailing the operation ID, reason and message.
+func errToStatus(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+
+	var opErr *operationError
+	if errors.As(err, &opErr) {
+		return operationStatus(err, opErr.op)
+	}
+
+	for _, e := range apiErrorCodes {
+		if errors.Is(err, e.err) {
+			return status.Error(e.code, err.Error())
+		}
+	}
+
+	return status.Error(codes.Internal, err.Error())
+}
+
+// operationStatus returns an Internal status error for the failed operation,
+// with the operation ID, state, reason and message as ErrorInfo details.
+func operationStatus(err error, op *v3.Operation) error {
+	st := status.New(codes.Internal, err.Error())
+	withDetails, detailsErr := st.WithDetails(&errdetails.ErrorInfo{
+		Reason: string(op.Reason),
+		Domain: operationErrorDomain,
+		Metadata: map[string]string{
+			"operationID": op.ID.String(),
+			"state":       string(op.State),
+			"message":     op.Message,
+		},
+	})
+	if detailsErr != nil {
+		return st.Err()
+	}
+
+	return withDetails.Err()
+}
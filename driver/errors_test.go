@@ -0,0 +1,122 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	kmount "k8s.io/mount-utils"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+
+	v3 "github.com/exoscale/egoscale/v3"
+)
+
+func TestErrToStatus(t *testing.T) {
+	testsBench := []struct {
+		err  error
+		code codes.Code
+	}{
+		{err: nil, code: codes.OK},
+		{err: status.Error(codes.OutOfRange, "too large"), code: codes.OutOfRange},
+		{err: fmt.Errorf("get volume: %w: volume not found", v3.ErrNotFound), code: codes.NotFound},
+		{err: fmt.Errorf("%w: invalid size", v3.ErrBadRequest), code: codes.InvalidArgument},
+		{err: fmt.Errorf("%w: operation in progress", v3.ErrConflict), code: codes.Aborted},
+		{err: fmt.Errorf("%w: slow down", v3.ErrTooManyRequests), code: codes.Unavailable},
+		{err: fmt.Errorf("wait: %w", context.DeadlineExceeded), code: codes.DeadlineExceeded},
+		{err: errors.New("mount failed"), code: codes.Internal},
+	}
+
+	for _, test := range testsBench {
+		require.Equal(t, test.code, status.Code(errToStatus(test.err)), test.err)
+	}
+}
+
+func TestErrToStatusOperationDetails(t *testing.T) {
+	op := &v3.Operation{
+		ID:      v3.UUID("8ef6a8a5-9b0b-4c4a-a8b4-6a4c2b3e4d5f"),
+		State:   v3.OperationStateFailure,
+		Reason:  v3.OperationReasonBusy,
+		Message: "volume is attached",
+	}
+	err := fmt.Errorf("wait detach block storage volume: %w", &operationError{op: op})
+
+	st := status.Convert(errToStatus(err))
+	require.Equal(t, codes.Internal, st.Code())
+	require.Equal(t, err.Error(), st.Message())
+	require.Len(t, st.Details(), 1)
+
+	info, ok := st.Details()[0].(*errdetails.ErrorInfo)
+	require.True(t, ok)
+	require.Equal(t, string(v3.OperationReasonBusy), info.Reason)
+	require.Equal(t, operationErrorDomain, info.Domain)
+	require.Equal(t, map[string]string{
+		"operationID": op.ID.String(),
+		"state":       string(v3.OperationStateFailure),
+		"message":     "volume is attached",
+	}, info.Metadata)
+}
+
+func TestMountErrorStatus(t *testing.T) {
+	testsBench := []struct {
+		err   error
+		code  codes.Code
+		cause string
+	}{
+		{
+			err:   kmount.NewMountError(kmount.FilesystemMismatch, "failed to mount the volume as \"ext4\", it already contains xfs"),
+			code:  codes.FailedPrecondition,
+			cause: "already formatted with another filesystem",
+		},
+		{
+			err:   fmt.Errorf("failed to optionnaly format and mount: %w", kmount.NewMountError(kmount.UnformattedReadOnly, "cannot mount unformatted disk /dev/vdb as we are manipulating it in read-only mode")),
+			code:  codes.FailedPrecondition,
+			cause: "the device is read-only",
+		},
+		{
+			err:   errors.New("mount failed: exit status 32\nOutput: mount: /staging: /dev/vdb already mounted or mount point busy."),
+			code:  codes.Unavailable,
+			cause: "the device is busy",
+		},
+		{
+			err:   kmount.NewMountError(kmount.FormatFailed, "format of disk \"/dev/vdb\" failed: output: /dev/vdb is apparently in use by the system; will not make a filesystem here!"),
+			code:  codes.Unavailable,
+			cause: "the device is busy",
+		},
+		{
+			err:   errors.New("mount failed: exit status 32\nOutput: mount: /staging: unknown filesystem type 'f2fs'."),
+			code:  codes.FailedPrecondition,
+			cause: "doesn't support the filesystem",
+		},
+		{
+			err:   kmount.NewMountError(kmount.HasFilesystemErrors, "'fsck' found errors on device /dev/vdb but could not correct them"),
+			code:  codes.FailedPrecondition,
+			cause: "the filesystem is corrupted",
+		},
+		{
+			err:   errors.New("mount failed: exit status 32\nOutput: mount: /staging: can't read superblock on /dev/vdb."),
+			code:  codes.FailedPrecondition,
+			cause: "the filesystem is corrupted",
+		},
+		{
+			err:   errors.New("mount failed: exit status 32\nOutput: mount: /staging: wrong fs type, bad option, bad superblock on /dev/vdb, missing codepage or helper program, or other error."),
+			code:  codes.Internal,
+			cause: "check the mount options",
+		},
+		{
+			err:  errors.New("mount failed: exit status 1"),
+			code: codes.Internal,
+		},
+	}
+
+	for _, test := range testsBench {
+		err := mountErrorStatus(test.err, "format and mount device /dev/vdb")
+		require.Equal(t, test.code, status.Code(err), err)
+		require.ErrorContains(t, err, test.cause)
+		require.ErrorContains(t, err, test.err.Error())
+	}
+}
@@ -0,0 +1,22 @@
+package driver
+
+import (
+	"k8s.io/klog/v2"
+
+	v3 "github.com/exoscale/egoscale/v3"
+)
+
+// growF2FS resizes the unmounted f2fs filesystem of the device to the size of the device,
+// as resize.f2fs can't grow mounted filesystems. Errors are only logged as the volume is usable nevertheless.
+func (d *nodeService) growF2FS(volumeID v3.UUID, devicePath string) {
+	klog.V(4).Infof("growing f2fs filesystem of volume %s on %s", volumeID, devicePath)
+	if err := d.diskUtils.ResizeF2FS(devicePath); err != nil {
+		nodeFailures.WithLabelValues(resizePhase).Inc()
+		klog.Warningf("resize f2fs filesystem of volume %s on %s: %v", volumeID, devicePath, err)
+	}
+}
+
+// ResizeF2FS grows the unmounted f2fs filesystem of the device, nothing is done if it already fills the device.
+func (d *diskUtils) ResizeF2FS(devicePath string) error {
+	return runCommand(nil, "resize.f2fs", devicePath)
+}
@@ -0,0 +1,394 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	v3 "github.com/exoscale/egoscale/v3"
+	"golang.org/x/sys/unix"
+)
+
+// fakeDeviceSize is the size of the fake devices.
+const fakeDeviceSize = 10 * GiB
+
+// fakeDiskUtils is an in-memory DiskUtils simulating the devices and mounts of a node,
+// used by the unit tests and by the node started with --mock-diskutils.
+// It is only referenced by the production code built with the mockdiskutils build tag.
+type fakeDiskUtils struct {
+	mu sync.Mutex
+
+	// attachAll simulates the attachment of every volume looked up, on a device named after its serial.
+	attachAll bool
+	// devices maps the serials of the attached volumes to their device path.
+	devices map[string]string
+	// mounts maps the mount points to their mount.
+	mounts map[string]*mountInfo
+	// readonly holds the read-only state of the devices.
+	readonly map[string]bool
+	// formatted maps the formatted devices to their filesystem type.
+	formatted map[string]string
+	// formatOptions maps the formatted devices to their mkfs options.
+	formatOptions map[string][]string
+	// luks maps the names of the opened encrypted mappings to their path.
+	luks map[string]string
+	// luksResized holds the names of the resized encrypted mappings.
+	luksResized []string
+	// frozen holds the frozen mount points.
+	frozen map[string]bool
+	// stripedVolumes maps the volume groups of the assembled striped volumes to their devices.
+	stripedVolumes map[string][]string
+	// tuned maps the devices tuned with tune2fs to their options.
+	tuned map[string][]string
+	// resized holds the device paths of the resized filesystems.
+	resized    []string
+	needResize bool
+}
+
+func newFakeDiskUtils() *fakeDiskUtils {
+	return &fakeDiskUtils{
+		devices:   make(map[string]string),
+		mounts:    make(map[string]*mountInfo),
+		readonly:  make(map[string]bool),
+		formatted: make(map[string]string),
+		luks:      make(map[string]string),
+		frozen:    make(map[string]bool),
+		tuned:     make(map[string][]string),
+
+		formatOptions:  make(map[string][]string),
+		stripedVolumes: make(map[string][]string),
+	}
+}
+
+// attach simulates the attachment of the volume on devicePath.
+func (f *fakeDiskUtils) attach(volumeID v3.UUID, devicePath string) {
+	f.devices[deviceSerial(volumeID)] = devicePath
+}
+
+func (f *fakeDiskUtils) isDevice(path string) bool {
+	for _, devicePath := range f.devices {
+		if devicePath == path {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *fakeDiskUtils) devicePathBySerial(serial string) (string, error) {
+	devicePath, ok := f.devices[serial]
+	if !ok && f.attachAll {
+		devicePath = filepath.Join("/dev/mock", serial)
+		f.devices[serial] = devicePath
+	} else if !ok {
+		return "", &os.PathError{Op: "find device", Path: serial, Err: os.ErrNotExist}
+	}
+	return devicePath, nil
+}
+
+func (f *fakeDiskUtils) GetDevicePath(volumeID v3.UUID) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.stripedVolumes[stripedVolumeGroup(volumeID)]; ok {
+		return stripedVolumePath(stripedVolumeGroup(volumeID)), nil
+	}
+	return f.devicePathBySerial(deviceSerial(volumeID))
+}
+
+func (f *fakeDiskUtils) GetDevicePathBySerial(serial string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.devicePathBySerial(serial)
+}
+
+func (f *fakeDiskUtils) WaitDevicePathBySerial(ctx context.Context, serial string) (string, error) {
+	return f.GetDevicePathBySerial(serial)
+}
+
+func (f *fakeDiskUtils) WaitDeviceRemoval(ctx context.Context) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (f *fakeDiskUtils) FormatAndMount(targetPath string, devicePath string, fsType string, mountOptions []string, formatOptions []string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.formatted[devicePath]; !ok {
+		f.formatted[devicePath] = fsType
+		f.formatOptions[devicePath] = formatOptions
+	}
+	return f.mountToTarget(devicePath, targetPath, f.formatted[devicePath], mountOptions)
+}
+
+func (f *fakeDiskUtils) GetDiskFormat(devicePath string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.formatted[devicePath], nil
+}
+
+func (f *fakeDiskUtils) IsSharedMounted(targetPath string, devicePath string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	_, ok := f.mounts[targetPath]
+	return ok, nil
+}
+
+func (f *fakeDiskUtils) GetMountInfo(targetPath string) (*mountInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.mounts[targetPath], nil
+}
+
+func (f *fakeDiskUtils) isBlockDevice(path string) bool {
+	// The bind mounts of a device are block devices too.
+	if mount, ok := f.mounts[path]; ok && mount.fsType == "" {
+		return f.isBlockDevice(mount.source)
+	} else if ok {
+		return false
+	}
+	return f.isDevice(path)
+}
+
+func (f *fakeDiskUtils) IsBlockDevice(path string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.isBlockDevice(path), nil
+}
+
+func (f *fakeDiskUtils) mountToTarget(sourcePath, targetPath, fsType string, mountOptions []string) error {
+	mode := "rw"
+	if slices.Contains(mountOptions, "ro") {
+		mode = "ro"
+	}
+
+	f.mounts[targetPath] = &mountInfo{
+		source:       sourcePath,
+		mountPoint:   targetPath,
+		fsType:       fsType,
+		mountOptions: append([]string{mode}, mountOptions...),
+		superOptions: []string{mode},
+	}
+	return nil
+}
+
+func (f *fakeDiskUtils) MountToTarget(sourcePath, targetPath, fsType string, mountOptions []string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.mountToTarget(sourcePath, targetPath, fsType, mountOptions)
+}
+
+func (f *fakeDiskUtils) MountIdmapped(sourcePath, targetPath, idmap string, mountOptions []string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.mountToTarget(sourcePath, targetPath, "", append(slices.Clone(mountOptions), idmapMountOption+"="+idmap))
+}
+
+func (f *fakeDiskUtils) Unmount(target string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.mounts, target)
+	return nil
+}
+
+func (f *fakeDiskUtils) ForceUnmount(target string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.mounts, target)
+	if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (f *fakeDiskUtils) GetStatfs(path string) (*unix.Statfs_t, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.mounts[path]; !ok {
+		return nil, &os.PathError{Op: "statfs", Path: path, Err: os.ErrNotExist}
+	}
+	return &unix.Statfs_t{Bsize: 4096, Blocks: 1024, Bfree: 256, Files: 128, Ffree: 64}, nil
+}
+
+func (f *fakeDiskUtils) GetBlockReadonly(devicePath string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.readonly[devicePath], nil
+}
+
+func (f *fakeDiskUtils) GetBlockSize(devicePath string) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.isDevice(devicePath) {
+		return 0, &os.PathError{Op: "open", Path: devicePath, Err: os.ErrNotExist}
+	}
+	return fakeDeviceSize, nil
+}
+
+func (f *fakeDiskUtils) SetBlockReadonly(devicePath string, readonly bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.readonly[devicePath] = readonly
+	return nil
+}
+
+func (f *fakeDiskUtils) GetFilesystemErrors(info *mountInfo) uint64 {
+	return 0
+}
+
+func (f *fakeDiskUtils) Resize(targetPath string, devicePath string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.resized = append(f.resized, devicePath)
+	return nil
+}
+
+func (f *fakeDiskUtils) ResizeF2FS(devicePath string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.resized = append(f.resized, devicePath)
+	return nil
+}
+
+func (f *fakeDiskUtils) RepairXFS(devicePath string) error {
+	return nil
+}
+
+func (f *fakeDiskUtils) Tune2fs(devicePath string, options []string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.tuned[devicePath] = options
+	return nil
+}
+
+func (f *fakeDiskUtils) CreateBtrfsSubvolume(path string) error {
+	return os.Mkdir(path, 0o755)
+}
+
+func (f *fakeDiskUtils) NeedResize(targetPath string, devicePath string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.needResize, nil
+}
+
+func (f *fakeDiskUtils) LuksOpen(devicePath, name, passphrase string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.luks[name] = filepath.Join("/dev/mapper", name)
+	return f.luks[name], nil
+}
+
+func (f *fakeDiskUtils) LuksClose(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.luks, name)
+	return nil
+}
+
+func (f *fakeDiskUtils) LuksResize(name, passphrase string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.luksResized = append(f.luksResized, name)
+	return nil
+}
+
+func (f *fakeDiskUtils) LuksMapping(name string) (string, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	mapperPath, ok := f.luks[name]
+	return mapperPath, ok
+}
+
+func (f *fakeDiskUtils) ListMountInfo() ([]*mountInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var mounts []*mountInfo
+	for _, mount := range f.mounts {
+		mounts = append(mounts, mount)
+	}
+	return mounts, nil
+}
+
+func (f *fakeDiskUtils) ListVolumeDevices() (map[string]bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	devices := make(map[string]bool)
+	for _, devicePath := range f.devices {
+		devices[devicePath] = true
+	}
+	for _, mapperPath := range f.luks {
+		devices[mapperPath] = true
+	}
+	return devices, nil
+}
+
+func (f *fakeDiskUtils) Fstrim(mountPoint string) error {
+	return nil
+}
+
+func (f *fakeDiskUtils) Freeze(mountPoint string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.frozen[mountPoint] {
+		return fmt.Errorf("fsfreeze: %s: freeze failed: Device or resource busy", mountPoint)
+	}
+	f.frozen[mountPoint] = true
+	return nil
+}
+
+func (f *fakeDiskUtils) Thaw(mountPoint string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.frozen[mountPoint] {
+		return fmt.Errorf("fsfreeze: %s: unfreeze failed: Invalid argument", mountPoint)
+	}
+	delete(f.frozen, mountPoint)
+	return nil
+}
+
+func (f *fakeDiskUtils) AssembleStripedVolume(volumeGroup string, devicePaths []string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if devices, ok := f.stripedVolumes[volumeGroup]; ok && !slices.Equal(devices, devicePaths) {
+		return "", fmt.Errorf("volume group %s is on %v, not %v", volumeGroup, devices, devicePaths)
+	}
+	f.stripedVolumes[volumeGroup] = devicePaths
+	return stripedVolumePath(volumeGroup), nil
+}
+
+func (f *fakeDiskUtils) DisassembleStripedVolume(volumeGroup string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.stripedVolumes, volumeGroup)
+	return nil
+}
@@ -0,0 +1,77 @@
+package driver
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Feature represents an optional driver feature that can be toggled with --feature-gates.
+type Feature string
+
+const (
+	// OnlineExpansion allows to expand volumes while they are attached to an instance,
+	// for when Exoscale block storage supports resizing attached volumes.
+	OnlineExpansion Feature = "OnlineExpansion"
+)
+
+// defaultFeatureGates represents the known features and whether they are enabled by default.
+var defaultFeatureGates = map[Feature]bool{
+	OnlineExpansion: false,
+}
+
+// FeatureGates represents the state of the driver features.
+type FeatureGates map[Feature]bool
+
+// ParseFeatureGates parses a comma separated list of Feature=bool pairs, e.g. "OnlineExpansion=true".
+func ParseFeatureGates(s string) (FeatureGates, error) {
+	gates := FeatureGates{}
+	for k, v := range defaultFeatureGates {
+		gates[k] = v
+	}
+
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("malformed feature gate %q, expected Feature=bool", pair)
+		}
+
+		feature := Feature(strings.TrimSpace(k))
+		if _, known := defaultFeatureGates[feature]; !known {
+			return nil, fmt.Errorf("unknown feature gate %q, known features: %s", feature, knownFeatures())
+		}
+
+		enabled, err := strconv.ParseBool(strings.TrimSpace(v))
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for feature gate %q: %w", feature, err)
+		}
+		gates[feature] = enabled
+	}
+
+	return gates, nil
+}
+
+// Enabled returns whether the feature is enabled.
+func (g FeatureGates) Enabled(feature Feature) bool {
+	if enabled, ok := g[feature]; ok {
+		return enabled
+	}
+
+	return defaultFeatureGates[feature]
+}
+
+func knownFeatures() string {
+	features := make([]string, 0, len(defaultFeatureGates))
+	for feature := range defaultFeatureGates {
+		features = append(features, string(feature))
+	}
+	sort.Strings(features)
+
+	return strings.Join(features, ", ")
+}
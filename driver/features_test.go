@@ -0,0 +1,30 @@
+package driver
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseFeatureGates(t *testing.T) {
+	testsBench := []struct {
+		value           string
+		onlineExpansion bool
+		valid           bool
+	}{
+		{value: "", onlineExpansion: false, valid: true},
+		{value: "OnlineExpansion=true", onlineExpansion: true, valid: true},
+		{value: " OnlineExpansion = false ,", onlineExpansion: false, valid: true},
+		{value: "OnlineExpansion", valid: false},
+		{value: "OnlineExpansion=yes", valid: false},
+		{value: "Unknown=true", valid: false},
+	}
+
+	for _, test := range testsBench {
+		gates, err := ParseFeatureGates(test.value)
+		require.Equal(t, test.valid, err == nil, test.value)
+		if err == nil {
+			require.Equal(t, test.onlineExpansion, gates.Enabled(OnlineExpansion), test.value)
+		}
+	}
+}
@@ -0,0 +1,423 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+
+	v3 "github.com/exoscale/egoscale/v3"
+)
+
+// The controller coordinates the freeze of the filesystem of a volume with the node it is attached to
+// through the PV of the volume: it labels the PV with the node and annotates it with a freeze request and its deadline,
+// the node freezes the filesystem and acknowledges the request with the frozen annotation,
+// the controller takes the snapshot and removes the request for the node to thaw the filesystem.
+// The node thaws the filesystem at the deadline even if the request wasn't removed, so that the applications
+// aren't blocked forever if the controller fails, and removes the acknowledgment for the snapshot to fail.
+const (
+	fsFreezeParameter = "fsFreeze"
+
+	// fsFreezeWaitTimeout is the maximum duration the controller waits for the node to freeze the filesystem.
+	fsFreezeWaitTimeout = 30 * time.Second
+	// fsFreezePollInterval is the interval between two checks of the acknowledgment by the controller,
+	// and the minimum interval between two reconciliations of the freezes by the node.
+	fsFreezePollInterval = time.Second
+	// fsFreezeResyncInterval is the maximum interval between two reconciliations of the freezes by the node,
+	// which are otherwise reconciled on the changes of the PVs labeled with the node.
+	fsFreezeResyncInterval = 5 * time.Minute
+	// fsFreezeMaxDuration is the maximum duration a filesystem stays frozen for a snapshot, independently of --operation-timeout:
+	// the deadline of the requests, after which the node thaws the filesystem, including those without deadline.
+	fsFreezeMaxDuration = time.Minute
+)
+
+var (
+	exoscaleFreezeNodeLabel          = DriverName + "/freeze-node"
+	exoscaleFreezeRequestAnnotation  = DriverName + "/freeze-request"
+	exoscaleFreezeDeadlineAnnotation = DriverName + "/freeze-deadline"
+	exoscaleFrozenAnnotation         = DriverName + "/frozen"
+)
+
+// findPersistentVolume returns the path of the PV of the volume handle in the Kubernetes API.
+// The name of the PV is cached, the PVs are only listed when the cached PV isn't the one of the volume anymore.
+func findPersistentVolume(ctx context.Context, kube *kubeClient, volumeHandle string) (string, error) {
+	if name, ok := kube.pvNames.Load(volumeHandle); ok {
+		pvPath := "/api/v1/persistentvolumes/" + name.(string)
+		if ok, err := isPersistentVolumeOf(ctx, kube, pvPath, volumeHandle); err == nil && ok {
+			return pvPath, nil
+		}
+		kube.pvNames.Delete(volumeHandle)
+	}
+
+	var pvs kubePersistentVolumeList
+	if err := kube.get(ctx, "/api/v1/persistentvolumes", &pvs); err != nil {
+		return "", err
+	}
+
+	for _, pv := range pvs.Items {
+		if pv.Spec.CSI != nil && pv.Spec.CSI.Driver == DriverName && pv.Spec.CSI.VolumeHandle == volumeHandle {
+			kube.pvNames.Store(volumeHandle, pv.Metadata.Name)
+			return "/api/v1/persistentvolumes/" + pv.Metadata.Name, nil
+		}
+	}
+
+	return "", fmt.Errorf("persistent volume of volume %s not found", volumeHandle)
+}
+
+// isPersistentVolumeOf returns whether the PV at pvPath is the PV of the volume handle.
+func isPersistentVolumeOf(ctx context.Context, kube *kubeClient, pvPath, volumeHandle string) (bool, error) {
+	var pv kubePersistentVolume
+	if err := kube.get(ctx, pvPath, &pv); err != nil {
+		return false, err
+	}
+
+	return pv.Spec.CSI != nil && pv.Spec.CSI.Driver == DriverName && pv.Spec.CSI.VolumeHandle == volumeHandle, nil
+}
+
+// findSnapshotSourceVolume returns the path of the PV of the volume handle from the VolumeSnapshot of the snapshot parameters,
+// through the PVC it is taken from, or the PV found by findPersistentVolume if the parameters have no VolumeSnapshot,
+// the external-snapshotter only adding it with --extra-create-metadata.
+func findSnapshotSourceVolume(ctx context.Context, kube *kubeClient, volumeHandle string, parameters map[string]string) (string, error) {
+	namespace, name := parameters[volumeSnapshotNamespaceKey], parameters[volumeSnapshotNameKey]
+	if namespace == "" || name == "" {
+		return findPersistentVolume(ctx, kube, volumeHandle)
+	}
+
+	var snapshot kubeVolumeSnapshot
+	if err := kube.get(ctx, "/apis/snapshot.storage.k8s.io/v1/namespaces/"+url.PathEscape(namespace)+"/volumesnapshots/"+url.PathEscape(name), &snapshot); err != nil {
+		return "", err
+	}
+	claimName := snapshot.Spec.Source.PersistentVolumeClaimName
+	if claimName == "" {
+		return "", fmt.Errorf("volume snapshot %s/%s has no persistent volume claim source", namespace, name)
+	}
+
+	var claim kubePersistentVolumeClaim
+	if err := kube.get(ctx, "/api/v1/namespaces/"+url.PathEscape(namespace)+"/persistentvolumeclaims/"+url.PathEscape(claimName), &claim); err != nil {
+		return "", err
+	}
+	if claim.Spec.VolumeName == "" {
+		return "", fmt.Errorf("persistent volume claim %s/%s is not bound", namespace, claimName)
+	}
+
+	pvPath := "/api/v1/persistentvolumes/" + url.PathEscape(claim.Spec.VolumeName)
+	ok, err := isPersistentVolumeOf(ctx, kube, pvPath, volumeHandle)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", fmt.Errorf("persistent volume %s of volume snapshot %s/%s isn't the one of volume %s", claim.Spec.VolumeName, namespace, name, volumeHandle)
+	}
+
+	return pvPath, nil
+}
+
+// volumeFreeze is the freeze of the filesystem of a volume requested by the controller.
+type volumeFreeze struct {
+	kube         *kubeClient
+	pvPath       string
+	volumeHandle string
+	token        string
+	deadline     time.Time
+}
+
+// freezeVolume requests the node instanceID to freeze the filesystem of the volume of the snapshot parameters
+// and waits for it to be frozen. The node thaws it at the latest fsFreezeMaxDuration after the request.
+func (d *controllerService) freezeVolume(ctx context.Context, volumeHandle string, parameters map[string]string, instanceID v3.UUID, token string) (*volumeFreeze, error) {
+	pvPath, err := findSnapshotSourceVolume(ctx, d.kube, volumeHandle, parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &volumeFreeze{
+		kube:         d.kube,
+		pvPath:       pvPath,
+		volumeHandle: volumeHandle,
+		token:        token,
+		deadline:     time.Now().Add(fsFreezeMaxDuration),
+	}
+	request := map[string]any{
+		"metadata": map[string]any{
+			"labels": map[string]any{exoscaleFreezeNodeLabel: instanceID.String()},
+			"annotations": map[string]any{
+				exoscaleFreezeRequestAnnotation:  token,
+				exoscaleFreezeDeadlineAnnotation: f.deadline.UTC().Format(time.RFC3339),
+			},
+		},
+	}
+	if err := d.kube.patch(ctx, pvPath, request); err != nil {
+		return nil, fmt.Errorf("request freeze: %w", err)
+	}
+
+	klog.V(4).Infof("waiting for the filesystem of volume %s to be frozen", volumeHandle)
+	err = wait.PollUntilContextTimeout(ctx, fsFreezePollInterval, fsFreezeWaitTimeout, true, func(ctx context.Context) (bool, error) {
+		return f.frozen(ctx)
+	})
+	if err != nil {
+		f.thaw()
+		return nil, fmt.Errorf("wait for the node to freeze the filesystem: %w", err)
+	}
+
+	return f, nil
+}
+
+// frozen returns whether the node acknowledged the freeze and didn't thaw the filesystem since.
+func (f *volumeFreeze) frozen(ctx context.Context) (bool, error) {
+	var pv kubePersistentVolume
+	if err := f.kube.get(ctx, f.pvPath, &pv); err != nil {
+		return false, err
+	}
+
+	return pv.Metadata.Annotations[exoscaleFrozenAnnotation] == f.token, nil
+}
+
+// check returns an error if the node thawed the filesystem before the request was removed,
+// e.g. at the deadline of the request or because the node restarted.
+func (f *volumeFreeze) check(ctx context.Context) error {
+	frozen, err := f.frozen(ctx)
+	if err != nil {
+		return fmt.Errorf("check freeze of volume %s: %w", f.volumeHandle, err)
+	}
+	if !frozen {
+		return fmt.Errorf("filesystem of volume %s was thawed by the node before the snapshot completed", f.volumeHandle)
+	}
+
+	return nil
+}
+
+// thaw removes the request for the node to thaw the filesystem.
+func (f *volumeFreeze) thaw() {
+	// The request context may be done already, the request must be removed nevertheless.
+	ctx, cancel := context.WithTimeout(context.Background(), fsFreezeWaitTimeout)
+	defer cancel()
+
+	removal := map[string]any{
+		"metadata": map[string]any{
+			"labels": map[string]any{exoscaleFreezeNodeLabel: nil},
+			"annotations": map[string]any{
+				exoscaleFreezeRequestAnnotation:  nil,
+				exoscaleFreezeDeadlineAnnotation: nil,
+				exoscaleFrozenAnnotation:         nil,
+			},
+		},
+	}
+	if err := f.kube.patch(ctx, f.pvPath, removal); err != nil {
+		klog.Errorf("remove freeze request of volume %s, the node thaws it at %s: %v", f.volumeHandle, f.deadline, err)
+	}
+}
+
+// frozenVolume is a filesystem frozen by the node on request.
+type frozenVolume struct {
+	token      string
+	pvName     string
+	mountPoint string
+	deadline   time.Time
+	// thawed is set once the filesystem is thawed while the request is still pending.
+	thawed bool
+}
+
+// runFreezeAgent calls reconcileFreezes on every change of the PVs labeled with the node until ctx is done,
+// and at least every fsFreezeResyncInterval or at the deadline of the frozen filesystems.
+func (d *nodeService) runFreezeAgent(ctx context.Context, kube *kubeClient) {
+	klog.Info("filesystem freeze agent started")
+
+	frozen := make(map[string]*frozenVolume)
+	for ctx.Err() == nil {
+		now := time.Now()
+		resourceVersion, err := d.reconcileFreezes(ctx, kube, frozen, now)
+
+		timeout := fsFreezeResyncInterval
+		for _, f := range frozen {
+			if !f.thawed {
+				timeout = min(timeout, f.deadline.Sub(now))
+			}
+		}
+		timeout = max(timeout, fsFreezePollInterval)
+
+		if err == nil {
+			err = kube.watch(ctx, d.freezeRequestsPath()+"&resourceVersion="+url.QueryEscape(resourceVersion), timeout)
+			if err == nil {
+				continue
+			}
+		}
+		klog.Errorf("reconcile filesystem freezes: %v", err)
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(fsFreezePollInterval):
+		}
+	}
+}
+
+// freezeRequestsPath returns the Kubernetes API path of the PVs labeled with the node.
+func (d *nodeService) freezeRequestsPath() string {
+	return "/api/v1/persistentvolumes?labelSelector=" + url.QueryEscape(exoscaleFreezeNodeLabel+"="+d.nodeID.String())
+}
+
+// freezeDeadline returns the deadline of the freeze request of the PV annotations, or fsFreezeMaxDuration after now
+// for the requests without deadline.
+func freezeDeadline(annotations map[string]string, now time.Time) time.Time {
+	deadline, err := time.Parse(time.RFC3339, annotations[exoscaleFreezeDeadlineAnnotation])
+	if err != nil {
+		return now.Add(fsFreezeMaxDuration)
+	}
+
+	return deadline
+}
+
+// reconcileFreezes freezes the filesystems of the volumes whose PV requests it from the node,
+// and thaws the frozen filesystems whose request was removed or whose deadline is reached.
+// frozen holds the filesystems frozen by the node, keyed by volume handle.
+// The resource version of the PVs is returned to watch their changes from it.
+func (d *nodeService) reconcileFreezes(ctx context.Context, kube *kubeClient, frozen map[string]*frozenVolume, now time.Time) (string, error) {
+	var pvs kubePersistentVolumeList
+	if err := kube.get(ctx, d.freezeRequestsPath(), &pvs); err != nil {
+		return "", err
+	}
+
+	requests := make(map[string]string)
+	for _, pv := range pvs.Items {
+		token := pv.Metadata.Annotations[exoscaleFreezeRequestAnnotation]
+		if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != DriverName || token == "" {
+			continue
+		}
+		volumeHandle := pv.Spec.CSI.VolumeHandle
+		requests[volumeHandle] = token
+
+		if f, ok := frozen[volumeHandle]; ok && f.token == token {
+			continue
+		}
+
+		mountPoint, err := d.volumeMountPoint(volumeHandle)
+		if err != nil {
+			klog.Errorf("freeze volume %s: %v", volumeHandle, err)
+			continue
+		}
+
+		f := &frozenVolume{
+			token:      token,
+			pvName:     pv.Metadata.Name,
+			mountPoint: mountPoint,
+			deadline:   freezeDeadline(pv.Metadata.Annotations, now),
+		}
+
+		// The node may have restarted while the filesystem was frozen, thaw it rather than freezing it for longer.
+		if pv.Metadata.Annotations[exoscaleFrozenAnnotation] == token {
+			klog.Warningf("volume %s was frozen before the agent started, thawing it", volumeHandle)
+			if err := d.diskUtils.Thaw(mountPoint); err != nil {
+				klog.V(4).Infof("thaw volume %s: %v", volumeHandle, err)
+			}
+			f.thawed = true
+			frozen[volumeHandle] = f
+			removeFrozenAcknowledgment(ctx, kube, f)
+			continue
+		}
+		if !now.Before(f.deadline) {
+			klog.Warningf("freeze request of volume %s is past its deadline %s, ignoring it", volumeHandle, f.deadline)
+			f.thawed = true
+			frozen[volumeHandle] = f
+			continue
+		}
+
+		klog.Infof("freezing filesystem of volume %s mounted on %s", volumeHandle, mountPoint)
+		if err := d.diskUtils.Freeze(mountPoint); err != nil {
+			klog.Errorf("freeze volume %s: %v", volumeHandle, err)
+			continue
+		}
+		frozen[volumeHandle] = f
+
+		acknowledgment := map[string]any{
+			"metadata": map[string]any{
+				"annotations": map[string]any{exoscaleFrozenAnnotation: token},
+			},
+		}
+		if err := kube.patch(ctx, "/api/v1/persistentvolumes/"+pv.Metadata.Name, acknowledgment); err != nil {
+			klog.Errorf("acknowledge freeze of volume %s: %v", volumeHandle, err)
+		}
+	}
+
+	for volumeHandle, f := range frozen {
+		pending := requests[volumeHandle] == f.token
+		if pending && (f.thawed || now.Before(f.deadline)) {
+			continue
+		}
+
+		if !f.thawed {
+			if pending {
+				klog.Warningf("volume %s is still frozen at the deadline %s of its request, thawing it", volumeHandle, f.deadline)
+			}
+			klog.Infof("thawing filesystem of volume %s mounted on %s", volumeHandle, f.mountPoint)
+			if err := d.diskUtils.Thaw(f.mountPoint); err != nil {
+				klog.Errorf("thaw volume %s: %v", volumeHandle, err)
+				continue
+			}
+			f.thawed = true
+			// The snapshot taken while the filesystem was frozen fails rather than being inconsistent.
+			if pending {
+				removeFrozenAcknowledgment(ctx, kube, f)
+			}
+		}
+		if !pending {
+			delete(frozen, volumeHandle)
+		}
+	}
+
+	return pvs.Metadata.ResourceVersion, nil
+}
+
+// removeFrozenAcknowledgment removes the acknowledgment of the freeze thawed while its request is still pending,
+// for the controller to fail the snapshot.
+func removeFrozenAcknowledgment(ctx context.Context, kube *kubeClient, f *frozenVolume) {
+	removal := map[string]any{
+		"metadata": map[string]any{
+			"annotations": map[string]any{exoscaleFrozenAnnotation: nil},
+		},
+	}
+	if err := kube.patch(ctx, "/api/v1/persistentvolumes/"+f.pvName, removal); err != nil {
+		klog.Errorf("remove freeze acknowledgment of persistent volume %s: %v", f.pvName, err)
+	}
+}
+
+// volumeMountPoint returns a mount point of the filesystem of the volume staged on the node.
+func (d *nodeService) volumeMountPoint(volumeHandle string) (string, error) {
+	_, volumeID, err := getExoscaleID(volumeHandle)
+	if err != nil {
+		return "", err
+	}
+
+	devicePath, err := d.diskUtils.GetDevicePath(volumeID)
+	if err != nil {
+		return "", err
+	}
+	devices := map[string]bool{devicePath: true}
+	if realPath, err := filepath.EvalSymlinks(devicePath); err == nil {
+		devices[realPath] = true
+	}
+	if mapperPath, ok := d.diskUtils.LuksMapping(luksMapperName(volumeID)); ok {
+		devices[mapperPath] = true
+	}
+
+	mounts, err := d.diskUtils.ListMountInfo()
+	if err != nil {
+		return "", err
+	}
+
+	mountPoints := volumeMountPoints(mounts, devices)
+	if len(mountPoints) == 0 {
+		return "", fmt.Errorf("filesystem of volume %s is not mounted on the node", volumeHandle)
+	}
+
+	return mountPoints[0], nil
+}
+
+func (d *diskUtils) Freeze(mountPoint string) error {
+	return runCommand(nil, "fsfreeze", "--freeze", mountPoint)
+}
+
+func (d *diskUtils) Thaw(mountPoint string) error {
+	return runCommand(nil, "fsfreeze", "--unfreeze", mountPoint)
+}
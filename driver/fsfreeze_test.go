@@ -0,0 +1,285 @@
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	v3 "github.com/exoscale/egoscale/v3"
+)
+
+// fakePersistentVolumesAPI serves the persistent volumes of the Kubernetes API with the label selector and merge patch support
+// the freeze coordination relies on, and the PVCs and VolumeSnapshots leading to them.
+type fakePersistentVolumesAPI struct {
+	mu  sync.Mutex
+	pvs map[string]*kubePersistentVolume
+	// claims maps the namespace/name of the PVCs to the name of their PV.
+	claims map[string]string
+	// snapshots maps the namespace/name of the VolumeSnapshots to the name of their source PVC.
+	snapshots map[string]string
+	// lists counts the lists of the PVs.
+	lists int
+	// acknowledge simulates the node acknowledging the freeze requests.
+	acknowledge bool
+}
+
+func newFakePersistentVolumesAPI(t *testing.T, pvs ...*kubePersistentVolume) (*fakePersistentVolumesAPI, *kubeClient) {
+	api := &fakePersistentVolumesAPI{
+		pvs:       make(map[string]*kubePersistentVolume),
+		claims:    make(map[string]string),
+		snapshots: make(map[string]string),
+	}
+	for _, pv := range pvs {
+		api.pvs[pv.Metadata.Name] = pv
+	}
+
+	server := httptest.NewServer(api)
+	t.Cleanup(server.Close)
+
+	return api, &kubeClient{httpClient: server.Client(), host: server.URL}
+}
+
+func (api *fakePersistentVolumesAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+
+	if parts := strings.Split(r.URL.Path, "/"); len(parts) >= 4 && parts[len(parts)-4] == "namespaces" {
+		key := parts[len(parts)-3] + "/" + parts[len(parts)-1]
+		switch resource := parts[len(parts)-2]; {
+		case resource == "volumesnapshots" && api.snapshots[key] != "":
+			var snapshot kubeVolumeSnapshot
+			snapshot.Spec.Source.PersistentVolumeClaimName = api.snapshots[key]
+			_ = json.NewEncoder(w).Encode(snapshot)
+		case resource == "persistentvolumeclaims" && api.claims[key] != "":
+			var claim kubePersistentVolumeClaim
+			claim.Spec.VolumeName = api.claims[key]
+			_ = json.NewEncoder(w).Encode(claim)
+		default:
+			http.NotFound(w, r)
+		}
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/api/v1/persistentvolumes")
+	name = strings.TrimPrefix(name, "/")
+
+	switch {
+	case r.Method == http.MethodGet && name == "" && r.URL.Query().Get("watch") == "true":
+		_ = json.NewEncoder(w).Encode(map[string]any{"type": "MODIFIED"})
+	case r.Method == http.MethodGet && name == "":
+		api.lists++
+		key, value, _ := strings.Cut(r.URL.Query().Get("labelSelector"), "=")
+		var list kubePersistentVolumeList
+		list.Metadata.ResourceVersion = "42"
+		for _, pv := range api.pvs {
+			if key == "" || pv.Metadata.Labels[key] == value {
+				list.Items = append(list.Items, *pv)
+			}
+		}
+		_ = json.NewEncoder(w).Encode(list)
+	case r.Method == http.MethodGet && api.pvs[name] != nil:
+		_ = json.NewEncoder(w).Encode(api.pvs[name])
+	case r.Method == http.MethodPatch && api.pvs[name] != nil:
+		var patch struct {
+			Metadata struct {
+				Labels      map[string]*string `json:"labels"`
+				Annotations map[string]*string `json:"annotations"`
+			} `json:"metadata"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		pv := api.pvs[name]
+		mergeStrings(&pv.Metadata.Labels, patch.Metadata.Labels)
+		mergeStrings(&pv.Metadata.Annotations, patch.Metadata.Annotations)
+		if token := pv.Metadata.Annotations[exoscaleFreezeRequestAnnotation]; api.acknowledge && token != "" {
+			pv.Metadata.Annotations[exoscaleFrozenAnnotation] = token
+		}
+		_ = json.NewEncoder(w).Encode(pv)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func mergeStrings(dst *map[string]string, patch map[string]*string) {
+	if *dst == nil {
+		*dst = make(map[string]string)
+	}
+	for key, value := range patch {
+		if value == nil {
+			delete(*dst, key)
+		} else {
+			(*dst)[key] = *value
+		}
+	}
+}
+
+func newTestPersistentVolume(name, volumeHandle string) *kubePersistentVolume {
+	pv := &kubePersistentVolume{Metadata: kubeObjectMeta{Name: name}}
+	pv.Spec.CSI = &struct {
+		Driver       string `json:"driver"`
+		VolumeHandle string `json:"volumeHandle"`
+	}{Driver: DriverName, VolumeHandle: volumeHandle}
+
+	return pv
+}
+
+func TestFreezeVolume(t *testing.T) {
+	volumeHandle := exoscaleID("ch-gva-2", testNodeVolumeID)
+	instanceID := v3.UUID("0b4f3c2e-9d1a-4f6e-8a3e-5f0c1d2b3a4c")
+	api, kube := newFakePersistentVolumesAPI(t, newTestPersistentVolume("pvc-1", volumeHandle))
+	api.acknowledge = true
+	d := &controllerService{kube: kube}
+
+	f, err := d.freezeVolume(context.Background(), volumeHandle, nil, instanceID, "snapshot-1")
+	require.NoError(t, err)
+	require.Equal(t, instanceID.String(), api.pvs["pvc-1"].Metadata.Labels[exoscaleFreezeNodeLabel])
+	require.Equal(t, "snapshot-1", api.pvs["pvc-1"].Metadata.Annotations[exoscaleFrozenAnnotation])
+	require.Equal(t, f.deadline.UTC().Format(time.RFC3339), api.pvs["pvc-1"].Metadata.Annotations[exoscaleFreezeDeadlineAnnotation])
+	require.NoError(t, f.check(context.Background()))
+
+	// The snapshot fails if the node thawed the filesystem before the request was removed.
+	delete(api.pvs["pvc-1"].Metadata.Annotations, exoscaleFrozenAnnotation)
+	require.ErrorContains(t, f.check(context.Background()), "thawed")
+
+	f.thaw()
+	require.Empty(t, api.pvs["pvc-1"].Metadata.Labels)
+	require.Empty(t, api.pvs["pvc-1"].Metadata.Annotations)
+
+	_, err = d.freezeVolume(context.Background(), exoscaleID("ch-gva-2", instanceID), nil, instanceID, "snapshot-2")
+	require.ErrorContains(t, err, "not found")
+}
+
+func TestFindSnapshotSourceVolume(t *testing.T) {
+	volumeHandle := exoscaleID("ch-gva-2", testNodeVolumeID)
+	otherHandle := exoscaleID("ch-gva-2", "0b4f3c2e-9d1a-4f6e-8a3e-5f0c1d2b3a4c")
+	api, kube := newFakePersistentVolumesAPI(t,
+		newTestPersistentVolume("pvc-1", volumeHandle),
+		newTestPersistentVolume("pvc-2", otherHandle),
+	)
+	api.snapshots["default/snapshot-1"] = "data"
+	api.claims["default/data"] = "pvc-1"
+	parameters := map[string]string{volumeSnapshotNamespaceKey: "default", volumeSnapshotNameKey: "snapshot-1"}
+	ctx := context.Background()
+
+	// The PV is found through the source of the VolumeSnapshot without listing the PVs.
+	pvPath, err := findSnapshotSourceVolume(ctx, kube, volumeHandle, parameters)
+	require.NoError(t, err)
+	require.Equal(t, "/api/v1/persistentvolumes/pvc-1", pvPath)
+	require.Zero(t, api.lists)
+
+	_, err = findSnapshotSourceVolume(ctx, kube, otherHandle, parameters)
+	require.Error(t, err)
+
+	// Without VolumeSnapshot metadata, the PVs are listed once and the name of the PV cached.
+	for range 2 {
+		pvPath, err = findSnapshotSourceVolume(ctx, kube, volumeHandle, nil)
+		require.NoError(t, err)
+		require.Equal(t, "/api/v1/persistentvolumes/pvc-1", pvPath)
+	}
+	require.Equal(t, 1, api.lists)
+
+	// A stale cached name is looked up again.
+	api.pvs["pvc-3"] = api.pvs["pvc-1"]
+	api.pvs["pvc-3"].Metadata.Name = "pvc-3"
+	delete(api.pvs, "pvc-1")
+	pvPath, err = findSnapshotSourceVolume(ctx, kube, volumeHandle, nil)
+	require.NoError(t, err)
+	require.Equal(t, "/api/v1/persistentvolumes/pvc-3", pvPath)
+	require.Equal(t, 2, api.lists)
+}
+
+func TestReconcileFreezes(t *testing.T) {
+	ns, fake := newTestNodeService(t)
+	fake.mounts["/staging"] = &mountInfo{source: testNodeDevicePath, mountPoint: "/staging", majorMinor: "254:16", fsType: "ext4"}
+	volumeHandle := exoscaleID("ch-gva-2", testNodeVolumeID)
+	api, kube := newFakePersistentVolumesAPI(t, newTestPersistentVolume("pvc-1", volumeHandle))
+	d := &controllerService{kube: kube}
+
+	now := time.Now()
+	request := func(token string) {
+		require.NoError(t, kube.patch(context.Background(), "/api/v1/persistentvolumes/pvc-1", map[string]any{
+			"metadata": map[string]any{
+				"labels": map[string]any{exoscaleFreezeNodeLabel: ns.nodeID.String()},
+				"annotations": map[string]any{
+					exoscaleFreezeRequestAnnotation:  token,
+					exoscaleFreezeDeadlineAnnotation: now.Add(time.Minute).UTC().Format(time.RFC3339),
+				},
+			},
+		}))
+	}
+
+	frozen := make(map[string]*frozenVolume)
+	reconcile := func() {
+		resourceVersion, err := ns.reconcileFreezes(context.Background(), kube, frozen, now)
+		require.NoError(t, err)
+		require.Equal(t, "42", resourceVersion)
+	}
+
+	// Nothing is frozen without request.
+	reconcile()
+	require.Empty(t, fake.frozen)
+
+	request("snapshot-1")
+	reconcile()
+	require.True(t, fake.frozen["/staging"])
+	require.Equal(t, "snapshot-1", api.pvs["pvc-1"].Metadata.Annotations[exoscaleFrozenAnnotation])
+
+	// The filesystem stays frozen while the request is pending.
+	reconcile()
+	require.True(t, fake.frozen["/staging"])
+
+	// The removal of the request thaws the filesystem.
+	f, err := d.freezeVolume(context.Background(), volumeHandle, nil, ns.nodeID, "snapshot-1")
+	require.NoError(t, err)
+	f.thaw()
+	reconcile()
+	require.Empty(t, fake.frozen)
+	require.Empty(t, frozen)
+
+	// A filesystem frozen past the deadline of its request is thawed without freezing it again for the same request,
+	// and its acknowledgment removed for the snapshot to fail.
+	request("snapshot-2")
+	reconcile()
+	require.True(t, fake.frozen["/staging"])
+	now = now.Add(time.Minute)
+	reconcile()
+	require.Empty(t, fake.frozen)
+	require.NotContains(t, api.pvs["pvc-1"].Metadata.Annotations, exoscaleFrozenAnnotation)
+	reconcile()
+	require.Empty(t, fake.frozen)
+
+	// A filesystem acknowledged as frozen before a restart of the agent is thawed.
+	request("snapshot-3")
+	require.NoError(t, kube.patch(context.Background(), "/api/v1/persistentvolumes/pvc-1", map[string]any{
+		"metadata": map[string]any{"annotations": map[string]any{exoscaleFrozenAnnotation: "snapshot-3"}},
+	}))
+	require.NoError(t, fake.Freeze("/staging"))
+	clear(frozen)
+	reconcile()
+	require.Empty(t, fake.frozen)
+	require.NotContains(t, api.pvs["pvc-1"].Metadata.Annotations, exoscaleFrozenAnnotation)
+}
+
+func TestKubeWatch(t *testing.T) {
+	_, kube := newFakePersistentVolumesAPI(t)
+	require.NoError(t, kube.watch(context.Background(), "/api/v1/persistentvolumes?resourceVersion=42", time.Second))
+
+	// The watch returns once the timeout elapsed without change.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	t.Cleanup(server.Close)
+	kube = &kubeClient{httpClient: server.Client(), host: server.URL}
+	require.NoError(t, kube.watch(context.Background(), "/api/v1/persistentvolumes", 50*time.Millisecond))
+}
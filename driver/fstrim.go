@@ -0,0 +1,97 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// runFstrim calls trimVolumes every interval until ctx is done.
+func (d *nodeService) runFstrim(ctx context.Context, interval time.Duration) {
+	klog.Infof("fstrim started, interval %s", interval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := d.trimVolumes(); err != nil {
+				klog.Errorf("trim volumes: %v", err)
+			}
+		}
+	}
+}
+
+// trimVolumes discards the unused blocks of the filesystems of the block storage volumes mounted on the node,
+// so that the space of the deleted data is returned to the block storage backend.
+func (d *nodeService) trimVolumes() error {
+	devices, err := d.diskUtils.ListVolumeDevices()
+	if err != nil {
+		return fmt.Errorf("list volume devices: %w", err)
+	}
+
+	mounts, err := d.diskUtils.ListMountInfo()
+	if err != nil {
+		return fmt.Errorf("list mounts: %w", err)
+	}
+
+	for _, mountPoint := range volumeMountPoints(mounts, devices) {
+		klog.V(4).Infof("trimming filesystem mounted on %s", mountPoint)
+		if err := d.diskUtils.Fstrim(mountPoint); err != nil {
+			klog.Errorf("trim filesystem mounted on %s: %v", mountPoint, err)
+		}
+	}
+
+	return nil
+}
+
+// volumeMountPoints returns a mount point of each filesystem mounted from the devices,
+// the staging path and the bind mounts of a volume share the same filesystem which only needs to be trimmed once.
+func volumeMountPoints(mounts []*mountInfo, devices map[string]bool) []string {
+	var mountPoints []string
+	seen := make(map[string]bool)
+	for _, mount := range mounts {
+		if !devices[mount.source] || seen[mount.majorMinor] {
+			continue
+		}
+		seen[mount.majorMinor] = true
+		mountPoints = append(mountPoints, mount.mountPoint)
+	}
+
+	return mountPoints
+}
+
+func (d *diskUtils) ListVolumeDevices() (map[string]bool, error) {
+	var links []string
+	for _, pattern := range []string{
+		filepath.Join(devDiskByID, devDiskPrefix+"*"),
+		filepath.Join(devMapper, luksMapperPrefix+"*"),
+	} {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, matches...)
+	}
+
+	// mounts may refer to either the link or the device.
+	devices := make(map[string]bool)
+	for _, link := range links {
+		devices[link] = true
+		if realPath, err := filepath.EvalSymlinks(link); err == nil {
+			devices[realPath] = true
+		}
+	}
+
+	return devices, nil
+}
+
+func (d *diskUtils) Fstrim(mountPoint string) error {
+	return runCommand(nil, "fstrim", mountPoint)
+}
@@ -0,0 +1,112 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"k8s.io/klog/v2"
+)
+
+// checkLiveness returns an error if the CSI gRPC server isn't serving.
+func (d *Driver) checkLiveness() error {
+	if !d.serving.Load() {
+		return errors.New("CSI server not serving")
+	}
+
+	return nil
+}
+
+// checkReadiness returns an error if the driver isn't live or, for the controller, the Exoscale API isn't reachable
+// or doesn't allow the API key the operations of the driver.
+func (d *Driver) checkReadiness(ctx context.Context) error {
+	if err := d.checkLiveness(); err != nil {
+		return err
+	}
+
+	if d.config.Mode != NodeMode {
+		if err := d.controllerService.checkAPI(ctx); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// healthHandler returns the handler of the /healthz liveness and /readyz readiness endpoints,
+// answering 503 Service Unavailable with the cause when failing, and of the /verbosity log verbosity endpoint.
+func (d *Driver) healthHandler() http.Handler {
+	check := func(check func(*http.Request) error) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if err := check(r); err != nil {
+				klog.V(4).Infof("health check %s failed: %v", r.URL.Path, err)
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+			fmt.Fprintln(w, "ok")
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", check(func(*http.Request) error { return d.checkLiveness() }))
+	mux.Handle("/readyz", check(func(r *http.Request) error { return d.checkReadiness(r.Context()) }))
+	mux.HandleFunc("/verbosity", verbosityHandler)
+
+	return mux
+}
+
+// serveHealth serves the health endpoints on addr until the process exits.
+func (d *Driver) serveHealth(addr string) {
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           d.healthHandler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	klog.Infof("health server started on %s", addr)
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		klog.Errorf("health server: %v", err)
+	}
+}
+
+// csiServices returns the names of the CSI gRPC services served in the driver mode.
+func (d *Driver) csiServices() []string {
+	services := []string{csi.Identity_ServiceDesc.ServiceName}
+	if d.config.Mode != NodeMode {
+		services = append(services, csi.Controller_ServiceDesc.ServiceName)
+	}
+	if d.config.Mode != ControllerMode {
+		services = append(services, csi.Node_ServiceDesc.ServiceName)
+	}
+
+	return services
+}
+
+// registerHealthServer registers the standard gRPC health service on the CSI server,
+// reporting the status of each CSI service and the overall status under the empty service name.
+func (d *Driver) registerHealthServer() {
+	d.health = health.NewServer()
+	healthpb.RegisterHealthServer(d.srv, d.health)
+	d.setServing(false)
+}
+
+// setServing records whether the CSI server is serving, in the health service if registered.
+func (d *Driver) setServing(serving bool) {
+	d.serving.Store(serving)
+	if d.health == nil {
+		return
+	}
+
+	status := healthpb.HealthCheckResponse_NOT_SERVING
+	if serving {
+		status = healthpb.HealthCheckResponse_SERVING
+	}
+	for _, service := range append(d.csiServices(), "") {
+		d.health.SetServingStatus(service, status)
+	}
+}
@@ -0,0 +1,122 @@
+package driver
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+func TestHealthHandler(t *testing.T) {
+	apiStatus := http.StatusOK
+	client, _ := newTestAPIClient(t, func(w http.ResponseWriter, r *http.Request) {
+		require.Contains(t, []string{"/zone", "/block-storage", "/block-storage-snapshot", "/quota"}, r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(apiStatus)
+		_, _ = w.Write([]byte(`{}`))
+	})
+
+	testsBench := []struct {
+		name      string
+		mode      Mode
+		serving   bool
+		apiStatus int
+		healthz   int
+		readyz    int
+	}{
+		{
+			name:    "node serving",
+			mode:    NodeMode,
+			serving: true,
+			healthz: http.StatusOK,
+			readyz:  http.StatusOK,
+		},
+		{
+			name:    "node not serving",
+			mode:    NodeMode,
+			healthz: http.StatusServiceUnavailable,
+			readyz:  http.StatusServiceUnavailable,
+		},
+		{
+			name:      "controller with reachable API",
+			mode:      ControllerMode,
+			serving:   true,
+			apiStatus: http.StatusOK,
+			healthz:   http.StatusOK,
+			readyz:    http.StatusOK,
+		},
+		{
+			name:      "controller with failing API",
+			mode:      AllMode,
+			serving:   true,
+			apiStatus: http.StatusInternalServerError,
+			healthz:   http.StatusOK,
+			readyz:    http.StatusServiceUnavailable,
+		},
+	}
+
+	for _, tt := range testsBench {
+		t.Run(tt.name, func(t *testing.T) {
+			apiStatus = tt.apiStatus
+			d := &Driver{
+				config:            &DriverConfig{Mode: tt.mode},
+				controllerService: controllerService{client: client},
+			}
+			d.serving.Store(tt.serving)
+
+			for path, want := range map[string]int{"/healthz": tt.healthz, "/readyz": tt.readyz} {
+				rec := httptest.NewRecorder()
+				d.healthHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+				require.Equal(t, want, rec.Code, path)
+			}
+		})
+	}
+}
+
+func TestHealthServer(t *testing.T) {
+	d := &Driver{config: &DriverConfig{Mode: NodeMode}}
+	d.srv = grpc.NewServer()
+	d.registerHealthServer()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() { _ = d.srv.Serve(listener) }()
+	t.Cleanup(d.srv.Stop)
+
+	conn, err := grpc.NewClient(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	client := healthpb.NewHealthClient(conn)
+
+	check := func(service string) (healthpb.HealthCheckResponse_ServingStatus, error) {
+		resp, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{Service: service})
+		return resp.GetStatus(), err
+	}
+
+	serving, err := check("")
+	require.NoError(t, err)
+	require.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, serving)
+
+	d.setServing(true)
+	for _, service := range []string{"", "csi.v1.Identity", "csi.v1.Node"} {
+		serving, err = check(service)
+		require.NoError(t, err)
+		require.Equal(t, healthpb.HealthCheckResponse_SERVING, serving, service)
+	}
+
+	_, err = check("csi.v1.Controller")
+	require.Equal(t, codes.NotFound, status.Code(err), "the controller service isn't served by the node")
+
+	d.setServing(false)
+	serving, err = check("csi.v1.Node")
+	require.NoError(t, err)
+	require.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, serving)
+}
@@ -2,11 +2,16 @@ package driver
 
 import (
 	"fmt"
+	"maps"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
+	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/klog/v2"
 
 	v3 "github.com/exoscale/egoscale/v3"
@@ -14,8 +19,15 @@ import (
 
 const (
 	GiB = 1024 * 1024 * 1024
+
+	// virtioSerialMaxLength is the maximum length of a virtio-blk device serial,
+	// the virtio-blk devices expose the volume ID truncated to this length.
+	virtioSerialMaxLength = 20
 )
 
+// supportedFSTypes represents the filesystems that can be formatted and resized by the driver.
+var supportedFSTypes = []string{"ext3", "ext4", "xfs", "btrfs", "f2fs"}
+
 func exoscaleID(zoneName v3.ZoneName, id v3.UUID) string {
 	return fmt.Sprintf("%s/%s", zoneName, id)
 }
@@ -34,31 +46,282 @@ func getExoscaleID(exoID string) (v3.ZoneName, v3.UUID, error) {
 	return v3.ZoneName(s[0]), id, nil
 }
 
+// deviceSerial returns the serial of the virtio-blk device of an attached volume, its volume ID truncated to virtioSerialMaxLength.
+// The truncated serials of two volumes may collide, the devices sharing it are reported by findDeviceBySerial.
+func deviceSerial(volumeID v3.UUID) string {
+	serial := volumeID.String()
+	if len(serial) > virtioSerialMaxLength {
+		serial = serial[:virtioSerialMaxLength]
+	}
+
+	return serial
+}
+
 func newZoneTopology(zoneName v3.ZoneName) []*csi.Topology {
 	return []*csi.Topology{
 		{
-			Segments: map[string]string{ZoneTopologyKey: string(zoneName)},
+			Segments: map[string]string{
+				ZoneTopologyKey:   string(zoneName),
+				RegionTopologyKey: zoneRegion(zoneName),
+			},
 		},
 	}
 }
 
+// zoneRegion returns the region of the zone, i.e. its name without the trailing number,
+// e.g. at-vie for at-vie-1 and at-vie-2.
+func zoneRegion(zoneName v3.ZoneName) string {
+	name := string(zoneName)
+	i := strings.LastIndex(name, "-")
+	if i < 0 {
+		return name
+	}
+	if _, err := strconv.Atoi(name[i+1:]); err != nil {
+		return name
+	}
+
+	return name[:i]
+}
+
 func validateVolumeCapability(volumeCapability *csi.VolumeCapability) error {
 	if volumeCapability == nil {
 		return fmt.Errorf("volumeCapability is nil")
 	}
+
+	if volumeCapability.GetMount() == nil && volumeCapability.GetBlock() == nil {
+		return fmt.Errorf("access type must be either mount or block")
+	}
+
 	for i := range supportedAccessModes {
 		if supportedAccessModes[i].Mode == volumeCapability.GetAccessMode().GetMode() {
 			return nil
 		}
 	}
 
-	mount := volumeCapability.GetMount() != nil
-	block := volumeCapability.GetBlock() != nil
-	if mount && block {
-		panic("TODO check mount && block")
+	return fmt.Errorf("access mode %s not supported", volumeCapability.GetAccessMode().GetMode())
+}
+
+// validateVolumeCapabilities checks the access mode, the access type
+// and the filesystem type of every given capability.
+func validateVolumeCapabilities(volumeCapabilities []*csi.VolumeCapability) error {
+	for _, volumeCapability := range volumeCapabilities {
+		if err := validateVolumeCapability(volumeCapability); err != nil {
+			return err
+		}
+
+		if mount := volumeCapability.GetMount(); mount != nil {
+			if err := validateFSType(mount.GetFsType()); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// hasMountCapability returns whether a volume may be used as a mounted filesystem.
+func hasMountCapability(volumeCapabilities []*csi.VolumeCapability) bool {
+	for _, volumeCapability := range volumeCapabilities {
+		if volumeCapability.GetMount() != nil {
+			return true
+		}
 	}
 
-	return fmt.Errorf("access mode not supported")
+	return false
+}
+
+// validateFSType returns an error if the filesystem type is not supported.
+// An empty filesystem type is valid and means the default one.
+func validateFSType(fsType string) error {
+	if fsType == "" {
+		return nil
+	}
+
+	for _, supported := range supportedFSTypes {
+		if fsType == supported {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("filesystem type %s not supported", fsType)
+}
+
+// getVolumeFSType returns the filesystem type requested for a new volume by the StorageClass parameters
+// or its mount capabilities, an error is returned if they conflict or the filesystem is not supported.
+func getVolumeFSType(parameters map[string]string, volumeCapabilities []*csi.VolumeCapability) (string, error) {
+	fsType := strings.ToLower(parameters[fsTypeParameter])
+	for _, volumeCapability := range volumeCapabilities {
+		capFSType := strings.ToLower(volumeCapability.GetMount().GetFsType())
+		if capFSType == "" {
+			continue
+		}
+		if fsType != "" && fsType != capFSType {
+			return "", fmt.Errorf("conflicting filesystem types %s and %s", fsType, capFSType)
+		}
+		fsType = capFSType
+	}
+
+	if err := validateFSType(fsType); err != nil {
+		return "", err
+	}
+
+	return fsType, nil
+}
+
+// getVolumeEncrypted returns whether a new volume is to be encrypted according to the StorageClass parameters,
+// an error is returned if the parameter is invalid or the volume may be used as a raw block device.
+func getVolumeEncrypted(parameters map[string]string, volumeCapabilities []*csi.VolumeCapability) (bool, error) {
+	value, ok := parameters[encryptedParameter]
+	if !ok {
+		return false, nil
+	}
+
+	encrypted, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, err
+	}
+
+	if encrypted {
+		for _, volumeCapability := range volumeCapabilities {
+			if volumeCapability.GetBlock() != nil {
+				return false, fmt.Errorf("raw block volumes can't be encrypted")
+			}
+		}
+	}
+
+	return encrypted, nil
+}
+
+// getMkfsOptions returns the mkfs options of the StorageClass parameters keyed by filesystem type,
+// an error is returned if the filesystem is not supported.
+func getMkfsOptions(parameters map[string]string) (map[string]string, error) {
+	var mkfsOptions map[string]string
+	for key, value := range parameters {
+		fsType, ok := strings.CutPrefix(key, mkfsOptionsParameterPrefix)
+		if !ok {
+			continue
+		}
+		if fsType == "" {
+			return nil, fmt.Errorf("%s parameter without filesystem type", key)
+		}
+		if err := validateFSType(fsType); err != nil {
+			return nil, err
+		}
+
+		if mkfsOptions == nil {
+			mkfsOptions = make(map[string]string)
+		}
+		mkfsOptions[fsType] = value
+	}
+
+	return mkfsOptions, nil
+}
+
+// newVolumeContext returns the volume context of a new volume, nil if there is nothing to pass to the node.
+// entries hold additional volume context entries, e.g. the I/O tuning.
+func newVolumeContext(fsType string, encrypted bool, mkfsOptions map[string]string, entries ...map[string]string) map[string]string {
+	hasEntries := slices.ContainsFunc(entries, func(e map[string]string) bool { return len(e) > 0 })
+	if fsType == "" && !encrypted && len(mkfsOptions) == 0 && !hasEntries {
+		return nil
+	}
+
+	volumeContext := make(map[string]string)
+	if fsType != "" {
+		volumeContext[exoscaleVolumeFSType] = fsType
+	}
+	if encrypted {
+		volumeContext[exoscaleVolumeEncrypted] = "true"
+	}
+	for mkfsFSType, options := range mkfsOptions {
+		volumeContext[exoscaleMkfsOptionsPrefix+mkfsFSType] = options
+	}
+	for _, e := range entries {
+		maps.Copy(volumeContext, e)
+	}
+
+	return volumeContext
+}
+
+// getStageMkfsOptions returns the options to format the volume with the filesystem type, set in the volume context at provisioning.
+func getStageMkfsOptions(fsType string, volumeContext map[string]string) []string {
+	return strings.Fields(volumeContext[exoscaleMkfsOptionsPrefix+fsType])
+}
+
+// isVolumeEncrypted returns whether the volume context requests the volume to be encrypted.
+func isVolumeEncrypted(volumeContext map[string]string) bool {
+	encrypted, _ := strconv.ParseBool(volumeContext[exoscaleVolumeEncrypted])
+	return encrypted
+}
+
+// getStageFSType returns the filesystem type to format the volume with when staging it,
+// taken from the mount capability or the volume context set at provisioning.
+func getStageFSType(capFSType string, volumeContext map[string]string) (string, error) {
+	fsType := volumeContext[exoscaleVolumeFSType]
+	if capFSType != "" {
+		if fsType != "" && fsType != capFSType {
+			return "", fmt.Errorf("filesystem type %s differs from the %s type the volume was provisioned with", capFSType, fsType)
+		}
+		fsType = capFSType
+	}
+
+	if err := validateFSType(fsType); err != nil {
+		return "", err
+	}
+
+	return fsType, nil
+}
+
+// isSnapshotReady returns whether the snapshot is complete and volumes can be restored from it.
+func isSnapshotReady(snapshot *v3.BlockStorageSnapshot) bool {
+	return snapshot.State == v3.BlockStorageSnapshotStateCreated
+}
+
+// newCSISnapshot returns the CSI representation of a block storage snapshot.
+func newCSISnapshot(zoneName v3.ZoneName, snapshot *v3.BlockStorageSnapshot) *csi.Snapshot {
+	s := &csi.Snapshot{
+		SnapshotId:   exoscaleID(zoneName, snapshot.ID),
+		CreationTime: timestamppb.New(snapshot.CreatedAT),
+		ReadyToUse:   isSnapshotReady(snapshot),
+		// We leave the optional SizeBytes field unset as the size of a block storage snapshot is the size of the difference to the volume or previous snapshots, k8s however expects the size to be the size of the restored volume.
+	}
+	if snapshot.BlockStorageVolume != nil {
+		s.SourceVolumeId = exoscaleID(zoneName, snapshot.BlockStorageVolume.ID)
+	}
+
+	return s
+}
+
+// newPublishContext returns the publish context passed by the CO to the node
+// for a volume published by ControllerPublishVolume.
+func newPublishContext(zoneName v3.ZoneName, volume *v3.BlockStorageVolume, readonly bool) map[string]string {
+	publishContext := map[string]string{
+		exoscaleVolumeName: volume.Name,
+		exoscaleVolumeID:   volume.ID.String(),
+		exoscaleVolumeZone: string(zoneName),
+		// Let the node find the device without guessing its serial from the volume ID,
+		// the node falls back on the truncated serial of the virtio-blk devices.
+		exoscaleDeviceSerial: deviceSerial(volume.ID),
+	}
+	if readonly {
+		publishContext[exoscaleVolumeReadonly] = "true"
+	}
+
+	return publishContext
+}
+
+// isPublishedReadonly returns whether the volume was published read-only by ControllerPublishVolume.
+func isPublishedReadonly(publishContext map[string]string) bool {
+	return publishContext[exoscaleVolumeReadonly] == "true"
+}
+
+// publishedNodeIDs returns the node IDs of the instances the volume is attached to.
+func publishedNodeIDs(zoneName v3.ZoneName, volume *v3.BlockStorageVolume) []string {
+	var nodeIDs []string
+	if volume.Instance != nil && volume.Instance.ID != "" {
+		nodeIDs = append(nodeIDs, exoscaleID(zoneName, volume.Instance.ID))
+	}
+
+	return nodeIDs
 }
 
 func createMountPoint(path string, file bool) error {
@@ -103,36 +366,98 @@ func getRequiredZone(requirements *csi.TopologyRequirement, defaultZone v3.ZoneN
 		return defaultZone, nil
 	}
 
-	if requirements.GetRequisite() == nil {
+	// Since volume can only be handled by one zone, the first preferred topology wins.
+	// Topologies may only have a region segment when StorageClasses use region-level allowedTopologies,
+	// the default zone is used if it is part of the region.
+	topologies := append(append([]*csi.Topology{}, requirements.GetPreferred()...), requirements.GetRequisite()...)
+	if len(topologies) == 0 {
 		klog.Warning("get required zone returned the default zone")
 		return defaultZone, nil
 	}
 
-	// Since volume can only be handle by one zone
-	// and volumes/nodes are announced with only one zone accessible topology,
-	// TopologyRequirement will always ask for one zone at a time.
+	var regions []string
+	for _, topology := range topologies {
+		if zone, ok := topology.GetSegments()[ZoneTopologyKey]; ok {
+			return v3.ZoneName(zone), nil
+		}
+
+		if region, ok := topology.GetSegments()[RegionTopologyKey]; ok {
+			if region == zoneRegion(defaultZone) {
+				return defaultZone, nil
+			}
+			regions = append(regions, region)
+		}
+	}
 
-	if len(requirements.GetRequisite()) != 1 {
-		return "", fmt.Errorf("topology requisite must always be equal to one zone")
+	if len(regions) > 0 {
+		return "", fmt.Errorf("zone %s is not in the required regions %v", defaultZone, regions)
 	}
 
-	required := requirements.GetRequisite()[0]
+	return "", fmt.Errorf("zone topology key %s not found", ZoneTopologyKey)
+}
+
+// getDefaultVolumeSizeGiB returns the size of a volume provisioned without requested capacity,
+// taken from the StorageClass parameters if set or from the sizing policy otherwise.
+func getDefaultVolumeSizeGiB(parameters map[string]string, limits volumeSizeLimits) (int64, error) {
+	value, ok := parameters[defaultSizeParameter]
+	if !ok {
+		return limits.defaultGiB, nil
+	}
 
-	if len(required.Segments) != 1 {
-		return "", fmt.Errorf("topology requisite segments must always be equal to one zone")
+	quantity, err := resource.ParseQuantity(value)
+	if err != nil {
+		return 0, err
 	}
 
-	zone, ok := required.Segments[ZoneTopologyKey]
+	sizeInBytes := quantity.Value()
+	if sizeInBytes%GiB != 0 {
+		return 0, fmt.Errorf("size %s cannot be exactly converted to GiB", value)
+	}
+
+	sizeInGiB := convertBytesToGiB(sizeInBytes)
+	if sizeInGiB < limits.minGiB || sizeInGiB > limits.maxGiB {
+		return 0, fmt.Errorf("size %s is not between %d GiB and %d GiB", value, limits.minGiB, limits.maxGiB)
+	}
+
+	return sizeInGiB, nil
+}
+
+// getVolumeLabels returns the labels of a volume with the deletion protection label
+// set or removed according to the deletionProtection parameter, if present.
+func getVolumeLabels(parameters map[string]string, labels v3.Labels) (v3.Labels, error) {
+	result := maps.Clone(labels)
+
+	value, ok := parameters[deletionProtectionParameter]
 	if !ok {
-		return "", fmt.Errorf("zone topology key %s not found", ZoneTopologyKey)
+		return result, nil
 	}
 
-	return v3.ZoneName(zone), nil
+	protected, err := strconv.ParseBool(value)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", deletionProtectionParameter, err)
+	}
+
+	if protected {
+		if result == nil {
+			result = v3.Labels{}
+		}
+		result[exoscaleDeletionProtection] = "true"
+	} else {
+		delete(result, exoscaleDeletionProtection)
+	}
+
+	return result, nil
+}
+
+// isDeletionProtected returns whether the volume labels protect it against deletion.
+func isDeletionProtected(labels v3.Labels) bool {
+	protected, _ := strconv.ParseBool(labels[exoscaleDeletionProtection])
+	return protected
 }
 
-func getNewVolumeSize(capacityRange *csi.CapacityRange) (int64, error) {
-	MinimalVolumeSizeBytes := convertGiBToBytes(MinimalVolumeSizeGiB)
-	MaximumVolumeSizeBytes := convertGiBToBytes(MaximumVolumeSizeGiB)
+func getNewVolumeSize(capacityRange *csi.CapacityRange, limits volumeSizeLimits) (int64, error) {
+	MinimalVolumeSizeBytes := convertGiBToBytes(limits.minGiB)
+	MaximumVolumeSizeBytes := convertGiBToBytes(limits.maxGiB)
 
 	if capacityRange == nil {
 		return MinimalVolumeSizeBytes, nil
@@ -5,11 +5,15 @@ import (
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/stretchr/testify/require"
+
+	v3 "github.com/exoscale/egoscale/v3"
 )
 
 func TestGetNewVolumeSize(t *testing.T) {
 	var min int64 = convertGiBToBytes(MinimalVolumeSizeGiB)
 	var max int64 = convertGiBToBytes(MaximumVolumeSizeGiB)
+	limits, err := newVolumeSizeLimits(0, 0, 0)
+	require.NoError(t, err)
 	testsBench := []struct {
 		capRange *csi.CapacityRange
 		res      int64
@@ -106,8 +110,382 @@ func TestGetNewVolumeSize(t *testing.T) {
 	}
 
 	for _, test := range testsBench {
-		res, err := getNewVolumeSize(test.capRange)
+		res, err := getNewVolumeSize(test.capRange, limits)
 		require.Equal(t, test.err, err)
 		require.Equal(t, test.res, res)
 	}
 }
+
+func TestValidateVolumeCapabilities(t *testing.T) {
+	mount := func(fsType string) *csi.VolumeCapability_Mount {
+		return &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: fsType}}
+	}
+	block := &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}}
+	accessMode := func(mode csi.VolumeCapability_AccessMode_Mode) *csi.VolumeCapability_AccessMode {
+		return &csi.VolumeCapability_AccessMode{Mode: mode}
+	}
+
+	testsBench := []struct {
+		name  string
+		caps  []*csi.VolumeCapability
+		valid bool
+	}{
+		{
+			name: "mount single node writer",
+			caps: []*csi.VolumeCapability{
+				{AccessType: mount(""), AccessMode: accessMode(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)},
+			},
+			valid: true,
+		},
+		{
+			name: "block single node multi writer",
+			caps: []*csi.VolumeCapability{
+				{AccessType: block, AccessMode: accessMode(csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER)},
+			},
+			valid: true,
+		},
+		{
+			name: "supported fsType",
+			caps: []*csi.VolumeCapability{
+				{AccessType: mount("xfs"), AccessMode: accessMode(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)},
+			},
+			valid: true,
+		},
+		{
+			name: "unsupported fsType",
+			caps: []*csi.VolumeCapability{
+				{AccessType: mount("ntfs"), AccessMode: accessMode(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)},
+			},
+			valid: false,
+		},
+		{
+			name: "unsupported access mode",
+			caps: []*csi.VolumeCapability{
+				{AccessType: mount(""), AccessMode: accessMode(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)},
+				{AccessType: mount(""), AccessMode: accessMode(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER)},
+			},
+			valid: false,
+		},
+		{
+			name: "missing access type",
+			caps: []*csi.VolumeCapability{
+				{AccessMode: accessMode(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)},
+			},
+			valid: false,
+		},
+	}
+
+	for _, test := range testsBench {
+		err := validateVolumeCapabilities(test.caps)
+		require.Equal(t, test.valid, err == nil, test.name)
+	}
+}
+
+func TestNewVolumeSizeLimits(t *testing.T) {
+	testsBench := []struct {
+		minGiB, maxGiB, defaultGiB int64
+		res                        volumeSizeLimits
+		valid                      bool
+	}{
+		{
+			res:   volumeSizeLimits{minGiB: MinimalVolumeSizeGiB, maxGiB: MaximumVolumeSizeGiB, defaultGiB: DefaultVolumeSizeGiB},
+			valid: true,
+		},
+		{
+			minGiB: 10, maxGiB: 500, defaultGiB: 50,
+			res:   volumeSizeLimits{minGiB: 10, maxGiB: 500, defaultGiB: 50},
+			valid: true,
+		},
+		{
+			minGiB: 10, maxGiB: 5, defaultGiB: 5,
+			valid: false,
+		},
+		{
+			minGiB: 200,
+			valid:  false,
+		},
+		{
+			minGiB: -1,
+			valid:  false,
+		},
+	}
+
+	for _, test := range testsBench {
+		res, err := newVolumeSizeLimits(test.minGiB, test.maxGiB, test.defaultGiB)
+		require.Equal(t, test.valid, err == nil)
+		require.Equal(t, test.res, res)
+	}
+}
+
+func TestGetDefaultVolumeSizeGiB(t *testing.T) {
+	limits := volumeSizeLimits{minGiB: 1, maxGiB: 1000, defaultGiB: 100}
+	testsBench := []struct {
+		parameters map[string]string
+		res        int64
+		valid      bool
+	}{
+		{
+			parameters: nil,
+			res:        100,
+			valid:      true,
+		},
+		{
+			parameters: map[string]string{defaultSizeParameter: "20Gi"},
+			res:        20,
+			valid:      true,
+		},
+		{
+			parameters: map[string]string{defaultSizeParameter: "1Ti"},
+			valid:      false,
+		},
+		{
+			parameters: map[string]string{defaultSizeParameter: "1500Mi"},
+			valid:      false,
+		},
+		{
+			parameters: map[string]string{defaultSizeParameter: "large"},
+			valid:      false,
+		},
+	}
+
+	for _, test := range testsBench {
+		res, err := getDefaultVolumeSizeGiB(test.parameters, limits)
+		require.Equal(t, test.valid, err == nil)
+		require.Equal(t, test.res, res)
+	}
+}
+
+func TestGetVolumeLabels(t *testing.T) {
+	testsBench := []struct {
+		parameters map[string]string
+		labels     v3.Labels
+		res        v3.Labels
+		valid      bool
+	}{
+		{
+			parameters: nil,
+			labels:     v3.Labels{"team": "data"},
+			res:        v3.Labels{"team": "data"},
+			valid:      true,
+		},
+		{
+			parameters: map[string]string{deletionProtectionParameter: "true"},
+			labels:     nil,
+			res:        v3.Labels{exoscaleDeletionProtection: "true"},
+			valid:      true,
+		},
+		{
+			parameters: map[string]string{deletionProtectionParameter: "false"},
+			labels:     v3.Labels{"team": "data", exoscaleDeletionProtection: "true"},
+			res:        v3.Labels{"team": "data"},
+			valid:      true,
+		},
+		{
+			parameters: map[string]string{deletionProtectionParameter: "maybe"},
+			valid:      false,
+		},
+	}
+
+	for _, test := range testsBench {
+		res, err := getVolumeLabels(test.parameters, test.labels)
+		require.Equal(t, test.valid, err == nil)
+		require.Equal(t, test.res, res)
+		require.Equal(t, test.valid && test.res[exoscaleDeletionProtection] == "true", isDeletionProtected(res))
+	}
+}
+
+func TestNewPublishContext(t *testing.T) {
+	volume := &v3.BlockStorageVolume{
+		ID:   v3.UUID("8a6ad5e0-5de1-4ecb-b9d6-e2d4c2a3c0e4"),
+		Name: "pvc-1",
+	}
+
+	publishContext := newPublishContext("ch-gva-2", volume, false)
+	require.Equal(t, map[string]string{
+		exoscaleVolumeName:   "pvc-1",
+		exoscaleVolumeID:     "8a6ad5e0-5de1-4ecb-b9d6-e2d4c2a3c0e4",
+		exoscaleVolumeZone:   "ch-gva-2",
+		exoscaleDeviceSerial: "8a6ad5e0-5de1-4ecb-b",
+	}, publishContext)
+	require.False(t, isPublishedReadonly(publishContext))
+
+	publishContext = newPublishContext("ch-gva-2", volume, true)
+	require.True(t, isPublishedReadonly(publishContext))
+}
+
+func TestGetVolumeFSType(t *testing.T) {
+	mountCap := func(fsType string) *csi.VolumeCapability {
+		return &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: fsType}},
+		}
+	}
+	testsBench := []struct {
+		parameters map[string]string
+		caps       []*csi.VolumeCapability
+		res        string
+		valid      bool
+	}{
+		{caps: []*csi.VolumeCapability{mountCap("")}, res: "", valid: true},
+		{caps: []*csi.VolumeCapability{mountCap("xfs")}, res: "xfs", valid: true},
+		{parameters: map[string]string{fsTypeParameter: "btrfs"}, caps: []*csi.VolumeCapability{mountCap("")}, res: "btrfs", valid: true},
+		{parameters: map[string]string{fsTypeParameter: "ext4"}, caps: []*csi.VolumeCapability{mountCap("xfs")}, valid: false},
+		{caps: []*csi.VolumeCapability{mountCap("ntfs")}, valid: false},
+	}
+
+	for _, test := range testsBench {
+		res, err := getVolumeFSType(test.parameters, test.caps)
+		require.Equal(t, test.valid, err == nil)
+		require.Equal(t, test.res, res)
+	}
+}
+
+func TestGetVolumeEncrypted(t *testing.T) {
+	mountCap := &csi.VolumeCapability{AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}}}
+	blockCap := &csi.VolumeCapability{AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}}}
+	testsBench := []struct {
+		parameters map[string]string
+		caps       []*csi.VolumeCapability
+		res        bool
+		valid      bool
+	}{
+		{caps: []*csi.VolumeCapability{mountCap}, res: false, valid: true},
+		{parameters: map[string]string{encryptedParameter: "true"}, caps: []*csi.VolumeCapability{mountCap}, res: true, valid: true},
+		{parameters: map[string]string{encryptedParameter: "false"}, caps: []*csi.VolumeCapability{blockCap}, res: false, valid: true},
+		{parameters: map[string]string{encryptedParameter: "true"}, caps: []*csi.VolumeCapability{blockCap}, valid: false},
+		{parameters: map[string]string{encryptedParameter: "yes"}, caps: []*csi.VolumeCapability{mountCap}, valid: false},
+	}
+
+	for _, test := range testsBench {
+		res, err := getVolumeEncrypted(test.parameters, test.caps)
+		require.Equal(t, test.valid, err == nil)
+		require.Equal(t, test.res, res)
+	}
+
+	require.True(t, isVolumeEncrypted(newVolumeContext("", true, nil, nil)))
+	require.False(t, isVolumeEncrypted(newVolumeContext("ext4", false, nil, nil)))
+
+	require.True(t, hasMountCapability([]*csi.VolumeCapability{blockCap, mountCap}))
+	require.False(t, hasMountCapability([]*csi.VolumeCapability{blockCap}))
+}
+
+func TestGetMkfsOptions(t *testing.T) {
+	testsBench := []struct {
+		parameters map[string]string
+		res        map[string]string
+		valid      bool
+	}{
+		{parameters: nil, res: nil, valid: true},
+		{parameters: map[string]string{defaultSizeParameter: "50Gi"}, res: nil, valid: true},
+		{
+			parameters: map[string]string{"mkfsOptions-ext4": "-b 4096 -I 256", "mkfsOptions-xfs": "-m bigtime=1"},
+			res:        map[string]string{"ext4": "-b 4096 -I 256", "xfs": "-m bigtime=1"},
+			valid:      true,
+		},
+		{parameters: map[string]string{"mkfsOptions-zfs": "-o compression=on"}, valid: false},
+		{parameters: map[string]string{"mkfsOptions-": "-b 4096"}, valid: false},
+	}
+
+	for _, test := range testsBench {
+		res, err := getMkfsOptions(test.parameters)
+		require.Equal(t, test.valid, err == nil)
+		require.Equal(t, test.res, res)
+	}
+}
+
+func TestGetStageMkfsOptions(t *testing.T) {
+	volumeContext := newVolumeContext("", false, map[string]string{"ext4": "-b 4096  -I 256", "xfs": "-m bigtime=1"}, nil)
+
+	require.Equal(t, []string{"-b", "4096", "-I", "256"}, getStageMkfsOptions("ext4", volumeContext))
+	require.Equal(t, []string{"-m", "bigtime=1"}, getStageMkfsOptions("xfs", volumeContext))
+	require.Empty(t, getStageMkfsOptions("", volumeContext))
+	require.Empty(t, getStageMkfsOptions("btrfs", volumeContext))
+	require.Empty(t, getStageMkfsOptions("ext4", nil))
+}
+
+func TestGetStageFSType(t *testing.T) {
+	testsBench := []struct {
+		capFSType     string
+		volumeContext map[string]string
+		res           string
+		valid         bool
+	}{
+		{capFSType: "", volumeContext: nil, res: "", valid: true},
+		{capFSType: "", volumeContext: newVolumeContext("xfs", false, nil, nil), res: "xfs", valid: true},
+		{capFSType: "xfs", volumeContext: newVolumeContext("xfs", false, nil, nil), res: "xfs", valid: true},
+		{capFSType: "ext4", volumeContext: newVolumeContext("xfs", false, nil, nil), valid: false},
+		{capFSType: "zfs", volumeContext: nil, valid: false},
+	}
+
+	for _, test := range testsBench {
+		res, err := getStageFSType(test.capFSType, test.volumeContext)
+		require.Equal(t, test.valid, err == nil)
+		require.Equal(t, test.res, res)
+	}
+}
+
+func TestZoneRegion(t *testing.T) {
+	require.Equal(t, "at-vie", zoneRegion("at-vie-1"))
+	require.Equal(t, "at-vie", zoneRegion("at-vie-2"))
+	require.Equal(t, "ch-gva", zoneRegion("ch-gva-2"))
+	require.Equal(t, "local", zoneRegion("local"))
+}
+
+func TestGetRequiredZone(t *testing.T) {
+	zoneTopology := func(zone string) *csi.Topology {
+		return &csi.Topology{Segments: map[string]string{ZoneTopologyKey: zone, RegionTopologyKey: zoneRegion(v3.ZoneName(zone))}}
+	}
+	regionTopology := func(region string) *csi.Topology {
+		return &csi.Topology{Segments: map[string]string{RegionTopologyKey: region}}
+	}
+	testsBench := []struct {
+		requirements *csi.TopologyRequirement
+		res          v3.ZoneName
+		valid        bool
+	}{
+		{requirements: nil, res: "ch-gva-2", valid: true},
+		{
+			requirements: &csi.TopologyRequirement{Requisite: []*csi.Topology{zoneTopology("de-fra-1")}},
+			res:          "de-fra-1",
+			valid:        true,
+		},
+		{
+			requirements: &csi.TopologyRequirement{
+				Requisite: []*csi.Topology{zoneTopology("at-vie-1"), zoneTopology("at-vie-2")},
+				Preferred: []*csi.Topology{zoneTopology("at-vie-2")},
+			},
+			res:   "at-vie-2",
+			valid: true,
+		},
+		{
+			requirements: &csi.TopologyRequirement{Requisite: []*csi.Topology{regionTopology("ch-gva")}},
+			res:          "ch-gva-2",
+			valid:        true,
+		},
+		{
+			requirements: &csi.TopologyRequirement{Requisite: []*csi.Topology{regionTopology("de-muc")}},
+			valid:        false,
+		},
+	}
+
+	for _, test := range testsBench {
+		res, err := getRequiredZone(test.requirements, "ch-gva-2")
+		require.Equal(t, test.valid, err == nil)
+		require.Equal(t, test.res, res)
+	}
+}
+
+func TestNewCSISnapshot(t *testing.T) {
+	snapshot := &v3.BlockStorageSnapshot{
+		ID:                 v3.UUID("b0b1c2d3-0000-4000-8000-000000000001"),
+		State:              v3.BlockStorageSnapshotStateCreating,
+		BlockStorageVolume: &v3.BlockStorageVolumeTarget{ID: v3.UUID("8a6ad5e0-5de1-4ecb-b9d6-e2d4c2a3c0e4")},
+	}
+
+	res := newCSISnapshot("ch-gva-2", snapshot)
+	require.Equal(t, "ch-gva-2/b0b1c2d3-0000-4000-8000-000000000001", res.SnapshotId)
+	require.Equal(t, "ch-gva-2/8a6ad5e0-5de1-4ecb-b9d6-e2d4c2a3c0e4", res.SourceVolumeId)
+	require.False(t, res.ReadyToUse)
+
+	snapshot.State = v3.BlockStorageSnapshotStateCreated
+	require.True(t, newCSISnapshot("ch-gva-2", snapshot).ReadyToUse)
+}
@@ -23,6 +23,12 @@ func (d *Driver) GetPluginInfo(ctx context.Context, req *csi.GetPluginInfoReques
 
 // GetPluginCapabilities allows to query the supported capabilities of the Plugin as a whole
 func (d *Driver) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) {
+	// Exoscale block storage volumes must be detached to be resized unless online expansion is enabled.
+	expansion := csi.PluginCapability_VolumeExpansion_OFFLINE
+	if d.config.FeatureGates.Enabled(OnlineExpansion) {
+		expansion = csi.PluginCapability_VolumeExpansion_ONLINE
+	}
+
 	res := &csi.GetPluginCapabilitiesResponse{
 		Capabilities: []*csi.PluginCapability{
 			{
@@ -42,7 +48,7 @@ func (d *Driver) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCa
 			{
 				Type: &csi.PluginCapability_VolumeExpansion_{
 					VolumeExpansion: &csi.PluginCapability_VolumeExpansion{
-						Type: csi.PluginCapability_VolumeExpansion_ONLINE,
+						Type: expansion,
 					},
 				},
 			},
@@ -53,11 +59,22 @@ func (d *Driver) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCa
 	return res, nil
 }
 
-// Probe allows to verify that the plugin is in a healthy and ready state
+// Probe allows to verify that the plugin is in a healthy and ready state.
+// The controller checks that the Exoscale API is reachable and that the API key is allowed the operations of the driver,
+// reporting not ready with the cause in the logs otherwise: failing would restart the controller in a loop
+// without fixing the API key.
 func (d *Driver) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
+	ready := true
+	if d.config.Mode != NodeMode {
+		if err := d.controllerService.checkAPI(ctx); err != nil {
+			klog.Warningf("Probe: %v", err)
+			ready = false
+		}
+	}
+
 	return &csi.ProbeResponse{
 		Ready: &wrappers.BoolValue{
-			Value: true,
+			Value: ready,
 		},
 	}, nil
 }
@@ -0,0 +1,44 @@
+package driver
+
+import (
+	"context"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetPluginCapabilitiesVolumeExpansion(t *testing.T) {
+	testsBench := []struct {
+		name         string
+		featureGates FeatureGates
+		want         csi.PluginCapability_VolumeExpansion_Type
+	}{
+		{
+			name: "offline by default",
+			want: csi.PluginCapability_VolumeExpansion_OFFLINE,
+		},
+		{
+			name:         "online with the OnlineExpansion feature",
+			featureGates: FeatureGates{OnlineExpansion: true},
+			want:         csi.PluginCapability_VolumeExpansion_ONLINE,
+		},
+	}
+
+	for _, tt := range testsBench {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &Driver{config: &DriverConfig{FeatureGates: tt.featureGates}}
+
+			resp, err := d.GetPluginCapabilities(context.Background(), &csi.GetPluginCapabilitiesRequest{})
+			require.NoError(t, err)
+
+			var expansions []csi.PluginCapability_VolumeExpansion_Type
+			for _, capability := range resp.GetCapabilities() {
+				if expansion := capability.GetVolumeExpansion(); expansion != nil {
+					expansions = append(expansions, expansion.GetType())
+				}
+			}
+			require.Equal(t, []csi.PluginCapability_VolumeExpansion_Type{tt.want}, expansions)
+		})
+	}
+}
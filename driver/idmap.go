@@ -0,0 +1,77 @@
+package driver
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// idmapMountOption is the util-linux mount option requesting an idmapped mount,
+// shifting the owners of the files for the user namespace of a pod, e.g. "X-mount.idmap=b:0:100000:65536".
+const idmapMountOption = "X-mount.idmap"
+
+var (
+	// idmapPattern matches the ID mappings of the idmap mount option: space separated
+	// u (users), g (groups) or b (both) mappings of an ID range to the IDs of the user namespace.
+	idmapPattern = regexp.MustCompile(`^[ugb]:[0-9]+:[0-9]+:[0-9]+( [ugb]:[0-9]+:[0-9]+:[0-9]+)*$`)
+
+	// idmapFSTypes are the filesystems supporting idmapped mounts.
+	idmapFSTypes = []string{"ext3", "ext4", "xfs", "btrfs", "f2fs"}
+)
+
+// splitIdmapMountOption returns the ID mapping of the idmap mount option and the other mount options.
+// The mapping is either ID mappings or the path of the user namespace to take the mappings of, e.g. /proc/<pid>/ns/user.
+func splitIdmapMountOption(mountOptions []string) (string, []string, error) {
+	var idmap string
+	var options []string
+	for _, option := range mountOptions {
+		key, value, _ := strings.Cut(option, "=")
+		if key != idmapMountOption {
+			options = append(options, option)
+			continue
+		}
+
+		if idmap != "" && value != idmap {
+			return "", nil, fmt.Errorf("several %s mount options", idmapMountOption)
+		}
+		if !idmapPattern.MatchString(value) && !filepath.IsAbs(value) {
+			return "", nil, fmt.Errorf("invalid %s mount option %q, expected ID mappings like b:0:100000:65536 or a user namespace path", idmapMountOption, value)
+		}
+		idmap = value
+	}
+
+	return idmap, options, nil
+}
+
+// validateIdmapFSType returns an error if the filesystem doesn't support idmapped mounts.
+func validateIdmapFSType(fsType string) error {
+	if !slices.Contains(idmapFSTypes, fsType) {
+		return fmt.Errorf("filesystem %s doesn't support idmapped mounts", fsType)
+	}
+
+	return nil
+}
+
+// MountIdmapped bind mounts sourcePath on targetPath with the ID mapping,
+// the other mount options are applied by remounting the bind mount.
+func (d *diskUtils) MountIdmapped(sourcePath, targetPath, idmap string, mountOptions []string) error {
+	if err := runCommand(nil, "mount", "--bind", "-o", idmapMountOption+"="+idmap, sourcePath, targetPath); err != nil {
+		return err
+	}
+
+	options := slices.DeleteFunc(slices.Clone(mountOptions), func(option string) bool { return option == "bind" })
+	if len(options) == 0 {
+		return nil
+	}
+
+	if err := runCommand(nil, "mount", "-o", "remount,bind,"+strings.Join(options, ","), targetPath); err != nil {
+		if err := d.Unmount(targetPath); err != nil {
+			return fmt.Errorf("unmount %s after failed remount: %w", targetPath, err)
+		}
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,66 @@
+package driver
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitIdmapMountOption(t *testing.T) {
+	testsBench := []struct {
+		mountOptions []string
+		idmap        string
+		options      []string
+		valid        bool
+	}{
+		{mountOptions: []string{"noatime"}, options: []string{"noatime"}, valid: true},
+		{mountOptions: []string{"X-mount.idmap=b:0:100000:65536", "noatime"}, idmap: "b:0:100000:65536", options: []string{"noatime"}, valid: true},
+		{mountOptions: []string{"X-mount.idmap=u:0:100000:65536 g:0:200000:65536"}, idmap: "u:0:100000:65536 g:0:200000:65536", valid: true},
+		{mountOptions: []string{"X-mount.idmap=/proc/1234/ns/user"}, idmap: "/proc/1234/ns/user", valid: true},
+		{mountOptions: []string{"X-mount.idmap=b:0:100000"}, valid: false},
+		{mountOptions: []string{"X-mount.idmap=proc/1234/ns/user"}, valid: false},
+		{mountOptions: []string{"X-mount.idmap=b:0:100000:65536", "X-mount.idmap=b:0:200000:65536"}, valid: false},
+	}
+
+	for _, test := range testsBench {
+		idmap, options, err := splitIdmapMountOption(test.mountOptions)
+		require.Equal(t, test.valid, err == nil, test.mountOptions)
+		require.Equal(t, test.idmap, idmap)
+		require.Equal(t, test.options, options)
+	}
+}
+
+func TestValidateIdmapFSType(t *testing.T) {
+	require.NoError(t, validateIdmapFSType("xfs"))
+	require.Error(t, validateIdmapFSType("vfat"))
+}
+
+func TestNodeIdmappedMount(t *testing.T) {
+	ns, fake := newTestNodeService(t)
+	stagingPath := t.TempDir()
+	targetPath := filepath.Join(t.TempDir(), "target")
+	volumeID := exoscaleID("ch-gva-2", testNodeVolumeID)
+	capability := mountCapability("ext4")
+	capability.GetMount().MountFlags = []string{"noatime", "X-mount.idmap=b:0:100000:65536"}
+
+	_, err := ns.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+		VolumeId:          volumeID,
+		StagingTargetPath: stagingPath,
+		VolumeCapability:  capability,
+	})
+	require.NoError(t, err)
+	require.NotContains(t, fake.mounts[stagingPath].mountOptions, "X-mount.idmap=b:0:100000:65536")
+
+	_, err = ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:          volumeID,
+		StagingTargetPath: stagingPath,
+		TargetPath:        targetPath,
+		VolumeCapability:  capability,
+		Readonly:          true,
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"ro", "noatime", "bind", "ro", "X-mount.idmap=b:0:100000:65536"}, fake.mounts[targetPath].mountOptions)
+}
@@ -0,0 +1,99 @@
+package driver
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+)
+
+// ioTuningParameters maps the StorageClass parameters tuning the block device queue of the volumes
+// to the volume context key passed to the node and the /sys/block/<device>/queue attribute they set.
+var ioTuningParameters = []struct {
+	parameter  string
+	contextKey string
+	attribute  string
+	validate   func(value string) error
+}{
+	{parameter: "ioScheduler", contextKey: DriverName + "/io-scheduler", attribute: "scheduler", validate: validateIOScheduler},
+	{parameter: "readAheadKB", contextKey: DriverName + "/read-ahead-kb", attribute: "read_ahead_kb", validate: validateQueueSize},
+	{parameter: "nrRequests", contextKey: DriverName + "/nr-requests", attribute: "nr_requests", validate: validateQueueSize},
+}
+
+// ioSchedulers are the multi-queue I/O schedulers of the virtio block devices.
+var ioSchedulers = []string{"none", "mq-deadline", "kyber", "bfq"}
+
+func validateIOScheduler(value string) error {
+	if !slices.Contains(ioSchedulers, value) {
+		return fmt.Errorf("unknown I/O scheduler %q, expected one of %v", value, ioSchedulers)
+	}
+
+	return nil
+}
+
+func validateQueueSize(value string) error {
+	if _, err := strconv.ParseUint(value, 10, 32); err != nil {
+		return fmt.Errorf("invalid value %q, expected a positive integer", value)
+	}
+
+	return nil
+}
+
+// getIOTuning returns the volume context entries of the I/O tuning StorageClass parameters,
+// an error is returned if a value is invalid.
+func getIOTuning(parameters map[string]string) (map[string]string, error) {
+	var ioTuning map[string]string
+	for _, p := range ioTuningParameters {
+		value, ok := parameters[p.parameter]
+		if !ok {
+			continue
+		}
+		if err := p.validate(value); err != nil {
+			return nil, fmt.Errorf("%s: %w", p.parameter, err)
+		}
+
+		if ioTuning == nil {
+			ioTuning = make(map[string]string)
+		}
+		ioTuning[p.contextKey] = value
+	}
+
+	return ioTuning, nil
+}
+
+// applyIOTuning writes the I/O tuning of the volume context to the queue attributes of the device in the sysBlockDir sysfs directory.
+// The devices mapped by a device-mapper device, e.g. the logical volume of a striped volume, are tuned instead.
+func applyIOTuning(sysBlockDir, devicePath string, volumeContext map[string]string) error {
+	var queueDirs []string
+	for _, p := range ioTuningParameters {
+		value, ok := volumeContext[p.contextKey]
+		if !ok {
+			continue
+		}
+
+		if queueDirs == nil {
+			realDevicePath, err := filepath.EvalSymlinks(devicePath)
+			if err != nil {
+				return err
+			}
+			deviceNames := []string{filepath.Base(realDevicePath)}
+			if slaves, err := os.ReadDir(filepath.Join(sysBlockDir, deviceNames[0], "slaves")); err == nil && len(slaves) > 0 {
+				deviceNames = nil
+				for _, slave := range slaves {
+					deviceNames = append(deviceNames, slave.Name())
+				}
+			}
+			for _, deviceName := range deviceNames {
+				queueDirs = append(queueDirs, filepath.Join(sysBlockDir, deviceName, "queue"))
+			}
+		}
+		for _, queueDir := range queueDirs {
+			if err := os.WriteFile(filepath.Join(queueDir, p.attribute), []byte(value), 0o644); err != nil {
+				return fmt.Errorf("set %s: %w", p.parameter, err)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,84 @@
+package driver
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetIOTuning(t *testing.T) {
+	testsBench := []struct {
+		parameters map[string]string
+		res        map[string]string
+		valid      bool
+	}{
+		{parameters: nil, res: nil, valid: true},
+		{
+			parameters: map[string]string{"ioScheduler": "none", "readAheadKB": "4096", "nrRequests": "256"},
+			res: map[string]string{
+				DriverName + "/io-scheduler":  "none",
+				DriverName + "/read-ahead-kb": "4096",
+				DriverName + "/nr-requests":   "256",
+			},
+			valid: true,
+		},
+		{parameters: map[string]string{"ioScheduler": "cfq"}, valid: false},
+		{parameters: map[string]string{"readAheadKB": "-1"}, valid: false},
+		{parameters: map[string]string{"nrRequests": "many"}, valid: false},
+	}
+
+	for _, test := range testsBench {
+		res, err := getIOTuning(test.parameters)
+		require.Equal(t, test.valid, err == nil)
+		require.Equal(t, test.res, res)
+	}
+}
+
+func TestApplyIOTuning(t *testing.T) {
+	sysBlockDir := t.TempDir()
+	devDir := t.TempDir()
+	devicePath := filepath.Join(devDir, "vdb")
+	require.NoError(t, os.WriteFile(devicePath, nil, 0o644))
+	require.NoError(t, os.Symlink(devicePath, filepath.Join(devDir, "virtio-8a6ad5e0-5de1-4ecb-b")))
+	queueDir := filepath.Join(sysBlockDir, "vdb", "queue")
+	require.NoError(t, os.MkdirAll(queueDir, 0o755))
+
+	ioTuning, err := getIOTuning(map[string]string{"ioScheduler": "mq-deadline", "readAheadKB": "4096"})
+	require.NoError(t, err)
+	require.NoError(t, applyIOTuning(sysBlockDir, filepath.Join(devDir, "virtio-8a6ad5e0-5de1-4ecb-b"), newVolumeContext("", false, nil, ioTuning)))
+
+	scheduler, err := os.ReadFile(filepath.Join(queueDir, "scheduler"))
+	require.NoError(t, err)
+	require.Equal(t, "mq-deadline", string(scheduler))
+	readAhead, err := os.ReadFile(filepath.Join(queueDir, "read_ahead_kb"))
+	require.NoError(t, err)
+	require.Equal(t, "4096", string(readAhead))
+	require.NoFileExists(t, filepath.Join(queueDir, "nr_requests"))
+
+	// The device isn't looked up without tuning.
+	require.NoError(t, applyIOTuning(sysBlockDir, filepath.Join(devDir, "missing"), nil))
+}
+
+func TestApplyIOTuningDeviceMapper(t *testing.T) {
+	sysBlockDir := t.TempDir()
+	devDir := t.TempDir()
+	devicePath := filepath.Join(devDir, "dm-0")
+	require.NoError(t, os.WriteFile(devicePath, nil, 0o644))
+	for _, name := range []string{"vdb", "vdc"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(sysBlockDir, name, "queue"), 0o755))
+		require.NoError(t, os.MkdirAll(filepath.Join(sysBlockDir, "dm-0", "slaves", name), 0o755))
+	}
+
+	ioTuning, err := getIOTuning(map[string]string{"nrRequests": "256"})
+	require.NoError(t, err)
+	require.NoError(t, applyIOTuning(sysBlockDir, devicePath, newVolumeContext("", false, nil, ioTuning)))
+
+	for _, name := range []string{"vdb", "vdc"} {
+		nrRequests, err := os.ReadFile(filepath.Join(sysBlockDir, name, "queue", "nr_requests"))
+		require.NoError(t, err)
+		require.Equal(t, "256", string(nrRequests))
+	}
+	require.NoDirExists(t, filepath.Join(sysBlockDir, "dm-0", "queue"))
+}
@@ -0,0 +1,273 @@
+package driver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/client-go/rest"
+)
+
+// kubeClient is a minimal Kubernetes API client for the few objects read by the driver,
+// decoding them into the small structs below rather than depending on the full API types.
+type kubeClient struct {
+	httpClient *http.Client
+	host       string
+
+	// pvNames caches the names of the PVs of the volume handles found by findPersistentVolume.
+	pvNames sync.Map
+}
+
+func newKubeClient(config *rest.Config) (*kubeClient, error) {
+	if config == nil {
+		return nil, fmt.Errorf("no Kubernetes client configuration")
+	}
+
+	httpClient, err := rest.HTTPClientFor(config)
+	if err != nil {
+		return nil, fmt.Errorf("new Kubernetes HTTP client: %w", err)
+	}
+
+	return &kubeClient{
+		httpClient: httpClient,
+		host:       strings.TrimSuffix(config.Host, "/"),
+	}, nil
+}
+
+// get decodes the JSON object at the Kubernetes API path into out.
+func (c *kubeClient) get(ctx context.Context, path string, out any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.host+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("get %s: %s: %s", path, resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// watch watches the Kubernetes API path of a collection, from the resource version of its query if any,
+// and returns once the first change is received, the watch is closed by the server or the timeout elapsed.
+func (c *kubeClient) watch(ctx context.Context, path string, timeout time.Duration) error {
+	watchCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	separator := "?"
+	if strings.Contains(path, "?") {
+		separator = "&"
+	}
+	req, err := http.NewRequestWithContext(watchCtx, http.MethodGet, c.host+path+separator+"watch=true", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		if ctx.Err() == nil && watchCtx.Err() != nil {
+			return nil
+		}
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("watch %s: %s: %s", path, resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	// Any event, including the expiration of the resource version, requires to list the collection again.
+	var event struct {
+		Type string `json:"type"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&event); err != nil && !errors.Is(err, io.EOF) && watchCtx.Err() == nil {
+		return fmt.Errorf("watch %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// patch applies the JSON merge patch to the object at the Kubernetes API path.
+func (c *kubeClient) patch(ctx context.Context, path string, patch any) error {
+	body, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPatch, c.host+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("patch %s: %s: %s", path, resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	return nil
+}
+
+// create posts the object to the Kubernetes API collection path.
+func (c *kubeClient) create(ctx context.Context, path string, object any) error {
+	body, err := json.Marshal(object)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.host+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("create %s: %s: %s", path, resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	return nil
+}
+
+// createVolumeEvent creates a warning event with the reason and message on the PVC bound to the PV of the volume handle,
+// host is the node reporting it.
+func createVolumeEvent(ctx context.Context, kube *kubeClient, volumeHandle, reason, message, host string) error {
+	pvPath, err := findPersistentVolume(ctx, kube, volumeHandle)
+	if err != nil {
+		return err
+	}
+	var pv kubePersistentVolume
+	if err := kube.get(ctx, pvPath, &pv); err != nil {
+		return err
+	}
+	claim := pv.Spec.ClaimRef
+	if claim == nil {
+		return fmt.Errorf("persistent volume %s is not bound", pv.Metadata.Name)
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	event := map[string]any{
+		"metadata": map[string]any{"generateName": claim.Name + "."},
+		"involvedObject": map[string]any{
+			"apiVersion": "v1",
+			"kind":       "PersistentVolumeClaim",
+			"namespace":  claim.Namespace,
+			"name":       claim.Name,
+		},
+		"reason":         reason,
+		"message":        message,
+		"type":           "Warning",
+		"source":         map[string]any{"component": "exoscale-csi-node", "host": host},
+		"firstTimestamp": now,
+		"lastTimestamp":  now,
+		"count":          1,
+	}
+
+	return kube.create(ctx, "/api/v1/namespaces/"+claim.Namespace+"/events", event)
+}
+
+type kubeObjectMeta struct {
+	Name        string            `json:"name"`
+	Namespace   string            `json:"namespace,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type kubePersistentVolume struct {
+	Metadata kubeObjectMeta `json:"metadata"`
+	Spec     struct {
+		CSI *struct {
+			Driver       string `json:"driver"`
+			VolumeHandle string `json:"volumeHandle"`
+		} `json:"csi,omitempty"`
+		ClaimRef *struct {
+			Namespace string `json:"namespace"`
+			Name      string `json:"name"`
+		} `json:"claimRef,omitempty"`
+	} `json:"spec"`
+}
+
+type kubePersistentVolumeList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []kubePersistentVolume `json:"items"`
+}
+
+type kubePersistentVolumeClaim struct {
+	Metadata kubeObjectMeta `json:"metadata"`
+	Spec     struct {
+		VolumeName string `json:"volumeName,omitempty"`
+	} `json:"spec"`
+}
+
+type kubePersistentVolumeClaimList struct {
+	Items []kubePersistentVolumeClaim `json:"items"`
+}
+
+type kubeVolumeSnapshot struct {
+	Metadata kubeObjectMeta `json:"metadata"`
+	Spec     struct {
+		Source struct {
+			PersistentVolumeClaimName string `json:"persistentVolumeClaimName,omitempty"`
+		} `json:"source"`
+	} `json:"spec"`
+}
+
+type kubeSecret struct {
+	Metadata kubeObjectMeta    `json:"metadata"`
+	Data     map[string][]byte `json:"data"`
+}
+
+type kubeVolumeAttachment struct {
+	Metadata kubeObjectMeta `json:"metadata"`
+	Spec     struct {
+		Attacher string `json:"attacher"`
+		NodeName string `json:"nodeName"`
+		Source   struct {
+			PersistentVolumeName string `json:"persistentVolumeName,omitempty"`
+		} `json:"source"`
+	} `json:"spec"`
+}
+
+type kubeVolumeAttachmentList struct {
+	Items []kubeVolumeAttachment `json:"items"`
+}
+
+type kubeNode struct {
+	Metadata kubeObjectMeta `json:"metadata"`
+	Spec     struct {
+		ProviderID string `json:"providerID"`
+	} `json:"spec"`
+}
@@ -0,0 +1,183 @@
+package driver
+
+import (
+	"context"
+	"maps"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	v3 "github.com/exoscale/egoscale/v3"
+)
+
+// Annotations set by external-provisioner on the PVs provisioned with the
+// csi.storage.k8s.io/provisioner-secret-name and -namespace StorageClass parameters.
+const (
+	provisionerSecretNameAnnotation      = "volume.kubernetes.io/provisioner-deletion-secret-name"
+	provisionerSecretNamespaceAnnotation = "volume.kubernetes.io/provisioner-deletion-secret-namespace"
+)
+
+// labelSyncGroup are the volumes of a zone synced with the same credentials.
+type labelSyncGroup struct {
+	secretPath string
+	zoneName   v3.ZoneName
+}
+
+// runPVCLabelSync calls syncPVCLabels every interval until ctx is done.
+func (d *controllerService) runPVCLabelSync(ctx context.Context, kube *kubeClient, keys []string, interval time.Duration) {
+	klog.Infof("PVC label sync started, interval %s, keys %v", interval, keys)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := d.syncPVCLabels(ctx, kube, keys); err != nil {
+				klog.Errorf("sync PVC labels: %v", err)
+			}
+		}
+	}
+}
+
+// syncPVCLabels copies the keys labels of the PVCs onto the labels of their block storage volume,
+// removing the ones which are no longer set on the PVC, so that e.g. cost-allocation labels stay accurate.
+func (d *controllerService) syncPVCLabels(ctx context.Context, kube *kubeClient, keys []string) error {
+	var pvs kubePersistentVolumeList
+	if err := kube.get(ctx, "/api/v1/persistentvolumes", &pvs); err != nil {
+		return err
+	}
+
+	var pvcs kubePersistentVolumeClaimList
+	if err := kube.get(ctx, "/api/v1/persistentvolumeclaims", &pvcs); err != nil {
+		return err
+	}
+
+	pvcLabels := make(map[string]map[string]string, len(pvcs.Items))
+	for _, pvc := range pvcs.Items {
+		pvcLabels[pvc.Metadata.Namespace+"/"+pvc.Metadata.Name] = pvc.Metadata.Labels
+	}
+
+	// The volumes are grouped by credentials and zone so that each zone is listed once per pass.
+	groups := make(map[labelSyncGroup]map[v3.UUID]map[string]string)
+	for _, pv := range pvs.Items {
+		if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != DriverName || pv.Spec.ClaimRef == nil {
+			continue
+		}
+
+		labels, ok := pvcLabels[pv.Spec.ClaimRef.Namespace+"/"+pv.Spec.ClaimRef.Name]
+		if !ok {
+			continue
+		}
+
+		zoneName, volumeID, err := getExoscaleID(pv.Spec.CSI.VolumeHandle)
+		if err != nil {
+			klog.Errorf("sync labels of volume %s: %v", pv.Spec.CSI.VolumeHandle, err)
+			continue
+		}
+
+		group := labelSyncGroup{secretPath: provisionerSecretPath(pv.Metadata.Annotations), zoneName: zoneName}
+		if groups[group] == nil {
+			groups[group] = make(map[v3.UUID]map[string]string)
+		}
+		groups[group][volumeID] = labels
+	}
+
+	for group, volumesLabels := range groups {
+		if err := d.syncZoneLabels(ctx, kube, group, volumesLabels, keys); err != nil {
+			klog.Errorf("sync labels of the volumes of zone %s: %v", group.zoneName, err)
+		}
+	}
+
+	return nil
+}
+
+// provisionerSecretPath returns the Kubernetes API path of the provisioner Secret of the PV annotations,
+// empty if the volume was provisioned with the driver credentials.
+func provisionerSecretPath(annotations map[string]string) string {
+	name, namespace := annotations[provisionerSecretNameAnnotation], annotations[provisionerSecretNamespaceAnnotation]
+	if name == "" || namespace == "" {
+		return ""
+	}
+
+	return "/api/v1/namespaces/" + namespace + "/secrets/" + name
+}
+
+// syncZoneLabels lists the volumes of the zone of the group with its credentials
+// and syncs the labels of the volumes of volumesLabels.
+func (d *controllerService) syncZoneLabels(ctx context.Context, kube *kubeClient, group labelSyncGroup, volumesLabels map[v3.UUID]map[string]string, keys []string) error {
+	var secrets map[string]string
+	if group.secretPath != "" {
+		var secret kubeSecret
+		if err := kube.get(ctx, group.secretPath, &secret); err != nil {
+			return err
+		}
+		secrets = make(map[string]string, len(secret.Data))
+		for key, value := range secret.Data {
+			secrets[key] = string(value)
+		}
+	}
+
+	client, err := d.clientZone(ctx, secrets, group.zoneName)
+	if err != nil {
+		return err
+	}
+
+	volumes, err := client.ListBlockStorageVolumes(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, volume := range volumes.BlockStorageVolumes {
+		pvcLabels, ok := volumesLabels[volume.ID]
+		if !ok {
+			continue
+		}
+
+		if err := d.syncVolumeLabels(ctx, client, &volume, pvcLabels, keys); err != nil {
+			klog.Errorf("sync labels of volume %s: %v", volume.ID, err)
+		}
+	}
+
+	return nil
+}
+
+// syncVolumeLabels updates the labels of the volume if the keys labels differ from pvcLabels.
+func (d *controllerService) syncVolumeLabels(ctx context.Context, client *v3.Client, volume *v3.BlockStorageVolume, pvcLabels map[string]string, keys []string) error {
+	labels := syncedLabels(volume.Labels, pvcLabels, keys)
+	if maps.Equal(labels, volume.Labels) {
+		return nil
+	}
+
+	klog.V(4).Infof("updating labels of volume %s", volume.ID)
+	op, err := client.UpdateBlockStorageVolume(ctx, volume.ID, v3.UpdateBlockStorageVolumeRequest{
+		Labels: labels,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = d.waitOperation(ctx, client, op)
+	return err
+}
+
+// syncedLabels returns the volume labels with the keys labels set to their value on the PVC,
+// or removed if the PVC doesn't have them.
+func syncedLabels(volumeLabels v3.Labels, pvcLabels map[string]string, keys []string) v3.Labels {
+	labels := maps.Clone(volumeLabels)
+	if labels == nil {
+		labels = v3.Labels{}
+	}
+
+	for _, key := range keys {
+		if value, ok := pvcLabels[key]; ok {
+			labels[key] = value
+		} else {
+			delete(labels, key)
+		}
+	}
+
+	return labels
+}
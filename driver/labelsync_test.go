@@ -0,0 +1,133 @@
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	v3 "github.com/exoscale/egoscale/v3"
+)
+
+func TestSyncedLabels(t *testing.T) {
+	keys := []string{"team", "cost-center"}
+	testsBench := []struct {
+		volumeLabels v3.Labels
+		pvcLabels    map[string]string
+		res          v3.Labels
+	}{
+		{
+			volumeLabels: nil,
+			pvcLabels:    map[string]string{"team": "data", "app": "db"},
+			res:          v3.Labels{"team": "data"},
+		},
+		{
+			volumeLabels: v3.Labels{"team": "data", "cost-center": "42", exoscaleDeletionProtection: "true"},
+			pvcLabels:    map[string]string{"team": "platform"},
+			res:          v3.Labels{"team": "platform", exoscaleDeletionProtection: "true"},
+		},
+	}
+
+	for _, test := range testsBench {
+		require.Equal(t, test.res, syncedLabels(test.volumeLabels, test.pvcLabels, keys))
+	}
+}
+
+func TestSyncPVCLabels(t *testing.T) {
+	const (
+		driverVolume v3.UUID = "a0b1c2d3-0000-4000-8000-000000000001"
+		secretVolume v3.UUID = "a0b1c2d3-0000-4000-8000-000000000002"
+	)
+
+	var (
+		mu      sync.Mutex
+		lists   = map[string]int{}
+		updates = map[string]v3.Labels{}
+	)
+	client, server := newTestAPIClient(t, func(w http.ResponseWriter, r *http.Request) {
+		// The API key is part of the credential of the signed requests.
+		apiKey := testAPIKey
+		if strings.Contains(r.Header.Get("Authorization"), "EXOtenant") {
+			apiKey = "EXOtenant"
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/block-storage":
+			lists[apiKey]++
+			require.NoError(t, json.NewEncoder(w).Encode(v3.ListBlockStorageVolumesResponse{
+				BlockStorageVolumes: []v3.BlockStorageVolume{
+					{ID: driverVolume, Labels: v3.Labels{"team": "data"}},
+					{ID: secretVolume},
+				},
+			}))
+		case r.Method == http.MethodPut:
+			var req v3.UpdateBlockStorageVolumeRequest
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+			updates[apiKey+" "+r.URL.Path] = req.Labels
+			require.NoError(t, json.NewEncoder(w).Encode(v3.Operation{ID: "op", State: v3.OperationStateSuccess}))
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+	})
+
+	kubeServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/persistentvolumes":
+			require.NoError(t, json.NewEncoder(w).Encode(map[string]any{"items": []map[string]any{
+				{
+					"metadata": map[string]any{"name": "pv-driver"},
+					"spec": map[string]any{
+						"csi":      map[string]any{"driver": DriverName, "volumeHandle": "ch-gva-2/" + driverVolume.String()},
+						"claimRef": map[string]any{"namespace": "default", "name": "driver"},
+					},
+				},
+				{
+					"metadata": map[string]any{"name": "pv-secret", "annotations": map[string]any{
+						provisionerSecretNameAnnotation:      "tenant",
+						provisionerSecretNamespaceAnnotation: "tenant",
+					}},
+					"spec": map[string]any{
+						"csi":      map[string]any{"driver": DriverName, "volumeHandle": "ch-gva-2/" + secretVolume.String()},
+						"claimRef": map[string]any{"namespace": "tenant", "name": "secret"},
+					},
+				},
+			}}))
+		case "/api/v1/persistentvolumeclaims":
+			require.NoError(t, json.NewEncoder(w).Encode(map[string]any{"items": []map[string]any{
+				{"metadata": map[string]any{"namespace": "default", "name": "driver", "labels": map[string]any{"team": "data"}}},
+				{"metadata": map[string]any{"namespace": "tenant", "name": "secret", "labels": map[string]any{"team": "tenant"}}},
+			}}))
+		case "/api/v1/namespaces/tenant/secrets/tenant":
+			require.NoError(t, json.NewEncoder(w).Encode(kubeSecret{Data: map[string][]byte{
+				secretAPIKey:    []byte("EXOtenant"),
+				secretAPISecret: []byte("secret"),
+			}}))
+		default:
+			t.Errorf("unexpected kube request %s %s", r.Method, r.URL.Path)
+		}
+	}))
+	t.Cleanup(kubeServer.Close)
+	kube := &kubeClient{httpClient: kubeServer.Client(), host: kubeServer.URL}
+
+	d := &controllerService{
+		client:                client,
+		clientOpts:            []v3.ClientOpt{v3.ClientOptWithEndpoint(v3.Endpoint(server.URL))},
+		zoneEndpoints:         ZoneEndpoints{"ch-gva-2": v3.Endpoint(server.URL)},
+		operationTimeout:      time.Second,
+		operationPollInterval: 10 * time.Millisecond,
+	}
+
+	require.NoError(t, d.syncPVCLabels(context.Background(), kube, []string{"team"}))
+	require.Equal(t, map[string]int{testAPIKey: 1, "EXOtenant": 1}, lists)
+	require.Equal(t, map[string]v3.Labels{
+		"EXOtenant /block-storage/" + secretVolume.String(): {"team": "tenant"},
+	}, updates)
+}
@@ -0,0 +1,63 @@
+package driver
+
+import (
+	"context"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	v3 "github.com/exoscale/egoscale/v3"
+)
+
+// volumeLocks serializes the node operations on the same volume, which the kubelet may call concurrently,
+// while the operations on different volumes proceed in parallel.
+type volumeLocks struct {
+	mu    sync.Mutex
+	locks map[v3.UUID]*volumeLock
+}
+
+type volumeLock struct {
+	// held holds a token while the lock is held, so that waiting for it can be canceled.
+	held chan struct{}
+	// refs is the number of operations holding or waiting for the lock, which is dropped once unused.
+	refs int
+}
+
+func newVolumeLocks() *volumeLocks {
+	return &volumeLocks{locks: make(map[v3.UUID]*volumeLock)}
+}
+
+// lock waits for the lock of the volume until ctx is done, Aborted is returned then.
+// The returned function releases the lock.
+func (l *volumeLocks) lock(ctx context.Context, volumeID v3.UUID) (func(), error) {
+	l.mu.Lock()
+	vl, ok := l.locks[volumeID]
+	if !ok {
+		vl = &volumeLock{held: make(chan struct{}, 1)}
+		l.locks[volumeID] = vl
+	}
+	vl.refs++
+	l.mu.Unlock()
+
+	select {
+	case vl.held <- struct{}{}:
+		return func() {
+			<-vl.held
+			l.release(volumeID, vl)
+		}, nil
+	case <-ctx.Done():
+		l.release(volumeID, vl)
+		return nil, status.Errorf(codes.Aborted, "an operation on volume %s is already in progress: %v", volumeID, ctx.Err())
+	}
+}
+
+func (l *volumeLocks) release(volumeID v3.UUID, vl *volumeLock) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	vl.refs--
+	if vl.refs == 0 {
+		delete(l.locks, volumeID)
+	}
+}
@@ -0,0 +1,56 @@
+package driver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	v3 "github.com/exoscale/egoscale/v3"
+)
+
+func TestVolumeLocks(t *testing.T) {
+	locks := newVolumeLocks()
+	otherVolumeID := v3.UUID("2c9d4e7b-1f3a-4b8c-9e6d-7a5b3c1d0f2e")
+
+	unlock, err := locks.lock(context.Background(), testNodeVolumeID)
+	require.NoError(t, err)
+
+	// Other volumes proceed in parallel.
+	unlockOther, err := locks.lock(context.Background(), otherVolumeID)
+	require.NoError(t, err)
+	unlockOther()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = locks.lock(ctx, testNodeVolumeID)
+	require.Equal(t, codes.Aborted, status.Code(err), err)
+
+	locked := make(chan struct{})
+	go func() {
+		unlock, err := locks.lock(context.Background(), testNodeVolumeID)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		close(locked)
+		unlock()
+	}()
+
+	select {
+	case <-locked:
+		t.Fatal("volume locked twice")
+	case <-time.After(10 * time.Millisecond):
+	}
+	unlock()
+	<-locked
+
+	require.Eventually(t, func() bool {
+		locks.mu.Lock()
+		defer locks.mu.Unlock()
+		return len(locks.locks) == 0
+	}, time.Second, time.Millisecond)
+}
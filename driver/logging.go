@@ -0,0 +1,268 @@
+package driver
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"k8s.io/klog/v2"
+)
+
+// redactedValue replaces the values of the secret fields in the logged messages.
+const redactedValue = "***redacted***"
+
+// rpcLogVerbosity is the verbosity from which the requests and responses of the RPCs are logged.
+const rpcLogVerbosity = 5
+
+// sanitizeMessage returns the message as a single line of JSON, with the values of the fields marked as
+// CSI secrets redacted, e.g. the Exoscale API credentials or the LUKS passphrase of the Secrets fields.
+func sanitizeMessage(msg any) string {
+	m, ok := msg.(proto.Message)
+	if !ok || m == nil {
+		return "{}"
+	}
+
+	m = proto.Clone(m)
+	redactSecrets(m.ProtoReflect())
+
+	b, err := protojson.Marshal(m)
+	if err != nil {
+		return "<unmarshalable " + string(m.ProtoReflect().Descriptor().FullName()) + ">"
+	}
+
+	return string(b)
+}
+
+// redactSecrets replaces the values of the secret fields of m and its nested messages with redactedValue.
+func redactSecrets(m protoreflect.Message) {
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		switch {
+		case isSecretField(fd):
+			if fd.IsMap() && fd.MapValue().Kind() == protoreflect.StringKind {
+				v.Map().Range(func(k protoreflect.MapKey, _ protoreflect.Value) bool {
+					v.Map().Set(k, protoreflect.ValueOfString(redactedValue))
+					return true
+				})
+			} else if fd.Kind() == protoreflect.StringKind && !fd.IsList() {
+				m.Set(fd, protoreflect.ValueOfString(redactedValue))
+			} else {
+				m.Clear(fd)
+			}
+		case fd.IsMap():
+			if fd.MapValue().Kind() == protoreflect.MessageKind {
+				v.Map().Range(func(_ protoreflect.MapKey, v protoreflect.Value) bool {
+					redactSecrets(v.Message())
+					return true
+				})
+			}
+		case fd.IsList():
+			if fd.Kind() == protoreflect.MessageKind {
+				for i := 0; i < v.List().Len(); i++ {
+					redactSecrets(v.List().Get(i).Message())
+				}
+			}
+		case fd.Kind() == protoreflect.MessageKind:
+			redactSecrets(v.Message())
+		}
+		return true
+	})
+}
+
+// isSecretField returns whether the field is marked with the csi_secret option of the CSI spec.
+func isSecretField(fd protoreflect.FieldDescriptor) bool {
+	options := fd.Options()
+	if options == nil || !proto.HasExtension(options, csi.E_CsiSecret) {
+		return false
+	}
+
+	secret, _ := proto.GetExtension(options, csi.E_CsiSecret).(bool)
+	return secret
+}
+
+// rpcLogger returns the logger of the RPC, carrying its name and the IDs and zone of the volume or snapshot of the request.
+func rpcLogger(ctx context.Context, method string, req any) klog.Logger {
+	values := []any{"rpc", path.Base(method)}
+
+	var volumeHandle, snapshotHandle string
+	switch r := req.(type) {
+	case interface{ GetVolumeId() string }:
+		volumeHandle = r.GetVolumeId()
+	case interface{ GetSourceVolumeId() string }:
+		volumeHandle = r.GetSourceVolumeId()
+	}
+	if r, ok := req.(interface{ GetSnapshotId() string }); ok {
+		snapshotHandle = r.GetSnapshotId()
+	}
+
+	var zone string
+	for _, h := range []struct{ key, handle string }{{"volumeID", volumeHandle}, {"snapshotID", snapshotHandle}} {
+		if h.handle == "" {
+			continue
+		}
+		zoneName, id, err := getExoscaleID(h.handle)
+		if err != nil {
+			values = append(values, h.key, h.handle)
+			continue
+		}
+		values = append(values, h.key, id.String())
+		zone = string(zoneName)
+	}
+	if zone != "" {
+		values = append(values, "zone", zone)
+	}
+
+	if r, ok := req.(interface{ GetName() string }); ok && r.GetName() != "" {
+		values = append(values, "name", r.GetName())
+	}
+
+	return klog.FromContext(ctx).WithValues(values...)
+}
+
+// logSubsystems maps the subsystems whose log verbosity can be tuned to the klog -vmodule patterns of their source files.
+var logSubsystems = map[string][]string{
+	"controller": {"controller", "reconciler", "labelsync", "quota", "operations", "credentials", "probe", "cache", "secrets", "zones", "ratelimit", "naming"},
+	"node":       {"node", "fstrim", "usage", "removal", "orphans", "device", "locks", "fsfreeze", "blockreadonly"},
+	"diskutils":  {"diskutils", "fake_diskutils", "command", "luks", "f2fs", "btrfs", "tune2fs", "idmap", "iotuning", "stripes"},
+}
+
+// LogVerbosity maps log subsystems to their verbosity, raising the -v verbosity of their logs.
+type LogVerbosity map[string]int
+
+// ParseLogVerbosity parses a comma separated list of subsystem=level pairs, e.g. "node=4,diskutils=5".
+func ParseLogVerbosity(s string) (LogVerbosity, error) {
+	verbosity := make(LogVerbosity)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		subsystem, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid log verbosity %q, expected subsystem=level", pair)
+		}
+		if _, ok := logSubsystems[subsystem]; !ok {
+			return nil, fmt.Errorf("unknown log subsystem %q, expected one of %s", subsystem, strings.Join(slices.Sorted(maps.Keys(logSubsystems)), ", "))
+		}
+		level, err := strconv.Atoi(value)
+		if err != nil || level < 0 {
+			return nil, fmt.Errorf("invalid log verbosity level %q of subsystem %s", value, subsystem)
+		}
+		verbosity[subsystem] = level
+	}
+
+	return verbosity, nil
+}
+
+// String returns the sorted subsystem=level pairs.
+func (v LogVerbosity) String() string {
+	pairs := make([]string, 0, len(v))
+	for _, subsystem := range slices.Sorted(maps.Keys(v)) {
+		pairs = append(pairs, subsystem+"="+strconv.Itoa(v[subsystem]))
+	}
+
+	return strings.Join(pairs, ",")
+}
+
+// vmodule returns the -vmodule patterns of the source files of the subsystems.
+func (v LogVerbosity) vmodule() string {
+	var patterns []string
+	for _, subsystem := range slices.Sorted(maps.Keys(v)) {
+		if v[subsystem] == 0 {
+			continue
+		}
+		for _, file := range logSubsystems[subsystem] {
+			patterns = append(patterns, file+"="+strconv.Itoa(v[subsystem]))
+		}
+	}
+
+	return strings.Join(patterns, ",")
+}
+
+// logVerbosity is the verbosity of the subsystems, which can be updated at runtime.
+var logVerbosity = struct {
+	sync.Mutex
+	levels LogVerbosity
+	// vmodule is the klog -vmodule flag, and baseVmodule its value set on the command line, kept along the subsystem patterns.
+	vmodule     flag.Value
+	baseVmodule string
+}{levels: make(LogVerbosity)}
+
+// updateLogVerbosity sets the verbosity of the subsystems of v, a level of 0 resetting a subsystem to the -v verbosity,
+// and returns the verbosity of all the subsystems.
+func updateLogVerbosity(v LogVerbosity) (LogVerbosity, error) {
+	logVerbosity.Lock()
+	defer logVerbosity.Unlock()
+
+	if logVerbosity.vmodule == nil {
+		fs := flag.NewFlagSet("klog", flag.ContinueOnError)
+		klog.InitFlags(fs)
+		logVerbosity.vmodule = fs.Lookup("vmodule").Value
+		logVerbosity.baseVmodule = logVerbosity.vmodule.String()
+	}
+
+	levels := maps.Clone(logVerbosity.levels)
+	for subsystem, level := range v {
+		if level == 0 {
+			delete(levels, subsystem)
+		} else {
+			levels[subsystem] = level
+		}
+	}
+
+	vmodule := levels.vmodule()
+	if logVerbosity.baseVmodule != "" {
+		vmodule = strings.Trim(logVerbosity.baseVmodule+","+vmodule, ",")
+	}
+	if err := logVerbosity.vmodule.Set(vmodule); err != nil {
+		return nil, err
+	}
+	logVerbosity.levels = levels
+
+	return maps.Clone(levels), nil
+}
+
+// verbosityHandler answers the verbosity of the subsystems on GET,
+// and updates it from the subsystem=level pairs of the body on PUT, e.g. "node=5".
+func verbosityHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		logVerbosity.Lock()
+		levels := logVerbosity.levels.String()
+		logVerbosity.Unlock()
+		fmt.Fprintln(w, levels)
+	case http.MethodPut:
+		body, err := io.ReadAll(io.LimitReader(r.Body, 1024))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		v, err := ParseLogVerbosity(string(body))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		levels, err := updateLogVerbosity(v)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		klog.Infof("log verbosity set to %q", levels)
+		fmt.Fprintln(w, levels)
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
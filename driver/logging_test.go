@@ -0,0 +1,179 @@
+package driver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+	"k8s.io/klog/v2"
+)
+
+func TestSanitizeMessage(t *testing.T) {
+	req := &csi.NodeStageVolumeRequest{
+		VolumeId:          "ch-gva-2/b0b1c2d3-0000-4000-8000-000000000001",
+		StagingTargetPath: "/var/lib/kubelet/staging",
+		Secrets:           map[string]string{"passphrase": "s3cr3t"},
+		VolumeContext:     map[string]string{"fsType": "ext4"},
+	}
+
+	got := sanitizeMessage(req)
+	require.Contains(t, got, "b0b1c2d3-0000-4000-8000-000000000001")
+	require.Contains(t, got, "passphrase")
+	require.Contains(t, got, redactedValue)
+	require.Contains(t, got, "ext4")
+	require.NotContains(t, got, "s3cr3t")
+	require.Equal(t, "s3cr3t", req.Secrets["passphrase"], "the request must not be modified")
+
+	// The secrets of the other requests are redacted too.
+	got = sanitizeMessage(&csi.CreateVolumeRequest{
+		Name:    "pvc-1",
+		Secrets: map[string]string{"apiSecret": "s3cr3t"},
+		CapacityRange: &csi.CapacityRange{
+			RequiredBytes: 10 << 30,
+		},
+	})
+	require.Contains(t, got, "pvc-1")
+	require.NotContains(t, got, "s3cr3t")
+
+	require.Equal(t, "{}", sanitizeMessage(nil))
+	require.Equal(t, "{}", sanitizeMessage((*csi.NodeStageVolumeRequest)(nil)))
+}
+
+func TestRPCLogger(t *testing.T) {
+	testsBench := []struct {
+		method string
+		req    any
+		res    map[string]any
+	}{
+		{
+			method: "/csi.v1.Node/NodeStageVolume",
+			req:    &csi.NodeStageVolumeRequest{VolumeId: "ch-gva-2/b0b1c2d3-0000-4000-8000-000000000001"},
+			res: map[string]any{
+				"rpc":      "NodeStageVolume",
+				"volumeID": "b0b1c2d3-0000-4000-8000-000000000001",
+				"zone":     "ch-gva-2",
+			},
+		},
+		{
+			method: "/csi.v1.Controller/CreateSnapshot",
+			req:    &csi.CreateSnapshotRequest{SourceVolumeId: "de-fra-1/b0b1c2d3-0000-4000-8000-000000000001", Name: "snapshot-1"},
+			res: map[string]any{
+				"rpc":      "CreateSnapshot",
+				"volumeID": "b0b1c2d3-0000-4000-8000-000000000001",
+				"zone":     "de-fra-1",
+				"name":     "snapshot-1",
+			},
+		},
+		{
+			method: "/csi.v1.Controller/DeleteSnapshot",
+			req:    &csi.DeleteSnapshotRequest{SnapshotId: "at-vie-1/b0b1c2d3-0000-4000-8000-000000000002"},
+			res: map[string]any{
+				"rpc":        "DeleteSnapshot",
+				"snapshotID": "b0b1c2d3-0000-4000-8000-000000000002",
+				"zone":       "at-vie-1",
+			},
+		},
+		{
+			method: "/csi.v1.Controller/DeleteVolume",
+			req:    &csi.DeleteVolumeRequest{VolumeId: "invalid"},
+			res:    map[string]any{"rpc": "DeleteVolume", "volumeID": "invalid"},
+		},
+		{
+			method: "/csi.v1.Identity/Probe",
+			req:    &csi.ProbeRequest{},
+			res:    map[string]any{"rpc": "Probe"},
+		},
+	}
+
+	for _, tt := range testsBench {
+		var buf bytes.Buffer
+		ctx := klog.NewContext(context.Background(), logr.FromSlogHandler(slog.NewJSONHandler(&buf, nil)))
+
+		rpcLogger(ctx, tt.method, tt.req).Info("test")
+
+		var record map[string]any
+		require.NoError(t, json.Unmarshal(buf.Bytes(), &record))
+		for _, key := range []string{"time", "level", "msg"} {
+			delete(record, key)
+		}
+		require.Equal(t, tt.res, record, tt.method)
+	}
+}
+
+func TestParseLogVerbosity(t *testing.T) {
+	testsBench := []struct {
+		value   string
+		res     LogVerbosity
+		vmodule string
+		err     bool
+	}{
+		{value: "", res: LogVerbosity{}},
+		{
+			value:   "node=4, diskutils=5",
+			res:     LogVerbosity{"node": 4, "diskutils": 5},
+			vmodule: "diskutils=5,fake_diskutils=5,command=5",
+		},
+		{value: "node=0", res: LogVerbosity{"node": 0}},
+		{value: "kubelet=4", err: true},
+		{value: "node", err: true},
+		{value: "node=-1", err: true},
+		{value: "node=high", err: true},
+	}
+
+	for _, tt := range testsBench {
+		v, err := ParseLogVerbosity(tt.value)
+		if tt.err {
+			require.Error(t, err, tt.value)
+			continue
+		}
+		require.NoError(t, err, tt.value)
+		require.Equal(t, tt.res, v, tt.value)
+		require.True(t, strings.HasPrefix(v.vmodule(), tt.vmodule), v.vmodule())
+	}
+
+	require.Equal(t, "diskutils=5,node=4", LogVerbosity{"node": 4, "diskutils": 5}.String())
+	require.Contains(t, LogVerbosity{"node": 4}.vmodule(), "node=4")
+	require.NotContains(t, LogVerbosity{"node": 4}.vmodule(), "controller=")
+}
+
+func TestVerbosityHandler(t *testing.T) {
+	t.Cleanup(func() {
+		_, err := updateLogVerbosity(LogVerbosity{"controller": 0, "node": 0, "diskutils": 0})
+		require.NoError(t, err)
+	})
+
+	request := func(method, body string) (int, string) {
+		w := httptest.NewRecorder()
+		verbosityHandler(w, httptest.NewRequest(method, "/verbosity", strings.NewReader(body)))
+		return w.Code, strings.TrimSpace(w.Body.String())
+	}
+
+	code, body := request(http.MethodPut, "node=5,diskutils=6")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "diskutils=6,node=5", body)
+	require.Contains(t, logVerbosity.vmodule.String(), "node=5")
+	require.Contains(t, logVerbosity.vmodule.String(), "luks=6")
+
+	code, body = request(http.MethodPut, "diskutils=0")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "node=5", body)
+	require.NotContains(t, logVerbosity.vmodule.String(), "luks=")
+
+	code, body = request(http.MethodGet, "")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "node=5", body)
+
+	code, _ = request(http.MethodPut, "kubelet=5")
+	require.Equal(t, http.StatusBadRequest, code)
+
+	code, _ = request(http.MethodDelete, "")
+	require.Equal(t, http.StatusMethodNotAllowed, code)
+}
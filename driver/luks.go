@@ -0,0 +1,97 @@
+package driver
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	v3 "github.com/exoscale/egoscale/v3"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	// luksPassphraseKey is the key of the LUKS passphrase in the node stage and node expand secrets.
+	luksPassphraseKey = "encryptionPassphrase"
+
+	luksMapperPrefix = "exoscale-luks-"
+	luksDiskFormat   = "crypto_LUKS"
+	devMapper        = "/dev/mapper"
+)
+
+// luksMapperName returns the name of the device mapping of the encrypted volume.
+func luksMapperName(volumeID v3.UUID) string {
+	return luksMapperPrefix + volumeID.String()
+}
+
+// LuksOpen opens the encrypted device as the name mapping and returns the path of the mapping.
+// A blank device is formatted with LUKS first, a device with another filesystem is never encrypted.
+func (d *diskUtils) LuksOpen(devicePath, name, passphrase string) (string, error) {
+	mapperPath, ok := d.LuksMapping(name)
+	if ok {
+		return mapperPath, nil
+	}
+
+	format, err := d.kMounter.GetDiskFormat(devicePath)
+	if err != nil {
+		return "", fmt.Errorf("get disk format of %s: %w", devicePath, err)
+	}
+
+	switch format {
+	case "":
+		klog.V(4).Infof("formatting %s with LUKS", devicePath)
+		if err := runCryptsetup(passphrase, "luksFormat", "--batch-mode", "--type", "luks2", "--key-file", "-", devicePath); err != nil {
+			return "", err
+		}
+	case luksDiskFormat:
+	default:
+		return "", fmt.Errorf("device %s is formatted with %s, refusing to encrypt it", devicePath, format)
+	}
+
+	if err := runCryptsetup(passphrase, "luksOpen", "--key-file", "-", devicePath, name); err != nil {
+		return "", err
+	}
+
+	return mapperPath, nil
+}
+
+// LuksClose closes the name mapping, if opened.
+func (d *diskUtils) LuksClose(name string) error {
+	if _, ok := d.LuksMapping(name); !ok {
+		return nil
+	}
+
+	return runCryptsetup("", "luksClose", name)
+}
+
+// LuksResize resizes the name mapping to the size of its device.
+// The passphrase is only needed when the volume key isn't in the kernel keyring.
+func (d *diskUtils) LuksResize(name, passphrase string) error {
+	if passphrase == "" {
+		return runCryptsetup("", "resize", name)
+	}
+
+	return runCryptsetup(passphrase, "resize", "--key-file", "-", name)
+}
+
+// LuksMapping returns the path of the name mapping and whether it is opened.
+func (d *diskUtils) LuksMapping(name string) (string, bool) {
+	mapperPath := filepath.Join(devMapper, name)
+	if _, err := os.Stat(mapperPath); err != nil {
+		return mapperPath, false
+	}
+
+	return mapperPath, true
+}
+
+// runCryptsetup runs cryptsetup with args, passing the passphrase on its standard input.
+func runCryptsetup(passphrase string, args ...string) error {
+	var stdin io.Reader
+	if passphrase != "" {
+		stdin = strings.NewReader(passphrase)
+	}
+
+	return runCommand(stdin, "cryptsetup", args...)
+}
@@ -0,0 +1,186 @@
+package driver
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc/codes"
+	"k8s.io/klog/v2"
+)
+
+const metricsNamespace = "exoscale_csi"
+
+var (
+	// metricsRegistry holds the metrics exposed by the driver on --metrics-address.
+	metricsRegistry = prometheus.NewRegistry()
+
+	apiThrottledRequests = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "api_throttled_requests_total",
+		Help:      "Number of Exoscale API requests delayed by the client-side rate limiter.",
+	})
+	apiThrottleWaitSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "api_throttle_wait_seconds",
+		Help:      "Time Exoscale API requests spent waiting on the client-side rate limiter.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 12),
+	})
+
+	orphanedVolumesDetached = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "orphaned_volumes_detached_total",
+		Help:      "Number of volumes detached from deleted instances by the attachment reconciler.",
+	})
+
+	volumeAbnormal = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "volume_abnormal",
+		Help:      "Whether the volume staged on the node was reported abnormal by its last NodeGetVolumeStats, e.g. because of filesystem errors.",
+	}, []string{"volume_id"})
+
+	volumeUsageAboveThreshold = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "volume_usage_above_threshold",
+		Help:      "Whether the usage of the space (bytes) or inodes of the filesystem of the volume staged on the node is above the usage threshold.",
+	}, []string{"volume_id", "resource"})
+
+	nodeOperationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "node_operation_duration_seconds",
+		Help:      "Duration of the stage, publish and expand operations of the node, failed ones included.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 14),
+	}, []string{"operation"})
+	nodeFormats = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "node_formats_total",
+		Help:      "Number of blank volume devices formatted by the node.",
+	}, []string{"fs_type"})
+	nodeFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "node_failures_total",
+		Help:      "Number of failures of the node operations by phase: device lookup, format, mount or resize.",
+	}, []string{"phase"})
+
+	rpcRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "rpc_requests_total",
+		Help:      "Number of CSI RPCs handled by the driver by method and gRPC status code.",
+	}, []string{"method", "code"})
+	rpcDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "rpc_duration_seconds",
+		Help:      "Duration of the CSI RPCs handled by the driver, failed ones included.",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 16),
+	}, []string{"method"})
+
+	apiRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "api_requests_total",
+		Help:      "Number of Exoscale API requests by HTTP method, path with the IDs replaced by :id, and HTTP status code, or error if no response was received.",
+	}, []string{"method", "path", "code"})
+	apiRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "api_request_duration_seconds",
+		Help:      "Duration of the Exoscale API requests by HTTP method and path with the IDs replaced by :id.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 12),
+	}, []string{"method", "path"})
+)
+
+// uuidPathSegment matches the IDs in the Exoscale API paths, replaced to bound the cardinality of the path label.
+var uuidPathSegment = regexp.MustCompile(`/[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}(/|:|$)`)
+
+// The operations and phases of the node metrics.
+const (
+	stageOperation   = "stage"
+	publishOperation = "publish"
+	expandOperation  = "expand"
+
+	devicePhase = "device"
+	formatPhase = "format"
+	mountPhase  = "mount"
+	resizePhase = "resize"
+)
+
+// observeNodeOperation records the duration of the node operation started at start.
+func observeNodeOperation(operation string, start time.Time) {
+	nodeOperationDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
+
+// observeRPC records the CSI RPC method started at start and answered with the code.
+func observeRPC(method string, code codes.Code, start time.Time) {
+	rpcRequests.WithLabelValues(method, code.String()).Inc()
+	rpcDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+}
+
+// apiMetricsTransport is an HTTP transport recording the metrics of the Exoscale API requests.
+type apiMetricsTransport struct {
+	next http.RoundTripper
+}
+
+// newAPIMetricsHTTPClient returns an HTTP client recording the metrics of the Exoscale API requests sent through next.
+func newAPIMetricsHTTPClient(next http.RoundTripper) *http.Client {
+	return &http.Client{Transport: &apiMetricsTransport{next: next}}
+}
+
+func (t *apiMetricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	path := apiMetricsPath(req.URL.Path)
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	apiRequestDuration.WithLabelValues(req.Method, path).Observe(time.Since(start).Seconds())
+
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	apiRequests.WithLabelValues(req.Method, path, code).Inc()
+
+	return resp, err
+}
+
+// apiMetricsPath returns the path of an Exoscale API request with the IDs replaced by :id.
+func apiMetricsPath(path string) string {
+	// The matches share their trailing slash with the next ID, replace until none is left.
+	for uuidPathSegment.MatchString(path) {
+		path = uuidPathSegment.ReplaceAllString(path, "/:id$1")
+	}
+
+	return path
+}
+
+func init() {
+	metricsRegistry.MustRegister(
+		apiThrottledRequests,
+		apiThrottleWaitSeconds,
+		orphanedVolumesDetached,
+		volumeAbnormal,
+		volumeUsageAboveThreshold,
+		nodeOperationDuration,
+		nodeFormats,
+		nodeFailures,
+		rpcRequests,
+		rpcDuration,
+		apiRequests,
+		apiRequestDuration,
+	)
+}
+
+// serveMetrics serves the driver metrics on addr under /metrics until the process exits.
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	klog.Infof("metrics server started on %s", addr)
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		klog.Errorf("metrics server: %v", err)
+	}
+}
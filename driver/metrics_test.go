@@ -0,0 +1,26 @@
+package driver
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAPIMetricsPath(t *testing.T) {
+	testsBench := []struct {
+		path string
+		want string
+	}{
+		{path: "/v2/block-storage", want: "/v2/block-storage"},
+		{path: "/v2/block-storage/b0b1c2d3-0000-4000-8000-000000000001", want: "/v2/block-storage/:id"},
+		{path: "/v2/block-storage/b0b1c2d3-0000-4000-8000-000000000001:attach", want: "/v2/block-storage/:id:attach"},
+		{path: "/v2/block-storage/b0b1c2d3-0000-4000-8000-000000000001/attach", want: "/v2/block-storage/:id/attach"},
+		{path: "/v2/operation/B0B1C2D3-0000-4000-8000-000000000001/b0b1c2d3-0000-4000-8000-000000000002", want: "/v2/operation/:id/:id"},
+	}
+
+	for _, tt := range testsBench {
+		t.Run(tt.path, func(t *testing.T) {
+			require.Equal(t, tt.want, apiMetricsPath(tt.path))
+		})
+	}
+}
@@ -0,0 +1,11 @@
+//go:build mockdiskutils
+
+package driver
+
+// newMockDiskUtils returns the fakeDiskUtils of the node started with --mock-diskutils,
+// to run the node RPCs without devices nor root privileges.
+func newMockDiskUtils() (DiskUtils, error) {
+	f := newFakeDiskUtils()
+	f.attachAll = true
+	return f, nil
+}
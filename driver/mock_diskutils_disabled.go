@@ -0,0 +1,11 @@
+//go:build !mockdiskutils
+
+package driver
+
+import "errors"
+
+// newMockDiskUtils refuses --mock-diskutils: the fakeDiskUtils is not shipped
+// in the drivers built without the mockdiskutils build tag.
+func newMockDiskUtils() (DiskUtils, error) {
+	return nil, errors.New("--mock-diskutils requires the driver to be built with the mockdiskutils build tag")
+}
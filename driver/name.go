@@ -0,0 +1,61 @@
+package driver
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// driverNamePattern matches the plugin names allowed by the CSI specification,
+// of at most 63 characters.
+var driverNamePattern = regexp.MustCompile(`^[a-zA-Z0-9]([-a-zA-Z0-9_.]*[a-zA-Z0-9])?$`)
+
+func validateDriverName(name string) error {
+	if len(name) > 63 || !driverNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid driver name %q, expected at most 63 alphanumeric, '-', '_' or '.' characters, starting and ending with an alphanumeric character", name)
+	}
+
+	return nil
+}
+
+// driverNameKeys returns the topology, volume context, publish context and Kubernetes metadata keys
+// prefixed with the name of the driver, so that the drivers installed side by side don't share them.
+// The volume labels stored in the Exoscale API keep the default name: the deletion protection
+// and the striped volumes are recognized whatever the name of the driver which labeled them.
+// TestDriverNameKeysComplete fails when a package-level key built from DriverName is missing.
+func driverNameKeys() []*string {
+	keys := []*string{
+		&ZoneTopologyKey,
+		&RegionTopologyKey,
+		&exoscaleVolumeID,
+		&exoscaleVolumeName,
+		&exoscaleVolumeZone,
+		&exoscaleDeviceSerial,
+		&exoscaleVolumeReadonly,
+		&exoscaleVolumeFSType,
+		&exoscaleVolumeEncrypted,
+		&exoscaleMkfsOptionsPrefix,
+		&exoscaleStripeSerials,
+		&exoscaleBtrfsCompression,
+		&exoscaleBtrfsSubvolume,
+		&exoscaleReservedBlocksPercentage,
+		&exoscaleExt4Features,
+		&exoscaleFreezeNodeLabel,
+		&exoscaleFreezeRequestAnnotation,
+		&exoscaleFreezeDeadlineAnnotation,
+		&exoscaleFrozenAnnotation,
+	}
+	for i := range ioTuningParameters {
+		keys = append(keys, &ioTuningParameters[i].contextKey)
+	}
+
+	return keys
+}
+
+// setDriverName renames the driver and the keys prefixed with its name.
+func setDriverName(name string) {
+	for _, key := range driverNameKeys() {
+		*key = strings.Replace(*key, DriverName, name, 1)
+	}
+	DriverName = name
+}
@@ -0,0 +1,115 @@
+package driver
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateDriverName(t *testing.T) {
+	testsBench := []struct {
+		name  string
+		valid bool
+	}{
+		{name: DefaultDriverName, valid: true},
+		{name: "canary.csi.exoscale.com", valid: true},
+		{name: "csi_exoscale-v2", valid: true},
+		{name: "", valid: false},
+		{name: "-csi.exoscale.com", valid: false},
+		{name: "csi.exoscale.com.", valid: false},
+		{name: "csi/exoscale", valid: false},
+		{name: strings.Repeat("a", 64), valid: false},
+	}
+
+	for _, tt := range testsBench {
+		err := validateDriverName(tt.name)
+		if tt.valid {
+			require.NoError(t, err, tt.name)
+		} else {
+			require.Error(t, err, tt.name)
+		}
+	}
+}
+
+func TestSetDriverName(t *testing.T) {
+	const name = "canary.csi.exoscale.com"
+	t.Cleanup(func() { setDriverName(DefaultDriverName) })
+
+	setDriverName(name)
+
+	require.Equal(t, name, DriverName)
+	require.Equal(t, "topology.canary.csi.exoscale.com/zone", ZoneTopologyKey)
+	require.Equal(t, "topology.canary.csi.exoscale.com/region", RegionTopologyKey)
+	require.Equal(t, "canary.csi.exoscale.com/device-serial", exoscaleDeviceSerial)
+	require.Equal(t, "canary.csi.exoscale.com/io-scheduler", ioTuningParameters[0].contextKey)
+	for _, key := range driverNameKeys() {
+		require.Contains(t, *key, name)
+	}
+
+	// The volume labels stored in the Exoscale API keep the default name.
+	require.Equal(t, "csi.exoscale.com/deletion-protection", exoscaleDeletionProtection)
+	require.Equal(t, "csi.exoscale.com/stripes", exoscaleVolumeStripes)
+
+	setDriverName(DefaultDriverName)
+	require.Equal(t, "topology.csi.exoscale.com/zone", ZoneTopologyKey)
+	require.Equal(t, "csi.exoscale.com/device-serial", exoscaleDeviceSerial)
+}
+
+// TestDriverNameKeysComplete checks that every package-level key built from DriverName is renamed by setDriverName,
+// driverNameKeys being maintained by hand.
+func TestDriverNameKeysComplete(t *testing.T) {
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, ".", func(info fs.FileInfo) bool {
+		return !strings.HasSuffix(info.Name(), "_test.go")
+	}, 0)
+	require.NoError(t, err)
+
+	// keyValue returns the default value of a concatenation of DriverName and string literals.
+	var keyValue func(expr ast.Expr) (string, bool)
+	keyValue = func(expr ast.Expr) (string, bool) {
+		switch e := expr.(type) {
+		case *ast.Ident:
+			return DefaultDriverName, e.Name == "DriverName"
+		case *ast.BasicLit:
+			value, err := strconv.Unquote(e.Value)
+			return value, e.Kind == token.STRING && err == nil
+		case *ast.BinaryExpr:
+			x, okX := keyValue(e.X)
+			y, okY := keyValue(e.Y)
+			return x + y, e.Op == token.ADD && okX && okY
+		}
+		return "", false
+	}
+
+	declared := map[string]bool{}
+	for _, file := range pkgs["driver"].Files {
+		for _, decl := range file.Decls {
+			if gen, ok := decl.(*ast.GenDecl); !ok || gen.Tok != token.VAR {
+				continue
+			}
+			ast.Inspect(decl, func(n ast.Node) bool {
+				expr, ok := n.(*ast.BinaryExpr)
+				if !ok {
+					return true
+				}
+				if value, ok := keyValue(expr); ok && strings.Contains(value, DefaultDriverName) {
+					declared[value] = true
+				}
+				return false
+			})
+		}
+	}
+	require.NotEmpty(t, declared)
+
+	renamed := map[string]bool{}
+	for _, key := range driverNameKeys() {
+		renamed[*key] = true
+	}
+	require.Equal(t, declared, renamed, "keys built from DriverName missing from driverNameKeys")
+}
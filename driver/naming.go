@@ -0,0 +1,116 @@
+package driver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	// DefaultVolumeNameTemplate names the volumes after the CSI volume name (the PV name).
+	DefaultVolumeNameTemplate = "{prefix}{name}"
+	// DefaultSnapshotNameTemplate names the snapshots after the CSI snapshot name (the VolumeSnapshotContent name).
+	DefaultSnapshotNameTemplate = "{prefix}{name}"
+
+	// maxResourceNameLength is the maximum length of a block storage volume or snapshot name.
+	maxResourceNameLength = 255
+	nameHashLength        = 8
+)
+
+// Keys of the metadata added to the CreateVolume and CreateSnapshot parameters
+// by the external-provisioner and external-snapshotter with --extra-create-metadata.
+const (
+	pvcNameKey                   = "csi.storage.k8s.io/pvc/name"
+	pvcNamespaceKey              = "csi.storage.k8s.io/pvc/namespace"
+	pvNameKey                    = "csi.storage.k8s.io/pv/name"
+	volumeSnapshotNameKey        = "csi.storage.k8s.io/volumesnapshot/name"
+	volumeSnapshotNamespaceKey   = "csi.storage.k8s.io/volumesnapshot/namespace"
+	volumeSnapshotContentNameKey = "csi.storage.k8s.io/volumesnapshotcontent/name"
+)
+
+var namePlaceholderRegexp = regexp.MustCompile(`\{([a-z]+)\}`)
+
+// volumeNamePlaceholders maps the placeholders of a volume name template to the request parameter holding their value.
+var volumeNamePlaceholders = map[string]string{
+	"namespace": pvcNamespaceKey,
+	"pvc":       pvcNameKey,
+	"pv":        pvNameKey,
+}
+
+// snapshotNamePlaceholders maps the placeholders of a snapshot name template to the request parameter holding their value.
+var snapshotNamePlaceholders = map[string]string{
+	"namespace":       volumeSnapshotNamespaceKey,
+	"snapshot":        volumeSnapshotNameKey,
+	"snapshotcontent": volumeSnapshotContentNameKey,
+}
+
+// nameTemplate renders the name of an Exoscale resource from the CSI request name,
+// the driver prefix and the metadata added by the sidecars.
+type nameTemplate struct {
+	template     string
+	prefix       string
+	placeholders map[string]string
+}
+
+func newNameTemplate(template, prefix string, placeholders map[string]string) (*nameTemplate, error) {
+	for _, match := range namePlaceholderRegexp.FindAllStringSubmatch(template, -1) {
+		placeholder := match[1]
+		if placeholder == "prefix" || placeholder == "name" {
+			continue
+		}
+		if _, ok := placeholders[placeholder]; !ok {
+			return nil, fmt.Errorf("unknown placeholder {%s} in name template %q", placeholder, template)
+		}
+	}
+
+	return &nameTemplate{
+		template:     template,
+		prefix:       prefix,
+		placeholders: placeholders,
+	}, nil
+}
+
+// render returns the resource name for the CSI request name and parameters.
+// It falls back to the prefixed request name if a placeholder cannot be resolved.
+// As the request name is the only value guaranteed to be unique, a hash of it is appended
+// when the template doesn't reference {name} or when the name has to be truncated.
+func (t *nameTemplate) render(name string, parameters map[string]string) string {
+	unresolved := false
+	rendered := namePlaceholderRegexp.ReplaceAllStringFunc(t.template, func(match string) string {
+		placeholder := match[1 : len(match)-1]
+		switch placeholder {
+		case "prefix":
+			return t.prefix
+		case "name":
+			return name
+		}
+
+		value := parameters[t.placeholders[placeholder]]
+		if value == "" {
+			unresolved = true
+		}
+		return value
+	})
+	if unresolved {
+		rendered = t.prefix + name
+	}
+
+	unique := unresolved || strings.Contains(t.template, "{name}")
+	if unique && len(rendered) <= maxResourceNameLength {
+		return rendered
+	}
+
+	hash := nameHash(name)
+	if len(rendered)+len(hash)+1 > maxResourceNameLength {
+		rendered = rendered[:maxResourceNameLength-len(hash)-1]
+	}
+
+	return rendered + "-" + hash
+}
+
+func nameHash(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return hex.EncodeToString(sum[:])[:nameHashLength]
+}
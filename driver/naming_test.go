@@ -0,0 +1,69 @@
+package driver
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNameTemplate(t *testing.T) {
+	const name = "pvc-8a6ad5e0-5de1-4ecb-b9d6-e2d4c2a3c0e4"
+	parameters := map[string]string{
+		pvcNamespaceKey: "default",
+		pvcNameKey:      "data",
+		pvNameKey:       name,
+	}
+
+	testsBench := []struct {
+		template   string
+		prefix     string
+		parameters map[string]string
+		res        string
+	}{
+		{
+			template:   DefaultVolumeNameTemplate,
+			parameters: parameters,
+			res:        name,
+		},
+		{
+			template:   DefaultVolumeNameTemplate,
+			prefix:     "sks-",
+			parameters: parameters,
+			res:        "sks-" + name,
+		},
+		{
+			template:   "{prefix}{namespace}-{pvc}-{name}",
+			prefix:     "sks-",
+			parameters: parameters,
+			res:        "sks-default-data-" + name,
+		},
+		{
+			template:   "{namespace}-{pvc}",
+			parameters: parameters,
+			res:        "default-data-" + nameHash(name),
+		},
+		{
+			template:   "{namespace}-{pvc}-{name}",
+			parameters: nil,
+			res:        name,
+		},
+		{
+			template:   "{pvc}-{name}",
+			parameters: map[string]string{pvcNameKey: strings.Repeat("a", 300)},
+			res:        strings.Repeat("a", maxResourceNameLength-nameHashLength-1) + "-" + nameHash(name),
+		},
+	}
+
+	for _, test := range testsBench {
+		template, err := newNameTemplate(test.template, test.prefix, volumeNamePlaceholders)
+		require.NoError(t, err)
+		require.Equal(t, test.res, template.render(name, test.parameters))
+	}
+
+	_, err := newNameTemplate("{cluster}-{name}", "", volumeNamePlaceholders)
+	require.Error(t, err)
+
+	_, err = newNameTemplate("{snapshot}-{name}", "", volumeNamePlaceholders)
+	require.Error(t, err)
+}
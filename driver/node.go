@@ -2,43 +2,236 @@ package driver
 
 import (
 	"context"
+	"fmt"
 	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	v3 "github.com/exoscale/egoscale/v3"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
-	"golang.org/x/sys/unix"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"k8s.io/klog/v2"
+	kmount "k8s.io/mount-utils"
 )
 
 const (
-	// TODO: replace it to get from Exoscale account resource limit.
-	maxVolumesPerNode = 5
+	// DefaultMaxVolumesPerNode is the default maximum number of block storage volumes
+	// that can be attached to a single instance.
+	DefaultMaxVolumesPerNode = 5
 )
 
 type nodeService struct {
-	nodeID    v3.UUID
-	zoneName  v3.ZoneName
-	diskUtils *diskUtils
+	nodeID        v3.UUID
+	zoneName      v3.ZoneName
+	defaultFSType string
+	// defaultMountOptions are added to the mount options of the filesystems unless they override them.
+	defaultMountOptions []string
+	// xfsRepair enables the repair of the xfs filesystems which fail to mount because of their dirty log.
+	xfsRepair bool
+	// deviceWaitTimeout is the maximum duration to wait for the device of a volume to appear after its attachment.
+	deviceWaitTimeout time.Duration
+	// maxVolumesPerNode is the maximum number of block storage volumes attached to the instance reported to the CO.
+	maxVolumesPerNode int64
+	diskUtils         DiskUtils
+	publications      *volumePublications
+	// readonlyBlockDevices are the raw block devices set read-only to be published read-only.
+	readonlyBlockDevices *readonlyBlockDevices
+	// volumeLocks serializes the operations on the same volume.
+	volumeLocks *volumeLocks
 
 	csi.UnimplementedNodeServer
 }
 
-func newNodeService(meta *nodeMetadata) nodeService {
+func newNodeService(meta *nodeMetadata, config *DriverConfig, diskUtils DiskUtils) nodeService {
+	defaultFSType := config.DefaultFSType
+	if defaultFSType == "" {
+		defaultFSType = DefaultFSType
+	}
+	deviceWaitTimeout := config.DeviceWaitTimeout
+	if deviceWaitTimeout <= 0 {
+		deviceWaitTimeout = DefaultDeviceWaitTimeout
+	}
+	maxVolumesPerNode := config.MaxVolumesPerNode
+	if maxVolumesPerNode <= 0 {
+		maxVolumesPerNode = DefaultMaxVolumesPerNode
+	}
+
 	return nodeService{
-		nodeID:    meta.InstanceID,
-		zoneName:  meta.zoneName,
-		diskUtils: newDiskUtils(),
+		nodeID:               meta.InstanceID,
+		zoneName:             meta.zoneName,
+		defaultFSType:        defaultFSType,
+		defaultMountOptions:  config.DefaultMountOptions,
+		xfsRepair:            config.XFSRepair,
+		deviceWaitTimeout:    deviceWaitTimeout,
+		maxVolumesPerNode:    maxVolumesPerNode,
+		diskUtils:            diskUtils,
+		publications:         newVolumePublications(),
+		readonlyBlockDevices: newReadonlyBlockDevices(),
+		volumeLocks:          newVolumeLocks(),
+	}
+}
+
+// volumePublications keeps track of the target paths each volume is published on,
+// to enforce the SINGLE_NODE_SINGLE_WRITER access mode.
+type volumePublications struct {
+	mu      sync.Mutex
+	targets map[v3.UUID]map[string]struct{}
+}
+
+func newVolumePublications() *volumePublications {
+	return &volumePublications{
+		targets: make(map[v3.UUID]map[string]struct{}),
+	}
+}
+
+// publishedElsewhere returns the target path the volume is published on, other than targetPath, if any.
+func (p *volumePublications) publishedElsewhere(volumeID v3.UUID, targetPath string) (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for target := range p.targets[volumeID] {
+		if target != targetPath {
+			return target, true
+		}
+	}
+
+	return "", false
+}
+
+func (p *volumePublications) add(volumeID v3.UUID, targetPath string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.targets[volumeID]; !ok {
+		p.targets[volumeID] = make(map[string]struct{})
+	}
+	p.targets[volumeID][targetPath] = struct{}{}
+}
+
+func (p *volumePublications) remove(volumeID v3.UUID, targetPath string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.targets[volumeID], targetPath)
+	if len(p.targets[volumeID]) == 0 {
+		delete(p.targets, volumeID)
+	}
+}
+
+// restorePublications rebuilds the publications of the volumes staged in the kubelet directory from their bind mounts,
+// which outlive the node plugin, so that SINGLE_NODE_SINGLE_WRITER is still enforced after a restart.
+func (d *nodeService) restorePublications(kubeletDir string) error {
+	stagingPaths, err := listKubeletStagingPaths(kubeletDir)
+	if err != nil {
+		return err
+	}
+	mounts, err := d.diskUtils.ListMountInfo()
+	if err != nil {
+		return err
+	}
+
+	readonlyMounts := make(map[string]bool)
+	for _, mount := range mounts {
+		readonlyMounts[mount.mountPoint] = slices.Contains(mount.mountOptions, "ro")
+	}
+
+	for _, p := range stagingPaths {
+		targets := volumePublicationTargets(mounts, p.volumeID, p.stagingTargetPath)
+		for _, targetPath := range targets {
+			klog.V(4).Infof("volume %s is published on %s", p.volumeID, targetPath)
+			d.publications.add(p.volumeID, targetPath)
+		}
+
+		// The raw block devices staged or published read-only were set read-only,
+		// which is to be restored once they are no longer staged or published read-only.
+		blockPath := blockStagingPath(p.stagingTargetPath, p.volumeID)
+		devicePath := blockStagingDevicePath(mounts, blockPath)
+		if devicePath == "" {
+			continue
+		}
+		for _, targetPath := range append([]string{blockPath}, targets...) {
+			if readonlyMounts[targetPath] {
+				klog.V(4).Infof("block device %s of volume %s is read-only on %s", devicePath, p.volumeID, targetPath)
+				d.readonlyBlockDevices.restore(devicePath, targetPath)
+			}
+		}
+	}
+
+	return nil
+}
+
+// blockStagingDevicePath returns the path of the device bind mounted on the block staging path blockPath,
+// in the device filesystem it is bind mounted from, empty if blockPath isn't mounted.
+func blockStagingDevicePath(mounts []*mountInfo, blockPath string) string {
+	var staging *mountInfo
+	for _, mount := range mounts {
+		if mount.mountPoint == blockPath {
+			staging = mount
+			break
+		}
+	}
+	if staging == nil {
+		return ""
 	}
+
+	for _, mount := range mounts {
+		if mount.majorMinor == staging.majorMinor && mount.root == "/" {
+			return filepath.Join(mount.mountPoint, staging.root)
+		}
+	}
+
+	return ""
+}
+
+// volumePublicationTargets returns the target paths the volume staged on stagingTargetPath is published on:
+// the mounts of the same filesystem, or of the same device for raw block volumes, as the staging mount.
+func volumePublicationTargets(mounts []*mountInfo, volumeID v3.UUID, stagingTargetPath string) []string {
+	var staging *mountInfo
+	for _, stagingPath := range []string{blockStagingPath(stagingTargetPath, volumeID), stagingTargetPath} {
+		for _, mount := range mounts {
+			if mount.mountPoint == stagingPath {
+				staging = mount
+				break
+			}
+		}
+		if staging != nil {
+			break
+		}
+	}
+	if staging == nil {
+		return nil
+	}
+
+	// The publications bind mount the staging path, or a subdirectory of it such as a btrfs subvolume,
+	// while the raw block devices are bind mounted from the device filesystem which must not match as a whole.
+	rootPrefix := strings.TrimSuffix(staging.root, "/") + "/"
+	var targets []string
+	for _, mount := range mounts {
+		if mount.majorMinor != staging.majorMinor || (mount.root != staging.root && !strings.HasPrefix(mount.root, rootPrefix)) {
+			continue
+		}
+		if mount.mountPoint == stagingTargetPath || strings.HasPrefix(mount.mountPoint, stagingTargetPath+"/") {
+			continue
+		}
+		targets = append(targets, mount.mountPoint)
+	}
+
+	return targets
 }
 
 // NodeStageVolume prepare the physical volume to be ready.
 // format, mkfs...etc.
 func (d *nodeService) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
-	klog.V(4).Infof("NodeStageVolume, %#v", req)
+	logger := klog.FromContext(ctx)
+	logger.V(4).Info("NodeStageVolume")
+	defer observeNodeOperation(stageOperation, time.Now())
+
 	stagingTargetPath := req.GetStagingTargetPath()
 	if stagingTargetPath == "" {
 		return nil, status.Error(codes.InvalidArgument, "stagingTargetPath not provided")
@@ -54,12 +247,18 @@ func (d *nodeService) NodeStageVolume(ctx context.Context, req *csi.NodeStageVol
 
 	_, volumeID, err := getExoscaleID(req.VolumeId)
 	if err != nil {
-		klog.Errorf("parse exoscale volume ID %s: %v", req.VolumeId, err)
+		logger.Error(err, "parse exoscale volume ID")
 		return nil, err
 	}
+	unlock, err := d.volumeLocks.lock(ctx, volumeID)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
 
-	devicePath, err := d.diskUtils.GetDevicePath(volumeID)
+	devicePath, err := d.getDevicePath(ctx, volumeID, req.GetPublishContext())
 	if err != nil {
+		nodeFailures.WithLabelValues(devicePhase).Inc()
 		if os.IsNotExist(err) {
 			return nil, status.Errorf(codes.NotFound, "volume %s is not mounted on node", volumeID)
 		}
@@ -67,13 +266,49 @@ func (d *nodeService) NodeStageVolume(ctx context.Context, req *csi.NodeStageVol
 		return nil, status.Errorf(codes.Internal, "get device path for volume %s: %s", volumeID, err.Error())
 	}
 
-	klog.V(4).Infof("volume %s has device path %s", volumeID, devicePath)
+	logger.V(4).Info("volume has device path", "devicePath", devicePath)
+
+	// The staging path of a volume published read-only everywhere is read-only too,
+	// rather than relying on the read-only publications only.
+	readonly := isPublishedReadonly(req.GetPublishContext())
 
-	// no need to mount if it's in block mode
+	if err := applyIOTuning(sysBlock, devicePath, req.GetVolumeContext()); err != nil {
+		return nil, status.Errorf(codes.Internal, "apply I/O tuning to volume %s: %v", volumeID, err)
+	}
+
+	// the device of a raw block volume is bind mounted in the staging path, the publications bind mount it in turn.
 	if _, ok := volumeCapability.GetAccessType().(*csi.VolumeCapability_Block); ok {
+		if isVolumeEncrypted(req.GetVolumeContext()) {
+			return nil, status.Errorf(codes.InvalidArgument, "volume %s: raw block volumes can't be encrypted", volumeID)
+		}
+		if err := d.stageBlockDevice(volumeID, devicePath, stagingTargetPath, readonly); err != nil {
+			return nil, status.Errorf(codes.Internal, "stage block device %s of volume %s: %v", devicePath, volumeID, err)
+		}
 		return &csi.NodeStageVolumeResponse{}, nil
 	}
 
+	if isVolumeEncrypted(req.GetVolumeContext()) {
+		passphrase := req.GetSecrets()[luksPassphraseKey]
+		if passphrase == "" {
+			return nil, status.Errorf(codes.InvalidArgument, "volume %s is encrypted but the %s node stage secret is not provided", volumeID, luksPassphraseKey)
+		}
+
+		devicePath, err = d.diskUtils.LuksOpen(devicePath, luksMapperName(volumeID), passphrase)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "open encrypted volume %s: %v", volumeID, err)
+		}
+		logger.V(4).Info("encrypted volume is opened", "devicePath", devicePath)
+
+		// The volume may have been expanded while detached, the mapping is resized to the device
+		// first so that the filesystem on it can be grown.
+		if !readonly {
+			if err := d.diskUtils.LuksResize(luksMapperName(volumeID), passphrase); err != nil {
+				nodeFailures.WithLabelValues(resizePhase).Inc()
+				logger.Error(err, "resize encrypted volume mapping", "devicePath", devicePath)
+			}
+		}
+	}
+
 	isMounted, err := d.diskUtils.IsSharedMounted(stagingTargetPath, devicePath)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "checking mount point of volume %s on path %s: %s", volumeID, stagingTargetPath, err.Error())
@@ -87,7 +322,7 @@ func (d *nodeService) NodeStageVolume(ctx context.Context, req *csi.NodeStageVol
 		if blockDevice {
 			return nil, status.Errorf(codes.Unknown, "block device mounted as stagingTargetPath %s for volume %s", stagingTargetPath, volumeID)
 		}
-		klog.V(4).Infof("volume %s is already mounted on %s", volumeID, stagingTargetPath)
+		logger.V(4).Info("volume is already mounted", "stagingTargetPath", stagingTargetPath)
 		return &csi.NodeStageVolumeResponse{}, nil
 	}
 
@@ -95,29 +330,129 @@ func (d *nodeService) NodeStageVolume(ctx context.Context, req *csi.NodeStageVol
 	if mountCap == nil {
 		return nil, status.Error(codes.InvalidArgument, "mount volume capability is nil")
 	}
+	if _, err := parseVolumeMountGroup(mountCap.GetVolumeMountGroup()); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "volume %s: %v", volumeID, err)
+	}
 
-	mountOptions := mountCap.GetMountFlags()
-	fsType := mountCap.GetFsType()
+	// The ID mapping applies to the bind mounts of the publications, not to the filesystem.
+	idmap, mountFlags, err := splitIdmapMountOption(mountCap.GetMountFlags())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "volume %s: %v", volumeID, err)
+	}
+	mountOptions, err := validateMountOptions(withDefaultMountOptions(mountFlags, d.defaultMountOptions))
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "volume %s: %v", volumeID, err)
+	}
+	fsType, err := getStageFSType(mountCap.GetFsType(), req.GetVolumeContext())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "volume %s: %v", volumeID, err)
+	}
 
-	klog.V(4).Infof("Volume %s will be mounted on %s with type %s and options %s", volumeID, stagingTargetPath, fsType, strings.Join(mountOptions, ","))
+	// Mounting with another type would fail with an obscure error, and the device must never be reformatted.
+	existingFSType, err := d.diskUtils.GetDiskFormat(devicePath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "probe filesystem of volume %s on %s: %v", volumeID, devicePath, err)
+	}
+	// The volumes without filesystem type are mounted with the filesystem they were formatted with,
+	// so that changing the default filesystem type doesn't affect the existing volumes.
+	if fsType == "" {
+		fsType = existingFSType
+	}
+	if fsType == "" {
+		fsType = d.defaultFSType
+	}
+	if idmap != "" {
+		if err := validateIdmapFSType(fsType); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "volume %s: %v", volumeID, err)
+		}
+	}
+	if fsType == "btrfs" {
+		mountOptions = withBtrfsCompression(mountOptions, req.GetVolumeContext())
+	}
+
+	if readonly {
+		mountOptions = append(mountOptions, "ro")
+	}
+
+	if isFSTypeMismatch(existingFSType, fsType) {
+		return nil, status.Errorf(codes.FailedPrecondition, "volume %s is already formatted with %s but %s is requested, fix the fsType of the StorageClass or the volume", volumeID, existingFSType, fsType)
+	}
+
+	logger.V(4).Info("mounting volume", "stagingTargetPath", stagingTargetPath, "fsType", fsType, "mountOptions", mountOptions)
+
+	// The filesystems formatted elsewhere, e.g. restored from a snapshot, are tuned before mounting them,
+	// the features of which can't change once mounted.
+	extFormatOptions, tuneOptions := getStageExtTuning(fsType, req.GetVolumeContext(), existingFSType != "")
+	formatOptions := append(getStageMkfsOptions(fsType, req.GetVolumeContext()), extFormatOptions...)
+	if existingFSType != "" && len(tuneOptions) > 0 && !readonly {
+		if err := d.diskUtils.Tune2fs(devicePath, tuneOptions); err != nil {
+			return nil, status.Errorf(codes.Internal, "tune filesystem of volume %s on %s: %v", volumeID, devicePath, err)
+		}
+	}
+
+	// The volume may have been expanded while detached, f2fs filesystems can only be grown before mounting them.
+	if existingFSType == "f2fs" && !readonly {
+		d.growF2FS(volumeID, devicePath)
+	}
 
-	err = d.diskUtils.FormatAndMount(stagingTargetPath, devicePath, fsType, mountOptions)
+	err = d.diskUtils.FormatAndMount(stagingTargetPath, devicePath, fsType, mountOptions, formatOptions)
+	if err != nil && fsType == "xfs" && isXFSCorrupted(err) {
+		err = d.repairXFS(volumeID, devicePath, err)
+		if err == nil {
+			err = d.diskUtils.FormatAndMount(stagingTargetPath, devicePath, fsType, mountOptions, nil)
+		}
+	}
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "format and mount device from (%q) to (%q) with fstype (%q) and options (%q): %v",
-			devicePath, stagingTargetPath, fsType, mountOptions, err)
+		if existingFSType == "" {
+			nodeFailures.WithLabelValues(formatPhase).Inc()
+		} else {
+			nodeFailures.WithLabelValues(mountPhase).Inc()
+		}
+		if status.Code(err) == codes.FailedPrecondition {
+			return nil, err
+		}
+		return nil, mountErrorStatus(err, fmt.Sprintf("format and mount device from (%q) to (%q) with fstype (%q) and options (%q)",
+			devicePath, stagingTargetPath, fsType, mountOptions))
+	}
+	logger.V(4).Info("volume mounted", "stagingTargetPath", stagingTargetPath, "fsType", fsType, "mountOptions", mountOptions)
+	if existingFSType == "" {
+		nodeFormats.WithLabelValues(fsType).Inc()
+	}
+
+	if existingFSType == "" && len(tuneOptions) > 0 && !readonly {
+		if err := d.diskUtils.Tune2fs(devicePath, tuneOptions); err != nil {
+			return nil, status.Errorf(codes.Internal, "tune filesystem of volume %s on %s: %v", volumeID, devicePath, err)
+		}
+	}
+
+	// The volume may have been expanded while detached, grow the filesystem
+	// rather than waiting for a NodeExpandVolume call which may never come.
+	if !readonly {
+		if fsType != "f2fs" {
+			d.growFilesystem(volumeID, stagingTargetPath, devicePath)
+		}
+
+		if err := applyVolumeMountGroup(stagingTargetPath, mountCap.GetVolumeMountGroup()); err != nil {
+			return nil, status.Errorf(codes.Internal, "apply volume mount group %s to volume %s: %v", mountCap.GetVolumeMountGroup(), volumeID, err)
+		}
 	}
-	klog.V(4).Infof("Volume %s has been mounted on %s with type %s and options %s", volumeID, stagingTargetPath, fsType, strings.Join(mountOptions, ","))
 
 	return &csi.NodeStageVolumeResponse{}, nil
 }
 
 // Specific fs cleanup or close like luks close...etc.
 func (d *nodeService) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
-	klog.V(4).Infof("NodeUnstageVolume")
+	logger := klog.FromContext(ctx)
+	logger.V(4).Info("NodeUnstageVolume")
 	_, volumeID, err := getExoscaleID(req.GetVolumeId())
 	if err != nil {
 		return nil, err
 	}
+	unlock, err := d.volumeLocks.lock(ctx, volumeID)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
 
 	stagingTargetPath := req.GetStagingTargetPath()
 	if stagingTargetPath == "" {
@@ -127,7 +462,19 @@ func (d *nodeService) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstag
 	_, err = d.diskUtils.GetDevicePath(volumeID)
 	if err != nil {
 		if os.IsNotExist(err) {
-			// Volume not found ignore and return success.
+			// Volume not found, clean the staging path up if the device disappeared while mounted and return success.
+			if err := d.unstageBlockDevice(volumeID, stagingTargetPath); err != nil {
+				return nil, status.Errorf(codes.Internal, "unstage block device of volume %s: %v", volumeID, err)
+			}
+			if err := d.cleanupStaleStagingPath(volumeID, stagingTargetPath); err != nil {
+				return nil, status.Errorf(codes.Internal, "clean up stale staging path %s of volume %s: %v", stagingTargetPath, volumeID, err)
+			}
+			if err := d.diskUtils.LuksClose(luksMapperName(volumeID)); err != nil {
+				return nil, status.Errorf(codes.Internal, "close encrypted volume %s: %v", volumeID, err)
+			}
+			if err := d.diskUtils.DisassembleStripedVolume(stripedVolumeGroup(volumeID)); err != nil {
+				return nil, status.Errorf(codes.Internal, "deactivate striped volume %s: %v", volumeID, err)
+			}
 			return &csi.NodeUnstageVolumeResponse{}, nil
 		}
 		return nil, status.Errorf(codes.Internal, "error getting device path for volume %s: %s", volumeID, err.Error())
@@ -135,6 +482,14 @@ func (d *nodeService) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstag
 
 	if _, err := os.Stat(stagingTargetPath); os.IsNotExist(err) {
 		return nil, status.Errorf(codes.NotFound, "volume %s not found on node", volumeID)
+	} else if kmount.IsCorruptedMnt(err) {
+		if err := d.cleanupStaleStagingPath(volumeID, stagingTargetPath); err != nil {
+			return nil, status.Errorf(codes.Internal, "clean up stale staging path %s of volume %s: %v", stagingTargetPath, volumeID, err)
+		}
+	}
+
+	if err := d.unstageBlockDevice(volumeID, stagingTargetPath); err != nil {
+		return nil, status.Errorf(codes.Internal, "unstage block device of volume %s: %v", volumeID, err)
 	}
 
 	isMounted, err := d.diskUtils.IsSharedMounted(stagingTargetPath, "")
@@ -143,23 +498,110 @@ func (d *nodeService) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstag
 	}
 
 	if isMounted {
-		klog.V(4).Infof("Volume with ID %s is mounted on %s, umounting it", volumeID, stagingTargetPath)
+		logger.V(4).Info("volume is mounted, unmounting it", "stagingTargetPath", stagingTargetPath)
 		err = d.diskUtils.Unmount(stagingTargetPath)
 		if err != nil {
 			return nil, status.Errorf(codes.Internal, "error unmounting target path: %s", err.Error())
 		}
 	}
 
+	if err := d.diskUtils.LuksClose(luksMapperName(volumeID)); err != nil {
+		return nil, status.Errorf(codes.Internal, "close encrypted volume %s: %v", volumeID, err)
+	}
+	if err := d.diskUtils.DisassembleStripedVolume(stripedVolumeGroup(volumeID)); err != nil {
+		return nil, status.Errorf(codes.Internal, "deactivate striped volume %s: %v", volumeID, err)
+	}
+	volumeAbnormal.DeleteLabelValues(volumeID.String())
+
 	return &csi.NodeUnstageVolumeResponse{}, nil
 }
 
+// blockStagingPath returns the path the device of a raw block volume is bind mounted on in the staging path.
+func blockStagingPath(stagingTargetPath string, volumeID v3.UUID) string {
+	return filepath.Join(stagingTargetPath, volumeID.String())
+}
+
+// stageBlockDevice bind mounts the device of the raw block volume in the staging path,
+// the device is set read-only for the volumes staged read-only.
+func (d *nodeService) stageBlockDevice(volumeID v3.UUID, devicePath, stagingTargetPath string, readonly bool) error {
+	blockPath := blockStagingPath(stagingTargetPath, volumeID)
+	if readonly {
+		if err := d.readonlyBlockDevices.publish(d.diskUtils, devicePath, blockPath); err != nil {
+			return err
+		}
+	}
+
+	isMounted, err := d.diskUtils.IsSharedMounted(blockPath, "")
+	if err != nil {
+		return err
+	}
+	if isMounted {
+		klog.V(4).Infof("block device of volume %s is already staged on %s", volumeID, blockPath)
+		return nil
+	}
+
+	if err := createMountPoint(blockPath, true); err != nil {
+		return err
+	}
+
+	// The read-only state of the device is restored from the read-only bind mount after a restart of the driver.
+	mountOptions := []string{"bind"}
+	if readonly {
+		mountOptions = append(mountOptions, "ro")
+	}
+
+	return d.diskUtils.MountToTarget(devicePath, blockPath, "", mountOptions)
+}
+
+// unstageBlockDevice unmounts the device of the raw block volume from the staging path, if staged,
+// and restores the read-only state of the device staged read-only.
+func (d *nodeService) unstageBlockDevice(volumeID v3.UUID, stagingTargetPath string) error {
+	blockPath := blockStagingPath(stagingTargetPath, volumeID)
+	isMounted, err := d.diskUtils.IsSharedMounted(blockPath, "")
+	if err != nil {
+		return err
+	}
+
+	if isMounted {
+		klog.V(4).Infof("block device of volume %s is staged on %s, unmounting it", volumeID, blockPath)
+		if err := d.diskUtils.Unmount(blockPath); err != nil {
+			return err
+		}
+	}
+
+	return d.readonlyBlockDevices.unpublish(d.diskUtils, blockPath)
+}
+
+// cleanupStaleStagingPath forcibly unmounts the staging path if it is still mounted,
+// e.g. because the device disappeared after an instance-level detach, so that the volume can be staged again on the node.
+func (d *nodeService) cleanupStaleStagingPath(volumeID v3.UUID, stagingTargetPath string) error {
+	info, err := d.diskUtils.GetMountInfo(stagingTargetPath)
+	if err != nil {
+		return err
+	}
+	if info == nil {
+		return nil
+	}
+
+	klog.Warningf("volume %s staging path %s is stale, forcibly unmounting it", volumeID, stagingTargetPath)
+	return d.diskUtils.ForceUnmount(stagingTargetPath)
+}
+
 // Mounting volume in right path...etc.
 func (d *nodeService) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) { // nolint:gocyclo
-	klog.V(4).Infof("NodePublishVolume")
+	logger := klog.FromContext(ctx)
+	logger.V(4).Info("NodePublishVolume")
+	defer observeNodeOperation(publishOperation, time.Now())
+
 	_, volumeID, err := getExoscaleID(req.GetVolumeId())
 	if err != nil {
 		return nil, err
 	}
+	unlock, err := d.volumeLocks.lock(ctx, volumeID)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
 
 	targetPath := req.GetTargetPath()
 	if targetPath == "" {
@@ -181,8 +623,17 @@ func (d *nodeService) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 		return nil, status.Error(codes.FailedPrecondition, "stagingTargetPath not provided")
 	}
 
-	devicePath, err := d.diskUtils.GetDevicePath(volumeID)
+	readonly := req.GetReadonly() || isPublishedReadonly(req.GetPublishContext())
+
+	if volumeCapability.GetAccessMode().GetMode() == csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER {
+		if target, ok := d.publications.publishedElsewhere(volumeID, targetPath); ok {
+			return nil, status.Errorf(codes.FailedPrecondition, "volume %s with access mode SINGLE_NODE_SINGLE_WRITER is already published on %s", volumeID, target)
+		}
+	}
+
+	devicePath, err := d.getDevicePath(ctx, volumeID, req.GetPublishContext())
 	if err != nil {
+		nodeFailures.WithLabelValues(devicePhase).Inc()
 		return nil, status.Errorf(codes.NotFound, "volume %s not found: %s", volumeID, err.Error())
 	}
 
@@ -201,19 +652,13 @@ func (d *nodeService) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 		}
 
 		if volumeCapability.GetBlock() != nil {
-			// unix specific, will error if not unix
-			fd, err := unix.Openat(unix.AT_FDCWD, devicePath, unix.O_RDONLY, uint32(0))
-			defer unix.Close(fd)
+			ro, err := d.diskUtils.GetBlockReadonly(devicePath)
 			if err != nil {
-				return nil, status.Errorf(codes.Internal, "error opening block device %s: %s", devicePath, err.Error())
-			}
-			ro, err := unix.IoctlGetInt(fd, unix.BLKROGET)
-			if err != nil {
-				return nil, status.Errorf(codes.Internal, "error getting BLKROGET for block device %s: %s", devicePath, err.Error())
+				return nil, status.Error(codes.Internal, err.Error())
 			}
 
-			if (ro == 1) == req.GetReadonly() {
-				klog.V(4).Infof("Volume %s is already mounted as a raw device on %s", volumeID, targetPath)
+			if ro == readonly {
+				logger.V(4).Info("volume is already mounted as a raw device", "targetPath", targetPath)
 				return &csi.NodePublishVolumeResponse{}, nil
 			}
 			return nil, status.Errorf(codes.AlreadyExists, "volume %s does not match the given mount mode for the request", volumeID)
@@ -236,42 +681,61 @@ func (d *nodeService) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 			}
 		}
 
-		if isReadOnly != req.GetReadonly() {
+		if isReadOnly != readonly {
 			return nil, status.Errorf(codes.AlreadyExists, "volume with ID %s does not match the given mount mode for the request", volumeID)
 		}
 
-		klog.V(4).Infof("Volume %s is already mounted on %s", volumeID, stagingTargetPath)
+		logger.V(4).Info("volume is already mounted", "stagingTargetPath", stagingTargetPath)
 		return &csi.NodePublishVolumeResponse{}, nil
 	}
 
 	var sourcePath string
 	var fsType string
 	var mountOptions []string
+	var idmap string
 	mount := volumeCapability.GetMount()
 	if mount == nil {
 		if volumeCapability.GetBlock() != nil {
 			sourcePath = devicePath
-			if req.GetReadonly() {
-				fd, err := unix.Openat(unix.AT_FDCWD, devicePath, unix.O_RDONLY, uint32(0))
-				if err != nil {
-					return nil, status.Errorf(codes.Internal, "error opening block device %s: %s", devicePath, err.Error())
-				}
-				err = unix.IoctlSetPointerInt(fd, unix.BLKROSET, 1)
-				unix.Close(fd)
-				if err != nil {
-					return nil, status.Errorf(codes.Internal, "error setting BLKROSET for block device %s: %s", devicePath, err.Error())
+			// The volumes staged by a previous version of the driver don't have their device in the staging path.
+			blockPath := blockStagingPath(stagingTargetPath, volumeID)
+			if staged, err := d.diskUtils.IsSharedMounted(blockPath, ""); err == nil && staged {
+				sourcePath = blockPath
+			}
+			if readonly {
+				if err := d.readonlyBlockDevices.publish(d.diskUtils, devicePath, targetPath); err != nil {
+					return nil, status.Error(codes.Internal, err.Error())
 				}
 			}
 		}
 	} else {
+		// The volume mount group was applied to the filesystem when staging the volume.
+		if _, err := parseVolumeMountGroup(mount.GetVolumeMountGroup()); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "volume %s: %v", volumeID, err)
+		}
 		sourcePath = stagingTargetPath
+		if subvolume, ok := req.GetVolumeContext()[exoscaleBtrfsSubvolume]; ok {
+			sourcePath, err = d.btrfsSubvolume(stagingTargetPath, subvolume)
+			if err != nil {
+				return nil, status.Errorf(codes.FailedPrecondition, "volume %s: %v", volumeID, err)
+			}
+		}
 		fsType = mount.GetFsType()
-		mountOptions = mount.GetMountFlags()
+		// The SELinux context applies to the filesystem, it was set when mounting the staging path.
+		mountOptions, err = validateMountOptions(withoutSELinuxMountOptions(mount.GetMountFlags()))
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "volume %s: %v", volumeID, err)
+		}
+		// The owners of the files are shifted for the user namespace of the pod by an idmapped bind mount.
+		idmap, mountOptions, err = splitIdmapMountOption(mountOptions)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "volume %s: %v", volumeID, err)
+		}
 	}
 
 	mountOptions = append(mountOptions, "bind")
 
-	if req.GetReadonly() {
+	if readonly {
 		mountOptions = append(mountOptions, "ro")
 	}
 
@@ -280,32 +744,60 @@ func (d *nodeService) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 		return nil, status.Errorf(codes.Internal, "error creating mount point %s for volume with ID %s", targetPath, volumeID)
 	}
 
-	err = d.diskUtils.MountToTarget(sourcePath, targetPath, fsType, mountOptions)
+	if idmap != "" {
+		logger.V(4).Info("bind mounting volume with ID mapping", "targetPath", targetPath, "idmap", idmap)
+		err = d.diskUtils.MountIdmapped(sourcePath, targetPath, idmap, mountOptions)
+	} else {
+		err = d.diskUtils.MountToTarget(sourcePath, targetPath, fsType, mountOptions)
+	}
 	if err != nil {
+		nodeFailures.WithLabelValues(mountPhase).Inc()
+		if err := d.readonlyBlockDevices.unpublish(d.diskUtils, targetPath); err != nil {
+			logger.Error(err, "restore read-only state of block device", "devicePath", devicePath)
+		}
 		return nil, status.Errorf(codes.Internal, "error mounting source %s to target %s with fs of type %s : %s", sourcePath, targetPath, fsType, err.Error())
 	}
+	d.publications.add(volumeID, targetPath)
+
 	return &csi.NodePublishVolumeResponse{}, nil
 }
 
 // Unmounting volume.
 func (d *nodeService) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
-	klog.V(4).Infof("NodeUnpublishVolume")
+	klog.FromContext(ctx).V(4).Info("NodeUnpublishVolume")
 	targetPath := req.GetTargetPath()
 	if targetPath == "" {
 		return nil, status.Error(codes.InvalidArgument, "targetPath not provided")
 	}
 
+	// The target is unmounted even if the volume ID is invalid, the publication of the volume isn't tracked then.
+	if _, volumeID, err := getExoscaleID(req.GetVolumeId()); err == nil {
+		unlock, err := d.volumeLocks.lock(ctx, volumeID)
+		if err != nil {
+			return nil, err
+		}
+		defer unlock()
+	}
+
 	err := d.diskUtils.Unmount(targetPath)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "error unmounting target path: %s", err.Error())
 	}
 
+	if err := d.readonlyBlockDevices.unpublish(d.diskUtils, targetPath); err != nil {
+		return nil, status.Errorf(codes.Internal, "restore read-only state of the block device published on %s: %v", targetPath, err)
+	}
+
+	if _, volumeID, err := getExoscaleID(req.GetVolumeId()); err == nil {
+		d.publications.remove(volumeID, targetPath)
+	}
+
 	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
 
 // NodeGetVolumeStats returns the volume capacity statistics available for the volume
 func (d *nodeService) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
-	klog.V(4).Infof("NodeGetVolumeStats")
+	klog.FromContext(ctx).V(4).Info("NodeGetVolumeStats")
 	_, volumeID, err := getExoscaleID(req.GetVolumeId())
 	if err != nil {
 		return nil, err
@@ -316,32 +808,46 @@ func (d *nodeService) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVo
 		return nil, status.Error(codes.InvalidArgument, "volumePath not provided")
 	}
 
-	stagingPath := req.GetStagingTargetPath()
-	if stagingPath != "" {
-		volumePath = stagingPath
+	statsPath, isBlock, err := d.volumeStatsPath(volumeID, volumePath, req.GetStagingTargetPath())
+	if err != nil {
+		return nil, err
 	}
 
-	isMounted, err := d.diskUtils.IsSharedMounted(volumePath, "")
+	// The volume is still mounted, report the failures as an abnormal condition of the volume.
+	devicePath, err := d.diskUtils.GetDevicePath(volumeID)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "error checking mount point of path %s for volume %s: %s", volumePath, volumeID, err.Error())
+		if os.IsNotExist(err) {
+			volumeCondition := abnormalVolumeCondition("device of volume %s not found on the node", volumeID)
+			recordVolumeCondition(volumeID, volumeCondition)
+			return &csi.NodeGetVolumeStatsResponse{VolumeCondition: volumeCondition}, nil
+		}
+		return nil, status.Errorf(codes.Internal, "error getting device path for volume with ID %s: %s", volumeID, err.Error())
 	}
 
-	if !isMounted {
-		return nil, status.Errorf(codes.NotFound, "volume with ID %s not found", volumeID)
+	if isBlock {
+		return d.blockVolumeStats(volumeID, devicePath), nil
 	}
 
-	_, err = d.diskUtils.GetDevicePath(volumeID)
+	fs, err := d.diskUtils.GetStatfs(statsPath)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return nil, status.Errorf(codes.NotFound, "volume with ID %s not found", volumeID)
-		}
-		return nil, status.Errorf(codes.Internal, "error getting device path for volume with ID %s: %s", volumeID, err.Error())
+		volumeCondition := abnormalVolumeCondition("error doing stat on %s: %v", statsPath, err)
+		recordVolumeCondition(volumeID, volumeCondition)
+		return &csi.NodeGetVolumeStatsResponse{VolumeCondition: volumeCondition}, nil
 	}
 
-	fs, err := d.diskUtils.GetStatfs(volumePath)
+	volumeCondition := &csi.VolumeCondition{Message: "volume is healthy"}
+	mountInfo, err := d.diskUtils.GetMountInfo(statsPath)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "error doing stat on %s: %s", volumePath, err.Error())
+		return nil, status.Errorf(codes.Internal, "error getting mount information of path %s: %s", statsPath, err.Error())
+	}
+	if mountInfo != nil && isReadOnlyUnexpectedly(mountInfo) {
+		volumeCondition = abnormalVolumeCondition("filesystem mounted read-write on %s is read-only, it may have been remounted read-only after errors", statsPath)
+	} else if mountInfo != nil {
+		if errorsCount := d.diskUtils.GetFilesystemErrors(mountInfo); errorsCount > 0 {
+			volumeCondition = abnormalVolumeCondition("filesystem mounted on %s recorded %d errors, it may be corrupted", statsPath, errorsCount)
+		}
 	}
+	recordVolumeCondition(volumeID, volumeCondition)
 
 	totalBytes := fs.Blocks * uint64(fs.Bsize)
 	availableBytes := fs.Bfree * uint64(fs.Bsize)
@@ -370,12 +876,109 @@ func (d *nodeService) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVo
 			diskUsage,
 			inodesUsage,
 		},
+		VolumeCondition: volumeCondition,
 	}, nil
 }
 
+// volumeStatsPath returns the path to get the statistics of the volume published on volumePath from,
+// and whether the volume is a raw block volume. The staging path is preferred when provided,
+// as it still holds the mount of the volume when volumePath is gone.
+// A NotFound status is returned if the volume is neither staged nor published on volumePath.
+func (d *nodeService) volumeStatsPath(volumeID v3.UUID, volumePath, stagingTargetPath string) (string, bool, error) {
+	if stagingTargetPath != "" {
+		blockPath := blockStagingPath(stagingTargetPath, volumeID)
+		isMounted, err := d.diskUtils.IsSharedMounted(blockPath, "")
+		if err != nil {
+			return "", false, status.Errorf(codes.Internal, "error checking mount point of path %s for volume %s: %s", blockPath, volumeID, err.Error())
+		}
+		if isMounted {
+			return blockPath, true, nil
+		}
+
+		isMounted, err = d.diskUtils.IsSharedMounted(stagingTargetPath, "")
+		if err != nil {
+			return "", false, status.Errorf(codes.Internal, "error checking mount point of path %s for volume %s: %s", stagingTargetPath, volumeID, err.Error())
+		}
+		if isMounted {
+			return stagingTargetPath, false, nil
+		}
+	}
+
+	if _, err := os.Stat(volumePath); os.IsNotExist(err) {
+		return "", false, status.Errorf(codes.NotFound, "volume path %s of volume %s not found", volumePath, volumeID)
+	} else if err != nil {
+		return "", false, status.Errorf(codes.Internal, "error checking volume path %s of volume %s: %s", volumePath, volumeID, err.Error())
+	}
+
+	// The raw block volumes are published as device files, not mounted filesystems.
+	isBlock, err := d.diskUtils.IsBlockDevice(volumePath)
+	if err != nil {
+		return "", false, status.Errorf(codes.Internal, "error checking if path %s of volume %s is a block device: %s", volumePath, volumeID, err.Error())
+	}
+	if isBlock {
+		return volumePath, true, nil
+	}
+
+	isMounted, err := d.diskUtils.IsSharedMounted(volumePath, "")
+	if err != nil {
+		return "", false, status.Errorf(codes.Internal, "error checking mount point of path %s for volume %s: %s", volumePath, volumeID, err.Error())
+	}
+	if !isMounted {
+		return "", false, status.Errorf(codes.NotFound, "volume %s is not mounted on %s", volumeID, volumePath)
+	}
+
+	return volumePath, false, nil
+}
+
+// blockVolumeStats returns the statistics of a raw block volume, which only have the size of its device.
+func (d *nodeService) blockVolumeStats(volumeID v3.UUID, devicePath string) *csi.NodeGetVolumeStatsResponse {
+	size, err := d.diskUtils.GetBlockSize(devicePath)
+	if err != nil {
+		volumeCondition := abnormalVolumeCondition("error getting the size of device %s: %v", devicePath, err)
+		recordVolumeCondition(volumeID, volumeCondition)
+		return &csi.NodeGetVolumeStatsResponse{VolumeCondition: volumeCondition}
+	}
+
+	volumeCondition := &csi.VolumeCondition{Message: "volume is healthy"}
+	recordVolumeCondition(volumeID, volumeCondition)
+
+	return &csi.NodeGetVolumeStatsResponse{
+		Usage: []*csi.VolumeUsage{
+			{
+				Unit:  csi.VolumeUsage_BYTES,
+				Total: size,
+			},
+		},
+		VolumeCondition: volumeCondition,
+	}
+}
+
+// abnormalVolumeCondition returns an abnormal volume condition with the formatted message.
+func abnormalVolumeCondition(format string, a ...any) *csi.VolumeCondition {
+	return &csi.VolumeCondition{
+		Abnormal: true,
+		Message:  fmt.Sprintf(format, a...),
+	}
+}
+
+// recordVolumeCondition exposes the volume condition as the volume_abnormal metric.
+func recordVolumeCondition(volumeID v3.UUID, volumeCondition *csi.VolumeCondition) {
+	value := 0.0
+	if volumeCondition.GetAbnormal() {
+		value = 1
+	}
+	volumeAbnormal.WithLabelValues(volumeID.String()).Set(value)
+}
+
+// isReadOnlyUnexpectedly returns whether the filesystem of a read-write mount is read-only,
+// which happens when the filesystem is remounted read-only after errors, e.g. with the ext4 errors=remount-ro option.
+func isReadOnlyUnexpectedly(info *mountInfo) bool {
+	return slices.Contains(info.mountOptions, "rw") && slices.Contains(info.superOptions, "ro")
+}
+
 // NodeGetCapabilities allows the CO to check the supported capabilities of node service provided by the Plugin.
 func (d *nodeService) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
-	klog.V(4).Infof("NodeGetCapabilities")
+	klog.FromContext(ctx).V(4).Info("NodeGetCapabilities")
 	return &csi.NodeGetCapabilitiesResponse{
 		Capabilities: []*csi.NodeServiceCapability{
 			{
@@ -406,18 +1009,32 @@ func (d *nodeService) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetC
 					},
 				},
 			},
+			{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_VOLUME_CONDITION,
+					},
+				},
+			},
+			{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_VOLUME_MOUNT_GROUP,
+					},
+				},
+			},
 		},
 	}, nil
 }
 
 // NodeGetInfo returns inqformation about node's volumes
 func (d *nodeService) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
-	klog.V(4).Infof("NodeGetInfo")
+	klog.FromContext(ctx).V(4).Info("NodeGetInfo")
 	return &csi.NodeGetInfoResponse{
 		// Store the zone and the instanceID to let the CSI controller know the zone of the node.
 		NodeId: exoscaleID(d.zoneName, d.nodeID),
-		// TODO Will depend on Exoscale account limit, (remove const)
-		MaxVolumesPerNode: maxVolumesPerNode,
+		// The CO doesn't schedule more volumes on the node, the controller refuses the attachments beyond it nevertheless.
+		MaxVolumesPerNode: d.maxVolumesPerNode,
 		// newZoneTopology returns always len(1).
 		AccessibleTopology: newZoneTopology(d.zoneName)[0],
 	}, nil
@@ -426,11 +1043,19 @@ func (d *nodeService) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoReque
 // NodeExpandVolume expands the given volume, mkfs, resize...etc
 // not supported yet at Exoscale Public API yet.
 func (d *nodeService) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
-	klog.V(4).Infof("NodeExpandVolume")
+	logger := klog.FromContext(ctx)
+	logger.V(4).Info("NodeExpandVolume")
+	defer observeNodeOperation(expandOperation, time.Now())
+
 	_, volumeID, err := getExoscaleID(req.GetVolumeId())
 	if err != nil {
 		return nil, err
 	}
+	unlock, err := d.volumeLocks.lock(ctx, volumeID)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
 
 	volumePath := req.GetVolumePath()
 	if volumePath == "" {
@@ -467,11 +1092,238 @@ func (d *nodeService) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandV
 		return &csi.NodeExpandVolumeResponse{}, nil
 	}
 
-	klog.V(4).Infof("resizing volume %s mounted on %s", volumeID, volumePath)
+	// the filesystem of an encrypted volume is on the mapping, which has to be resized first.
+	if mapperPath, ok := d.diskUtils.LuksMapping(luksMapperName(volumeID)); ok {
+		logger.V(4).Info("resizing encrypted volume mapping", "mapperPath", mapperPath)
+		if err := d.diskUtils.LuksResize(luksMapperName(volumeID), req.GetSecrets()[luksPassphraseKey]); err != nil {
+			nodeFailures.WithLabelValues(resizePhase).Inc()
+			return nil, status.Errorf(codes.Internal, "failed to resize encrypted volume %s: %v", volumeID, err)
+		}
+		devicePath = mapperPath
+	}
+
+	// The f2fs filesystems are grown when staging the volumes, resize.f2fs refuses mounted filesystems:
+	// ControllerExpandVolume only expands them detached, the volume staged since has already been grown.
+	if info, err := d.diskUtils.GetMountInfo(volumePath); err == nil && info != nil && info.fsType == "f2fs" {
+		logger.V(4).Info("f2fs filesystem of volume grown when staged", "volumePath", volumePath)
+		return &csi.NodeExpandVolumeResponse{}, nil
+	}
+
+	logger.V(4).Info("resizing volume", "volumePath", volumePath)
 
 	if err = d.diskUtils.Resize(volumePath, devicePath); err != nil {
+		nodeFailures.WithLabelValues(resizePhase).Inc()
 		return nil, status.Errorf(codes.Internal, "failed to resize volume %s mounted on %s: %v", volumeID, volumePath, err)
 	}
 
 	return &csi.NodeExpandVolumeResponse{}, nil
 }
+
+// repairXFS repairs the xfs filesystem of the device which failed to mount with mountErr if xfsRepair is enabled,
+// zeroing its log which may lose the latest changes. FailedPrecondition is returned otherwise.
+func (d *nodeService) repairXFS(volumeID v3.UUID, devicePath string, mountErr error) error {
+	if !d.xfsRepair {
+		return status.Errorf(codes.FailedPrecondition,
+			"xfs filesystem of volume %s needs to be repaired, run xfs_repair -L on %s or enable --xfs-repair: %v", volumeID, devicePath, mountErr)
+	}
+
+	klog.Warningf("xfs filesystem of volume %s failed to mount, repairing it and zeroing its log: %v", volumeID, mountErr)
+	if err := d.diskUtils.RepairXFS(devicePath); err != nil {
+		return fmt.Errorf("repair xfs filesystem: %w", err)
+	}
+
+	return nil
+}
+
+// growFilesystem resizes the filesystem mounted on stagingTargetPath if it is smaller than the device.
+// Errors are only logged as the volume is usable nevertheless and NodeExpandVolume may still resize it.
+func (d *nodeService) growFilesystem(volumeID v3.UUID, stagingTargetPath, devicePath string) {
+	needResize, err := d.diskUtils.NeedResize(stagingTargetPath, devicePath)
+	if err != nil {
+		klog.Warningf("check whether volume %s needs a resize: %v", volumeID, err)
+		return
+	}
+	if !needResize {
+		return
+	}
+
+	klog.Infof("volume %s device is larger than its filesystem, resizing it", volumeID)
+	if err := d.diskUtils.Resize(stagingTargetPath, devicePath); err != nil {
+		nodeFailures.WithLabelValues(resizePhase).Inc()
+		klog.Warningf("resize volume %s mounted on %s: %v", volumeID, stagingTargetPath, err)
+	}
+}
+
+// btrfsSubvolume returns the path of the subvolume of the btrfs filesystem mounted on stagingTargetPath,
+// creating the subvolume on the first publication.
+func (d *nodeService) btrfsSubvolume(stagingTargetPath, subvolume string) (string, error) {
+	info, err := d.diskUtils.GetMountInfo(stagingTargetPath)
+	if err != nil {
+		return "", err
+	}
+	if info == nil || info.fsType != "btrfs" {
+		return "", fmt.Errorf("btrfs subvolume %s requested but the staged filesystem isn't btrfs", subvolume)
+	}
+
+	subvolumePath := filepath.Join(stagingTargetPath, subvolume)
+	if _, err := os.Stat(subvolumePath); err == nil {
+		return subvolumePath, nil
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	klog.V(4).Infof("creating btrfs subvolume %s", subvolumePath)
+	if err := d.diskUtils.CreateBtrfsSubvolume(subvolumePath); err != nil {
+		return "", fmt.Errorf("create btrfs subvolume: %w", err)
+	}
+
+	return subvolumePath, nil
+}
+
+// driverMountOptions are the mount options set by the driver itself, which can't be requested.
+var driverMountOptions = []string{"bind", "rbind", "remount", "move"}
+
+// conflictingMountOptions are the pairs of mount options which can't be requested together.
+var conflictingMountOptions = [][2]string{
+	{"ro", "rw"},
+	{"sync", "async"},
+	{"atime", "noatime"},
+	{"relatime", "norelatime"},
+	{"strictatime", "nostrictatime"},
+	{"exec", "noexec"},
+	{"suid", "nosuid"},
+	{"dev", "nodev"},
+	{"diratime", "nodiratime"},
+	{"discard", "nodiscard"},
+}
+
+// validateMountOptions returns the mount options without duplicates,
+// an error listing the offending options is returned for the options which conflict or are set by the driver.
+func validateMountOptions(mountOptions []string) ([]string, error) {
+	var result []string
+	for _, option := range mountOptions {
+		if !slices.Contains(result, option) {
+			result = append(result, option)
+		}
+	}
+
+	var invalid []string
+	for _, option := range result {
+		if slices.Contains(driverMountOptions, option) {
+			invalid = append(invalid, fmt.Sprintf("%s is set by the driver", option))
+		}
+	}
+	for _, pair := range conflictingMountOptions {
+		if slices.Contains(result, pair[0]) && slices.Contains(result, pair[1]) {
+			invalid = append(invalid, fmt.Sprintf("%s conflicts with %s", pair[0], pair[1]))
+		}
+	}
+	if len(invalid) > 0 {
+		return nil, fmt.Errorf("invalid mount options: %s", strings.Join(invalid, ", "))
+	}
+
+	return result, nil
+}
+
+// withDefaultMountOptions returns the mount options with the default ones they don't override,
+// an option overrides the default options it conflicts with or which have the same key, e.g. commit=60 overrides commit=30.
+func withDefaultMountOptions(mountOptions, defaultMountOptions []string) []string {
+	overrides := func(option, defaultOption string) bool {
+		if optionKey(option) == optionKey(defaultOption) {
+			return true
+		}
+		for _, pair := range conflictingMountOptions {
+			if option == pair[0] && defaultOption == pair[1] || option == pair[1] && defaultOption == pair[0] {
+				return true
+			}
+		}
+		return false
+	}
+
+	result := slices.Clone(mountOptions)
+	for _, defaultOption := range defaultMountOptions {
+		if !slices.ContainsFunc(mountOptions, func(option string) bool { return overrides(option, defaultOption) }) {
+			result = append(result, defaultOption)
+		}
+	}
+
+	return result
+}
+
+// optionKey returns the key of a key=value mount option, the option itself otherwise.
+func optionKey(option string) string {
+	key, _, _ := strings.Cut(option, "=")
+	return key
+}
+
+// selinuxMountOptions are the mount options setting the SELinux context of a filesystem,
+// passed by the kubelet when the CSIDriver has seLinuxMount enabled.
+var selinuxMountOptions = []string{"context=", "fscontext=", "defcontext=", "rootcontext="}
+
+// withoutSELinuxMountOptions returns the mount options without the SELinux context options,
+// which can't be changed by bind mounts.
+func withoutSELinuxMountOptions(mountOptions []string) []string {
+	return slices.DeleteFunc(slices.Clone(mountOptions), func(option string) bool {
+		for _, prefix := range selinuxMountOptions {
+			if strings.HasPrefix(option, prefix) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// parseVolumeMountGroup returns the GID of the volume mount group, -1 if there is none.
+func parseVolumeMountGroup(group string) (int, error) {
+	if group == "" {
+		return -1, nil
+	}
+
+	gid, err := strconv.Atoi(group)
+	if err != nil || gid < 0 {
+		return -1, fmt.Errorf("invalid volume mount group %q, expected a GID", group)
+	}
+
+	return gid, nil
+}
+
+// applyVolumeMountGroup gives the volume mount group access to the root directory of the filesystem mounted on path,
+// setting its setgid bit for the new files to inherit the group. Like the fsGroup applied by the kubelet,
+// without recursively changing the ownership of the existing files which is what the delegation avoids on large volumes.
+func applyVolumeMountGroup(path, group string) error {
+	gid, err := parseVolumeMountGroup(group)
+	if err != nil || gid < 0 {
+		return err
+	}
+
+	if err := os.Chown(path, -1, gid); err != nil {
+		return err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	return os.Chmod(path, info.Mode().Perm()|os.ModeSetgid|0o070)
+}
+
+// getDevicePath returns the device path of the volume, using the device serial
+// from the publish context when provided by the controller.
+// It waits up to deviceWaitTimeout for the device of a freshly attached volume to appear,
+// rather than failing and relying on the CO retries while the hypervisor completes the attachment.
+func (d *nodeService) getDevicePath(ctx context.Context, volumeID v3.UUID, publishContext map[string]string) (string, error) {
+	serial := publishContext[exoscaleDeviceSerial]
+	if serial == "" {
+		serial = deviceSerial(volumeID)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, d.deviceWaitTimeout)
+	defer cancel()
+
+	if serials := publishContext[exoscaleStripeSerials]; serials != "" {
+		return d.getStripedDevicePath(ctx, volumeID, serials)
+	}
+
+	return d.diskUtils.WaitDevicePathBySerial(ctx, serial)
+}
@@ -0,0 +1,917 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/utils/exec"
+	testingexec "k8s.io/utils/exec/testing"
+
+	v3 "github.com/exoscale/egoscale/v3"
+)
+
+func TestVolumePublications(t *testing.T) {
+	publications := newVolumePublications()
+	volumeID := v3.UUID("8a6ad5e0-5de1-4ecb-b9d6-e2d4c2a3c0e4")
+
+	_, ok := publications.publishedElsewhere(volumeID, "/target/a")
+	require.False(t, ok)
+
+	publications.add(volumeID, "/target/a")
+
+	_, ok = publications.publishedElsewhere(volumeID, "/target/a")
+	require.False(t, ok)
+
+	target, ok := publications.publishedElsewhere(volumeID, "/target/b")
+	require.True(t, ok)
+	require.Equal(t, "/target/a", target)
+
+	publications.remove(volumeID, "/target/a")
+
+	_, ok = publications.publishedElsewhere(volumeID, "/target/b")
+	require.False(t, ok)
+}
+
+func TestVolumePublicationTargets(t *testing.T) {
+	volumeID := v3.UUID("8a6ad5e0-5de1-4ecb-b9d6-e2d4c2a3c0e4")
+	stagingTargetPath := "/var/lib/kubelet/plugins/kubernetes.io/csi/csi.exoscale.com/abc/globalmount"
+	blockVolumeID := v3.UUID("8a6ad5e0-5de1-4ecb-b9d6-e2d4c2a3c0e5")
+	blockStagingTargetPath := "/var/lib/kubelet/plugins/kubernetes.io/csi/csi.exoscale.com/def/globalmount"
+
+	mounts := []*mountInfo{
+		{majorMinor: "253:1", root: "/", mountPoint: "/"},
+		{majorMinor: "0:5", root: "/", mountPoint: "/dev"},
+		{majorMinor: "253:16", root: "/", mountPoint: stagingTargetPath},
+		{majorMinor: "253:16", root: "/", mountPoint: "/var/lib/kubelet/pods/123/volumes/kubernetes.io~csi/pvc-1/mount"},
+		{majorMinor: "253:16", root: "/data", mountPoint: "/var/lib/kubelet/pods/456/volumes/kubernetes.io~csi/pvc-1/mount"},
+		{majorMinor: "0:5", root: "/vdc", mountPoint: blockStagingPath(blockStagingTargetPath, blockVolumeID)},
+		{majorMinor: "0:5", root: "/vdc", mountPoint: "/var/lib/kubelet/plugins/kubernetes.io/csi/volumeDevices/publish/pvc-2/789"},
+		{majorMinor: "0:5", root: "/vdd", mountPoint: "/var/lib/kubelet/plugins/kubernetes.io/csi/volumeDevices/publish/pvc-3/789"},
+	}
+
+	require.Equal(t, []string{
+		"/var/lib/kubelet/pods/123/volumes/kubernetes.io~csi/pvc-1/mount",
+		"/var/lib/kubelet/pods/456/volumes/kubernetes.io~csi/pvc-1/mount",
+	}, volumePublicationTargets(mounts, volumeID, stagingTargetPath))
+	require.Equal(t, []string{
+		"/var/lib/kubelet/plugins/kubernetes.io/csi/volumeDevices/publish/pvc-2/789",
+	}, volumePublicationTargets(mounts, blockVolumeID, blockStagingTargetPath))
+	require.Empty(t, volumePublicationTargets(mounts, volumeID, "/var/lib/kubelet/plugins/kubernetes.io/csi/csi.exoscale.com/ghi/globalmount"))
+
+	require.Equal(t, "/dev/vdc", blockStagingDevicePath(mounts, blockStagingPath(blockStagingTargetPath, blockVolumeID)))
+	require.Empty(t, blockStagingDevicePath(mounts, blockStagingPath(stagingTargetPath, volumeID)))
+}
+
+func TestVolumeMountPoints(t *testing.T) {
+	mounts := []*mountInfo{
+		{majorMinor: "253:1", source: "/dev/vda1", mountPoint: "/"},
+		{majorMinor: "253:16", source: "/dev/vdb", mountPoint: "/var/lib/kubelet/plugins/kubernetes.io/csi/csi.exoscale.com/abc/globalmount"},
+		{majorMinor: "253:16", source: "/dev/vdb", mountPoint: "/var/lib/kubelet/pods/123/volumes/kubernetes.io~csi/pvc-1/mount"},
+		{majorMinor: "252:0", source: "/dev/mapper/exoscale-luks-8a6ad5e0", mountPoint: "/var/lib/kubelet/plugins/kubernetes.io/csi/csi.exoscale.com/def/globalmount"},
+	}
+	devices := map[string]bool{
+		"/dev/disk/by-id/virtio-8a6ad5e0-5de1-4ecb-b": true,
+		"/dev/vdb":                           true,
+		"/dev/mapper/exoscale-luks-8a6ad5e0": true,
+	}
+
+	require.Equal(t, []string{
+		"/var/lib/kubelet/plugins/kubernetes.io/csi/csi.exoscale.com/abc/globalmount",
+		"/var/lib/kubelet/plugins/kubernetes.io/csi/csi.exoscale.com/def/globalmount",
+	}, volumeMountPoints(mounts, devices))
+	require.Empty(t, volumeMountPoints(mounts, nil))
+}
+
+func TestFindDeviceBySerial(t *testing.T) {
+	sysBlockDir := t.TempDir()
+	for name, serial := range map[string]string{"vda": "", "vdb": "8a6ad5e0-5de1-4ecb-b\n"} {
+		require.NoError(t, os.Mkdir(filepath.Join(sysBlockDir, name), 0o755))
+		if serial != "" {
+			require.NoError(t, os.WriteFile(filepath.Join(sysBlockDir, name, "serial"), []byte(serial), 0o644))
+		}
+	}
+
+	devicePath, err := findDeviceBySerial(sysBlockDir, "8a6ad5e0-5de1-4ecb-b")
+	require.NoError(t, err)
+	require.Equal(t, "/dev/vdb", devicePath)
+
+	_, err = findDeviceBySerial(sysBlockDir, "0b4f3c2e-9d1a-4f6e-8")
+	require.True(t, os.IsNotExist(err))
+
+	require.NoError(t, os.Mkdir(filepath.Join(sysBlockDir, "vdc"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(sysBlockDir, "vdc", "serial"), []byte("8a6ad5e0-5de1-4ecb-b\n"), 0o644))
+	_, err = findDeviceBySerial(sysBlockDir, "8a6ad5e0-5de1-4ecb-b")
+	require.Error(t, err)
+	require.False(t, os.IsNotExist(err))
+}
+
+func TestDeviceSerial(t *testing.T) {
+	require.Equal(t, "8a6ad5e0-5de1-4ecb-b", deviceSerial("8a6ad5e0-5de1-4ecb-b9d6-e2d4c2a3c0e4"))
+}
+
+func TestRescanBuses(t *testing.T) {
+	sysDir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(sysDir, "bus", "pci"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(sysDir, "bus", "pci", "rescan"), nil, 0o644))
+	for _, host := range []string{"host0", "host1"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(sysDir, "class", "scsi_host", host), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(sysDir, "class", "scsi_host", host, "scan"), nil, 0o644))
+	}
+
+	rescanBuses(sysDir)
+
+	data, err := os.ReadFile(filepath.Join(sysDir, "bus", "pci", "rescan"))
+	require.NoError(t, err)
+	require.Equal(t, "1", string(data))
+	for _, host := range []string{"host0", "host1"} {
+		data, err := os.ReadFile(filepath.Join(sysDir, "class", "scsi_host", host, "scan"))
+		require.NoError(t, err)
+		require.Equal(t, "- - -", string(data))
+	}
+
+	// Missing buses are skipped.
+	rescanBuses(t.TempDir())
+}
+
+func TestIsReadOnlyUnexpectedly(t *testing.T) {
+	testsBench := []struct {
+		mountOptions []string
+		superOptions []string
+		res          bool
+	}{
+		{mountOptions: []string{"rw", "relatime"}, superOptions: []string{"rw"}, res: false},
+		{mountOptions: []string{"ro", "relatime"}, superOptions: []string{"ro"}, res: false},
+		{mountOptions: []string{"ro", "relatime"}, superOptions: []string{"rw"}, res: false},
+		{mountOptions: []string{"rw", "relatime"}, superOptions: []string{"ro", "errors=remount-ro"}, res: true},
+	}
+
+	for _, test := range testsBench {
+		info := &mountInfo{mountOptions: test.mountOptions, superOptions: test.superOptions}
+		require.Equal(t, test.res, isReadOnlyUnexpectedly(info))
+	}
+}
+
+func TestApplyVolumeMountGroup(t *testing.T) {
+	path := t.TempDir()
+	require.NoError(t, os.Chmod(path, 0o700))
+
+	require.NoError(t, applyVolumeMountGroup(path, ""))
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o700), info.Mode().Perm())
+
+	require.Error(t, applyVolumeMountGroup(path, "users"))
+	require.Error(t, applyVolumeMountGroup(path, "-1"))
+
+	require.NoError(t, applyVolumeMountGroup(path, strconv.Itoa(os.Getgid())))
+	info, err = os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o770), info.Mode().Perm())
+	require.NotZero(t, info.Mode()&os.ModeSetgid)
+}
+
+func TestWithoutSELinuxMountOptions(t *testing.T) {
+	mountOptions := []string{"noatime", `context="system_u:object_r:container_file_t:s0:c0,c1"`, "rootcontext=system_u:object_r:container_file_t:s0", "discard"}
+
+	require.Equal(t, []string{"noatime", "discard"}, withoutSELinuxMountOptions(mountOptions))
+	require.Len(t, mountOptions, 4)
+	require.Empty(t, withoutSELinuxMountOptions(nil))
+}
+
+func TestValidateMountOptions(t *testing.T) {
+	testsBench := []struct {
+		mountOptions []string
+		res          []string
+		errMsg       string
+	}{
+		{mountOptions: nil, res: nil},
+		{mountOptions: []string{"noatime", "discard", "noatime"}, res: []string{"noatime", "discard"}},
+		{mountOptions: []string{"rw", "noatime", "ro"}, errMsg: "invalid mount options: ro conflicts with rw"},
+		{mountOptions: []string{"bind", "sync", "async"}, errMsg: "invalid mount options: bind is set by the driver, sync conflicts with async"},
+	}
+
+	for _, test := range testsBench {
+		res, err := validateMountOptions(test.mountOptions)
+		if test.errMsg != "" {
+			require.EqualError(t, err, test.errMsg)
+			continue
+		}
+		require.NoError(t, err)
+		require.Equal(t, test.res, res)
+	}
+}
+
+func TestWithDefaultMountOptions(t *testing.T) {
+	defaultMountOptions := []string{"noatime", "nodiscard", "commit=30"}
+	testsBench := []struct {
+		mountOptions []string
+		res          []string
+	}{
+		{mountOptions: nil, res: []string{"noatime", "nodiscard", "commit=30"}},
+		{mountOptions: []string{"sync"}, res: []string{"sync", "noatime", "nodiscard", "commit=30"}},
+		{mountOptions: []string{"discard", "commit=60"}, res: []string{"discard", "commit=60", "noatime"}},
+		{mountOptions: []string{"atime", "noatime"}, res: []string{"atime", "noatime", "nodiscard", "commit=30"}},
+	}
+
+	for _, test := range testsBench {
+		require.Equal(t, test.res, withDefaultMountOptions(test.mountOptions, defaultMountOptions))
+	}
+	require.Empty(t, withDefaultMountOptions(nil, nil))
+}
+
+func TestIsXFSCorrupted(t *testing.T) {
+	require.True(t, isXFSCorrupted(errors.New("mount failed: exit status 32\nmount: /staging: mount(2) system call failed: Structure needs cleaning.")))
+	require.False(t, isXFSCorrupted(errors.New("mount failed: exit status 32\nmount: /staging: wrong fs type, bad option, bad superblock on /dev/vdb")))
+}
+
+func TestNewNodeMetadata(t *testing.T) {
+	meta, err := newNodeMetadata("8A6AD5E0-5DE1-4ECB-B9D6-E2D4C2A3C0E4", "ch-gva-2")
+	require.NoError(t, err)
+	require.Equal(t, &nodeMetadata{zoneName: "ch-gva-2", InstanceID: "8a6ad5e0-5de1-4ecb-b9d6-e2d4c2a3c0e4"}, meta)
+
+	_, err = newNodeMetadata("8a6ad5e0-5de1-4ecb-b9d6-e2d4c2a3c0e4", "")
+	require.Error(t, err)
+	_, err = newNodeMetadata("", "ch-gva-2")
+	require.Error(t, err)
+	_, err = newNodeMetadata("node-1", "ch-gva-2")
+	require.Error(t, err)
+}
+
+func TestGetNodeMetadataController(t *testing.T) {
+	testsBench := []struct {
+		name   string
+		config *DriverConfig
+		res    *nodeMetadata
+		err    bool
+	}{
+		{
+			name:   "controller zone",
+			config: &DriverConfig{Mode: ControllerMode, ControllerZone: "de-fra-1"},
+			res:    &nodeMetadata{zoneName: "de-fra-1"},
+		},
+		{
+			name:   "skip with the node zone",
+			config: &DriverConfig{Mode: ControllerMode, SkipNodeMetadata: true, Zone: "ch-gva-2"},
+			res:    &nodeMetadata{zoneName: "ch-gva-2"},
+		},
+		{
+			name:   "controller zone preferred",
+			config: &DriverConfig{Mode: ControllerMode, SkipNodeMetadata: true, ControllerZone: "de-fra-1", Zone: "ch-gva-2"},
+			res:    &nodeMetadata{zoneName: "de-fra-1"},
+		},
+		{
+			name:   "skip without zone",
+			config: &DriverConfig{Mode: ControllerMode, SkipNodeMetadata: true},
+			err:    true,
+		},
+		{
+			name:   "skip in node mode",
+			config: &DriverConfig{Mode: NodeMode, SkipNodeMetadata: true, Zone: "ch-gva-2"},
+			err:    true,
+		},
+		{
+			name: "node metadata in all mode",
+			config: &DriverConfig{
+				Mode:           AllMode,
+				ControllerZone: "de-fra-1",
+				NodeID:         "8a6ad5e0-5de1-4ecb-b9d6-e2d4c2a3c0e4",
+				Zone:           "ch-gva-2",
+			},
+			res: &nodeMetadata{zoneName: "ch-gva-2", InstanceID: "8a6ad5e0-5de1-4ecb-b9d6-e2d4c2a3c0e4"},
+		},
+	}
+
+	for _, tt := range testsBench {
+		meta, err := getNodeMetadata(tt.config)
+		if tt.err {
+			require.Error(t, err, tt.name)
+			continue
+		}
+		require.NoError(t, err, tt.name)
+		require.Equal(t, tt.res, meta, tt.name)
+	}
+}
+
+func TestFilesystemErrors(t *testing.T) {
+	sysFSDir := t.TempDir()
+	devDir := t.TempDir()
+	for _, name := range []string{"vdb", "vdc"} {
+		require.NoError(t, os.WriteFile(filepath.Join(devDir, name), nil, 0o644))
+	}
+	require.NoError(t, os.MkdirAll(filepath.Join(sysFSDir, "ext4", "vdb"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(sysFSDir, "ext4", "vdb", "errors_count"), []byte("3\n"), 0o644))
+	require.NoError(t, os.MkdirAll(filepath.Join(sysFSDir, "ext4", "vdc"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(sysFSDir, "ext4", "vdc", "errors_count"), []byte("0\n"), 0o644))
+
+	require.Equal(t, uint64(3), filesystemErrors(sysFSDir, &mountInfo{fsType: "ext4", source: filepath.Join(devDir, "vdb")}))
+	require.Equal(t, uint64(0), filesystemErrors(sysFSDir, &mountInfo{fsType: "ext4", source: filepath.Join(devDir, "vdc")}))
+	require.Equal(t, uint64(0), filesystemErrors(sysFSDir, &mountInfo{fsType: "xfs", source: filepath.Join(devDir, "vdb")}))
+	require.Equal(t, uint64(0), filesystemErrors(sysFSDir, &mountInfo{fsType: "ext4", source: filepath.Join(devDir, "vdd")}))
+}
+
+func TestParseMountPropagation(t *testing.T) {
+	testsBench := []struct {
+		propagation string
+		res         MountPropagation
+		valid       bool
+	}{
+		{propagation: "", res: SharedMountPropagation, valid: true},
+		{propagation: "shared", res: SharedMountPropagation, valid: true},
+		{propagation: "rshared", valid: false},
+		{propagation: "none", res: NoMountPropagation, valid: true},
+		{propagation: "private", valid: false},
+	}
+
+	for _, test := range testsBench {
+		res, err := ParseMountPropagation(test.propagation)
+		require.Equal(t, test.valid, err == nil)
+		require.Equal(t, test.res, res)
+	}
+
+	require.True(t, newDiskUtils(&DriverConfig{MountPropagation: SharedMountPropagation}).requireSharedMount)
+	require.True(t, newDiskUtils(&DriverConfig{}).requireSharedMount)
+	require.False(t, newDiskUtils(&DriverConfig{MountPropagation: NoMountPropagation}).requireSharedMount)
+}
+
+const (
+	testNodeVolumeID   = v3.UUID("8a6ad5e0-5de1-4ecb-b9d6-e2d4c2a3c0e4")
+	testNodeDevicePath = "/dev/vdb"
+)
+
+func newTestNodeService(t *testing.T) (*nodeService, *fakeDiskUtils) {
+	meta, err := newNodeMetadata("0b4f3c2e-9d1a-4f6e-8a3e-5f0c1d2b3a4c", "ch-gva-2")
+	require.NoError(t, err)
+
+	fake := newFakeDiskUtils()
+	fake.attach(testNodeVolumeID, testNodeDevicePath)
+	ns := newNodeService(meta, &DriverConfig{}, fake)
+
+	return &ns, fake
+}
+
+func mountCapability(fsType string) *csi.VolumeCapability {
+	return &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: fsType}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+}
+
+func blockCapability() *csi.VolumeCapability {
+	return &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+}
+
+func TestNodeStageVolume(t *testing.T) {
+	testsBench := []struct {
+		name           string
+		volumeID       v3.UUID
+		capability     *csi.VolumeCapability
+		publishContext map[string]string
+		volumeContext  map[string]string
+		mounts         map[string]*mountInfo
+		formatted      string
+		code           codes.Code
+		fsType         string
+		mode           string
+		mountOption    string
+	}{
+		{name: "default fsType", capability: mountCapability(""), fsType: "ext4", mode: "rw"},
+		{name: "capability fsType", capability: mountCapability("xfs"), fsType: "xfs", mode: "rw"},
+		{name: "context fsType", capability: mountCapability(""), volumeContext: newVolumeContext("xfs", false, nil, nil), fsType: "xfs", mode: "rw"},
+		{name: "published readonly", capability: mountCapability(""), publishContext: map[string]string{exoscaleVolumeReadonly: "true"}, fsType: "ext4", mode: "ro"},
+		{name: "block", capability: blockCapability()},
+		{
+			name:          "btrfs compression",
+			capability:    mountCapability("btrfs"),
+			volumeContext: newVolumeContext("btrfs", false, nil, map[string]string{exoscaleBtrfsCompression: "zstd:3"}),
+			fsType:        "btrfs",
+			mode:          "rw",
+			mountOption:   "compress=zstd:3",
+		},
+		{name: "formatted", capability: mountCapability("xfs"), formatted: "xfs", fsType: "xfs", mode: "rw"},
+		{name: "formatted with ext3", capability: mountCapability("ext4"), formatted: "ext3", fsType: "ext3", mode: "rw"},
+		{name: "formatted with another fsType", capability: mountCapability("xfs"), formatted: "ext4", code: codes.FailedPrecondition},
+		{name: "formatted without fsType", capability: mountCapability(""), formatted: "xfs", fsType: "xfs", mode: "rw"},
+		{
+			name:       "already staged",
+			capability: mountCapability(""),
+			mounts:     map[string]*mountInfo{"staging": {source: testNodeDevicePath, fsType: "xfs", mountOptions: []string{"rw"}}},
+			fsType:     "xfs",
+			mode:       "rw",
+		},
+		{
+			name:       "block device mounted on the staging path",
+			capability: mountCapability(""),
+			mounts:     map[string]*mountInfo{"staging": {source: testNodeDevicePath, mountOptions: []string{"rw"}}},
+			code:       codes.Unknown,
+		},
+		{name: "device not found", volumeID: "0b4f3c2e-9d1a-4f6e-8a3e-5f0c1d2b3a4c", capability: mountCapability(""), code: codes.NotFound},
+		{name: "missing capability", code: codes.InvalidArgument},
+		{name: "encrypted without passphrase", capability: mountCapability(""), volumeContext: newVolumeContext("", true, nil, nil), code: codes.InvalidArgument},
+		{name: "encrypted block", capability: blockCapability(), volumeContext: newVolumeContext("", true, nil, nil), code: codes.InvalidArgument},
+	}
+
+	for _, test := range testsBench {
+		t.Run(test.name, func(t *testing.T) {
+			ns, fake := newTestNodeService(t)
+			stagingPath := filepath.Join(t.TempDir(), "staging")
+			for target, mount := range test.mounts {
+				mount.mountPoint = filepath.Join(filepath.Dir(stagingPath), target)
+				fake.mounts[mount.mountPoint] = mount
+			}
+			if test.formatted != "" {
+				fake.formatted[testNodeDevicePath] = test.formatted
+			}
+			volumeID := test.volumeID
+			if volumeID == "" {
+				volumeID = testNodeVolumeID
+			}
+
+			_, err := ns.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+				VolumeId:          exoscaleID("ch-gva-2", volumeID),
+				StagingTargetPath: stagingPath,
+				VolumeCapability:  test.capability,
+				PublishContext:    test.publishContext,
+				VolumeContext:     test.volumeContext,
+			})
+			require.Equal(t, test.code, status.Code(err), err)
+			if test.code != codes.OK {
+				return
+			}
+
+			mount := fake.mounts[stagingPath]
+			if test.fsType == "" {
+				require.Nil(t, mount)
+				return
+			}
+			require.Equal(t, testNodeDevicePath, mount.source)
+			require.Equal(t, test.fsType, mount.fsType)
+			require.Equal(t, test.mode, mount.mountOptions[0])
+			if test.mountOption != "" {
+				require.Contains(t, mount.mountOptions, test.mountOption)
+			}
+		})
+	}
+}
+
+func TestNodeStageVolumeEncrypted(t *testing.T) {
+	ns, fake := newTestNodeService(t)
+	fake.needResize = true
+	stagingPath := filepath.Join(t.TempDir(), "staging")
+
+	_, err := ns.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+		VolumeId:          exoscaleID("ch-gva-2", testNodeVolumeID),
+		StagingTargetPath: stagingPath,
+		VolumeCapability:  mountCapability("ext4"),
+		VolumeContext:     newVolumeContext("ext4", true, nil, nil),
+		Secrets:           map[string]string{luksPassphraseKey: "passphrase"},
+	})
+	require.NoError(t, err)
+
+	// The mapping is resized before the filesystem on it.
+	mapperPath := "/dev/mapper/" + luksMapperName(testNodeVolumeID)
+	require.Equal(t, mapperPath, fake.mounts[stagingPath].source)
+	require.Equal(t, []string{luksMapperName(testNodeVolumeID)}, fake.luksResized)
+	require.Equal(t, []string{mapperPath}, fake.resized)
+}
+
+func TestNodePublishVolume(t *testing.T) {
+	testsBench := []struct {
+		name       string
+		capability *csi.VolumeCapability
+		readonly   bool
+		mounted    *mountInfo
+		code       codes.Code
+		source     string
+		mode       string
+	}{
+		{name: "mount", capability: mountCapability("ext4"), source: "staging", mode: "rw"},
+		{name: "mount readonly", capability: mountCapability("ext4"), readonly: true, source: "staging", mode: "ro"},
+		{name: "block", capability: blockCapability(), source: testNodeDevicePath, mode: "rw"},
+		{name: "block readonly", capability: blockCapability(), readonly: true, source: testNodeDevicePath, mode: "ro"},
+		{
+			name:       "already published",
+			capability: mountCapability("ext4"),
+			mounted:    &mountInfo{source: "staging", fsType: "ext4", mountOptions: []string{"rw"}},
+			source:     "staging",
+			mode:       "rw",
+		},
+		{
+			name:       "already published read-write",
+			capability: mountCapability("ext4"),
+			readonly:   true,
+			mounted:    &mountInfo{source: "staging", fsType: "ext4", mountOptions: []string{"rw"}},
+			code:       codes.AlreadyExists,
+		},
+		{
+			name:       "already published as block",
+			capability: mountCapability("ext4"),
+			mounted:    &mountInfo{source: testNodeDevicePath, mountOptions: []string{"rw"}},
+			code:       codes.AlreadyExists,
+		},
+		{
+			name:       "already published as block read-write",
+			capability: blockCapability(),
+			readonly:   true,
+			mounted:    &mountInfo{source: testNodeDevicePath, mountOptions: []string{"rw"}},
+			code:       codes.AlreadyExists,
+		},
+	}
+
+	for _, test := range testsBench {
+		t.Run(test.name, func(t *testing.T) {
+			ns, fake := newTestNodeService(t)
+			dir := t.TempDir()
+			targetPath := filepath.Join(dir, "target")
+			if test.mounted != nil {
+				test.mounted.mountPoint = targetPath
+				fake.mounts[targetPath] = test.mounted
+			}
+
+			_, err := ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+				VolumeId:          exoscaleID("ch-gva-2", testNodeVolumeID),
+				StagingTargetPath: "staging",
+				TargetPath:        targetPath,
+				VolumeCapability:  test.capability,
+				Readonly:          test.readonly,
+			})
+			require.Equal(t, test.code, status.Code(err), err)
+			if test.code != codes.OK {
+				return
+			}
+
+			mount := fake.mounts[targetPath]
+			require.Equal(t, test.source, mount.source)
+			require.Equal(t, test.mode, mount.mountOptions[0])
+			if test.mounted == nil {
+				require.Contains(t, mount.mountOptions, "bind")
+			}
+			if test.capability.GetBlock() != nil {
+				require.Equal(t, test.readonly, fake.readonly[testNodeDevicePath])
+			}
+
+			_, err = ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{
+				VolumeId:   exoscaleID("ch-gva-2", testNodeVolumeID),
+				TargetPath: targetPath,
+			})
+			require.NoError(t, err)
+			require.NotContains(t, fake.mounts, targetPath)
+			require.False(t, fake.readonly[testNodeDevicePath])
+		})
+	}
+}
+
+func TestNodeExpandVolume(t *testing.T) {
+	testsBench := []struct {
+		name       string
+		volumeID   v3.UUID
+		capability *csi.VolumeCapability
+		encrypted  bool
+		mounted    string
+		code       codes.Code
+		resized    []string
+	}{
+		{name: "mount", capability: mountCapability("ext4"), resized: []string{testNodeDevicePath}},
+		{name: "f2fs grown when staged", capability: mountCapability("f2fs"), mounted: "f2fs"},
+		{name: "without capability", resized: []string{testNodeDevicePath}},
+		{name: "encrypted", capability: mountCapability("ext4"), encrypted: true, resized: []string{"/dev/mapper/" + luksMapperName(testNodeVolumeID)}},
+		{name: "block", capability: blockCapability()},
+		{name: "device not found", volumeID: "0b4f3c2e-9d1a-4f6e-8a3e-5f0c1d2b3a4c", code: codes.NotFound},
+	}
+
+	for _, test := range testsBench {
+		t.Run(test.name, func(t *testing.T) {
+			ns, fake := newTestNodeService(t)
+			volumeID := test.volumeID
+			if volumeID == "" {
+				volumeID = testNodeVolumeID
+			}
+			if test.encrypted {
+				_, err := fake.LuksOpen(testNodeDevicePath, luksMapperName(testNodeVolumeID), "passphrase")
+				require.NoError(t, err)
+			}
+			volumePath := t.TempDir()
+			if test.mounted != "" {
+				require.NoError(t, fake.MountToTarget(testNodeDevicePath, volumePath, test.mounted, nil))
+			}
+
+			_, err := ns.NodeExpandVolume(context.Background(), &csi.NodeExpandVolumeRequest{
+				VolumeId:         exoscaleID("ch-gva-2", volumeID),
+				VolumePath:       volumePath,
+				VolumeCapability: test.capability,
+			})
+			require.Equal(t, test.code, status.Code(err), err)
+			require.Equal(t, test.resized, fake.resized)
+		})
+	}
+}
+
+func TestDiskUtilsResize(t *testing.T) {
+	fakeCommand := func(output string, err error) testingexec.FakeCommandAction {
+		return func(cmd string, args ...string) exec.Cmd {
+			return testingexec.InitFakeCmd(&testingexec.FakeCmd{
+				CombinedOutputScript: []testingexec.FakeAction{
+					func() ([]byte, []byte, error) { return []byte(output), nil, err },
+				},
+			}, cmd, args...)
+		}
+	}
+
+	fakeExec := &testingexec.FakeExec{
+		CommandScript: []testingexec.FakeCommandAction{
+			fakeCommand("TYPE=ext4\n", nil),
+			fakeCommand("", nil),
+			fakeCommand("TYPE=xfs\n", nil),
+			fakeCommand("xfs_growfs: /staging is not a mounted XFS filesystem", &testingexec.FakeExitError{Status: 1}),
+		},
+	}
+	d := newDiskUtils(&DriverConfig{})
+	d.kMounter.Exec = fakeExec
+
+	require.NoError(t, d.Resize("/staging", testNodeDevicePath))
+
+	err := d.Resize("/staging", testNodeDevicePath)
+	require.ErrorContains(t, err, "is not a mounted XFS filesystem")
+	require.Equal(t, 4, fakeExec.CommandCalls)
+}
+
+func TestUnmountWithRetry(t *testing.T) {
+	backoff := wait.Backoff{Duration: time.Millisecond, Factor: 1, Steps: 3}
+	busyErr := errors.New("unmount failed: exit status 32\nOutput: umount: /target: target is busy.")
+
+	testsBench := []struct {
+		name  string
+		errs  []error
+		calls int
+		valid bool
+	}{
+		{name: "unmounted", errs: []error{nil}, calls: 1, valid: true},
+		{name: "busy then unmounted", errs: []error{busyErr, unix.EBUSY, nil}, calls: 3, valid: true},
+		{name: "still busy", errs: []error{busyErr, busyErr, busyErr}, calls: 3, valid: false},
+		{name: "not mounted", errs: []error{errors.New("umount: /target: not mounted.")}, calls: 1, valid: true},
+		{name: "other error", errs: []error{errors.New("permission denied"), nil}, calls: 1, valid: false},
+	}
+
+	for _, test := range testsBench {
+		t.Run(test.name, func(t *testing.T) {
+			calls := 0
+			err := unmountWithRetry("/target", backoff, func() error {
+				err := test.errs[calls]
+				calls++
+				return err
+			})
+			require.Equal(t, test.valid, err == nil, err)
+			require.Equal(t, test.calls, calls)
+		})
+	}
+}
+
+func TestNodePublishVolumeBtrfsSubvolume(t *testing.T) {
+	ns, fake := newTestNodeService(t)
+	stagingPath := t.TempDir()
+	volumeContext := newVolumeContext("btrfs", false, nil, map[string]string{exoscaleBtrfsSubvolume: "data"})
+
+	publish := func(targetPath string) error {
+		_, err := ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+			VolumeId:          exoscaleID("ch-gva-2", testNodeVolumeID),
+			StagingTargetPath: stagingPath,
+			TargetPath:        targetPath,
+			VolumeCapability:  mountCapability("btrfs"),
+			VolumeContext:     volumeContext,
+		})
+		return err
+	}
+
+	// The subvolume can't be created on another filesystem.
+	fake.mounts[stagingPath] = &mountInfo{source: testNodeDevicePath, mountPoint: stagingPath, fsType: "ext4"}
+	require.Equal(t, codes.FailedPrecondition, status.Code(publish(filepath.Join(t.TempDir(), "target"))))
+
+	fake.mounts[stagingPath].fsType = "btrfs"
+	for _, targetPath := range []string{filepath.Join(t.TempDir(), "target"), filepath.Join(t.TempDir(), "target")} {
+		require.NoError(t, publish(targetPath))
+		require.Equal(t, filepath.Join(stagingPath, "data"), fake.mounts[targetPath].source)
+	}
+	require.DirExists(t, filepath.Join(stagingPath, "data"))
+}
+
+func TestNodeStageVolumeBlock(t *testing.T) {
+	ns, fake := newTestNodeService(t)
+	stagingPath := t.TempDir()
+	targetPath := filepath.Join(t.TempDir(), "target")
+	blockPath := blockStagingPath(stagingPath, testNodeVolumeID)
+	volumeID := exoscaleID("ch-gva-2", testNodeVolumeID)
+
+	for range 2 {
+		_, err := ns.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+			VolumeId:          volumeID,
+			StagingTargetPath: stagingPath,
+			VolumeCapability:  blockCapability(),
+		})
+		require.NoError(t, err)
+		require.Equal(t, testNodeDevicePath, fake.mounts[blockPath].source)
+		require.FileExists(t, blockPath)
+	}
+
+	_, err := ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:          volumeID,
+		StagingTargetPath: stagingPath,
+		TargetPath:        targetPath,
+		VolumeCapability:  blockCapability(),
+	})
+	require.NoError(t, err)
+	require.Equal(t, blockPath, fake.mounts[targetPath].source)
+	isBlock, err := fake.IsBlockDevice(targetPath)
+	require.NoError(t, err)
+	require.True(t, isBlock)
+
+	_, err = ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{VolumeId: volumeID, TargetPath: targetPath})
+	require.NoError(t, err)
+
+	_, err = ns.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{VolumeId: volumeID, StagingTargetPath: stagingPath})
+	require.NoError(t, err)
+	require.Empty(t, fake.mounts)
+}
+
+func TestNodeStageVolumeBlockReadonly(t *testing.T) {
+	ns, fake := newTestNodeService(t)
+	stagingPath := t.TempDir()
+	volumeID := exoscaleID("ch-gva-2", testNodeVolumeID)
+
+	_, err := ns.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+		VolumeId:          volumeID,
+		StagingTargetPath: stagingPath,
+		VolumeCapability:  blockCapability(),
+		PublishContext:    map[string]string{exoscaleVolumeReadonly: "true"},
+	})
+	require.NoError(t, err)
+	require.True(t, fake.readonly[testNodeDevicePath])
+
+	_, err = ns.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{VolumeId: volumeID, StagingTargetPath: stagingPath})
+	require.NoError(t, err)
+	require.False(t, fake.readonly[testNodeDevicePath])
+	require.Empty(t, fake.mounts)
+}
+
+func TestNodeGetVolumeStats(t *testing.T) {
+	testsBench := []struct {
+		name          string
+		staged        *mountInfo
+		blockStaged   bool
+		published     *mountInfo
+		targetMissing bool
+		detached      bool
+		code          codes.Code
+		usage         []*csi.VolumeUsage
+		abnormal      bool
+	}{
+		{
+			name:   "staged",
+			staged: &mountInfo{source: testNodeDevicePath, fsType: "ext4"},
+			usage: []*csi.VolumeUsage{
+				{Unit: csi.VolumeUsage_BYTES, Total: 4 * 1024 * 1024, Available: 1024 * 1024, Used: 3 * 1024 * 1024},
+				{Unit: csi.VolumeUsage_INODES, Total: 128, Available: 64, Used: 64},
+			},
+		},
+		{
+			name:          "staged without target",
+			staged:        &mountInfo{source: testNodeDevicePath, fsType: "ext4"},
+			targetMissing: true,
+			usage: []*csi.VolumeUsage{
+				{Unit: csi.VolumeUsage_BYTES, Total: 4 * 1024 * 1024, Available: 1024 * 1024, Used: 3 * 1024 * 1024},
+				{Unit: csi.VolumeUsage_INODES, Total: 128, Available: 64, Used: 64},
+			},
+		},
+		{
+			name:      "published only",
+			published: &mountInfo{source: testNodeDevicePath, fsType: "ext4"},
+			usage: []*csi.VolumeUsage{
+				{Unit: csi.VolumeUsage_BYTES, Total: 4 * 1024 * 1024, Available: 1024 * 1024, Used: 3 * 1024 * 1024},
+				{Unit: csi.VolumeUsage_INODES, Total: 128, Available: 64, Used: 64},
+			},
+		},
+		{
+			name:        "block staged",
+			blockStaged: true,
+			usage:       []*csi.VolumeUsage{{Unit: csi.VolumeUsage_BYTES, Total: fakeDeviceSize}},
+		},
+		{
+			name:      "block published",
+			published: &mountInfo{source: testNodeDevicePath},
+			usage:     []*csi.VolumeUsage{{Unit: csi.VolumeUsage_BYTES, Total: fakeDeviceSize}},
+		},
+		{
+			name:     "device vanished",
+			staged:   &mountInfo{source: testNodeDevicePath, fsType: "ext4"},
+			detached: true,
+			abnormal: true,
+		},
+		{name: "not mounted", code: codes.NotFound},
+		{name: "target missing", targetMissing: true, code: codes.NotFound},
+	}
+
+	for _, test := range testsBench {
+		t.Run(test.name, func(t *testing.T) {
+			ns, fake := newTestNodeService(t)
+			stagingPath := t.TempDir()
+			targetPath := filepath.Join(t.TempDir(), "target")
+			if !test.targetMissing {
+				require.NoError(t, os.WriteFile(targetPath, nil, 0o644))
+			}
+			if test.staged != nil {
+				test.staged.mountPoint = stagingPath
+				fake.mounts[stagingPath] = test.staged
+			}
+			if test.blockStaged {
+				blockPath := blockStagingPath(stagingPath, testNodeVolumeID)
+				fake.mounts[blockPath] = &mountInfo{source: testNodeDevicePath, mountPoint: blockPath}
+			}
+			if test.published != nil {
+				test.published.mountPoint = targetPath
+				fake.mounts[targetPath] = test.published
+			}
+			if test.detached {
+				delete(fake.devices, deviceSerial(testNodeVolumeID))
+			}
+
+			res, err := ns.NodeGetVolumeStats(context.Background(), &csi.NodeGetVolumeStatsRequest{
+				VolumeId:          exoscaleID("ch-gva-2", testNodeVolumeID),
+				VolumePath:        targetPath,
+				StagingTargetPath: stagingPath,
+			})
+			require.Equal(t, test.code, status.Code(err), err)
+			if test.code != codes.OK {
+				return
+			}
+			require.Equal(t, test.usage, res.GetUsage())
+			require.Equal(t, test.abnormal, res.GetVolumeCondition().GetAbnormal(), res.GetVolumeCondition().GetMessage())
+		})
+	}
+}
+
+func TestNodeStageVolumeMockDiskUtils(t *testing.T) {
+	meta, err := newNodeMetadata("0b4f3c2e-9d1a-4f6e-8a3e-5f0c1d2b3a4c", "ch-gva-2")
+	require.NoError(t, err)
+	mock := newFakeDiskUtils()
+	mock.attachAll = true
+	ns := newNodeService(meta, &DriverConfig{}, mock)
+	stagingPath := t.TempDir()
+	targetPath := t.TempDir()
+	volumeID := exoscaleID("ch-gva-2", testNodeVolumeID)
+
+	_, err = ns.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+		VolumeId:          volumeID,
+		StagingTargetPath: stagingPath,
+		VolumeCapability:  mountCapability("ext4"),
+	})
+	require.NoError(t, err)
+	require.Equal(t, "/dev/mock/"+deviceSerial(testNodeVolumeID), mock.mounts[stagingPath].source)
+
+	_, err = ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:          volumeID,
+		StagingTargetPath: stagingPath,
+		TargetPath:        targetPath,
+		VolumeCapability:  mountCapability("ext4"),
+	})
+	require.NoError(t, err)
+	require.Equal(t, stagingPath, mock.mounts[targetPath].source)
+}
+
+func TestNodeStageVolumeF2FS(t *testing.T) {
+	ns, fake := newTestNodeService(t)
+	stagingPath := t.TempDir()
+	volumeID := exoscaleID("ch-gva-2", testNodeVolumeID)
+
+	_, err := ns.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+		VolumeId:          volumeID,
+		StagingTargetPath: stagingPath,
+		VolumeCapability:  mountCapability("f2fs"),
+	})
+	require.NoError(t, err)
+	require.Equal(t, "f2fs", fake.mounts[stagingPath].fsType)
+	require.Empty(t, fake.resized)
+
+	_, err = ns.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{VolumeId: volumeID, StagingTargetPath: stagingPath})
+	require.NoError(t, err)
+
+	// The filesystem formatted at the first staging is grown before being mounted again.
+	_, err = ns.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+		VolumeId:          volumeID,
+		StagingTargetPath: stagingPath,
+		VolumeCapability:  mountCapability("f2fs"),
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{testNodeDevicePath}, fake.resized)
+}
@@ -0,0 +1,123 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	v3 "github.com/exoscale/egoscale/v3"
+)
+
+// exoscaleProviderIDPrefix prefixes the instance ID in the providerID set on the Nodes by the Exoscale cloud controller manager.
+const exoscaleProviderIDPrefix = "exoscale://"
+
+// nodeLookupTimeout bounds the lookup of the node metadata through the Kubernetes and Exoscale APIs.
+const nodeLookupTimeout = time.Minute
+
+// nodeZoneLabels are the labels of the zone of the Nodes, the deprecated one being set by older clusters.
+var nodeZoneLabels = []string{"topology.kubernetes.io/zone", "failure-domain.beta.kubernetes.io/zone"}
+
+// getNodeMetadataFromKube returns the node metadata of the Kubernetes Node config.NodeName,
+// for the instances whose metadata is filtered.
+func getNodeMetadataFromKube(config *DriverConfig) (*nodeMetadata, error) {
+	kube, err := newKubeClient(config.RestConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), nodeLookupTimeout)
+	defer cancel()
+
+	return getNodeMetadataFromNode(ctx, kube, config.NodeName, func(ctx context.Context, instanceID v3.UUID) (v3.ZoneName, error) {
+		return findInstanceZone(ctx, config, instanceID)
+	})
+}
+
+// getNodeMetadataFromNode returns the node metadata of the Kubernetes Node nodeName: the instance ID of its providerID
+// and the zone of its labels, or else the zone of the instance returned by findZone.
+func getNodeMetadataFromNode(
+	ctx context.Context,
+	kube *kubeClient,
+	nodeName string,
+	findZone func(ctx context.Context, instanceID v3.UUID) (v3.ZoneName, error),
+) (*nodeMetadata, error) {
+	var node kubeNode
+	if err := kube.get(ctx, "/api/v1/nodes/"+url.PathEscape(nodeName), &node); err != nil {
+		return nil, err
+	}
+
+	id, ok := strings.CutPrefix(node.Spec.ProviderID, exoscaleProviderIDPrefix)
+	if !ok {
+		return nil, fmt.Errorf("node %s has no Exoscale provider ID: %q", nodeName, node.Spec.ProviderID)
+	}
+	instanceID, err := v3.ParseUUID(id)
+	if err != nil {
+		return nil, fmt.Errorf("invalid provider ID %q of node %s: %w", node.Spec.ProviderID, nodeName, err)
+	}
+
+	for _, label := range nodeZoneLabels {
+		if zone := node.Metadata.Labels[label]; zone != "" {
+			klog.Infof("using instance ID %s and zone %s of node %s", instanceID, zone, nodeName)
+			return &nodeMetadata{zoneName: v3.ZoneName(zone), InstanceID: instanceID}, nil
+		}
+	}
+
+	zone, err := findZone(ctx, instanceID)
+	if err != nil {
+		return nil, fmt.Errorf("zone of node %s: %w", nodeName, err)
+	}
+	klog.Infof("using instance ID %s of node %s in zone %s", instanceID, nodeName, zone)
+
+	return &nodeMetadata{zoneName: zone, InstanceID: instanceID}, nil
+}
+
+// findInstanceZone returns the zone of the instance, looked up in all the zones through the Exoscale API.
+func findInstanceZone(ctx context.Context, config *DriverConfig, instanceID v3.UUID) (v3.ZoneName, error) {
+	if config.Credentials == nil {
+		return "", errors.New("no Exoscale API credentials to look the instance up")
+	}
+
+	clientOpts, err := newAPIClientOpts(config)
+	if err != nil {
+		return "", err
+	}
+	client, err := v3.NewClient(config.Credentials, clientOpts...)
+	if err != nil {
+		return "", fmt.Errorf("look the instance up: %w", err)
+	}
+
+	zones, err := client.ListZones(ctx)
+	if err != nil {
+		return "", fmt.Errorf("list zones: %w", err)
+	}
+	zoneList := config.ZoneEndpoints.apply(zones.Zones)
+
+	found := make([]bool, len(zoneList))
+	err = forEachZone(ctx, client, zoneList, func(ctx context.Context, i int, client *v3.Client, zone v3.Zone) error {
+		_, err := client.GetInstance(ctx, instanceID)
+		if errors.Is(err, v3.ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("get instance in zone %s: %w", zone.Name, err)
+		}
+		found[i] = true
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	for i, zone := range zoneList {
+		if found[i] {
+			return zone.Name, nil
+		}
+	}
+
+	return "", fmt.Errorf("instance %s not found in any zone", instanceID)
+}
@@ -0,0 +1,148 @@
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	v3 "github.com/exoscale/egoscale/v3"
+	"github.com/exoscale/egoscale/v3/credentials"
+)
+
+func TestGetNodeMetadataFromNode(t *testing.T) {
+	instanceID := v3.UUID("3b8f4e0c-4c1a-4f6b-9d4e-2f1c5b6a7d8e")
+
+	testsBench := []struct {
+		name       string
+		providerID string
+		labels     map[string]string
+		findZone   v3.ZoneName
+		expected   *nodeMetadata
+		err        bool
+	}{
+		{
+			name:       "zone label",
+			providerID: "exoscale://" + instanceID.String(),
+			labels:     map[string]string{"topology.kubernetes.io/zone": "ch-gva-2"},
+			expected:   &nodeMetadata{zoneName: "ch-gva-2", InstanceID: instanceID},
+		},
+		{
+			name:       "deprecated zone label",
+			providerID: "exoscale://" + instanceID.String(),
+			labels:     map[string]string{"failure-domain.beta.kubernetes.io/zone": "de-fra-1"},
+			expected:   &nodeMetadata{zoneName: "de-fra-1", InstanceID: instanceID},
+		},
+		{
+			name:       "zone of the instance",
+			providerID: "exoscale://" + instanceID.String(),
+			findZone:   "at-vie-1",
+			expected:   &nodeMetadata{zoneName: "at-vie-1", InstanceID: instanceID},
+		},
+		{
+			name:       "zone of the instance not found",
+			providerID: "exoscale://" + instanceID.String(),
+			err:        true,
+		},
+		{
+			name:       "invalid instance ID",
+			providerID: "exoscale://instance",
+			labels:     map[string]string{"topology.kubernetes.io/zone": "ch-gva-2"},
+			err:        true,
+		},
+		{
+			name:       "other provider",
+			providerID: "aws:///eu-west-1a/i-0123456789",
+			labels:     map[string]string{"topology.kubernetes.io/zone": "ch-gva-2"},
+			err:        true,
+		},
+		{
+			name:   "no provider ID",
+			labels: map[string]string{"topology.kubernetes.io/zone": "ch-gva-2"},
+			err:    true,
+		},
+	}
+
+	for _, tt := range testsBench {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/api/v1/nodes/worker-1" {
+					http.NotFound(w, r)
+					return
+				}
+				var node kubeNode
+				node.Metadata.Name = "worker-1"
+				node.Metadata.Labels = tt.labels
+				node.Spec.ProviderID = tt.providerID
+				require.NoError(t, json.NewEncoder(w).Encode(node))
+			}))
+			t.Cleanup(server.Close)
+			kube := &kubeClient{httpClient: server.Client(), host: server.URL}
+
+			findZone := func(_ context.Context, id v3.UUID) (v3.ZoneName, error) {
+				require.Equal(t, instanceID, id)
+				if tt.findZone == "" {
+					return "", errors.New("instance not found in any zone")
+				}
+				return tt.findZone, nil
+			}
+
+			nodeMeta, err := getNodeMetadataFromNode(context.Background(), kube, "worker-1", findZone)
+			if tt.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, nodeMeta)
+		})
+	}
+
+	t.Run("node not found", func(t *testing.T) {
+		server := httptest.NewServer(http.NotFoundHandler())
+		t.Cleanup(server.Close)
+		kube := &kubeClient{httpClient: server.Client(), host: server.URL}
+
+		_, err := getNodeMetadataFromNode(context.Background(), kube, "worker-1", nil)
+		require.Error(t, err)
+	})
+}
+
+func TestFindInstanceZone(t *testing.T) {
+	instanceID := v3.UUID("3b8f4e0c-4c1a-4f6b-9d4e-2f1c5b6a7d8e")
+
+	// Every zone has its own path prefix on the fake API, the instance only exists in de-fra-1.
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/zone":
+			require.NoError(t, json.NewEncoder(w).Encode(v3.ListZonesResponse{Zones: []v3.Zone{
+				{Name: "ch-gva-2", APIEndpoint: v3.Endpoint(server.URL + "/ch-gva-2")},
+				{Name: "de-fra-1", APIEndpoint: v3.Endpoint(server.URL + "/de-fra-1")},
+			}}))
+		case "/de-fra-1/instance/" + instanceID.String():
+			require.NoError(t, json.NewEncoder(w).Encode(v3.Instance{ID: instanceID}))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	config := &DriverConfig{
+		Credentials:  credentials.NewStaticCredentials("EXOkey", "secret"),
+		ZoneEndpoint: v3.Endpoint(server.URL),
+	}
+
+	zone, err := findInstanceZone(context.Background(), config, instanceID)
+	require.NoError(t, err)
+	require.Equal(t, v3.ZoneName("de-fra-1"), zone)
+
+	_, err = findInstanceZone(context.Background(), config, v3.UUID("00000000-0000-0000-0000-000000000000"))
+	require.Error(t, err)
+
+	_, err = findInstanceZone(context.Background(), &DriverConfig{}, instanceID)
+	require.Error(t, err)
+}
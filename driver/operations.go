@@ -0,0 +1,160 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+
+	v3 "github.com/exoscale/egoscale/v3"
+)
+
+const (
+	// DefaultOperationTimeout is the maximum duration to wait for an Exoscale operation to complete.
+	DefaultOperationTimeout = 5 * time.Minute
+	// DefaultOperationPollInterval is the interval between two polls of a pending Exoscale operation.
+	DefaultOperationPollInterval = 3 * time.Second
+
+	// operationPollMaxErrors is the number of subsequent polling errors after which waiting is aborted.
+	operationPollMaxErrors = 5
+)
+
+// waitOperation waits for the operation to succeed, polling it every operationPollInterval.
+// It fails with DeadlineExceeded if the operation is still pending after operationTimeout.
+func (d *controllerService) waitOperation(ctx context.Context, client *v3.Client, op *v3.Operation) (*v3.Operation, error) {
+	if op == nil {
+		return nil, fmt.Errorf("operation is nil")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, d.operationTimeout)
+	defer cancel()
+
+	ticker := time.NewTicker(d.operationPollInterval)
+	defer ticker.Stop()
+
+	var subsequentErrors int
+	for op.State == v3.OperationStatePending {
+		select {
+		case <-ctx.Done():
+			return nil, status.Errorf(status.FromContextError(ctx.Err()).Code(),
+				"operation %s still pending: %v", op.ID, ctx.Err())
+		case <-ticker.C:
+			o, err := client.GetOperation(ctx, op.ID)
+			if err != nil {
+				subsequentErrors++
+				if subsequentErrors >= operationPollMaxErrors {
+					return nil, fmt.Errorf("get operation %s: %w", op.ID, err)
+				}
+				klog.V(4).Infof("get operation %s: %v", op.ID, err)
+				continue
+			}
+			subsequentErrors = 0
+			op = o
+		}
+	}
+
+	if op.State != v3.OperationStateSuccess {
+		return nil, &operationError{op: op}
+	}
+
+	return op, nil
+}
+
+// operationError reports an Exoscale operation which did not succeed.
+type operationError struct {
+	op *v3.Operation
+}
+
+func (e *operationError) Error() string {
+	return fmt.Sprintf("operation %s %s: reason %q, message %q", e.op.ID, e.op.State, e.op.Reason, e.op.Message)
+}
+
+// newOperationSettings returns the operation timeout and poll interval,
+// zero values fall back to the driver defaults.
+func newOperationSettings(timeout, pollInterval time.Duration) (time.Duration, time.Duration) {
+	if timeout <= 0 {
+		timeout = DefaultOperationTimeout
+	}
+	if pollInterval <= 0 {
+		pollInterval = DefaultOperationPollInterval
+	}
+
+	return timeout, pollInterval
+}
+
+// pendingOperations keeps track of the Exoscale operations still running after the call that started them returned,
+// e.g. because the CO timed out, keyed by the resource they act on.
+type pendingOperations struct {
+	mu  sync.Mutex
+	ops map[string]v3.UUID
+}
+
+func newPendingOperations() *pendingOperations {
+	return &pendingOperations{
+		ops: make(map[string]v3.UUID),
+	}
+}
+
+func (p *pendingOperations) get(key string) (v3.UUID, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	id, ok := p.ops[key]
+	return id, ok
+}
+
+func (p *pendingOperations) set(key string, id v3.UUID) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.ops[key] = id
+}
+
+func (p *pendingOperations) delete(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.ops, key)
+}
+
+// checkPendingOperation returns Aborted if an operation started by a previous call on key is still pending,
+// so retries don't start a duplicate operation.
+func (d *controllerService) checkPendingOperation(ctx context.Context, client *v3.Client, key string) error {
+	id, ok := d.pendingOperations.get(key)
+	if !ok {
+		return nil
+	}
+
+	op, err := client.GetOperation(ctx, id)
+	if err != nil && !errors.Is(err, v3.ErrNotFound) {
+		return fmt.Errorf("get operation %s: %w", id, err)
+	}
+	if err == nil && op.State == v3.OperationStatePending {
+		return status.Errorf(codes.Aborted, "operation %s on %s is already in progress", id, key)
+	}
+
+	d.pendingOperations.delete(key)
+
+	return nil
+}
+
+// waitTrackedOperation waits for the operation like waitOperation,
+// and keeps track of it for key if it is still pending when the wait stops.
+func (d *controllerService) waitTrackedOperation(ctx context.Context, client *v3.Client, key string, op *v3.Operation) (*v3.Operation, error) {
+	if op != nil {
+		d.pendingOperations.set(key, op.ID)
+	}
+
+	opDone, err := d.waitOperation(ctx, client, op)
+	if code := status.Code(err); code == codes.DeadlineExceeded || code == codes.Canceled {
+		return nil, err
+	}
+	d.pendingOperations.delete(key)
+
+	return opDone, err
+}
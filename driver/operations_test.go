@@ -0,0 +1,67 @@
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	v3 "github.com/exoscale/egoscale/v3"
+)
+
+// newTestOperationClient returns a client to an API answering GetOperation
+// with a pending operation until pendingPolls polls were made, then with the final state.
+func newTestOperationClient(t *testing.T, pendingPolls int32, final v3.OperationState) *v3.Client {
+	var polls atomic.Int32
+	client, _ := newTestAPIClient(t, func(w http.ResponseWriter, r *http.Request) {
+		state := v3.OperationStatePending
+		if polls.Add(1) > pendingPolls {
+			state = final
+		}
+		require.NoError(t, json.NewEncoder(w).Encode(v3.Operation{ID: "op", State: state}))
+	})
+
+	return client
+}
+
+func TestWaitOperation(t *testing.T) {
+	d := &controllerService{
+		operationTimeout:      time.Second,
+		operationPollInterval: 10 * time.Millisecond,
+	}
+	pending := &v3.Operation{ID: "op", State: v3.OperationStatePending}
+
+	op, err := d.waitOperation(context.Background(), newTestOperationClient(t, 2, v3.OperationStateSuccess), pending)
+	require.NoError(t, err)
+	require.Equal(t, v3.OperationStateSuccess, op.State)
+
+	_, err = d.waitOperation(context.Background(), newTestOperationClient(t, 0, v3.OperationStateFailure), pending)
+	require.Error(t, err)
+
+	d.operationTimeout = 50 * time.Millisecond
+	_, err = d.waitOperation(context.Background(), newTestOperationClient(t, 1000, v3.OperationStateSuccess), pending)
+	require.Equal(t, codes.DeadlineExceeded, status.Code(err))
+}
+
+func TestCheckPendingOperation(t *testing.T) {
+	d := &controllerService{
+		pendingOperations: newPendingOperations(),
+	}
+	const key = "ch-gva-2/8a6ad5e0-5de1-4ecb-b9d6-e2d4c2a3c0e4"
+
+	require.NoError(t, d.checkPendingOperation(context.Background(), newTestOperationClient(t, 0, v3.OperationStateSuccess), key))
+
+	d.pendingOperations.set(key, "op")
+	err := d.checkPendingOperation(context.Background(), newTestOperationClient(t, 1000, v3.OperationStateSuccess), key)
+	require.Equal(t, codes.Aborted, status.Code(err))
+
+	require.NoError(t, d.checkPendingOperation(context.Background(), newTestOperationClient(t, 0, v3.OperationStateSuccess), key))
+	_, ok := d.pendingOperations.get(key)
+	require.False(t, ok)
+}
@@ -0,0 +1,116 @@
+package driver
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"k8s.io/klog/v2"
+
+	v3 "github.com/exoscale/egoscale/v3"
+)
+
+// DefaultKubeletDir is the root directory of the kubelet, in which it creates the staging paths of the volumes.
+const DefaultKubeletDir = "/var/lib/kubelet"
+
+// kubeletVolumeData is the vol_data.json file saved by the kubelet next to the staging path of the CSI volumes,
+// in the plugins/kubernetes.io/csi/<driver>/<volume handle hash>/ directory, plugins/kubernetes.io/csi/pv/<pv>/ before Kubernetes 1.24.
+type kubeletVolumeData struct {
+	DriverName   string `json:"driverName"`
+	VolumeHandle string `json:"volumeHandle"`
+}
+
+// kubeletStagingPath is the staging path created by the kubelet for a volume of the driver.
+type kubeletStagingPath struct {
+	volumeHandle      string
+	volumeID          v3.UUID
+	stagingTargetPath string
+}
+
+// listKubeletStagingPaths returns the staging paths of the volumes of the driver in the kubelet directory,
+// whether they are mounted or not. The unreadable volume data files are logged and skipped.
+func listKubeletStagingPaths(kubeletDir string) ([]kubeletStagingPath, error) {
+	volumeDataFiles, err := filepath.Glob(filepath.Join(kubeletDir, "plugins", "kubernetes.io", "csi", "*", "*", "vol_data.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var stagingPaths []kubeletStagingPath
+	for _, volumeDataFile := range volumeDataFiles {
+		data, err := os.ReadFile(volumeDataFile)
+		if err != nil {
+			klog.Errorf("read %s: %v", volumeDataFile, err)
+			continue
+		}
+		var volumeData kubeletVolumeData
+		if err := json.Unmarshal(data, &volumeData); err != nil {
+			klog.Errorf("parse %s: %v", volumeDataFile, err)
+			continue
+		}
+		if volumeData.DriverName != DriverName {
+			continue
+		}
+
+		_, volumeID, err := getExoscaleID(volumeData.VolumeHandle)
+		if err != nil {
+			klog.Errorf("parse volume handle of %s: %v", volumeDataFile, err)
+			continue
+		}
+
+		stagingPaths = append(stagingPaths, kubeletStagingPath{
+			volumeHandle:      volumeData.VolumeHandle,
+			volumeID:          volumeID,
+			stagingTargetPath: filepath.Join(filepath.Dir(volumeDataFile), "globalmount"),
+		})
+	}
+
+	return stagingPaths, nil
+}
+
+// cleanupOrphanedStagingPaths forcibly unmounts the staging paths of the volumes of the driver whose device is gone from the node,
+// e.g. after a node crash, and removes them once empty. It runs before the node plugin serves the kubelet,
+// which creates the staging path of a volume before staging it.
+func (d *nodeService) cleanupOrphanedStagingPaths(kubeletDir string) error {
+	stagingPaths, err := listKubeletStagingPaths(kubeletDir)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range stagingPaths {
+		if _, err := d.diskUtils.GetDevicePath(p.volumeID); !os.IsNotExist(err) {
+			continue
+		}
+
+		if err := d.cleanupOrphanedStagingPath(p.volumeID, p.stagingTargetPath); err != nil {
+			klog.Errorf("clean up orphaned staging path %s of volume %s: %v", p.stagingTargetPath, p.volumeID, err)
+		}
+	}
+
+	return nil
+}
+
+// cleanupOrphanedStagingPath unmounts the staging path of the volume whose device is gone, and removes it if empty.
+func (d *nodeService) cleanupOrphanedStagingPath(volumeID v3.UUID, stagingTargetPath string) error {
+	if err := d.cleanupStaleStagingPath(volumeID, blockStagingPath(stagingTargetPath, volumeID)); err != nil {
+		return err
+	}
+	if err := d.cleanupStaleStagingPath(volumeID, stagingTargetPath); err != nil {
+		return err
+	}
+	if err := d.diskUtils.LuksClose(luksMapperName(volumeID)); err != nil {
+		return err
+	}
+	if err := d.diskUtils.DisassembleStripedVolume(stripedVolumeGroup(volumeID)); err != nil {
+		return err
+	}
+
+	if err := os.Remove(stagingTargetPath); err != nil && !os.IsNotExist(err) && !errors.Is(err, syscall.ENOTEMPTY) {
+		return err
+	} else if err == nil {
+		klog.Infof("removed orphaned staging path %s of volume %s", stagingTargetPath, volumeID)
+	}
+
+	return nil
+}
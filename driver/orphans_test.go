@@ -0,0 +1,57 @@
+package driver
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	v3 "github.com/exoscale/egoscale/v3"
+	"github.com/stretchr/testify/require"
+)
+
+func writeVolumeData(t *testing.T, dir, driverName, volumeHandle string) string {
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "globalmount"), 0o750))
+	data := fmt.Sprintf(`{"driverName":%q,"volumeHandle":%q}`, driverName, volumeHandle)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "vol_data.json"), []byte(data), 0o600))
+	return filepath.Join(dir, "globalmount")
+}
+
+func TestCleanupOrphanedStagingPaths(t *testing.T) {
+	ns, fake := newTestNodeService(t)
+	kubeletDir := t.TempDir()
+	csiDir := filepath.Join(kubeletDir, "plugins", "kubernetes.io", "csi")
+	orphanedVolumeID := v3.UUID("2c9d4e7b-1f3a-4b8c-9e6d-7a5b3c1d0f2e")
+
+	attached := writeVolumeData(t, filepath.Join(csiDir, DriverName, "attached"), DriverName, exoscaleID("ch-gva-2", testNodeVolumeID))
+	orphaned := writeVolumeData(t, filepath.Join(csiDir, DriverName, "orphaned"), DriverName, exoscaleID("ch-gva-2", orphanedVolumeID))
+	orphanedBlock := writeVolumeData(t, filepath.Join(csiDir, "pv", "pvc-block"), DriverName, exoscaleID("ch-gva-2", orphanedVolumeID))
+	orphanedBusy := writeVolumeData(t, filepath.Join(csiDir, DriverName, "busy"), DriverName, exoscaleID("ch-gva-2", orphanedVolumeID))
+	other := writeVolumeData(t, filepath.Join(csiDir, "other.csi.k8s.io", "other"), "other.csi.k8s.io", "other")
+
+	orphanedBlockPath := blockStagingPath(orphanedBlock, orphanedVolumeID)
+	require.NoError(t, os.WriteFile(orphanedBlockPath, nil, 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(orphanedBusy, "data"), nil, 0o600))
+	for _, mountPoint := range []string{attached, orphaned, other} {
+		require.NoError(t, fake.MountToTarget("/dev/vdz", mountPoint, "ext4", nil))
+	}
+	require.NoError(t, fake.MountToTarget("/dev/vdz", orphanedBlockPath, "", nil))
+	fake.luks[luksMapperName(orphanedVolumeID)] = "/dev/mapper/" + luksMapperName(orphanedVolumeID)
+
+	require.NoError(t, ns.cleanupOrphanedStagingPaths(kubeletDir))
+
+	require.Contains(t, fake.mounts, attached)
+	require.DirExists(t, attached)
+	require.Contains(t, fake.mounts, other)
+	require.DirExists(t, other)
+
+	require.NotContains(t, fake.mounts, orphaned)
+	require.NoDirExists(t, orphaned)
+	require.NotContains(t, fake.mounts, orphanedBlockPath)
+	require.NoDirExists(t, orphanedBlock)
+	require.NotContains(t, fake.luks, luksMapperName(orphanedVolumeID))
+	// A staging path still holding files isn't mounted, it is left for the admin to inspect.
+	require.DirExists(t, orphanedBusy)
+
+	require.NoError(t, ns.cleanupOrphanedStagingPaths(filepath.Join(kubeletDir, "missing")))
+}
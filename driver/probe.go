@@ -0,0 +1,87 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	v3 "github.com/exoscale/egoscale/v3"
+)
+
+// apiCheckTimeout bounds the Exoscale API requests of an API check.
+const apiCheckTimeout = 5 * time.Second
+
+// apiCheckTTL is the duration during which a successful API check is reused,
+// Probe being called every few seconds by the livenessprobe sidecar.
+const apiCheckTTL = time.Minute
+
+// apiChecks are the operations called to check the API key: the read-only operations of the IAM policy of the driver,
+// the other ones can't be checked without side effects.
+var apiChecks = []struct {
+	operation string
+	call      func(ctx context.Context, client *v3.Client) error
+}{
+	{"list-zones", func(ctx context.Context, client *v3.Client) error {
+		_, err := client.ListZones(ctx)
+		return err
+	}},
+	{"list-block-storage-volumes", func(ctx context.Context, client *v3.Client) error {
+		_, err := client.ListBlockStorageVolumes(ctx)
+		return err
+	}},
+	{"list-block-storage-snapshots", func(ctx context.Context, client *v3.Client) error {
+		_, err := client.ListBlockStorageSnapshots(ctx)
+		return err
+	}},
+	{"list-quotas", func(ctx context.Context, client *v3.Client) error {
+		_, err := client.ListQuotas(ctx)
+		return err
+	}},
+}
+
+// apiCheck remembers the last successful API check.
+type apiCheck struct {
+	sync.Mutex
+	checkedAt time.Time
+}
+
+// checkAPI checks that the API of the zone is reachable and that the API key is allowed the read-only operations of the driver.
+// It returns UNAVAILABLE when the API can't be reached and FAILED_PRECONDITION when the key is rejected or not allowed an operation.
+// A successful check is reused for apiCheckTTL.
+func (d *controllerService) checkAPI(ctx context.Context) error {
+	if d.apiCheck != nil {
+		d.apiCheck.Lock()
+		defer d.apiCheck.Unlock()
+		if time.Since(d.apiCheck.checkedAt) < apiCheckTTL {
+			return nil
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, apiCheckTimeout)
+	defer cancel()
+
+	client := d.apiClient()
+	for _, check := range apiChecks {
+		err := check.call(ctx, client)
+		switch {
+		case err == nil:
+			continue
+		case errors.Is(err, v3.ErrUnauthorized):
+			return status.Errorf(codes.FailedPrecondition, "Exoscale API key rejected, check the API key and secret: %v", err)
+		case errors.Is(err, v3.ErrForbidden):
+			return status.Errorf(codes.FailedPrecondition, "IAM role of the Exoscale API key doesn't allow the %s operation: %v", check.operation, err)
+		default:
+			return status.Errorf(codes.Unavailable, "Exoscale API of zone %s unreachable: %v", d.zoneName, err)
+		}
+	}
+
+	if d.apiCheck != nil {
+		d.apiCheck.checkedAt = time.Now()
+	}
+
+	return nil
+}
@@ -0,0 +1,92 @@
+package driver
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestProbe(t *testing.T) {
+	testsBench := []struct {
+		name         string
+		mode         Mode
+		statuses     map[string]int
+		wantReady    bool
+		wantContains string
+	}{
+		{
+			name:      "node without API",
+			mode:      NodeMode,
+			statuses:  map[string]int{"/zone": http.StatusInternalServerError},
+			wantReady: true,
+		},
+		{
+			name:      "controller allowed",
+			mode:      ControllerMode,
+			wantReady: true,
+		},
+		{
+			name:      "controller with unreachable API",
+			mode:      ControllerMode,
+			statuses:  map[string]int{"/zone": http.StatusServiceUnavailable},
+			wantReady: false,
+		},
+		{
+			name:         "controller with rejected key",
+			mode:         AllMode,
+			statuses:     map[string]int{"/zone": http.StatusUnauthorized},
+			wantReady:    false,
+			wantContains: "API key rejected",
+		},
+		{
+			name:         "controller not allowed an operation",
+			mode:         ControllerMode,
+			statuses:     map[string]int{"/block-storage-snapshot": http.StatusForbidden},
+			wantReady:    false,
+			wantContains: "list-block-storage-snapshots",
+		},
+	}
+
+	for _, tt := range testsBench {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests atomic.Int32
+			client, _ := newTestAPIClient(t, func(w http.ResponseWriter, r *http.Request) {
+				requests.Add(1)
+				w.Header().Set("Content-Type", "application/json")
+				if code, ok := tt.statuses[r.URL.Path]; ok {
+					w.WriteHeader(code)
+				}
+				_, _ = w.Write([]byte(`{}`))
+			})
+
+			d := &Driver{
+				config:            &DriverConfig{Mode: tt.mode},
+				controllerService: controllerService{client: client, zoneName: "ch-gva-2", apiCheck: &apiCheck{}},
+			}
+
+			resp, err := d.Probe(context.Background(), nil)
+			require.NoError(t, err)
+			require.Equal(t, tt.wantReady, resp.GetReady().GetValue())
+
+			if tt.wantContains != "" {
+				// The cause logged by Probe is the error of the API check.
+				err := d.controllerService.checkAPI(context.Background())
+				require.Equal(t, codes.FailedPrecondition, status.Code(err))
+				require.ErrorContains(t, err, tt.wantContains)
+			}
+
+			if tt.mode != NodeMode && tt.wantReady {
+				// The successful check is reused.
+				count := requests.Load()
+				_, err = d.Probe(context.Background(), nil)
+				require.NoError(t, err)
+				require.Equal(t, count, requests.Load())
+			}
+		})
+	}
+}
@@ -0,0 +1,39 @@
+package driver
+
+import (
+	"context"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+
+	v3 "github.com/exoscale/egoscale/v3"
+)
+
+// blockStorageQuotaResource is the organization quota of the total size in GiB of the block storage volumes.
+const blockStorageQuotaResource = "block-storage-volume-size"
+
+// checkVolumeQuota returns ResourceExhausted with the remaining quota if provisioning a volume
+// of sizeInGiB would exceed the block storage quota of the organization.
+// The check is best effort: the API is left to fail on error or if the quota is not reported.
+func checkVolumeQuota(ctx context.Context, client *v3.Client, sizeInGiB int64) error {
+	quotas, err := client.ListQuotas(ctx)
+	if err != nil {
+		klog.Warningf("list quotas, skipping the block storage quota check: %v", err)
+		return nil
+	}
+
+	for _, quota := range quotas.Quotas {
+		if quota.Resource != blockStorageQuotaResource || quota.Limit < 0 {
+			continue
+		}
+
+		if remaining := quota.Limit - quota.Usage; sizeInGiB > remaining {
+			return status.Errorf(codes.ResourceExhausted,
+				"volume of %d GiB exceeds the block storage quota: %d GiB remaining out of %d GiB",
+				sizeInGiB, max(remaining, 0), quota.Limit)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,32 @@
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	v3 "github.com/exoscale/egoscale/v3"
+)
+
+func TestCheckVolumeQuota(t *testing.T) {
+	client, _ := newTestAPIClient(t, func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/quota", r.URL.Path)
+		require.NoError(t, json.NewEncoder(w).Encode(v3.ListQuotasResponse{
+			Quotas: []v3.Quota{
+				{Resource: "instance", Limit: 10, Usage: 10},
+				{Resource: blockStorageQuotaResource, Limit: 1000, Usage: 900},
+			},
+		}))
+	})
+
+	require.NoError(t, checkVolumeQuota(context.Background(), client, 100))
+
+	err := checkVolumeQuota(context.Background(), client, 101)
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+	require.Contains(t, err.Error(), "100 GiB remaining")
+}
@@ -0,0 +1,36 @@
+package driver
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"golang.org/x/time/rate"
+	"k8s.io/klog/v2"
+
+	v3 "github.com/exoscale/egoscale/v3"
+)
+
+// throttleThreshold is the wait on the rate limiter above which a request is considered throttled.
+const throttleThreshold = time.Millisecond
+
+// newRateLimitInterceptor returns an Exoscale API request interceptor delaying the requests
+// to respect qps requests per second on average with bursts of at most burst requests.
+func newRateLimitInterceptor(qps float64, burst int) v3.RequestInterceptorFn {
+	limiter := rate.NewLimiter(rate.Limit(qps), burst)
+
+	return func(ctx context.Context, req *http.Request) error {
+		start := time.Now()
+		if err := limiter.Wait(ctx); err != nil {
+			return err
+		}
+
+		if waited := time.Since(start); waited > throttleThreshold {
+			klog.V(5).Infof("API request %s %s throttled for %s", req.Method, req.URL.Path, waited)
+			apiThrottledRequests.Inc()
+			apiThrottleWaitSeconds.Observe(waited.Seconds())
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,153 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	v3 "github.com/exoscale/egoscale/v3"
+)
+
+// runAttachmentReconciler calls reconcileAttachments every interval until ctx is done.
+func (d *controllerService) runAttachmentReconciler(ctx context.Context, kube *kubeClient, interval time.Duration) {
+	klog.Infof("attachment reconciler started, interval %s", interval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := d.reconcileAttachments(ctx, kube); err != nil {
+				klog.Errorf("reconcile attachments: %v", err)
+			}
+		}
+	}
+}
+
+// reconcileAttachments detaches the volumes of the VolumeAttachments of the driver still attached to instances
+// which no longer exist, e.g. destroyed outside of Kubernetes, so that their VolumeAttachments can be released
+// and the volumes attached to another node without waiting for the API to clean them up.
+// The volumes of the zone of the controller which aren't attached by the cluster are left alone.
+func (d *controllerService) reconcileAttachments(ctx context.Context, kube *kubeClient) error {
+	attachedVolumes, err := listAttachedVolumes(ctx, kube, d.zoneName)
+	if err != nil {
+		return err
+	}
+	if len(attachedVolumes) == 0 {
+		return nil
+	}
+
+	client := d.apiClient()
+	volumes, err := client.ListBlockStorageVolumes(ctx)
+	if err != nil {
+		return err
+	}
+	// The instances are listed once for all the volumes, an instance missing from the list no longer exists.
+	instances, err := client.ListInstances(ctx)
+	if err != nil {
+		return fmt.Errorf("list instances: %w", err)
+	}
+	instanceExists := make(map[v3.UUID]bool, len(instances.Instances))
+	for _, instance := range instances.Instances {
+		instanceExists[instance.ID] = true
+	}
+
+	for _, volume := range volumes.BlockStorageVolumes {
+		if !attachedVolumes[volume.ID] || volume.Instance == nil || volume.Instance.ID == "" || instanceExists[volume.Instance.ID] {
+			continue
+		}
+
+		if err := d.detachOrphanedVolume(ctx, client, d.zoneName, volume.ID, volume.Instance.ID); err != nil {
+			klog.Errorf("reconcile attachments: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// listAttachedVolumes returns the IDs of the volumes of the zone which have a VolumeAttachment of the driver.
+func listAttachedVolumes(ctx context.Context, kube *kubeClient, zoneName v3.ZoneName) (map[v3.UUID]bool, error) {
+	var attachments kubeVolumeAttachmentList
+	if err := kube.get(ctx, "/apis/storage.k8s.io/v1/volumeattachments", &attachments); err != nil {
+		return nil, fmt.Errorf("list volume attachments: %w", err)
+	}
+	attachedPVs := make(map[string]bool)
+	for _, attachment := range attachments.Items {
+		if attachment.Spec.Attacher == DriverName && attachment.Spec.Source.PersistentVolumeName != "" {
+			attachedPVs[attachment.Spec.Source.PersistentVolumeName] = true
+		}
+	}
+	if len(attachedPVs) == 0 {
+		return nil, nil
+	}
+
+	var pvs kubePersistentVolumeList
+	if err := kube.get(ctx, "/api/v1/persistentvolumes", &pvs); err != nil {
+		return nil, fmt.Errorf("list persistent volumes: %w", err)
+	}
+	volumeIDs := make(map[v3.UUID]bool)
+	for _, pv := range pvs.Items {
+		if !attachedPVs[pv.Metadata.Name] || pv.Spec.CSI == nil || pv.Spec.CSI.Driver != DriverName {
+			continue
+		}
+		zone, volumeID, err := getExoscaleID(pv.Spec.CSI.VolumeHandle)
+		if err != nil || zone != zoneName {
+			continue
+		}
+		volumeIDs[volumeID] = true
+	}
+
+	return volumeIDs, nil
+}
+
+// isInstanceDeleted returns whether the instance no longer exists.
+func isInstanceDeleted(ctx context.Context, client *v3.Client, instanceID v3.UUID) bool {
+	_, err := client.GetInstance(ctx, instanceID)
+	return errors.Is(err, v3.ErrNotFound)
+}
+
+// detachInstanceVolumes detaches all the volumes still attached to the deleted instance at once,
+// rather than waiting for the ControllerUnpublishVolume of each of their VolumeAttachments.
+func (d *controllerService) detachInstanceVolumes(ctx context.Context, client *v3.Client, zoneName v3.ZoneName, instanceID v3.UUID) error {
+	volumes, err := client.ListBlockStorageVolumes(ctx, v3.ListBlockStorageVolumesWithInstanceID(instanceID))
+	if err != nil {
+		return fmt.Errorf("list block storage volumes of instance %s: %w", instanceID, err)
+	}
+
+	var errs []error
+	for _, volume := range volumes.BlockStorageVolumes {
+		if err := d.detachOrphanedVolume(ctx, client, zoneName, volume.ID, instanceID); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// detachOrphanedVolume detaches the volume from the deleted instance.
+func (d *controllerService) detachOrphanedVolume(ctx context.Context, client *v3.Client, zoneName v3.ZoneName, volumeID, instanceID v3.UUID) error {
+	key := exoscaleID(zoneName, volumeID)
+	if err := d.checkPendingOperation(ctx, client, key); err != nil {
+		return fmt.Errorf("skip detaching volume %s: %w", volumeID, err)
+	}
+
+	klog.Infof("detaching volume %s from deleted instance %s", volumeID, instanceID)
+	op, err := client.DetachBlockStorageVolume(ctx, volumeID)
+	if err != nil {
+		return fmt.Errorf("detach block storage volume %s: %w", volumeID, err)
+	}
+
+	if _, err := d.waitTrackedOperation(ctx, client, key, op); err != nil {
+		return fmt.Errorf("wait detach block storage volume %s: %w", volumeID, err)
+	}
+	orphanedVolumesDetached.Inc()
+	d.volumesList.invalidate()
+
+	return nil
+}
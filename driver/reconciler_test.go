@@ -0,0 +1,102 @@
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/require"
+
+	v3 "github.com/exoscale/egoscale/v3"
+)
+
+func TestReconcileAttachments(t *testing.T) {
+	const (
+		liveInstance    v3.UUID = "4ef2d9a8-5b21-4b3b-9c2b-1a8bd5a1e1c1"
+		deletedInstance v3.UUID = "7c1fd0e4-a3b0-4c64-8f6c-9d0c0ff4f2b2"
+	)
+
+	var (
+		mu       sync.Mutex
+		detached []string
+	)
+	client, _ := newTestAPIClient(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/block-storage":
+			require.NoError(t, json.NewEncoder(w).Encode(v3.ListBlockStorageVolumesResponse{
+				BlockStorageVolumes: []v3.BlockStorageVolume{
+					{ID: "a0b1c2d3-0000-4000-8000-000000000001", Instance: &v3.InstanceTarget{ID: liveInstance}},
+					{ID: "a0b1c2d3-0000-4000-8000-000000000002", Instance: &v3.InstanceTarget{ID: deletedInstance}},
+					{ID: "a0b1c2d3-0000-4000-8000-000000000003"},
+					// Not managed by the cluster.
+					{ID: "a0b1c2d3-0000-4000-8000-000000000004", Instance: &v3.InstanceTarget{ID: deletedInstance}},
+				},
+			}))
+		case r.URL.Path == "/instance":
+			require.NoError(t, json.NewEncoder(w).Encode(v3.ListInstancesResponse{
+				Instances: []v3.ListInstancesResponseInstances{{ID: liveInstance}},
+			}))
+		case r.Method == http.MethodPut:
+			mu.Lock()
+			detached = append(detached, r.URL.Path)
+			mu.Unlock()
+			require.NoError(t, json.NewEncoder(w).Encode(v3.Operation{ID: "op", State: v3.OperationStateSuccess}))
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+	})
+
+	kubeServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/apis/storage.k8s.io/v1/volumeattachments":
+			var attachments kubeVolumeAttachmentList
+			for _, attachment := range []struct{ attacher, pv string }{
+				{DriverName, "pv-live"},
+				{DriverName, "pv-deleted"},
+				{DriverName, "pv-other-zone"},
+				{"other.csi.k8s.io", "pv-other-driver"},
+			} {
+				var va kubeVolumeAttachment
+				va.Spec.Attacher = attachment.attacher
+				va.Spec.Source.PersistentVolumeName = attachment.pv
+				attachments.Items = append(attachments.Items, va)
+			}
+			require.NoError(t, json.NewEncoder(w).Encode(attachments))
+		case "/api/v1/persistentvolumes":
+			var pvs []map[string]any
+			for _, pv := range []struct{ name, driver, handle string }{
+				{"pv-live", DriverName, "ch-gva-2/a0b1c2d3-0000-4000-8000-000000000001"},
+				{"pv-deleted", DriverName, "ch-gva-2/a0b1c2d3-0000-4000-8000-000000000002"},
+				{"pv-other-zone", DriverName, "de-fra-1/a0b1c2d3-0000-4000-8000-000000000005"},
+				{"pv-other-driver", "other.csi.k8s.io", "a0b1c2d3-0000-4000-8000-000000000004"},
+			} {
+				pvs = append(pvs, map[string]any{
+					"metadata": map[string]any{"name": pv.name},
+					"spec":     map[string]any{"csi": map[string]any{"driver": pv.driver, "volumeHandle": pv.handle}},
+				})
+			}
+			require.NoError(t, json.NewEncoder(w).Encode(map[string]any{"items": pvs}))
+		default:
+			t.Errorf("unexpected kube request %s %s", r.Method, r.URL.Path)
+		}
+	}))
+	t.Cleanup(kubeServer.Close)
+	kube := &kubeClient{httpClient: kubeServer.Client(), host: kubeServer.URL}
+
+	d := &controllerService{
+		client:                client,
+		zoneName:              "ch-gva-2",
+		operationTimeout:      time.Second,
+		operationPollInterval: 10 * time.Millisecond,
+		pendingOperations:     newPendingOperations(),
+		volumesList:           newListCache[*csi.ListVolumesResponse_Entry](0),
+	}
+
+	require.NoError(t, d.reconcileAttachments(context.Background(), kube))
+	require.Equal(t, []string{"/block-storage/a0b1c2d3-0000-4000-8000-000000000002:detach"}, detached)
+}
@@ -0,0 +1,148 @@
+package driver
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"k8s.io/klog/v2"
+
+	v3 "github.com/exoscale/egoscale/v3"
+)
+
+const (
+	volumeDeviceRemovedReason = "VolumeDeviceRemoved"
+
+	// deviceRemovalCheckInterval is the interval between two checks of the staged volumes without device removal event,
+	// in case an event was missed.
+	deviceRemovalCheckInterval = time.Minute
+)
+
+// runDeviceRemovalWatcher checks the devices of the volumes staged on the node whenever a device is removed,
+// and every deviceRemovalCheckInterval, until ctx is done. kube may be nil to skip the events.
+func (d *nodeService) runDeviceRemovalWatcher(ctx context.Context, kube *kubeClient, kubeletDir string, cleanup bool) {
+	klog.Infof("device removal watcher started, cleanup %t", cleanup)
+
+	reported := make(map[v3.UUID]bool)
+	for {
+		if err := d.checkRemovedDevices(ctx, kube, kubeletDir, cleanup, reported); err != nil {
+			klog.Errorf("check removed devices: %v", err)
+		}
+
+		waitCtx, cancel := context.WithTimeout(ctx, deviceRemovalCheckInterval)
+		err := d.diskUtils.WaitDeviceRemoval(waitCtx)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil && waitCtx.Err() == nil {
+			klog.Errorf("wait for device removals: %v", err)
+			// Don't spin if the removals can't be watched, the periodic check still applies.
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(deviceRemovalCheckInterval):
+			}
+		}
+	}
+}
+
+// checkRemovedDevices reports the volumes still staged on the node whose device was removed, e.g. by a forced detach,
+// as abnormal with the exoscale_csi_volume_abnormal metric and with an event on their PVC.
+// With cleanup, their staging path is forcibly unmounted rather than waiting for the kubelet to unstage them.
+// reported holds the volumes already reported, so that they are reported once.
+func (d *nodeService) checkRemovedDevices(ctx context.Context, kube *kubeClient, kubeletDir string, cleanup bool, reported map[v3.UUID]bool) error {
+	stagingPaths, err := listKubeletStagingPaths(kubeletDir)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range stagingPaths {
+		staged, err := d.isStaged(p)
+		if err != nil {
+			klog.Errorf("check staging path %s of volume %s: %v", p.stagingTargetPath, p.volumeID, err)
+			continue
+		}
+		if _, err := d.diskUtils.GetDevicePath(p.volumeID); !staged || !os.IsNotExist(err) {
+			delete(reported, p.volumeID)
+			continue
+		}
+		if reported[p.volumeID] {
+			continue
+		}
+		reported[p.volumeID] = true
+
+		volumeCondition := abnormalVolumeCondition("device of volume %s was removed from the node while staged on %s", p.volumeID, p.stagingTargetPath)
+		klog.Warning(volumeCondition.GetMessage())
+		recordVolumeCondition(p.volumeID, volumeCondition)
+		if kube != nil {
+			if err := createVolumeEvent(ctx, kube, p.volumeHandle, volumeDeviceRemovedReason, volumeCondition.GetMessage(), d.nodeID.String()); err != nil {
+				klog.Errorf("emit device removal event of volume %s: %v", p.volumeID, err)
+			}
+		}
+
+		if cleanup {
+			if err := d.cleanupRemovedDeviceStagingPath(ctx, p); err != nil {
+				klog.Errorf("clean up staging path %s of volume %s: %v", p.stagingTargetPath, p.volumeID, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// cleanupRemovedDeviceStagingPath forcibly unmounts the staging path of the volume whose device was removed,
+// unless the kubelet is unstaging it concurrently.
+func (d *nodeService) cleanupRemovedDeviceStagingPath(ctx context.Context, p kubeletStagingPath) error {
+	unlock, err := d.volumeLocks.lock(ctx, p.volumeID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return d.cleanupOrphanedStagingPath(p.volumeID, p.stagingTargetPath)
+}
+
+// isStaged returns whether the filesystem or the device of the volume is mounted on its staging path.
+func (d *nodeService) isStaged(p kubeletStagingPath) (bool, error) {
+	for _, path := range []string{p.stagingTargetPath, blockStagingPath(p.stagingTargetPath, p.volumeID)} {
+		info, err := d.diskUtils.GetMountInfo(path)
+		if err != nil {
+			return false, err
+		}
+		if info != nil {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// WaitDeviceRemoval waits for the removal of a /dev/disk/by-id link of a device until ctx is done.
+func (d *diskUtils) WaitDeviceRemoval(ctx context.Context) error {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	if _, err := unix.InotifyAddWatch(fd, devDiskByID, unix.IN_DELETE|unix.IN_MOVED_FROM); err != nil {
+		return err
+	}
+
+	buf := make([]byte, unix.SizeofInotifyEvent*64+unix.NAME_MAX+1)
+	for ctx.Err() == nil {
+		pollFds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+		n, err := unix.Poll(pollFds, int(devicePollInterval.Milliseconds()))
+		if err != nil && err != unix.EINTR {
+			return err
+		}
+		if n > 0 {
+			_, _ = unix.Read(fd, buf)
+			return nil
+		}
+	}
+
+	return ctx.Err()
+}
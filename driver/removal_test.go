@@ -0,0 +1,40 @@
+package driver
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	v3 "github.com/exoscale/egoscale/v3"
+)
+
+func TestCheckRemovedDevices(t *testing.T) {
+	ns, fake := newTestNodeService(t)
+	kubeletDir := t.TempDir()
+	csiDir := filepath.Join(kubeletDir, "plugins", "kubernetes.io", "csi", DriverName)
+	removedVolumeID := v3.UUID("2c9d4e7b-1f3a-4b8c-9e6d-7a5b3c1d0f2e")
+
+	attached := writeVolumeData(t, filepath.Join(csiDir, "attached"), DriverName, exoscaleID("ch-gva-2", testNodeVolumeID))
+	removed := writeVolumeData(t, filepath.Join(csiDir, "removed"), DriverName, exoscaleID("ch-gva-2", removedVolumeID))
+	require.NoError(t, fake.MountToTarget(testNodeDevicePath, attached, "ext4", nil))
+	require.NoError(t, fake.MountToTarget("/dev/vdc", removed, "ext4", nil))
+
+	reported := make(map[v3.UUID]bool)
+	require.NoError(t, ns.checkRemovedDevices(context.Background(), nil, kubeletDir, false, reported))
+	require.Equal(t, map[v3.UUID]bool{removedVolumeID: true}, reported)
+	require.Contains(t, fake.mounts, removed)
+
+	require.NoError(t, ns.checkRemovedDevices(context.Background(), nil, kubeletDir, true, reported))
+	require.Contains(t, fake.mounts, removed, "volumes are reported and cleaned up once")
+
+	delete(reported, removedVolumeID)
+	require.NoError(t, ns.checkRemovedDevices(context.Background(), nil, kubeletDir, true, reported))
+	require.NotContains(t, fake.mounts, removed)
+	require.Contains(t, fake.mounts, attached)
+
+	// The volume is no longer staged once cleaned up.
+	require.NoError(t, ns.checkRemovedDevices(context.Background(), nil, kubeletDir, true, reported))
+	require.Empty(t, reported)
+}
@@ -0,0 +1,49 @@
+package driver
+
+import (
+	"context"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	v3 "github.com/exoscale/egoscale/v3"
+	"github.com/exoscale/egoscale/v3/credentials"
+)
+
+// Keys of the CSI secrets holding Exoscale API credentials,
+// the same as in the exoscale-credentials Secret of the driver.
+const (
+	secretAPIKey    = "EXOSCALE_API_KEY"
+	secretAPISecret = "EXOSCALE_API_SECRET"
+)
+
+// clientFromSecrets returns a client using the Exoscale API credentials of the CSI secrets
+// if any, e.g. set by a StorageClass with csi.storage.k8s.io/provisioner-secret-name,
+// or the driver client otherwise.
+func (d *controllerService) clientFromSecrets(secrets map[string]string) (*v3.Client, error) {
+	if len(secrets) == 0 {
+		return d.apiClient(), nil
+	}
+
+	apiKey, apiSecret := secrets[secretAPIKey], secrets[secretAPISecret]
+	if apiKey == "" || apiSecret == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "secrets must contain %s and %s", secretAPIKey, secretAPISecret)
+	}
+
+	client, err := v3.NewClient(credentials.NewStaticCredentials(apiKey, apiSecret), d.clientOpts...)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "new client from secrets: %v", err)
+	}
+
+	return client, nil
+}
+
+// clientZone returns a client to the zone using the credentials of the CSI secrets if any.
+func (d *controllerService) clientZone(ctx context.Context, secrets map[string]string, zoneName v3.ZoneName) (*v3.Client, error) {
+	client, err := d.clientFromSecrets(secrets)
+	if err != nil {
+		return nil, err
+	}
+
+	return newClientZone(ctx, client, zoneName, d.zoneEndpoints)
+}
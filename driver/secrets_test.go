@@ -0,0 +1,29 @@
+package driver
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	v3 "github.com/exoscale/egoscale/v3"
+	"github.com/exoscale/egoscale/v3/credentials"
+)
+
+func TestClientFromSecrets(t *testing.T) {
+	client, err := v3.NewClient(credentials.NewStaticCredentials("EXOtest", "secret"))
+	require.NoError(t, err)
+	d := &controllerService{client: client}
+
+	res, err := d.clientFromSecrets(nil)
+	require.NoError(t, err)
+	require.Same(t, client, res)
+
+	_, err = d.clientFromSecrets(map[string]string{secretAPIKey: "EXOother"})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	res, err = d.clientFromSecrets(map[string]string{secretAPIKey: "EXOother", secretAPISecret: "other"})
+	require.NoError(t, err)
+	require.NotSame(t, client, res)
+}
@@ -0,0 +1,84 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// DefaultShutdownTimeout is the default maximum duration to wait for the in-flight RPCs to complete on shutdown,
+	// leaving shutdownStopDelay within the default 30s termination grace period of the pods.
+	DefaultShutdownTimeout = 20 * time.Second
+
+	// shutdownStopDelay is the duration left to the RPCs canceled at the shutdown timeout to return before the server is stopped.
+	shutdownStopDelay = 5 * time.Second
+)
+
+// errShuttingDown is the cause of the cancellation of the RPCs still running at the shutdown timeout.
+var errShuttingDown = errors.New("driver shutting down")
+
+// newShutdownInterceptor returns a unary interceptor canceling the context of the RPCs once shutdown is done.
+// The RPCs failing once canceled return UNAVAILABLE for the caller to retry them on the next instance of the driver,
+// except if they already failed with a specific code.
+func newShutdownInterceptor(shutdown context.Context) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, cancel := context.WithCancelCause(ctx)
+		defer cancel(nil)
+		stop := context.AfterFunc(shutdown, func() { cancel(context.Cause(shutdown)) })
+		defer stop()
+
+		resp, err := handler(ctx, req)
+		if err == nil || !errors.Is(context.Cause(ctx), errShuttingDown) {
+			return resp, err
+		}
+
+		if st, ok := status.FromError(err); ok && st.Code() != codes.Internal && st.Code() != codes.Unknown {
+			return resp, err
+		}
+
+		return resp, status.Errorf(codes.Unavailable, "%s canceled by the driver shutdown: %v", info.FullMethod, err)
+	}
+}
+
+// shutdown gracefully stops the server, waiting up to timeout for the in-flight RPCs to complete.
+// The RPCs still running at the timeout are canceled, and the server is stopped
+// shutdownStopDelay later if they didn't return, e.g. blocked in a mount.
+// A zero timeout waits for the RPCs forever.
+func (d *Driver) shutdown(timeout time.Duration) {
+	d.setServing(false)
+
+	stopped := make(chan struct{})
+	go func() {
+		d.srv.GracefulStop()
+		close(stopped)
+	}()
+
+	if timeout == 0 {
+		<-stopped
+		return
+	}
+
+	select {
+	case <-stopped:
+		return
+	case <-time.After(timeout):
+	}
+
+	klog.Warningf("RPCs still running %s after the shutdown, canceling them", timeout)
+	d.cancelRPCs(errShuttingDown)
+
+	select {
+	case <-stopped:
+		return
+	case <-time.After(shutdownStopDelay):
+	}
+
+	klog.Warningf("canceled RPCs still running %s later, stopping the server", shutdownStopDelay)
+	d.srv.Stop()
+}
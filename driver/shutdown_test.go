@@ -0,0 +1,106 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+func TestShutdownInterceptor(t *testing.T) {
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Node/NodeStageVolume"}
+
+	waitCanceled := func(err error) grpc.UnaryHandler {
+		return func(ctx context.Context, req interface{}) (interface{}, error) {
+			<-ctx.Done()
+			return nil, err
+		}
+	}
+
+	testsBench := []struct {
+		name     string
+		handler  grpc.UnaryHandler
+		wantCode codes.Code
+	}{
+		{
+			name:     "canceled by the shutdown",
+			handler:  waitCanceled(errors.New("wait for the device: context canceled")),
+			wantCode: codes.Unavailable,
+		},
+		{
+			name:     "specific code kept",
+			handler:  waitCanceled(status.Error(codes.Aborted, "operation pending")),
+			wantCode: codes.Aborted,
+		},
+	}
+
+	for _, tt := range testsBench {
+		t.Run(tt.name, func(t *testing.T) {
+			shutdown, cancel := context.WithCancelCause(context.Background())
+			interceptor := newShutdownInterceptor(shutdown)
+			time.AfterFunc(10*time.Millisecond, func() { cancel(errShuttingDown) })
+
+			_, err := interceptor(context.Background(), nil, info, tt.handler)
+			require.Equal(t, tt.wantCode, status.Code(err), "%v", err)
+		})
+	}
+
+	t.Run("not shutting down", func(t *testing.T) {
+		interceptor := newShutdownInterceptor(context.Background())
+		resp, err := interceptor(context.Background(), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return "ok", nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, "ok", resp)
+	})
+}
+
+// blockingIdentityServer blocks in Probe until its context is canceled.
+type blockingIdentityServer struct {
+	csi.UnimplementedIdentityServer
+	started chan struct{}
+}
+
+func (s *blockingIdentityServer) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
+	close(s.started)
+	<-ctx.Done()
+	return nil, context.Cause(ctx)
+}
+
+func TestShutdown(t *testing.T) {
+	d := &Driver{config: &DriverConfig{}}
+	d.rpcs, d.cancelRPCs = context.WithCancelCause(context.Background())
+	d.srv = grpc.NewServer(grpc.ChainUnaryInterceptor(newShutdownInterceptor(d.rpcs)))
+	identity := &blockingIdentityServer{started: make(chan struct{})}
+	csi.RegisterIdentityServer(d.srv, identity)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	served := make(chan error, 1)
+	go func() { served <- d.srv.Serve(listener) }()
+
+	conn, err := grpc.NewClient(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	probed := make(chan error, 1)
+	go func() {
+		_, err := csi.NewIdentityClient(conn).Probe(context.Background(), &csi.ProbeRequest{})
+		probed <- err
+	}()
+	<-identity.started
+
+	d.shutdown(50 * time.Millisecond)
+
+	require.Equal(t, codes.Unavailable, status.Code(<-probed))
+	require.NoError(t, <-served)
+	require.False(t, d.serving.Load())
+}
@@ -0,0 +1,388 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+
+	v3 "github.com/exoscale/egoscale/v3"
+)
+
+// A striped volume is a set of block storage volumes assembled on the node into an LVM logical volume
+// striped over them, so that its throughput adds up the throughput of the volumes.
+// The CSI volume is its first volume, labeled with the number of stripes,
+// the other volumes are labeled with the ID of the first one and named after it.
+const (
+	// stripesParameter is the StorageClass parameter provisioning striped volumes over several block storage volumes, e.g. "4".
+	stripesParameter = "stripes"
+	// maxStripes is the maximum number of block storage volumes of a striped volume,
+	// which is also limited by the volume attachment limit of the nodes as they are all attached to the node.
+	maxStripes = 8
+
+	// stripedLogicalVolume is the name of the logical volume of the volume group of a striped volume.
+	stripedLogicalVolume = "data"
+	// stripeSize is the size of the LVM stripes, the amount of data written to a volume before the next one.
+	stripeSize = "64k"
+	// lvmConfig lets LVM create the device nodes of the logical volumes itself,
+	// as udev doesn't run in the node plugin container.
+	lvmConfig = "activation { udev_sync = 0 udev_rules = 0 }"
+)
+
+var (
+	// exoscaleVolumeStripes is the label of the first volume of a striped volume with its number of stripes,
+	// also set in the volume context.
+	exoscaleVolumeStripes = DefaultDriverName + "/stripes"
+	// exoscaleStripeOf is the label of the other volumes of a striped volume with the ID of the first one.
+	exoscaleStripeOf = DefaultDriverName + "/stripe-of"
+	// exoscaleStripeSerials is set in the publish context of striped volumes with the device serials of their volumes.
+	exoscaleStripeSerials = DriverName + "/stripe-serials"
+)
+
+// getVolumeStripes returns the number of stripes of the StorageClass parameters, 1 if not striped.
+// An error is returned if the number is invalid.
+func getVolumeStripes(parameters map[string]string) (int, error) {
+	value, ok := parameters[stripesParameter]
+	if !ok {
+		return 1, nil
+	}
+
+	stripes, err := strconv.Atoi(value)
+	if err != nil || stripes < 1 || stripes > maxStripes {
+		return 0, fmt.Errorf("invalid number of stripes %q, expected an integer between 1 and %d", value, maxStripes)
+	}
+
+	return stripes, nil
+}
+
+// volumeStripes returns the number of stripes of the volume labels, 1 if not striped.
+func volumeStripes(labels v3.Labels) int {
+	stripes, err := strconv.Atoi(labels[exoscaleVolumeStripes])
+	if err != nil || stripes < 1 {
+		return 1
+	}
+
+	return stripes
+}
+
+// stripeVolumeName returns the name of the index-th other volume of the striped volume volumeName.
+func stripeVolumeName(volumeName string, index int) string {
+	return fmt.Sprintf("%s-stripe-%d", volumeName, index)
+}
+
+// stripeSizeGiB returns the size of the volumes of a striped volume of sizeInGiB.
+func stripeSizeGiB(sizeInGiB int64, stripes int) int64 {
+	return max((sizeInGiB+int64(stripes)-1)/int64(stripes), MinimalVolumeSizeGiB)
+}
+
+// stripedVolumeSizeGiB returns the size of the volumes of a striped volume of sizeInGiB,
+// and an error if their total size, each of them being rounded up to a GiB, exceeds the limit
+// of the capacity range or the maximum volume size.
+func stripedVolumeSizeGiB(sizeInGiB int64, stripes int, capacityRange *csi.CapacityRange, limits volumeSizeLimits) (int64, error) {
+	stripeSizeInGiB := stripeSizeGiB(sizeInGiB, stripes)
+	totalSizeInGiB := stripeSizeInGiB * int64(stripes)
+	if limitBytes := capacityRange.GetLimitBytes(); limitBytes > 0 && convertGiBToBytes(totalSizeInGiB) > limitBytes {
+		return 0, fmt.Errorf("%d volumes of %d GiB exceed the limit of %d bytes", stripes, stripeSizeInGiB, limitBytes)
+	}
+	if totalSizeInGiB > limits.maxGiB {
+		return 0, fmt.Errorf("%d volumes of %d GiB exceed the maximum volume size of %d GiB", stripes, stripeSizeInGiB, limits.maxGiB)
+	}
+
+	return stripeSizeInGiB, nil
+}
+
+// listStripes returns the other volumes of the striped volume, in stripe order.
+func listStripes(ctx context.Context, client *v3.Client, volume *v3.BlockStorageVolume) ([]v3.BlockStorageVolume, error) {
+	resp, err := client.ListBlockStorageVolumes(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var stripes []v3.BlockStorageVolume
+	for _, v := range resp.BlockStorageVolumes {
+		if v.Labels[exoscaleStripeOf] == volume.ID.String() {
+			stripes = append(stripes, v)
+		}
+	}
+	slices.SortFunc(stripes, func(a, b v3.BlockStorageVolume) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	return stripes, nil
+}
+
+// createStripes creates the missing other volumes of the striped volume, the same size as the first one.
+func (d *controllerService) createStripes(ctx context.Context, client *v3.Client, zoneName v3.ZoneName, volume *v3.BlockStorageVolume) error {
+	stripes, err := listStripes(ctx, client, volume)
+	if err != nil {
+		return err
+	}
+
+	labels := maps.Clone(volume.Labels)
+	delete(labels, exoscaleVolumeStripes)
+	labels[exoscaleStripeOf] = volume.ID.String()
+
+	for i := 1; i < volumeStripes(volume.Labels); i++ {
+		name := stripeVolumeName(volume.Name, i)
+		if slices.ContainsFunc(stripes, func(v v3.BlockStorageVolume) bool { return v.Name == name }) {
+			continue
+		}
+
+		operationKey := "create-volume/" + volumeNameCacheKey(zoneName, name)
+		if err := d.checkPendingOperation(ctx, client, operationKey); err != nil {
+			return err
+		}
+
+		klog.V(4).Infof("creating volume %s of striped volume %s", name, volume.ID)
+		op, err := client.CreateBlockStorageVolume(ctx, v3.CreateBlockStorageVolumeRequest{
+			Name:   name,
+			Size:   volume.Size,
+			Labels: labels,
+		})
+		if err != nil {
+			return fmt.Errorf("create volume %s: %w", name, err)
+		}
+
+		if _, err := d.waitTrackedOperation(ctx, client, operationKey, op); err != nil {
+			return fmt.Errorf("wait create volume %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// deleteStripes deletes the other volumes of the striped volume.
+func (d *controllerService) deleteStripes(ctx context.Context, client *v3.Client, zoneName v3.ZoneName, volume *v3.BlockStorageVolume) error {
+	stripes, err := listStripes(ctx, client, volume)
+	if err != nil {
+		return err
+	}
+
+	for _, stripe := range stripes {
+		key := exoscaleID(zoneName, stripe.ID)
+		if err := d.checkPendingOperation(ctx, client, key); err != nil {
+			return err
+		}
+
+		klog.V(4).Infof("deleting volume %s of striped volume %s", stripe.ID, volume.ID)
+		op, err := client.DeleteBlockStorageVolume(ctx, stripe.ID)
+		if err != nil {
+			if errors.Is(err, v3.ErrNotFound) {
+				continue
+			}
+			return fmt.Errorf("delete volume %s: %w", stripe.ID, err)
+		}
+
+		if _, err := d.waitTrackedOperation(ctx, client, key, op); err != nil {
+			return fmt.Errorf("wait delete volume %s: %w", stripe.ID, err)
+		}
+	}
+
+	return nil
+}
+
+// publishStripes attaches the other volumes of the striped volume to the instance,
+// and sets the device serials of all its volumes in the publish context.
+// The volumes it attached are detached if one of them can't be attached, not to hold attachment slots of the instance.
+func (d *controllerService) publishStripes(ctx context.Context, client *v3.Client, zoneName v3.ZoneName, volume *v3.BlockStorageVolume, instanceID v3.UUID, publishContext map[string]string) (err error) {
+	stripes, err := listStripes(ctx, client, volume)
+	if err != nil {
+		return err
+	}
+	if len(stripes) != volumeStripes(volume.Labels)-1 {
+		return status.Errorf(codes.FailedPrecondition, "striped volume %s has %d volumes, expected %d",
+			volume.ID, len(stripes)+1, volumeStripes(volume.Labels))
+	}
+
+	unattached := 0
+	for _, stripe := range stripes {
+		if stripe.Instance == nil {
+			unattached++
+		}
+	}
+	if unattached > 0 {
+		if err := d.checkAttachLimit(ctx, client, instanceID, unattached); err != nil {
+			return err
+		}
+	}
+
+	var attached []v3.BlockStorageVolume
+	defer func() {
+		if err == nil {
+			return
+		}
+		for _, stripe := range attached {
+			if err := d.detachStripe(ctx, client, zoneName, volume, stripe); err != nil {
+				klog.Errorf("detach volume %s of striped volume %s partly attached to instance %s: %v", stripe.ID, volume.ID, instanceID, err)
+			}
+		}
+	}()
+
+	serials := []string{deviceSerial(volume.ID)}
+	for _, stripe := range stripes {
+		serials = append(serials, deviceSerial(stripe.ID))
+
+		if stripe.Instance != nil && stripe.Instance.ID == instanceID {
+			continue
+		}
+		if stripe.Instance != nil {
+			return status.Errorf(codes.FailedPrecondition, "volume %s of striped volume %s is already attached to node %s",
+				stripe.ID, volume.ID, exoscaleID(zoneName, stripe.Instance.ID))
+		}
+
+		key := exoscaleID(zoneName, stripe.ID)
+		if err := d.checkPendingOperation(ctx, client, key); err != nil {
+			return err
+		}
+
+		klog.V(4).Infof("attaching volume %s of striped volume %s to instance %s", stripe.ID, volume.ID, instanceID)
+		op, err := client.AttachBlockStorageVolumeToInstance(ctx, stripe.ID, v3.AttachBlockStorageVolumeToInstanceRequest{
+			Instance: &v3.InstanceTarget{
+				ID: instanceID,
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("attach volume %s to instance %s: %w", stripe.ID, instanceID, err)
+		}
+
+		if _, err := d.waitTrackedOperation(ctx, client, key, op); err != nil {
+			return fmt.Errorf("wait attach volume %s to instance %s: %w", stripe.ID, instanceID, err)
+		}
+		attached = append(attached, stripe)
+	}
+	publishContext[exoscaleStripeSerials] = strings.Join(serials, ",")
+
+	return nil
+}
+
+// unpublishStripes detaches the other volumes of the striped volume from the instance.
+func (d *controllerService) unpublishStripes(ctx context.Context, client *v3.Client, zoneName v3.ZoneName, volume *v3.BlockStorageVolume, instanceID v3.UUID) error {
+	stripes, err := listStripes(ctx, client, volume)
+	if err != nil {
+		return err
+	}
+
+	for _, stripe := range stripes {
+		if stripe.Instance == nil || stripe.Instance.ID != instanceID {
+			continue
+		}
+
+		if err := d.detachStripe(ctx, client, zoneName, volume, stripe); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// detachStripe detaches the other volume stripe of the striped volume from its instance.
+func (d *controllerService) detachStripe(ctx context.Context, client *v3.Client, zoneName v3.ZoneName, volume *v3.BlockStorageVolume, stripe v3.BlockStorageVolume) error {
+	key := exoscaleID(zoneName, stripe.ID)
+	if err := d.checkPendingOperation(ctx, client, key); err != nil {
+		return err
+	}
+
+	klog.V(4).Infof("detaching volume %s of striped volume %s", stripe.ID, volume.ID)
+	op, err := client.DetachBlockStorageVolume(ctx, stripe.ID)
+	if err != nil {
+		if strings.Contains(err.Error(), "Volume not attached") || errors.Is(err, v3.ErrNotFound) {
+			return nil
+		}
+		return fmt.Errorf("detach volume %s: %w", stripe.ID, err)
+	}
+
+	if _, err := d.waitTrackedOperation(ctx, client, key, op); err != nil {
+		return fmt.Errorf("wait detach volume %s: %w", stripe.ID, err)
+	}
+
+	return nil
+}
+
+// stripedVolumeGroup returns the name of the LVM volume group of the striped volume.
+func stripedVolumeGroup(volumeID v3.UUID) string {
+	return "csi-" + volumeID.String()
+}
+
+// stripedVolumePath returns the device path of the logical volume of the volume group of a striped volume.
+func stripedVolumePath(volumeGroup string) string {
+	return filepath.Join("/dev", volumeGroup, stripedLogicalVolume)
+}
+
+// getStripedDevicePath returns the device path of the logical volume of the striped volume,
+// waiting for the devices of the serials of the publish context and assembling them.
+func (d *nodeService) getStripedDevicePath(ctx context.Context, volumeID v3.UUID, serials string) (string, error) {
+	var devicePaths []string
+	for _, serial := range strings.Split(serials, ",") {
+		devicePath, err := d.diskUtils.WaitDevicePathBySerial(ctx, serial)
+		if err != nil {
+			return "", err
+		}
+		devicePaths = append(devicePaths, devicePath)
+	}
+
+	return d.diskUtils.AssembleStripedVolume(stripedVolumeGroup(volumeID), devicePaths)
+}
+
+func runLVM(command string, args ...string) error {
+	return runCommand(nil, command, append([]string{"--config", lvmConfig}, args...)...)
+}
+
+// AssembleStripedVolume creates the volumeGroup volume group on the blank devices, with a logical volume
+// striped over them, unless it exists, activates it and returns the device path of the logical volume.
+func (d *diskUtils) AssembleStripedVolume(volumeGroup string, devicePaths []string) (string, error) {
+	logicalVolume := volumeGroup + "/" + stripedLogicalVolume
+	if err := runLVM("lvs", logicalVolume); err != nil {
+		if err := runLVM("vgs", volumeGroup); err != nil {
+			// Refuse to wipe the devices which aren't blank rather than assuming they belong to the volume group.
+			for _, devicePath := range devicePaths {
+				format, err := d.GetDiskFormat(devicePath)
+				if err != nil {
+					return "", err
+				}
+				if format != "" && format != "LVM2_member" {
+					return "", fmt.Errorf("device %s is formatted with %s", devicePath, format)
+				}
+			}
+
+			klog.Infof("creating volume group %s on %v", volumeGroup, devicePaths)
+			if err := runLVM("pvcreate", append([]string{"--yes"}, devicePaths...)...); err != nil {
+				return "", err
+			}
+			if err := runLVM("vgcreate", append([]string{volumeGroup}, devicePaths...)...); err != nil {
+				return "", err
+			}
+		}
+
+		klog.Infof("creating logical volume %s striped over %d devices", logicalVolume, len(devicePaths))
+		err := runLVM("lvcreate", "--yes", "--type", "striped", "--stripes", strconv.Itoa(len(devicePaths)), "--stripesize", stripeSize,
+			"--extents", "100%FREE", "--name", stripedLogicalVolume, volumeGroup)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if err := runLVM("vgchange", "--activate", "y", volumeGroup); err != nil {
+		return "", err
+	}
+
+	return stripedVolumePath(volumeGroup), nil
+}
+
+// DisassembleStripedVolume deactivates the volumeGroup volume group, if it exists.
+func (d *diskUtils) DisassembleStripedVolume(volumeGroup string) error {
+	if _, err := os.Stat(filepath.Join("/dev", volumeGroup)); os.IsNotExist(err) {
+		return nil
+	}
+
+	return runLVM("vgchange", "--activate", "n", volumeGroup)
+}
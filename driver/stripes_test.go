@@ -0,0 +1,157 @@
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/require"
+
+	v3 "github.com/exoscale/egoscale/v3"
+)
+
+func TestGetVolumeStripes(t *testing.T) {
+	testsBench := []struct {
+		parameters map[string]string
+		res        int
+		valid      bool
+	}{
+		{parameters: nil, res: 1, valid: true},
+		{parameters: map[string]string{"stripes": "1"}, res: 1, valid: true},
+		{parameters: map[string]string{"stripes": "4"}, res: 4, valid: true},
+		{parameters: map[string]string{"stripes": "0"}, valid: false},
+		{parameters: map[string]string{"stripes": "9"}, valid: false},
+		{parameters: map[string]string{"stripes": "two"}, valid: false},
+	}
+
+	for _, test := range testsBench {
+		res, err := getVolumeStripes(test.parameters)
+		require.Equal(t, test.valid, err == nil, test.parameters)
+		require.Equal(t, test.res, res)
+	}
+}
+
+func TestVolumeStripes(t *testing.T) {
+	require.Equal(t, 1, volumeStripes(nil))
+	require.Equal(t, 1, volumeStripes(v3.Labels{exoscaleVolumeStripes: "invalid"}))
+	require.Equal(t, 4, volumeStripes(v3.Labels{exoscaleVolumeStripes: "4"}))
+}
+
+func TestStripeSizeGiB(t *testing.T) {
+	require.Equal(t, int64(25), stripeSizeGiB(100, 4))
+	require.Equal(t, int64(34), stripeSizeGiB(100, 3))
+	require.Equal(t, int64(1), stripeSizeGiB(1, 2))
+	require.Equal(t, int64(100), stripeSizeGiB(100, 1))
+}
+
+func TestStripedVolumeSizeGiB(t *testing.T) {
+	limits, err := newVolumeSizeLimits(1, 100, 10)
+	require.NoError(t, err)
+
+	testsBench := []struct {
+		name          string
+		sizeInGiB     int64
+		stripes       int
+		capacityRange *csi.CapacityRange
+		res           int64
+		valid         bool
+	}{
+		{name: "not striped", sizeInGiB: 10, stripes: 1, capacityRange: &csi.CapacityRange{LimitBytes: 10 * GiB}, res: 10, valid: true},
+		{name: "split evenly", sizeInGiB: 12, stripes: 4, capacityRange: &csi.CapacityRange{LimitBytes: 12 * GiB}, res: 3, valid: true},
+		{name: "rounded up without limit", sizeInGiB: 10, stripes: 4, res: 3, valid: true},
+		{name: "rounded up over the limit", sizeInGiB: 10, stripes: 4, capacityRange: &csi.CapacityRange{RequiredBytes: 10 * GiB, LimitBytes: 10 * GiB}},
+		{name: "rounded up over the maximum size", sizeInGiB: 100, stripes: 3},
+	}
+
+	for _, test := range testsBench {
+		t.Run(test.name, func(t *testing.T) {
+			res, err := stripedVolumeSizeGiB(test.sizeInGiB, test.stripes, test.capacityRange, limits)
+			require.Equal(t, test.valid, err == nil, err)
+			require.Equal(t, test.res, res)
+		})
+	}
+}
+
+func TestPublishStripesRollback(t *testing.T) {
+	volumeID := v3.UUID("a0b1c2d3-0000-4000-8000-000000000001")
+	instanceID := v3.UUID("7c1fd0e4-a3b0-4c64-8f6c-9d0c0ff4f2b2")
+	var (
+		mu       sync.Mutex
+		detached []string
+	)
+	client, _ := newTestAPIClient(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case r.URL.Path == "/block-storage" && r.URL.Query().Get("instanceID") != "":
+			require.NoError(t, json.NewEncoder(w).Encode(v3.ListBlockStorageVolumesResponse{
+				BlockStorageVolumes: []v3.BlockStorageVolume{{ID: volumeID}},
+			}))
+		case r.URL.Path == "/block-storage":
+			require.NoError(t, json.NewEncoder(w).Encode(v3.ListBlockStorageVolumesResponse{
+				BlockStorageVolumes: []v3.BlockStorageVolume{
+					{ID: "a0b1c2d3-0000-4000-8000-000000000002", Name: "pvc-1-stripe-1", Labels: v3.Labels{exoscaleStripeOf: volumeID.String()}},
+					{ID: "a0b1c2d3-0000-4000-8000-000000000003", Name: "pvc-1-stripe-2", Labels: v3.Labels{exoscaleStripeOf: volumeID.String()}},
+				},
+			}))
+		case r.URL.Path == "/block-storage/a0b1c2d3-0000-4000-8000-000000000002:attach":
+			require.NoError(t, json.NewEncoder(w).Encode(v3.Operation{ID: "op", State: v3.OperationStateSuccess}))
+		case r.URL.Path == "/block-storage/a0b1c2d3-0000-4000-8000-000000000003:attach":
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(`{"message": "attachment failed"}`))
+		case strings.HasSuffix(r.URL.Path, ":detach"):
+			detached = append(detached, r.URL.Path)
+			require.NoError(t, json.NewEncoder(w).Encode(v3.Operation{ID: "op", State: v3.OperationStateSuccess}))
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+	})
+	d := &controllerService{
+		pendingOperations:     newPendingOperations(),
+		maxVolumesPerNode:     5,
+		operationTimeout:      time.Second,
+		operationPollInterval: 10 * time.Millisecond,
+	}
+	volume := &v3.BlockStorageVolume{ID: volumeID, Name: "pvc-1", Labels: v3.Labels{exoscaleVolumeStripes: "3"}}
+
+	err := d.publishStripes(context.Background(), client, "ch-gva-2", volume, instanceID, map[string]string{})
+	require.ErrorContains(t, err, "attachment failed")
+	require.Equal(t, []string{"/block-storage/a0b1c2d3-0000-4000-8000-000000000002:detach"}, detached)
+}
+
+func TestNodeStageVolumeStriped(t *testing.T) {
+	ns, fake := newTestNodeService(t)
+	stripeID := v3.UUID("2f0c9a7e-4b1d-4c3a-9e8f-7a6b5c4d3e2f")
+	fake.attach(stripeID, "/dev/vdc")
+	stagingPath := t.TempDir()
+	volumeID := exoscaleID("ch-gva-2", testNodeVolumeID)
+	volumeGroup := stripedVolumeGroup(testNodeVolumeID)
+
+	_, err := ns.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+		VolumeId:          volumeID,
+		StagingTargetPath: stagingPath,
+		VolumeCapability:  mountCapability("xfs"),
+		PublishContext: map[string]string{
+			exoscaleDeviceSerial:  deviceSerial(testNodeVolumeID),
+			exoscaleStripeSerials: deviceSerial(testNodeVolumeID) + "," + deviceSerial(stripeID),
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{testNodeDevicePath, "/dev/vdc"}, fake.stripedVolumes[volumeGroup])
+	require.Equal(t, stripedVolumePath(volumeGroup), fake.mounts[stagingPath].source)
+	require.Equal(t, "xfs", fake.formatted[stripedVolumePath(volumeGroup)])
+
+	devicePath, err := fake.GetDevicePath(testNodeVolumeID)
+	require.NoError(t, err)
+	require.Equal(t, stripedVolumePath(volumeGroup), devicePath)
+
+	_, err = ns.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{VolumeId: volumeID, StagingTargetPath: stagingPath})
+	require.NoError(t, err)
+	require.Empty(t, fake.mounts)
+	require.Empty(t, fake.stripedVolumes)
+}
@@ -0,0 +1,39 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// errRPCTimeout is the cause of the cancellation of the RPCs exceeding the default RPC timeout.
+var errRPCTimeout = errors.New("RPC timeout exceeded")
+
+// newTimeoutInterceptor returns a unary interceptor canceling the context of the RPCs after timeout,
+// unless the caller set an earlier deadline. The RPCs failing once canceled by the timeout return DEADLINE_EXCEEDED,
+// except if they already failed with a specific code, e.g. ABORTED while waiting for another operation.
+func newTimeoutInterceptor(timeout time.Duration) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= timeout {
+			return handler(ctx, req)
+		}
+
+		ctx, cancel := context.WithTimeoutCause(ctx, timeout, errRPCTimeout)
+		defer cancel()
+
+		resp, err := handler(ctx, req)
+		if err == nil || !errors.Is(context.Cause(ctx), errRPCTimeout) {
+			return resp, err
+		}
+
+		if st, ok := status.FromError(err); ok && st.Code() != codes.Internal && st.Code() != codes.Unknown {
+			return resp, err
+		}
+
+		return resp, status.Errorf(codes.DeadlineExceeded, "%s canceled after the %s RPC timeout: %v", info.FullMethod, timeout, err)
+	}
+}
@@ -0,0 +1,81 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestTimeoutInterceptor(t *testing.T) {
+	interceptor := newTimeoutInterceptor(50 * time.Millisecond)
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Node/NodeStageVolume"}
+
+	waitCanceled := func(err error) grpc.UnaryHandler {
+		return func(ctx context.Context, req interface{}) (interface{}, error) {
+			<-ctx.Done()
+			return nil, err
+		}
+	}
+
+	testsBench := []struct {
+		name     string
+		ctx      func() (context.Context, context.CancelFunc)
+		handler  grpc.UnaryHandler
+		wantCode codes.Code
+	}{
+		{
+			name: "completed in time",
+			handler: func(ctx context.Context, req interface{}) (interface{}, error) {
+				return "ok", nil
+			},
+			wantCode: codes.OK,
+		},
+		{
+			name:     "canceled by the timeout",
+			handler:  waitCanceled(errors.New("wait for the device: context deadline exceeded")),
+			wantCode: codes.DeadlineExceeded,
+		},
+		{
+			name:     "specific code kept",
+			handler:  waitCanceled(status.Error(codes.Aborted, "operation pending")),
+			wantCode: codes.Aborted,
+		},
+		{
+			name: "earlier caller deadline kept",
+			ctx: func() (context.Context, context.CancelFunc) {
+				return context.WithTimeout(context.Background(), 10*time.Millisecond)
+			},
+			handler: func(ctx context.Context, req interface{}) (interface{}, error) {
+				deadline, ok := ctx.Deadline()
+				if !ok || time.Until(deadline) > 10*time.Millisecond {
+					return nil, errors.New("caller deadline not kept")
+				}
+				<-ctx.Done()
+				return nil, ctx.Err()
+			},
+			wantCode: codes.Unknown,
+		},
+	}
+
+	for _, tt := range testsBench {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.Background(), func() {}
+			if tt.ctx != nil {
+				ctx, cancel = tt.ctx()
+			}
+			defer cancel()
+
+			_, err := interceptor(ctx, nil, info, tt.handler)
+			require.Equal(t, tt.wantCode, status.Code(err), "%v", err)
+			if tt.wantCode == codes.Unknown {
+				require.ErrorIs(t, err, context.DeadlineExceeded)
+			}
+		})
+	}
+}
@@ -0,0 +1,44 @@
+package driver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+
+	"k8s.io/klog/v2"
+)
+
+// newAPITransport returns the HTTP transport of the Exoscale API clients, going through the proxy set by the
+// HTTPS_PROXY and NO_PROXY environment variables, and trusting the certificates of the caFile bundle besides
+// the system ones, e.g. the CA of a TLS intercepting proxy.
+func newAPITransport(caFile string) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+
+	if caFile == "" {
+		return transport, nil
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		klog.Warningf("load system certificates, only trusting %s: %v", caFile, err)
+		pool = x509.NewCertPool()
+	}
+
+	bundle, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("read CA bundle: %w", err)
+	}
+	if !pool.AppendCertsFromPEM(bundle) {
+		return nil, fmt.Errorf("no PEM certificate found in CA bundle %s", caFile)
+	}
+
+	transport.TLSClientConfig = &tls.Config{
+		RootCAs:    pool,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	return transport, nil
+}
@@ -0,0 +1,50 @@
+package driver
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewAPITransport(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCertificate(t, dir, "proxy")
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	require.NoError(t, err)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	get := func(transport *http.Transport) error {
+		resp, err := (&http.Client{Transport: transport}).Get(srv.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	transport, err := newAPITransport("")
+	require.NoError(t, err)
+	require.NotNil(t, transport.Proxy, "the proxy environment variables must be honored")
+	require.Error(t, get(transport), "the certificate isn't trusted without the CA bundle")
+
+	transport, err = newAPITransport(certFile)
+	require.NoError(t, err)
+	require.NotNil(t, transport.Proxy)
+	require.NoError(t, get(transport))
+
+	_, err = newAPITransport(filepath.Join(dir, "missing.crt"))
+	require.Error(t, err)
+
+	invalidFile := filepath.Join(dir, "invalid.crt")
+	require.NoError(t, os.WriteFile(invalidFile, []byte("not a certificate"), 0o600))
+	_, err = newAPITransport(invalidFile)
+	require.Error(t, err)
+}
@@ -0,0 +1,85 @@
+package driver
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	reservedBlocksPercentageParameter = "reservedBlocksPercentage"
+	ext4FeaturesParameter             = "ext4Features"
+)
+
+var (
+	exoscaleReservedBlocksPercentage = DriverName + "/reserved-blocks-percentage"
+	exoscaleExt4Features             = DriverName + "/ext4-features"
+
+	// extFSTypes are the filesystems tuned with tune2fs.
+	extFSTypes = []string{"ext3", "ext4"}
+
+	// ext4FeaturePattern matches an ext4 feature to enable, or to disable when prefixed with ^, e.g. metadata_csum or ^huge_file.
+	ext4FeaturePattern = regexp.MustCompile(`^\^?[a-z0-9_]+$`)
+)
+
+// getExtTuning returns the volume context entries of the ext tuning StorageClass parameters,
+// an error is returned if a value is invalid or if the volume filesystem isn't ext3 nor ext4.
+func getExtTuning(parameters map[string]string, fsType string) (map[string]string, error) {
+	percentage, hasPercentage := parameters[reservedBlocksPercentageParameter]
+	features, hasFeatures := parameters[ext4FeaturesParameter]
+	if !hasPercentage && !hasFeatures {
+		return nil, nil
+	}
+
+	if fsType != "" && !slices.Contains(extFSTypes, fsType) {
+		return nil, fmt.Errorf("ext tuning with filesystem type %s", fsType)
+	}
+
+	tuning := make(map[string]string)
+	if hasPercentage {
+		value, err := strconv.ParseFloat(percentage, 64)
+		if err != nil || value < 0 || value > 50 {
+			return nil, fmt.Errorf("%s: invalid percentage %q, expected a number between 0 and 50", reservedBlocksPercentageParameter, percentage)
+		}
+		tuning[exoscaleReservedBlocksPercentage] = percentage
+	}
+	if hasFeatures {
+		for _, feature := range strings.Split(features, ",") {
+			if !ext4FeaturePattern.MatchString(feature) {
+				return nil, fmt.Errorf("%s: invalid feature %q, expected comma separated features, prefixed with ^ to disable them, e.g. metadata_csum,^huge_file", ext4FeaturesParameter, feature)
+			}
+		}
+		tuning[exoscaleExt4Features] = features
+	}
+
+	return tuning, nil
+}
+
+// getStageExtTuning returns the mkfs and tune2fs options tuning the ext filesystem with the settings of the volume context,
+// nil if the filesystem isn't ext3 nor ext4 or nothing is tuned.
+// The mounter formats blank devices with -m0 after the mkfs options, the reserved blocks percentage is set with tune2fs then,
+// the filesystems already formatted are tuned with tune2fs only.
+func getStageExtTuning(fsType string, volumeContext map[string]string, formatted bool) ([]string, []string) {
+	if !slices.Contains(extFSTypes, fsType) {
+		return nil, nil
+	}
+
+	var formatOptions, tuneOptions []string
+	if percentage, ok := volumeContext[exoscaleReservedBlocksPercentage]; ok {
+		tuneOptions = append(tuneOptions, "-m", percentage)
+	}
+	if features, ok := volumeContext[exoscaleExt4Features]; ok && formatted {
+		tuneOptions = append(tuneOptions, "-O", features)
+	} else if ok {
+		formatOptions = append(formatOptions, "-O", features)
+	}
+
+	return formatOptions, tuneOptions
+}
+
+// Tune2fs applies the tune2fs options to the ext filesystem of the device, which must be unmounted to change its features.
+func (d *diskUtils) Tune2fs(devicePath string, options []string) error {
+	return runCommand(nil, "tune2fs", append(slices.Clone(options), devicePath)...)
+}
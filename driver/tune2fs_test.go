@@ -0,0 +1,95 @@
+package driver
+
+import (
+	"context"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetExtTuning(t *testing.T) {
+	testsBench := []struct {
+		parameters map[string]string
+		fsType     string
+		res        map[string]string
+		valid      bool
+	}{
+		{parameters: nil, fsType: "xfs", res: nil, valid: true},
+		{
+			parameters: map[string]string{"reservedBlocksPercentage": "0", "ext4Features": "metadata_csum,^huge_file"},
+			fsType:     "ext4",
+			res:        map[string]string{exoscaleReservedBlocksPercentage: "0", exoscaleExt4Features: "metadata_csum,^huge_file"},
+			valid:      true,
+		},
+		{parameters: map[string]string{"reservedBlocksPercentage": "0.5"}, fsType: "", res: map[string]string{exoscaleReservedBlocksPercentage: "0.5"}, valid: true},
+		{parameters: map[string]string{"reservedBlocksPercentage": "0"}, fsType: "xfs", valid: false},
+		{parameters: map[string]string{"reservedBlocksPercentage": "-1"}, fsType: "ext4", valid: false},
+		{parameters: map[string]string{"reservedBlocksPercentage": "51"}, fsType: "ext4", valid: false},
+		{parameters: map[string]string{"reservedBlocksPercentage": "five"}, fsType: "ext4", valid: false},
+		{parameters: map[string]string{"ext4Features": "metadata_csum,"}, fsType: "ext4", valid: false},
+		{parameters: map[string]string{"ext4Features": "-E stride=8"}, fsType: "ext4", valid: false},
+	}
+
+	for _, test := range testsBench {
+		res, err := getExtTuning(test.parameters, test.fsType)
+		require.Equal(t, test.valid, err == nil, err)
+		require.Equal(t, test.res, res)
+	}
+}
+
+func TestGetStageExtTuning(t *testing.T) {
+	volumeContext := map[string]string{exoscaleReservedBlocksPercentage: "0", exoscaleExt4Features: "metadata_csum"}
+
+	testsBench := []struct {
+		fsType        string
+		volumeContext map[string]string
+		formatted     bool
+		formatOptions []string
+		tuneOptions   []string
+	}{
+		{fsType: "ext4", volumeContext: volumeContext, formatOptions: []string{"-O", "metadata_csum"}, tuneOptions: []string{"-m", "0"}},
+		{fsType: "ext4", volumeContext: volumeContext, formatted: true, tuneOptions: []string{"-m", "0", "-O", "metadata_csum"}},
+		{fsType: "xfs", volumeContext: volumeContext},
+		{fsType: "ext4", volumeContext: nil},
+	}
+
+	for _, test := range testsBench {
+		formatOptions, tuneOptions := getStageExtTuning(test.fsType, test.volumeContext, test.formatted)
+		require.Equal(t, test.formatOptions, formatOptions)
+		require.Equal(t, test.tuneOptions, tuneOptions)
+	}
+}
+
+func TestNodeStageVolumeExtTuning(t *testing.T) {
+	volumeContext := map[string]string{exoscaleReservedBlocksPercentage: "1", exoscaleExt4Features: "metadata_csum"}
+
+	testsBench := []struct {
+		name          string
+		formatted     string
+		formatOptions []string
+		tuned         []string
+	}{
+		{name: "blank device formatted with the features", formatOptions: []string{"-O", "metadata_csum"}, tuned: []string{"-m", "1"}},
+		{name: "filesystem formatted elsewhere tuned with tune2fs", formatted: "ext4", tuned: []string{"-m", "1", "-O", "metadata_csum"}},
+	}
+
+	for _, test := range testsBench {
+		t.Run(test.name, func(t *testing.T) {
+			ns, fake := newTestNodeService(t)
+			if test.formatted != "" {
+				fake.formatted[testNodeDevicePath] = test.formatted
+			}
+
+			_, err := ns.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+				VolumeId:          exoscaleID("ch-gva-2", testNodeVolumeID),
+				StagingTargetPath: t.TempDir(),
+				VolumeCapability:  mountCapability("ext4"),
+				VolumeContext:     volumeContext,
+			})
+			require.NoError(t, err)
+			require.Equal(t, test.formatOptions, fake.formatOptions[testNodeDevicePath])
+			require.Equal(t, test.tuned, fake.tuned[testNodeDevicePath])
+		})
+	}
+}
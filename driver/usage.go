@@ -0,0 +1,119 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	// DefaultUsageThreshold is the default percentage of the space and inodes of a filesystem above which a volume usage is high.
+	DefaultUsageThreshold = 90
+
+	volumeUsageHighReason = "VolumeUsageHigh"
+
+	bytesResource  = "bytes"
+	inodesResource = "inodes"
+)
+
+// usageThresholds are the percentages of the space and inodes of a filesystem above which the node warns about the volume usage,
+// zero disables the check of the resource.
+type usageThresholds struct {
+	bytes  float64
+	inodes float64
+}
+
+// usageKey identifies the usage of a resource of a volume.
+type usageKey struct {
+	volumeID string
+	resource string
+}
+
+// runUsageWatcher calls checkVolumesUsage every interval until ctx is done.
+func (d *nodeService) runUsageWatcher(ctx context.Context, kube *kubeClient, kubeletDir string, thresholds usageThresholds, interval time.Duration) {
+	klog.Infof("volume usage watcher started, interval %s, thresholds %.f%% of the space and %.f%% of the inodes", interval, thresholds.bytes, thresholds.inodes)
+
+	above := make(map[usageKey]bool)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := d.checkVolumesUsage(ctx, kube, kubeletDir, thresholds, above); err != nil {
+				klog.Errorf("check volumes usage: %v", err)
+			}
+		}
+	}
+}
+
+// checkVolumesUsage warns with an event on their PVC about the filesystems staged on the node whose usage crossed the thresholds,
+// and exposes whether they are above the thresholds with the exoscale_csi_volume_usage_above_threshold metric.
+// above holds the volume resources above their threshold at the previous check, the event is only emitted when crossing it.
+func (d *nodeService) checkVolumesUsage(ctx context.Context, kube *kubeClient, kubeletDir string, thresholds usageThresholds, above map[usageKey]bool) error {
+	stagingPaths, err := listKubeletStagingPaths(kubeletDir)
+	if err != nil {
+		return err
+	}
+
+	seen := make(map[usageKey]bool)
+	for _, p := range stagingPaths {
+		// The staging path of raw block volumes isn't mounted, their device is bind mounted below it.
+		info, err := d.diskUtils.GetMountInfo(p.stagingTargetPath)
+		if err != nil || info == nil {
+			continue
+		}
+		fs, err := d.diskUtils.GetStatfs(p.stagingTargetPath)
+		if err != nil {
+			klog.Errorf("statfs volume %s staged on %s: %v", p.volumeID, p.stagingTargetPath, err)
+			continue
+		}
+
+		for _, usage := range []struct {
+			resource    string
+			used, total uint64
+			threshold   float64
+		}{
+			{resource: bytesResource, used: fs.Blocks - fs.Bfree, total: fs.Blocks, threshold: thresholds.bytes},
+			// Some filesystems, e.g. btrfs, have no inode count.
+			{resource: inodesResource, used: fs.Files - fs.Ffree, total: fs.Files, threshold: thresholds.inodes},
+		} {
+			if usage.threshold <= 0 || usage.total == 0 {
+				continue
+			}
+
+			key := usageKey{volumeID: p.volumeID.String(), resource: usage.resource}
+			seen[key] = true
+			percent := float64(usage.used) * 100 / float64(usage.total)
+			exceeded := percent >= usage.threshold
+
+			if exceeded {
+				volumeUsageAboveThreshold.WithLabelValues(key.volumeID, key.resource).Set(1)
+			} else {
+				volumeUsageAboveThreshold.WithLabelValues(key.volumeID, key.resource).Set(0)
+			}
+
+			if exceeded && !above[key] {
+				message := fmt.Sprintf("volume uses %.1f%% of its %s, above the %.f%% threshold", percent, usage.resource, usage.threshold)
+				klog.Warningf("volume %s %s", p.volumeID, message)
+				if err := createVolumeEvent(ctx, kube, p.volumeHandle, volumeUsageHighReason, message, d.nodeID.String()); err != nil {
+					klog.Errorf("emit usage event of volume %s: %v", p.volumeID, err)
+				}
+			}
+			above[key] = exceeded
+		}
+	}
+
+	for key := range above {
+		if !seen[key] {
+			delete(above, key)
+			volumeUsageAboveThreshold.DeleteLabelValues(key.volumeID, key.resource)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,67 @@
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckVolumesUsage(t *testing.T) {
+	ns, fake := newTestNodeService(t)
+	kubeletDir := t.TempDir()
+	volumeHandle := exoscaleID("ch-gva-2", testNodeVolumeID)
+	stagingPath := writeVolumeData(t, filepath.Join(kubeletDir, "plugins", "kubernetes.io", "csi", DriverName, "staged"), DriverName, volumeHandle)
+	writeVolumeData(t, filepath.Join(kubeletDir, "plugins", "kubernetes.io", "csi", DriverName, "unstaged"), DriverName, exoscaleID("ch-gva-2", "2c9d4e7b-1f3a-4b8c-9e6d-7a5b3c1d0f2e"))
+	require.NoError(t, fake.MountToTarget(testNodeDevicePath, stagingPath, "ext4", nil))
+
+	pv := newTestPersistentVolume("pvc-1", volumeHandle)
+	pv.Spec.ClaimRef = &struct {
+		Namespace string `json:"namespace"`
+		Name      string `json:"name"`
+	}{Namespace: "default", Name: "data"}
+	pvs := &fakePersistentVolumesAPI{pvs: map[string]*kubePersistentVolume{"pvc-1": pv}}
+
+	var mu sync.Mutex
+	var events []map[string]any
+	mux := http.NewServeMux()
+	mux.Handle("/api/v1/persistentvolumes", pvs)
+	mux.Handle("/api/v1/persistentvolumes/", pvs)
+	mux.HandleFunc("POST /api/v1/namespaces/default/events", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		var event map[string]any
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&event))
+		events = append(events, event)
+		w.WriteHeader(http.StatusCreated)
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	kube := &kubeClient{httpClient: server.Client(), host: server.URL}
+
+	// The fake filesystems use 75% of their space and 50% of their inodes.
+	thresholds := usageThresholds{bytes: 70, inodes: 60}
+	above := make(map[usageKey]bool)
+
+	for range 2 {
+		require.NoError(t, ns.checkVolumesUsage(context.Background(), kube, kubeletDir, thresholds, above))
+		require.Len(t, events, 1)
+		require.Equal(t, volumeUsageHighReason, events[0]["reason"])
+		require.Equal(t, "data", events[0]["involvedObject"].(map[string]any)["name"])
+		require.Contains(t, events[0]["message"], "75.0% of its bytes")
+		require.Equal(t, map[usageKey]bool{
+			{volumeID: testNodeVolumeID.String(), resource: bytesResource}:  true,
+			{volumeID: testNodeVolumeID.String(), resource: inodesResource}: false,
+		}, above)
+	}
+
+	require.NoError(t, fake.Unmount(stagingPath))
+	require.NoError(t, ns.checkVolumesUsage(context.Background(), kube, kubeletDir, thresholds, above))
+	require.Empty(t, above)
+	require.Len(t, events, 1)
+}
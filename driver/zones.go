@@ -0,0 +1,168 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	v3 "github.com/exoscale/egoscale/v3"
+)
+
+const (
+	// zonesConcurrency is the maximum number of zones queried concurrently by forEachZone.
+	zonesConcurrency = 4
+	// blockStorageUnavailableTTL is the duration during which a zone without block storage is skipped.
+	blockStorageUnavailableTTL = time.Hour
+)
+
+// ZoneEndpoints overrides the API endpoints of the zones returned by the API, e.g. for sovereign or air-gapped deployments.
+type ZoneEndpoints map[v3.ZoneName]v3.Endpoint
+
+// ParseZoneEndpoints parses a comma separated list of zone=endpoint pairs, e.g. "ch-gva-2=https://api.example.net/v2".
+func ParseZoneEndpoints(s string) (ZoneEndpoints, error) {
+	endpoints := ZoneEndpoints{}
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		zone, endpoint, ok := strings.Cut(pair, "=")
+		zone, endpoint = strings.TrimSpace(zone), strings.TrimSpace(endpoint)
+		if !ok || zone == "" {
+			return nil, fmt.Errorf("malformed zone endpoint %q, expected zone=endpoint", pair)
+		}
+		if err := validateAPIEndpoint(endpoint); err != nil {
+			return nil, fmt.Errorf("zone %s: %w", zone, err)
+		}
+		endpoints[v3.ZoneName(zone)] = v3.Endpoint(endpoint)
+	}
+
+	return endpoints, nil
+}
+
+// validateAPIEndpoint returns an error if the endpoint isn't an absolute http or https URL.
+func validateAPIEndpoint(endpoint string) error {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return fmt.Errorf("invalid API endpoint %q: %w", endpoint, err)
+	}
+	if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("invalid API endpoint %q, expected an http or https URL like https://api-ch-gva-2.exoscale.com/v2", endpoint)
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return fmt.Errorf("invalid API endpoint %q, no query nor fragment expected", endpoint)
+	}
+
+	return nil
+}
+
+// apply returns the zones with the overridden API endpoints.
+func (e ZoneEndpoints) apply(zones []v3.Zone) []v3.Zone {
+	if len(e) == 0 {
+		return zones
+	}
+
+	overridden := make([]v3.Zone, len(zones))
+	for i, zone := range zones {
+		if endpoint, ok := e[zone.Name]; ok {
+			zone.APIEndpoint = endpoint
+		}
+		overridden[i] = zone
+	}
+
+	return overridden
+}
+
+// forEachZone calls fn with a client to each zone, querying at most zonesConcurrency zones at once.
+// fn is given the index of the zone so that results can be aggregated in the order of the zones
+// regardless of the completion order. The first error cancels the remaining calls and is returned.
+func forEachZone(ctx context.Context, client *v3.Client, zones []v3.Zone, fn func(ctx context.Context, i int, client *v3.Client, zone v3.Zone) error) error {
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(zonesConcurrency)
+
+	for i, zone := range zones {
+		g.Go(func() error {
+			return fn(ctx, i, client.WithEndpoint(zone.APIEndpoint), zone)
+		})
+	}
+
+	return g.Wait()
+}
+
+// blockStorageUnavailableMessage is the message of the Forbidden error returned by the API
+// when block storage is not available in the zone.
+const blockStorageUnavailableMessage = "Availability of the block storage volumes"
+
+// isBlockStorageUnavailable returns whether err reports that block storage is not available in the zone.
+// The other Forbidden errors, e.g. a missing IAM permission, are not about the zone.
+// TODO: remove it when Block Storage is available in all zone.
+func isBlockStorageUnavailable(err error) bool {
+	return errors.Is(err, v3.ErrForbidden) && strings.Contains(err.Error(), blockStorageUnavailableMessage)
+}
+
+// listZoneError returns the error of a list in a zone, PermissionDenied if the IAM role
+// of the API key doesn't allow it.
+func listZoneError(zone v3.ZoneName, err error) error {
+	if errors.Is(err, v3.ErrForbidden) {
+		return status.Errorf(codes.PermissionDenied, "list in zone %s denied: %v", zone, err)
+	}
+
+	return err
+}
+
+// blockStorageZones remembers the zones where block storage is not available,
+// so that listing all the zones doesn't query them on every call.
+type blockStorageZones struct {
+	sync.Mutex
+	unavailable map[v3.ZoneName]time.Time
+}
+
+func newBlockStorageZones() *blockStorageZones {
+	return &blockStorageZones{unavailable: make(map[v3.ZoneName]time.Time)}
+}
+
+// available returns whether block storage may be available in the zone.
+func (z *blockStorageZones) available(zone v3.ZoneName) bool {
+	z.Lock()
+	defer z.Unlock()
+
+	since, ok := z.unavailable[zone]
+	if !ok {
+		return true
+	}
+	if time.Since(since) > blockStorageUnavailableTTL {
+		delete(z.unavailable, zone)
+		return true
+	}
+
+	return false
+}
+
+// setUnavailable records that block storage is not available in the zone.
+func (z *blockStorageZones) setUnavailable(zone v3.ZoneName) {
+	z.Lock()
+	defer z.Unlock()
+
+	z.unavailable[zone] = time.Now()
+}
+
+// filter returns the zones where block storage may be available.
+func (z *blockStorageZones) filter(zones []v3.Zone) []v3.Zone {
+	filtered := make([]v3.Zone, 0, len(zones))
+	for _, zone := range zones {
+		if z.available(zone.Name) {
+			filtered = append(filtered, zone)
+		}
+	}
+
+	return filtered
+}
@@ -0,0 +1,143 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	v3 "github.com/exoscale/egoscale/v3"
+	"github.com/exoscale/egoscale/v3/credentials"
+)
+
+func TestForEachZone(t *testing.T) {
+	client, err := v3.NewClient(credentials.NewStaticCredentials("EXOtest", "secret"))
+	require.NoError(t, err)
+
+	zones := []v3.Zone{
+		{Name: "ch-gva-2", APIEndpoint: v3.CHGva2},
+		{Name: "ch-dk-2", APIEndpoint: v3.CHDk2},
+		{Name: "de-fra-1", APIEndpoint: v3.DEFra1},
+		{Name: "de-muc-1", APIEndpoint: v3.DEMuc1},
+		{Name: "at-vie-1", APIEndpoint: v3.ATVie1},
+	}
+
+	names := make([]v3.ZoneName, len(zones))
+	err = forEachZone(context.Background(), client, zones, func(ctx context.Context, i int, client *v3.Client, zone v3.Zone) error {
+		names[i] = zone.Name
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []v3.ZoneName{"ch-gva-2", "ch-dk-2", "de-fra-1", "de-muc-1", "at-vie-1"}, names)
+
+	errZone := errors.New("zone unavailable")
+	err = forEachZone(context.Background(), client, zones, func(ctx context.Context, i int, client *v3.Client, zone v3.Zone) error {
+		if zone.Name == "de-fra-1" {
+			return errZone
+		}
+		return nil
+	})
+	require.ErrorIs(t, err, errZone)
+}
+
+func TestBlockStorageZones(t *testing.T) {
+	zones := []v3.Zone{{Name: "ch-gva-2"}, {Name: "bg-sof-1"}}
+	z := newBlockStorageZones()
+
+	require.Equal(t, zones, z.filter(zones))
+
+	z.setUnavailable("bg-sof-1")
+	require.Equal(t, []v3.Zone{{Name: "ch-gva-2"}}, z.filter(zones))
+
+	z.unavailable["bg-sof-1"] = time.Now().Add(-2 * blockStorageUnavailableTTL)
+	require.Equal(t, zones, z.filter(zones))
+
+	require.True(t, isBlockStorageUnavailable(fmt.Errorf("%w: %s in this zone", v3.ErrForbidden, blockStorageUnavailableMessage)))
+	require.False(t, isBlockStorageUnavailable(fmt.Errorf("%w: operation not allowed", v3.ErrForbidden)))
+	require.False(t, isBlockStorageUnavailable(v3.ErrNotFound))
+
+	require.Equal(t, codes.PermissionDenied, status.Code(listZoneError("ch-gva-2", fmt.Errorf("%w: operation not allowed", v3.ErrForbidden))))
+	require.ErrorIs(t, listZoneError("ch-gva-2", v3.ErrNotFound), v3.ErrNotFound)
+}
+
+func TestParseZoneEndpoints(t *testing.T) {
+	testsBench := []struct {
+		name    string
+		input   string
+		want    ZoneEndpoints
+		wantErr bool
+	}{
+		{
+			name:  "empty",
+			input: "",
+			want:  ZoneEndpoints{},
+		},
+		{
+			name:  "several zones",
+			input: "ch-gva-2=https://api.example.net/v2, de-fra-1 = http://10.0.0.1:8080/v2",
+			want: ZoneEndpoints{
+				"ch-gva-2": "https://api.example.net/v2",
+				"de-fra-1": "http://10.0.0.1:8080/v2",
+			},
+		},
+		{
+			name:    "missing endpoint",
+			input:   "ch-gva-2",
+			wantErr: true,
+		},
+		{
+			name:    "missing zone",
+			input:   "=https://api.example.net/v2",
+			wantErr: true,
+		},
+		{
+			name:    "relative endpoint",
+			input:   "ch-gva-2=api.example.net/v2",
+			wantErr: true,
+		},
+		{
+			name:    "unsupported scheme",
+			input:   "ch-gva-2=ftp://api.example.net/v2",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range testsBench {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseZoneEndpoints(tt.input)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestZoneEndpointsOverride(t *testing.T) {
+	endpoints := ZoneEndpoints{"ch-gva-2": "https://api.example.net/v2"}
+
+	zones := []v3.Zone{
+		{Name: "ch-gva-2", APIEndpoint: v3.CHGva2},
+		{Name: "de-fra-1", APIEndpoint: v3.DEFra1},
+	}
+	require.Equal(t, []v3.Zone{
+		{Name: "ch-gva-2", APIEndpoint: "https://api.example.net/v2"},
+		{Name: "de-fra-1", APIEndpoint: v3.DEFra1},
+	}, endpoints.apply(zones))
+	require.Equal(t, v3.CHGva2, zones[0].APIEndpoint, "the zones must not be modified")
+
+	// The overridden zone endpoint is used without querying the API.
+	client, err := v3.NewClient(credentials.NewStaticCredentials("EXOtest", "secret"),
+		v3.ClientOptWithEndpoint("http://127.0.0.1:1/v2"),
+	)
+	require.NoError(t, err)
+	_, err = newClientZone(context.Background(), client, "ch-gva-2", endpoints)
+	require.NoError(t, err)
+}